@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Tempo massimo per le operazioni sul database di una singola valutazione
+const storeTimeout = 5 * time.Second
+
+// Una serie è la sequenza di letture di un gateway valutata da una regola
+type seriesKey struct {
+	rule    string
+	gateway string
+}
+
+type sample struct {
+	at    time.Time
+	value float64
+}
+
+type series struct {
+	// Da quando la condizione è violata senza interruzioni, zero se non lo è
+	pendingSince time.Time
+	// Ultima lettura ricevuta, per missing_data
+	lastSeen time.Time
+	// Letture nella finestra, per rate_of_change
+	samples []sample
+	// Alert aperto: finché c'è non ne vengono aperti altri per la stessa serie
+	active *Alert
+	// Un cambio di stato è in corso di salvataggio (vedi apply): finché non finisce non se ne decidono altri
+	busy bool
+	// La serie è stata eliminata (regola modificata o rimossa) durante il salvataggio di un alert
+	dropped bool
+}
+
+// change è un cambio di stato di una serie deciso sotto e.mu. Viene salvato e pubblicato da apply
+// senza il lock, perché le operazioni sul database possono durare fino a storeTimeout
+type change struct {
+	s *series
+	// Alert da aprire, oppure l'alert aperto da risolvere
+	alert   *Alert
+	resolve bool
+	at      time.Time
+}
+
+// Engine valuta le letture con le regole dei tenant e gestisce il ciclo di vita degli alert:
+// firing quando la condizione resta violata per for_seconds, resolved quando il valore rientra
+// oltre l'isteresi. La conferma (acknowledged) arriva dalla dashboard, direttamente sul database.
+type Engine struct {
+	store *store
+	js    nats.JetStreamContext
+
+	mu     sync.Mutex
+	rules  map[string]Rule
+	series map[seriesKey]*series
+}
+
+func newEngine(store *store, js nats.JetStreamContext) *Engine {
+	return &Engine{
+		store:  store,
+		js:     js,
+		rules:  map[string]Rule{},
+		series: map[seriesKey]*series{},
+	}
+}
+
+func (e *Engine) get(key seriesKey) *series {
+	s, ok := e.series[key]
+	if !ok {
+		s = &series{lastSeen: time.Now()}
+		e.series[key] = s
+	}
+	return s
+}
+
+// setRule aggiunge o sostituisce una regola. Gli alert aperti della versione precedente vengono
+// risolti e le serie azzerate: con la nuova configurazione la condizione va rivalutata da capo
+func (e *Engine) setRule(rule Rule) {
+	var changes []change
+	defer func() { e.apply(changes) }()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	key := ruleKey(rule.Tenant, rule.ID)
+	if old, ok := e.rules[key]; ok {
+		if old == rule {
+			return
+		}
+		changes = e.dropSeries(key)
+	}
+	e.rules[key] = rule
+
+	// Per missing_data su un gateway preciso il silenzio si conta da adesso,
+	// anche se il gateway non ha mai inviato dati da quando l'alerting è partito
+	if rule.Type == MissingDataRule && rule.Gateway != "" {
+		e.get(seriesKey{rule: key, gateway: rule.Gateway})
+	}
+	log.Printf("Regola %s (%s) caricata: %s", key, rule.Name, rule.describe())
+}
+
+func (e *Engine) removeRule(key string) {
+	e.mu.Lock()
+	changes := e.dropSeries(key)
+	delete(e.rules, key)
+	e.mu.Unlock()
+
+	log.Printf("Regola %s rimossa", key)
+	e.apply(changes)
+}
+
+// dropSeries elimina le serie della regola e restituisce la risoluzione dei loro alert aperti.
+// Va chiamata con e.mu bloccato
+func (e *Engine) dropSeries(rule string) []change {
+	var changes []change
+	for key, s := range e.series {
+		if key.rule != rule {
+			continue
+		}
+		if s.busy {
+			// Se l'alert in corso di salvataggio viene aperto, apply lo risolve subito
+			s.dropped = true
+		} else if s.active != nil {
+			changes = append(changes, e.resolve(s, time.Now()))
+		}
+		delete(e.series, key)
+	}
+	return changes
+}
+
+// loadActive carica gli alert aperti del tenant, così dopo un riavvio non vengono duplicati.
+// Quelli di regole che non esistono più vengono risolti
+func (e *Engine) loadActive(tenantId string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	alerts, err := e.store.active(ctx, tenantId)
+	if err != nil {
+		log.Printf("Errore caricamento alert aperti del tenant %s: %v", tenantId, err)
+		return
+	}
+
+	var changes []change
+	e.mu.Lock()
+	for _, a := range alerts {
+		key := ruleKey(tenantId, a.RuleID)
+		s := &series{lastSeen: time.Now(), active: a}
+		if _, ok := e.rules[key]; !ok {
+			changes = append(changes, e.resolve(s, time.Now()))
+			continue
+		}
+		e.series[seriesKey{rule: key, gateway: a.GatewayID}] = s
+	}
+	e.mu.Unlock()
+
+	e.apply(changes)
+}
+
+// process valuta la lettura con tutte le regole del tenant che riguardano gateway e metrica
+func (e *Engine) process(msg *nats.Msg) {
+	// sensors.<tenant>.<gateway>.<metrica>
+	parts := strings.Split(msg.Subject, ".")
+	if len(parts) != 4 || strings.HasPrefix(parts[3], "$") {
+		return
+	}
+	tenantId, gatewayId, metric := parts[1], parts[2], parts[3]
+
+	var payload map[string]any
+	if err := json.Unmarshal(msg.Data, &payload); err != nil {
+		return
+	}
+	at := readingTime(msg, payload)
+
+	var changes []change
+	defer func() { e.apply(changes) }()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for key, rule := range e.rules {
+		if !rule.matches(tenantId, gatewayId, metric) {
+			continue
+		}
+
+		s := e.get(seriesKey{rule: key, gateway: gatewayId})
+		if at.After(s.lastSeen) {
+			s.lastSeen = at
+		}
+
+		switch rule.Type {
+		case MissingDataRule:
+			if s.active != nil && !s.busy {
+				changes = append(changes, e.resolve(s, at))
+			}
+
+		case ThresholdRule:
+			if value, ok := field(payload, rule.Field); ok {
+				changes = append(changes, e.evaluate(rule, gatewayId, s, value, at)...)
+			}
+
+		case RateOfChangeRule:
+			value, ok := field(payload, rule.Field)
+			if !ok {
+				continue
+			}
+			s.samples = append(s.samples, sample{at: at, value: value})
+			for len(s.samples) > 0 && at.Sub(s.samples[0].at) > rule.window() {
+				s.samples = s.samples[1:]
+			}
+			first := s.samples[0]
+			if elapsed := at.Sub(first.at).Minutes(); elapsed > 0 {
+				changes = append(changes, e.evaluate(rule, gatewayId, s, (value-first.value)/elapsed, at)...)
+			}
+		}
+	}
+}
+
+// evaluate aggiorna la serie con il nuovo valore (lettura o variazione al minuto) e restituisce
+// il cambio di stato, se c'è. Va chiamata con e.mu bloccato
+func (e *Engine) evaluate(rule Rule, gatewayId string, s *series, value float64, at time.Time) []change {
+	if rule.breached(value) {
+		if s.active != nil {
+			return nil
+		}
+		if s.pendingSince.IsZero() {
+			s.pendingSince = at
+		}
+		if at.Sub(s.pendingSince) >= rule.forDuration() && !s.busy {
+			return []change{e.fire(rule, gatewayId, s, value, at, fmt.Sprintf("%s: valore %g", rule.describe(), value))}
+		}
+		return nil
+	}
+
+	s.pendingSince = time.Time{}
+	if s.active != nil && !s.busy && rule.cleared(value) {
+		return []change{e.resolve(s, at)}
+	}
+	return nil
+}
+
+// checkMissing apre gli alert missing_data dei gateway silenziosi, finché ctx non viene annullato
+func (e *Engine) checkMissing(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var changes []change
+		e.mu.Lock()
+		for key, s := range e.series {
+			rule, ok := e.rules[key.rule]
+			if !ok || !rule.Enabled || rule.Type != MissingDataRule || s.active != nil || s.busy {
+				continue
+			}
+			if silence := now.Sub(s.lastSeen); silence >= rule.window() {
+				changes = append(changes, e.fire(rule, key.gateway, s, silence.Seconds(), now,
+					fmt.Sprintf("nessun dato %s dal gateway %s da %s", rule.Metric, key.gateway, silence.Round(time.Second))))
+			}
+		}
+		e.mu.Unlock()
+
+		e.apply(changes)
+	}
+}
+
+// fire decide l'apertura dell'alert, salvato poi da apply. Va chiamata con e.mu bloccato
+func (e *Engine) fire(rule Rule, gatewayId string, s *series, value float64, at time.Time, message string) change {
+	s.busy = true
+	return change{s: s, at: at, alert: &Alert{
+		Tenant:    rule.Tenant,
+		RuleID:    rule.ID,
+		RuleName:  rule.Name,
+		GatewayID: gatewayId,
+		Metric:    rule.Metric,
+		Severity:  rule.Severity,
+		Status:    StatusFiring,
+		Message:   message,
+		Value:     value,
+		Threshold: rule.Threshold,
+		FiredAt:   at,
+	}}
+}
+
+// resolve decide la risoluzione dell'alert aperto della serie. Va chiamata con e.mu bloccato
+func (e *Engine) resolve(s *series, at time.Time) change {
+	s.busy = true
+	return change{s: s, alert: s.active, resolve: true, at: at}
+}
+
+// apply salva e pubblica i cambi di stato, senza e.mu, poi aggiorna le serie
+func (e *Engine) apply(changes []change) {
+	for _, c := range changes {
+		if c.resolve {
+			e.applyResolve(c)
+		} else {
+			e.applyFire(c)
+		}
+	}
+}
+
+// applyFire apre l'alert. Se il salvataggio fallisce la serie resta in attesa e si riprova alla prossima valutazione
+func (e *Engine) applyFire(c change) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	alert, created, err := e.store.insert(ctx, c.alert)
+
+	e.mu.Lock()
+	c.s.busy = false
+	if err == nil {
+		c.s.active = alert
+	}
+	dropped := c.s.dropped
+	e.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Errore salvataggio alert della regola %d (tenant %s): %v", c.alert.RuleID, c.alert.Tenant, err)
+		return
+	}
+	if created {
+		log.Printf("Alert %d [%s] tenant %s, gateway %s: %s", alert.ID, alert.Severity, alert.Tenant, alert.GatewayID, alert.Message)
+		e.publish(alert)
+	}
+
+	// La regola è stata modificata o rimossa durante il salvataggio: l'alert non ha più una serie
+	if dropped {
+		e.applyResolve(change{s: c.s, alert: alert, resolve: true, at: time.Now()})
+	}
+}
+
+func (e *Engine) applyResolve(c change) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+
+	alert, err := e.store.resolve(ctx, c.alert.Tenant, c.alert.ID, c.at)
+
+	e.mu.Lock()
+	c.s.busy = false
+	if err == nil {
+		c.s.active = nil
+		c.s.pendingSince = time.Time{}
+	}
+	e.mu.Unlock()
+
+	if err != nil {
+		log.Printf("Errore risoluzione alert %d (tenant %s): %v", c.alert.ID, c.alert.Tenant, err)
+		return
+	}
+	if alert != nil {
+		log.Printf("Alert %d risolto (tenant %s, gateway %s)", alert.ID, alert.Tenant, alert.GatewayID)
+		e.publish(alert)
+	}
+}
+
+// publish invia l'evento su alerts.<tenant>.<gateway>.<regola>. Il Nats-Msg-Id evita
+// eventi doppi se lo stesso cambio di stato viene pubblicato più volte
+func (e *Engine) publish(a *Alert) {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+
+	subject := fmt.Sprintf("alerts.%s.%s.%d", a.Tenant, a.GatewayID, a.RuleID)
+	msgId := fmt.Sprintf("%s.%d.%s", a.Tenant, a.ID, a.Status)
+	if _, err := e.js.Publish(subject, data, nats.MsgId(msgId)); err != nil {
+		log.Printf("Errore pubblicazione alert %d su %s: %v", a.ID, subject, err)
+	}
+}
+
+// readingTime restituisce l'istante della lettura: il campo timestamp del payload,
+// altrimenti l'istante in cui è arrivata nello stream
+func readingTime(msg *nats.Msg, payload map[string]any) time.Time {
+	if ts, ok := payload["timestamp"].(string); ok {
+		if at, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			return at
+		}
+	}
+	if meta, err := msg.Metadata(); err == nil {
+		return meta.Timestamp
+	}
+	return time.Now()
+}
+
+func field(payload map[string]any, name string) (float64, bool) {
+	value, ok := payload[name].(float64)
+	return value, ok
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+
+	natsURL := flag.String("nats-url", "localhost:4222", "NATS server URL")
+	dbURL := flag.String("db-url", "localhost:5432", "Database URL")
+	credsPath := flag.String("creds", "dataconsumer.creds", "Credenziali NATS dell'account consumers")
+	durable := flag.String("durable", "alerting", "Nome del pull consumer durevole")
+	batchSize := flag.Int("batch-size", 100, "Numero massimo di messaggi per fetch")
+	checkInterval := flag.Duration("check-interval", 5*time.Second, "Ogni quanto vengono controllate le regole missing_data")
+
+	flag.Parse()
+
+	if *batchSize <= 0 || *checkInterval <= 0 {
+		log.Fatal("batch-size e check-interval devono essere positivi")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := getNatsConnection(*natsURL, "glitchhubteam.it", *credsPath)
+	if err != nil {
+		log.Fatalf("Errore connessione NATS: %v", err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Errore ottenimento JetStream: %v", err)
+	}
+	if err := configStreams(js); err != nil {
+		log.Fatalf("Errore configurazione stream: %v", err)
+	}
+	if err := configConsumer(js, *durable); err != nil {
+		log.Fatalf("Errore configurazione consumer: %v", err)
+	}
+
+	dbSecret := os.Getenv("TENANT_DB_SECRET")
+	if dbSecret == "" {
+		log.Fatal("TENANT_DB_SECRET non impostata: serve per le password degli utenti dei tenant")
+	}
+	store := newStore(*dbURL, dbSecret)
+	defer store.Close()
+
+	engine := newEngine(store, js)
+
+	// Prima le regole, poi i tenant: gli alert attivi caricati dal DB devono trovare la loro regola
+	if err := watchRules(ctx, js, engine); err != nil {
+		log.Fatalf("Errore registro delle regole: %v", err)
+	}
+	if err := watchTenants(ctx, js, engine); err != nil {
+		log.Fatalf("Errore registro dei tenant: %v", err)
+	}
+
+	go engine.checkMissing(ctx, *checkInterval)
+
+	consume(ctx, js, engine, *durable, *batchSize)
+	nc.Drain()
+}
+
+func getNatsConnection(natsURL string, servername string, credsPath string) (*nats.Conn, error) {
+	opts := nats.GetDefaultOptions()
+	opts.Url = natsURL
+
+	certPool := x509.NewCertPool()
+	caData, err := os.ReadFile("certs/ca.pem") //ca.pem da prendere da BITWARDEN
+	if err != nil {
+		log.Fatalf("Errore lettura file: %v", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(caData); !ok {
+		log.Fatal("Impossibile aggiungere il certificato CA al pool: il formato potrebbe essere errato")
+	}
+
+	opts.TLSConfig = &tls.Config{
+		RootCAs:    certPool,
+		ServerName: servername,
+	}
+	opts.MaxReconnect = -1
+
+	err = nats.UserCredentials(credsPath)(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.Connect()
+}
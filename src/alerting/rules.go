@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV con le regole, scritte dalla dashboard. La chiave è <tenant>.<id regola>,
+// il valore una Rule in JSON
+const rulesBucket = "alert_rules"
+
+// Tipi di regola
+const (
+	// Il campo supera la soglia per almeno for_seconds
+	ThresholdRule = "threshold"
+	// La variazione del campo al minuto, calcolata su window_seconds, supera la soglia per almeno for_seconds
+	RateOfChangeRule = "rate_of_change"
+	// Nessuna lettura della metrica dal gateway per window_seconds
+	MissingDataRule = "missing_data"
+)
+
+type Rule struct {
+	ID     uint   `json:"id"`
+	Tenant string `json:"tenant"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	// Metrica (ultimo token del subject) e campo del payload da valutare, es. heart_rate e bpm
+	Metric string `json:"metric"`
+	Field  string `json:"field"`
+	// Gateway a cui si applica la regola, vuoto = tutti
+	Gateway   string  `json:"gateway"`
+	Operator  string  `json:"operator"` // <, <=, >, >=
+	Threshold float64 `json:"threshold"`
+	// Margine oltre la soglia che il valore deve superare perché l'alert si risolva,
+	// così un valore che oscilla intorno alla soglia non apre e chiude alert di continuo
+	Hysteresis    float64 `json:"hysteresis"`
+	ForSeconds    int     `json:"for_seconds"`
+	WindowSeconds int     `json:"window_seconds"`
+	Severity      string  `json:"severity"`
+	Enabled       bool    `json:"enabled"`
+}
+
+func (r Rule) validate() error {
+	switch r.Type {
+	case ThresholdRule, RateOfChangeRule:
+		if r.Field == "" {
+			return errors.New("field obbligatorio")
+		}
+		switch r.Operator {
+		case "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("operatore non valido: %q", r.Operator)
+		}
+		if r.Hysteresis < 0 || r.ForSeconds < 0 {
+			return errors.New("hysteresis e for_seconds non possono essere negativi")
+		}
+		if r.Type == RateOfChangeRule && r.WindowSeconds <= 0 {
+			return errors.New("window_seconds obbligatorio")
+		}
+	case MissingDataRule:
+		if r.WindowSeconds <= 0 {
+			return errors.New("window_seconds obbligatorio")
+		}
+	default:
+		return fmt.Errorf("tipo di regola non valido: %q", r.Type)
+	}
+	if r.Tenant == "" || r.Metric == "" {
+		return errors.New("tenant e metric obbligatori")
+	}
+	return nil
+}
+
+func (r Rule) matches(tenantId string, gatewayId string, metric string) bool {
+	return r.Enabled && r.Tenant == tenantId && r.Metric == metric && (r.Gateway == "" || r.Gateway == gatewayId)
+}
+
+func (r Rule) forDuration() time.Duration {
+	return time.Duration(r.ForSeconds) * time.Second
+}
+
+func (r Rule) window() time.Duration {
+	return time.Duration(r.WindowSeconds) * time.Second
+}
+
+// breached indica se il valore viola la soglia
+func (r Rule) breached(value float64) bool {
+	switch r.Operator {
+	case "<":
+		return value < r.Threshold
+	case "<=":
+		return value <= r.Threshold
+	case ">":
+		return value > r.Threshold
+	case ">=":
+		return value >= r.Threshold
+	}
+	return false
+}
+
+// cleared indica se il valore è rientrato oltre la soglia di almeno hysteresis
+func (r Rule) cleared(value float64) bool {
+	switch r.Operator {
+	case "<", "<=":
+		return value >= r.Threshold+r.Hysteresis
+	default:
+		return value <= r.Threshold-r.Hysteresis
+	}
+}
+
+func (r Rule) describe() string {
+	switch r.Type {
+	case RateOfChangeRule:
+		return fmt.Sprintf("variazione di %s.%s %s %g/min", r.Metric, r.Field, r.Operator, r.Threshold)
+	case MissingDataRule:
+		return fmt.Sprintf("nessun dato %s da %s", r.Metric, r.window())
+	default:
+		return fmt.Sprintf("%s.%s %s %g", r.Metric, r.Field, r.Operator, r.Threshold)
+	}
+}
+
+// watchRules carica le regole nel motore e continua ad aggiornarle finché ctx non viene annullato.
+// Ritorna dopo aver caricato le regole esistenti
+func watchRules(ctx context.Context, js nats.JetStreamContext, engine *Engine) error {
+	kv, err := openBucket(js, &nats.KeyValueConfig{
+		Bucket:      rulesBucket,
+		Description: "Regole di alerting dei tenant",
+		History:     5,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = watchBucket(ctx, kv, func(entry nats.KeyValueEntry) { applyRule(engine, entry) })
+	return err
+}
+
+func applyRule(engine *Engine, entry nats.KeyValueEntry) {
+	if entry.Operation() != nats.KeyValuePut {
+		engine.removeRule(entry.Key())
+		return
+	}
+
+	var rule Rule
+	if err := json.Unmarshal(entry.Value(), &rule); err != nil {
+		log.Printf("Regola %s ignorata: %v", entry.Key(), err)
+		return
+	}
+	if err := rule.validate(); err != nil {
+		log.Printf("Regola %s ignorata: %v", entry.Key(), err)
+		return
+	}
+	if key := ruleKey(rule.Tenant, rule.ID); key != entry.Key() {
+		log.Printf("Regola %s ignorata: la chiave non corrisponde a %s", entry.Key(), key)
+		return
+	}
+	engine.setRule(rule)
+}
+
+func ruleKey(tenantId string, ruleId uint) string {
+	return fmt.Sprintf("%s.%d", tenantId, ruleId)
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestBreachedCleared(t *testing.T) {
+	tests := []struct {
+		name       string
+		operator   string
+		threshold  float64
+		hysteresis float64
+		value      float64
+		breached   bool
+		cleared    bool
+	}{
+		// Frequenza cardiaca alta: > 120 con isteresi 5, si risolve sotto 115
+		{name: "> sopra la soglia", operator: ">", threshold: 120, hysteresis: 5, value: 121, breached: true},
+		{name: "> sulla soglia", operator: ">", threshold: 120, hysteresis: 5, value: 120},
+		{name: "> dentro l'isteresi", operator: ">", threshold: 120, hysteresis: 5, value: 116},
+		{name: "> al limite dell'isteresi", operator: ">", threshold: 120, hysteresis: 5, value: 115, cleared: true},
+		{name: "> rientrato", operator: ">", threshold: 120, hysteresis: 5, value: 80, cleared: true},
+		{name: ">= sulla soglia", operator: ">=", threshold: 120, hysteresis: 5, value: 120, breached: true},
+		{name: ">= dentro l'isteresi", operator: ">=", threshold: 120, hysteresis: 5, value: 119.9},
+		{name: ">= rientrato", operator: ">=", threshold: 120, hysteresis: 5, value: 114, cleared: true},
+		{name: "> senza isteresi", operator: ">", threshold: 120, value: 120, cleared: true},
+
+		// Saturazione bassa: < 90 con isteresi 2, si risolve da 92 in su
+		{name: "< sotto la soglia", operator: "<", threshold: 90, hysteresis: 2, value: 89, breached: true},
+		{name: "< sulla soglia", operator: "<", threshold: 90, hysteresis: 2, value: 90},
+		{name: "< dentro l'isteresi", operator: "<", threshold: 90, hysteresis: 2, value: 91.5},
+		{name: "< al limite dell'isteresi", operator: "<", threshold: 90, hysteresis: 2, value: 92, cleared: true},
+		{name: "<= sulla soglia", operator: "<=", threshold: 90, hysteresis: 2, value: 90, breached: true},
+		{name: "<= rientrato", operator: "<=", threshold: 90, hysteresis: 2, value: 95, cleared: true},
+		{name: "< senza isteresi", operator: "<", threshold: 90, value: 90, cleared: true},
+		{name: "< soglia negativa", operator: "<", threshold: -10, hysteresis: 1, value: -9.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Rule{Type: ThresholdRule, Operator: tt.operator, Threshold: tt.threshold, Hysteresis: tt.hysteresis}
+			if got := r.breached(tt.value); got != tt.breached {
+				t.Errorf("breached(%g) = %v, atteso %v", tt.value, got, tt.breached)
+			}
+			if got := r.cleared(tt.value); got != tt.cleared {
+				t.Errorf("cleared(%g) = %v, atteso %v", tt.value, got, tt.cleared)
+			}
+		})
+	}
+}
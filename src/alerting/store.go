@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Stati di un alert
+const (
+	StatusFiring       = "firing"
+	StatusAcknowledged = "acknowledged"
+	StatusResolved     = "resolved"
+)
+
+// Alert è una riga della tabella <tenant>.alerts e il payload degli eventi su alerts.<tenant>.>
+type Alert struct {
+	ID             int64      `json:"id"`
+	Tenant         string     `json:"tenant"`
+	RuleID         uint       `json:"rule_id"`
+	RuleName       string     `json:"rule_name"`
+	GatewayID      string     `json:"gateway_id"`
+	Metric         string     `json:"metric"`
+	Severity       string     `json:"severity"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message"`
+	Value          float64    `json:"value"`
+	Threshold      float64    `json:"threshold"`
+	FiredAt        time.Time  `json:"fired_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *string    `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+const alertColumns = `id, rule_id, rule_name, gateway_id, metric, severity, status, message, value, threshold,
+	fired_at, acknowledged_at, acknowledged_by, resolved_at`
+
+// store salva gli alert nello schema di ogni tenant, con l'utente <tenant>_user come il subscriber.
+// L'indice unico parziale su (rule_id, gateway_id) garantisce un solo alert aperto per regola e gateway
+type store struct {
+	dbURL  string
+	secret string
+
+	mu    sync.Mutex
+	pools map[string]*pgxpool.Pool
+}
+
+// secret è TENANT_DB_SECRET, da cui la dashboard ricava le password degli utenti dei tenant
+func newStore(dbURL string, secret string) *store {
+	return &store{dbURL: dbURL, secret: secret, pools: map[string]*pgxpool.Pool{}}
+}
+
+// tenantPassword restituisce la password di <tenant>_user, come in subscriber/db-access/pools.go
+func tenantPassword(secret string, tenantId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tenantId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *store) pool(ctx context.Context, tenantId string) (*pgxpool.Pool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pool, ok := s.pools[tenantId]; ok {
+		return pool, nil
+	}
+
+	url := fmt.Sprintf("postgres://%s_user:%s@%s/sensors_db?sslmode=disable", tenantId, tenantPassword(s.secret, tenantId), s.dbURL)
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile creare il pool per %s: %v", tenantId, err)
+	}
+
+	s.pools[tenantId] = pool
+	return pool, nil
+}
+
+func (s *store) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tenantId, pool := range s.pools {
+		pool.Close()
+		delete(s.pools, tenantId)
+	}
+}
+
+func scanAlert(row pgx.Row, tenantId string) (*Alert, error) {
+	a := &Alert{Tenant: tenantId}
+	err := row.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.GatewayID, &a.Metric, &a.Severity, &a.Status, &a.Message,
+		&a.Value, &a.Threshold, &a.FiredAt, &a.AcknowledgedAt, &a.AcknowledgedBy, &a.ResolvedAt)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// insert salva un nuovo alert. Se per la regola e il gateway c'è già un alert aperto
+// restituisce quello e created = false
+func (s *store) insert(ctx context.Context, a *Alert) (stored *Alert, created bool, err error) {
+	pool, err := s.pool(ctx, a.Tenant)
+	if err != nil {
+		return nil, false, err
+	}
+
+	row := pool.QueryRow(ctx, `INSERT INTO alerts (rule_id, rule_name, gateway_id, metric, severity, status, message, value, threshold, fired_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (rule_id, gateway_id) WHERE status <> 'resolved' DO NOTHING
+		RETURNING `+alertColumns,
+		a.RuleID, a.RuleName, a.GatewayID, a.Metric, a.Severity, a.Status, a.Message, a.Value, a.Threshold, a.FiredAt,
+	)
+	stored, err = scanAlert(row, a.Tenant)
+	if err == nil {
+		return stored, true, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, false, err
+	}
+
+	row = pool.QueryRow(ctx, `SELECT `+alertColumns+` FROM alerts WHERE rule_id = $1 AND gateway_id = $2 AND status <> 'resolved'`,
+		a.RuleID, a.GatewayID,
+	)
+	stored, err = scanAlert(row, a.Tenant)
+	return stored, false, err
+}
+
+// resolve chiude l'alert e restituisce la riga aggiornata (con l'eventuale conferma dell'operatore).
+// Se era già risolto restituisce nil
+func (s *store) resolve(ctx context.Context, tenantId string, id int64, at time.Time) (*Alert, error) {
+	pool, err := s.pool(ctx, tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	row := pool.QueryRow(ctx, `UPDATE alerts SET status = 'resolved', resolved_at = $2
+		WHERE id = $1 AND status <> 'resolved'
+		RETURNING `+alertColumns,
+		id, at,
+	)
+	a, err := scanAlert(row, tenantId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return a, err
+}
+
+// active restituisce gli alert aperti (firing o acknowledged) del tenant
+func (s *store) active(ctx context.Context, tenantId string) ([]*Alert, error) {
+	pool, err := s.pool(ctx, tenantId)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := pool.Query(ctx, `SELECT `+alertColumns+` FROM alerts WHERE status <> 'resolved'`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var alerts []*Alert
+	for rows.Next() {
+		a, err := scanAlert(rows, tenantId)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, a)
+	}
+	return alerts, rows.Err()
+}
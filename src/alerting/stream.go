@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Stream con le letture di tutti i tenant da valutare. CONSUMING_SENSORS è una work queue
+	// e non può avere un secondo consumer, quindi l'alerting ha le sue sorgenti
+	inputStream  = "ALERTING_SENSORS"
+	inputSubject = "sensors.>"
+	// Le letture servono solo finché non vengono valutate
+	inputMaxAge = time.Hour
+
+	// Stream degli eventi degli alert, pubblicati su alerts.<tenant>.<gateway>.<regola>
+	alertsStream  = "ALERTS"
+	alertsSubject = "alerts.>"
+	alertsMaxAge  = 30 * 24 * time.Hour
+
+	// Bucket KV con i tenant, gestito dal subscriber e dal provisioning della dashboard
+	tenantsBucket = "tenants"
+)
+
+// TenantSource è la voce del bucket tenants (vedi subscriber/tenants.go)
+type TenantSource struct {
+	NatsID    string `json:"nats_id"`
+	Stream    string `json:"stream"`
+	APIPrefix string `json:"api_prefix"`
+}
+
+func configStreams(js nats.JetStreamContext) error {
+	streams := []*nats.StreamConfig{
+		{
+			Name:        inputStream,
+			Description: "Letture dei tenant valutate dalle regole di alerting",
+			Storage:     nats.FileStorage,
+			Retention:   nats.LimitsPolicy,
+			MaxAge:      inputMaxAge,
+		},
+		{
+			Name:        alertsStream,
+			Description: "Eventi degli alert (firing, acknowledged, resolved)",
+			Subjects:    []string{alertsSubject},
+			Storage:     nats.FileStorage,
+			Retention:   nats.LimitsPolicy,
+			MaxAge:      alertsMaxAge,
+		},
+	}
+
+	for _, cfg := range streams {
+		_, err := js.StreamInfo(cfg.Name)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			_, err = js.AddStream(cfg)
+		}
+		if err != nil {
+			return fmt.Errorf("stream %s: %v", cfg.Name, err)
+		}
+	}
+	return nil
+}
+
+// configConsumer crea il consumer durevole. Al primo avvio parte dalle letture nuove:
+// valutare lo storico farebbe scattare alert già superati
+func configConsumer(js nats.JetStreamContext, durable string) error {
+	_, err := js.ConsumerInfo(inputStream, durable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+
+	_, err = js.AddConsumer(inputStream, &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: inputSubject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverNewPolicy,
+		AckWait:       30 * time.Second,
+		MaxDeliver:    3,
+	})
+	return err
+}
+
+// Attesa dopo un errore di fetch, raddoppiata a ogni errore consecutivo fino a fetchRetryMaxDelay
+const (
+	fetchRetryDelay    = 500 * time.Millisecond
+	fetchRetryMaxDelay = 10 * time.Second
+)
+
+// consume valuta le letture finché ctx non viene annullato. Le letture vengono sempre confermate:
+// un errore di valutazione non si risolve riconsegnando la stessa lettura
+func consume(ctx context.Context, js nats.JetStreamContext, engine *Engine, durable string, batchSize int) {
+	sub, err := js.PullSubscribe(inputSubject, durable, nats.Bind(inputStream, durable))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	log.Printf("Alerting in ascolto su %s... premi Ctrl+C per uscire", inputStream)
+
+	delay := fetchRetryDelay
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(batchSize, nats.MaxWait(2*time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			// Errori come la connessione chiusa ritornano subito: senza attesa il ciclo girerebbe a vuoto
+			log.Printf("Errore fetch, nuovo tentativo tra %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, fetchRetryMaxDelay)
+			continue
+		}
+		delay = fetchRetryDelay
+
+		for _, msg := range msgs {
+			engine.process(msg)
+			msg.Ack()
+		}
+	}
+}
+
+// watchTenants allinea le sorgenti di ALERTING_SENSORS al bucket tenants e carica gli alert
+// attivi di ogni nuovo tenant. Ritorna dopo il primo allineamento
+func watchTenants(ctx context.Context, js nats.JetStreamContext, engine *Engine) error {
+	kv, err := js.KeyValue(tenantsBucket)
+	if err != nil {
+		return fmt.Errorf("errore apertura bucket %s (il subscriber è stato avviato?): %v", tenantsBucket, err)
+	}
+
+	var (
+		mu      sync.Mutex
+		tenants = map[string]TenantSource{}
+		// Le sorgenti si allineano dopo aver ricevuto tutti i tenant, poi a ogni cambiamento
+		loaded bool
+	)
+
+	watcher, err := watchBucket(ctx, kv, func(entry nats.KeyValueEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if entry.Operation() != nats.KeyValuePut {
+			delete(tenants, entry.Key())
+		} else {
+			var t TenantSource
+			if err := json.Unmarshal(entry.Value(), &t); err != nil || t.NatsID != entry.Key() || t.Stream == "" || t.APIPrefix == "" {
+				log.Printf("Tenant %s ignorato: voce non valida", entry.Key())
+				return
+			}
+			if _, ok := tenants[t.NatsID]; !ok {
+				engine.loadActive(t.NatsID)
+			}
+			tenants[t.NatsID] = t
+		}
+
+		if !loaded {
+			return
+		}
+		if err := reconcileSources(js, tenants); err != nil {
+			log.Printf("Errore aggiornamento sorgenti %s: %v", inputStream, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	loaded = true
+	err = reconcileSources(js, tenants)
+	mu.Unlock()
+	if err != nil {
+		watcher.Stop()
+		return err
+	}
+	return nil
+}
+
+// reconcileSources imposta le sorgenti dello stream in base ai tenant. Le sorgenti esistenti
+// restano invariate, quelle nuove partono da adesso e non dall'inizio dello stream del tenant
+func reconcileSources(js nats.JetStreamContext, tenants map[string]TenantSource) error {
+	info, err := js.StreamInfo(inputStream)
+	if err != nil {
+		return fmt.Errorf("errore lettura stream: %v", err)
+	}
+
+	existing := map[string]*nats.StreamSource{}
+	for _, s := range info.Config.Sources {
+		existing[s.Name+"|"+s.FilterSubject] = s
+	}
+
+	ids := make([]string, 0, len(tenants))
+	for id := range tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	changed := len(info.Config.Sources) != len(ids)
+	sources := make([]*nats.StreamSource, 0, len(ids))
+	for _, id := range ids {
+		t := tenants[id]
+		filter := "sensors." + t.NatsID + ".>"
+		if s, ok := existing[t.Stream+"|"+filter]; ok && s.External != nil && s.External.APIPrefix == t.APIPrefix {
+			sources = append(sources, s)
+			continue
+		}
+		changed = true
+		sources = append(sources, &nats.StreamSource{
+			Name:          t.Stream,
+			FilterSubject: filter,
+			OptStartTime:  &now,
+			External:      &nats.ExternalStream{APIPrefix: t.APIPrefix},
+		})
+	}
+
+	if !changed {
+		return nil
+	}
+
+	cfg := info.Config
+	cfg.Sources = sources
+	if _, err := js.UpdateStream(&cfg); err != nil {
+		return fmt.Errorf("errore aggiornamento stream: %v", err)
+	}
+
+	log.Printf("Sorgenti di %s aggiornate: %d tenant", inputStream, len(sources))
+	return nil
+}
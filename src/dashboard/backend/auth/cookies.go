@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	AccessTokenCookie  = "jwt-token"
+	RefreshTokenCookie = "refresh-token"
+)
+
+/*
+Salva i token nei cookie usati dalle pagine HTML.
+NOTA: Questo sistema non è sicuro contro attachi di CSRF, ma non importa per il PoC
+*/
+func SetCookies(c *gin.Context, tokens *Tokens) {
+	c.SetCookieData(&http.Cookie{
+		Name:     AccessTokenCookie,
+		Value:    tokens.AccessToken,
+		Path:     "/",
+		MaxAge:   int(RefreshTokenTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+	c.SetCookieData(&http.Cookie{
+		Name:     RefreshTokenCookie,
+		Value:    tokens.RefreshToken,
+		Path:     "/",
+		MaxAge:   int(RefreshTokenTTL.Seconds()),
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+}
+
+func ClearCookies(c *gin.Context) {
+	for _, name := range []string{AccessTokenCookie, RefreshTokenCookie} {
+		c.SetCookieData(&http.Cookie{
+			Name:   name,
+			Path:   "/",
+			MaxAge: -1,
+		})
+	}
+	ClearNatsCookie(c)
+}
+
+/* Cancella il JWT NATS, ad esempio quando il ruolo dell'utente non permette più di leggere i dati */
+func ClearNatsCookie(c *gin.Context) {
+	c.SetCookieData(&http.Cookie{
+		Name:   NatsJWTCookie,
+		Path:   "/",
+		Domain: natsCookieDomain(),
+		MaxAge: -1,
+	})
+}
@@ -0,0 +1,25 @@
+package auth
+
+import "fmt"
+
+type UnexpectedSigningMethodError struct {
+	Method any
+}
+func (e UnexpectedSigningMethodError) Error() string { return fmt.Sprintf("Unexpected signing method: %v", e.Method)}
+
+type UnknownKeyError struct {
+	Kid string
+}
+func (e UnknownKeyError) Error() string { return fmt.Sprintf("Unknown signing key %q", e.Kid) }
+
+type InvalidOrExpiredTokenError struct {}
+func (e InvalidOrExpiredTokenError) Error() string { return "Invalid or expired token" }
+
+type InvalidRefreshTokenError struct{}
+func (e InvalidRefreshTokenError) Error() string { return "Invalid or expired refresh token" }
+
+type RefreshTokenReusedError struct{}
+func (e RefreshTokenReusedError) Error() string { return "Refresh token already used, session revoked" }
+
+type SessionRevokedError struct{}
+func (e SessionRevokedError) Error() string { return "Session revoked or expired" }
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Algoritmi di firma supportati */
+type Algorithm string
+
+const (
+	RS256 Algorithm = "RS256"
+	EdDSA Algorithm = "EdDSA"
+)
+
+func ParseAlgorithm(s string) (Algorithm, error) {
+	switch Algorithm(s) {
+	case RS256, EdDSA:
+		return Algorithm(s), nil
+	}
+	return "", fmt.Errorf("algoritmo JWT non supportato: %q (ammessi RS256, EdDSA)", s)
+}
+
+/* Chiave di firma, salvata in <dir>/<kid>.pem */
+type signingKey struct {
+	kid     string
+	alg     Algorithm
+	created time.Time
+	private crypto.Signer
+}
+
+func (k *signingKey) method() jwt.SigningMethod {
+	if k.alg == RS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+func (k *signingKey) public() crypto.PublicKey {
+	return k.private.Public()
+}
+
+func generateKey(alg Algorithm, now time.Time) (*signingKey, error) {
+	var private crypto.Signer
+	var err error
+
+	switch alg {
+	case RS256:
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	// Il kid inizia con la data di creazione, così i file sono ordinati per età
+	kid := fmt.Sprintf("%s-%x", now.UTC().Format("20060102T150405"), suffix)
+
+	return &signingKey{kid: kid, alg: alg, created: now, private: private}, nil
+}
+
+func (k *signingKey) save(dir string) error {
+	der, err := x509.MarshalPKCS8PrivateKey(k.private)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	path := filepath.Join(dir, k.kid+".pem")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return err
+	}
+	return os.Chtimes(path, k.created, k.created)
+}
+
+func loadKey(path string) (*signingKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: PEM non valido", path)
+	}
+
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &signingKey{
+		kid:     strings.TrimSuffix(filepath.Base(path), ".pem"),
+		created: info.ModTime(),
+	}
+	switch key := parsed.(type) {
+	case *rsa.PrivateKey:
+		k.alg, k.private = RS256, key
+	case ed25519.PrivateKey:
+		k.alg, k.private = EdDSA, key
+	default:
+		return nil, fmt.Errorf("%s: tipo di chiave non supportato %T", path, parsed)
+	}
+
+	return k, nil
+}
+
+/* Chiave pubblica in formato JWK (RFC 7517), per /.well-known/jwks.json */
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Ed25519
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *signingKey) jwk() JWK {
+	jwk := JWK{Kid: k.kid, Use: "sig", Alg: string(k.alg)}
+
+	switch pub := k.public().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
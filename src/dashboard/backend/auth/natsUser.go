@@ -0,0 +1,182 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"gin-test/models"
+
+	"github.com/gin-gonic/gin"
+	natsjwt "github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nkeys"
+)
+
+/* Cookie letto dal server NATS all'apertura del WebSocket (jwt_cookie in nats.conf) */
+const NatsJWTCookie = "real_time_data_jwt"
+
+/*
+Durata dei JWT NATS degli utenti (NATS_USER_JWT_TTL). Alla scadenza il server NATS chiude la connessione,
+quindi il client deve chiederne uno nuovo con GET /api/nats/credentials prima di riconnettersi
+*/
+var NatsUserJWTTTL = durationFromEnv("NATS_USER_JWT_TTL", 15*time.Minute)
+
+type NatsCredentials struct {
+	JWT       string
+	Subject   string
+	ExpiresAt time.Time
+}
+
+type NoTenantError struct{}
+func (e NoTenantError) Error() string { return "User has no tenant" }
+
+type MissingAccountSeedError struct {
+	Tenant string
+}
+func (e MissingAccountSeedError) Error() string {
+	return fmt.Sprintf("Seed dell'account NATS del tenant %s non disponibile", e.Tenant)
+}
+
+/*
+Chiave dell'account NATS del tenant. Per i tenant creati dal provisioning il seed è nel DB (cifrato),
+per quelli creati a mano con nsc (tenant_1, tenant_2) nella variabile <NATS_ID>_ACCOUNT_SEED
+*/
+func tenantAccountKey(tenant models.Tenant) (nkeys.KeyPair, error) {
+	seed, err := tenant.AccountSeed()
+	if err != nil {
+		return nil, err
+	}
+	if seed == "" {
+		seed = os.Getenv(strings.ToUpper(tenant.NatsID) + "_ACCOUNT_SEED")
+	}
+	if seed == "" {
+		return nil, &MissingAccountSeedError{Tenant: tenant.NatsID}
+	}
+
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("seed dell'account %s non valido: %w", tenant.NatsID, err)
+	}
+	publicKey, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	if !nkeys.IsValidPublicAccountKey(publicKey) {
+		return nil, fmt.Errorf("il seed del tenant %s non è di un account", tenant.NatsID)
+	}
+	if tenant.NatsAccount != "" && tenant.NatsAccount != publicKey {
+		return nil, fmt.Errorf("il seed del tenant %s non corrisponde all'account %s", tenant.NatsID, tenant.NatsAccount)
+	}
+
+	return kp, nil
+}
+
+/*
+Genera il JWT NATS dell'utente, firmato dall'account del tenant.
+L'utente può solo sottoscriversi ai dati dei sensori del proprio tenant: niente publish,
+quindi nemmeno l'API JetStream. Il JWT è un bearer token perché il browser non ha la chiave privata
+dell'utente con cui firmare il nonce del server
+*/
+func IssueNatsUserJWT(user models.User) (*NatsCredentials, error) {
+	if user.Tenant.NatsID == "" {
+		return nil, &NoTenantError{}
+	}
+
+	accountKey, err := tenantAccountKey(user.Tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	// La chiave dell'utente serve solo come identificativo, la parte privata viene scartata
+	userKey, err := nkeys.CreateUser()
+	if err != nil {
+		return nil, err
+	}
+	userPublicKey, err := userKey.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+
+	subject := "sensors." + user.Tenant.NatsID + ".>"
+	expiresAt := time.Now().Add(NatsUserJWTTTL)
+
+	claims := natsjwt.NewUserClaims(userPublicKey)
+	claims.Name = fmt.Sprintf("%s (%d)", user.Username, user.ID)
+	claims.Expires = expiresAt.Unix()
+	claims.BearerToken = true
+	claims.Sub.Allow.Add(subject)
+	claims.Pub.Deny.Add(">")
+
+	token, err := claims.Encode(accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("errore firma JWT NATS: %w", err)
+	}
+
+	return &NatsCredentials{JWT: token, Subject: subject, ExpiresAt: expiresAt}, nil
+}
+
+/*
+Dominio del cookie NATS (NATS_JWT_COOKIE_DOMAIN). Il server NATS è su un altro host rispetto alla dashboard,
+quindi il cookie va impostato sul dominio comune (es. glitchhubteam.it) perché il browser lo invii
+*/
+func natsCookieDomain() string {
+	return os.Getenv("NATS_JWT_COOKIE_DOMAIN")
+}
+
+/* Genera il JWT NATS dell'utente e lo salva nel cookie letto dal server NATS */
+func SetNatsCookie(c *gin.Context, user models.User) (*NatsCredentials, error) {
+	creds, err := IssueNatsUserJWT(user)
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetCookieData(&http.Cookie{
+		Name:     NatsJWTCookie,
+		Value:    creds.JWT,
+		Path:     "/",
+		Domain:   natsCookieDomain(),
+		Expires:  creds.ExpiresAt,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+	})
+
+	return creds, nil
+}
+
+/*
+Credenziali con cui il backend si connette all'account del tenant, per i tenant che non hanno
+un file creds (<NATS_ID>_CREDS). A differenza dei JWT degli utenti non scadono e non sono bearer:
+il seed dell'utente resta al backend e serve a firmare il nonce
+*/
+func IssueNatsServiceUser(tenant models.Tenant) (string, []byte, error) {
+	accountKey, err := tenantAccountKey(tenant)
+	if err != nil {
+		return "", nil, err
+	}
+
+	userKey, err := nkeys.CreateUser()
+	if err != nil {
+		return "", nil, err
+	}
+	userPublicKey, err := userKey.PublicKey()
+	if err != nil {
+		return "", nil, err
+	}
+	seed, err := userKey.Seed()
+	if err != nil {
+		return "", nil, err
+	}
+
+	claims := natsjwt.NewUserClaims(userPublicKey)
+	claims.Name = "dashboard-backend"
+
+	token, err := claims.Encode(accountKey)
+	if err != nil {
+		return "", nil, fmt.Errorf("errore firma JWT NATS: %w", err)
+	}
+
+	return token, seed, nil
+}
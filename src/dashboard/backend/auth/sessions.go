@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"time"
+
+	"gin-test/models"
+)
+
+/* Coppia di token restituita a login e refresh */
+type Tokens struct {
+	Session      models.Session
+	AccessToken  string
+	RefreshToken string
+}
+
+func newRefreshToken() (token string, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	hash = hashToken(token)
+	return
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+/* Crea una nuova sessione per l'utente (login o registrazione) */
+func StartSession(user models.User, userAgent string, ip string) (*Tokens, error) {
+	refreshToken, hash, err := newRefreshToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	session := models.Session{
+		UserID:           user.ID,
+		RefreshTokenHash: hash,
+		UserAgent:        userAgent,
+		IP:               ip,
+		ExpiresAt:        now.Add(RefreshTokenTTL),
+		LastUsedAt:       now,
+	}
+	if err := session.Create(); err != nil {
+		return nil, err
+	}
+
+	accessToken, err := IssueAccessToken(user, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tokens{Session: session, AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+/*
+Per quanto tempo dopo una rotazione il refresh token precedente viene ancora accettato (REFRESH_REUSE_GRACE):
+le schede del browser condividono il refresh token e possono rinnovarlo quasi insieme.
+Oltre questa finestra il riuso viene trattato come un furto del token e la sessione revocata
+*/
+var RefreshReuseGrace = durationFromEnv("REFRESH_REUSE_GRACE", 30*time.Second)
+
+/* Tentativi di rotazione se un refresh concorrente cambia la sessione tra la lettura e l'aggiornamento */
+const refreshAttempts = 3
+
+/*
+Scambia un refresh token con una nuova coppia di token, ruotando il refresh token.
+La rotazione è condizionata al token letto, quindi due refresh concorrenti non possono ruotare
+entrambi la stessa versione della sessione: il secondo rilegge la sessione e riprova.
+Se viene presentato un refresh token già usato, dopo RefreshReuseGrace, la sessione viene revocata.
+*/
+func RefreshSession(refreshToken string, userAgent string, ip string) (*Tokens, error) {
+	hash := hashToken(refreshToken)
+
+	for attempt := 0; attempt < refreshAttempts; attempt++ {
+		session, err := refreshableSession(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		var user models.User
+		models.GetUserById(&user, int(session.UserID))
+		if user.ID == 0 {
+			return nil, &InvalidRefreshTokenError{}
+		}
+
+		newToken, newHash, err := newRefreshToken()
+		if err != nil {
+			return nil, err
+		}
+
+		rotated, err := session.Rotate(session.RefreshTokenHash, newHash, userAgent, ip)
+		if err != nil {
+			return nil, err
+		}
+		if !rotated {
+			continue
+		}
+
+		accessToken, err := IssueAccessToken(user, session.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		return &Tokens{Session: *session, AccessToken: accessToken, RefreshToken: newToken}, nil
+	}
+
+	return nil, &InvalidRefreshTokenError{}
+}
+
+/*
+Sessione da ruotare per il refresh token con questo hash: quella di cui è il token corrente oppure,
+entro RefreshReuseGrace dalla rotazione, quella di cui è il token precedente (un'altra scheda
+ha appena rinnovato la sessione). Un token precedente presentato più tardi revoca la sessione
+*/
+func refreshableSession(hash string) (*models.Session, error) {
+	var session models.Session
+	models.GetSessionByRefreshHash(&session, hash)
+	if session.ID == 0 {
+		models.GetSessionByPreviousHash(&session, hash)
+		if !session.Active() {
+			return nil, &InvalidRefreshTokenError{}
+		}
+		if time.Since(session.RotatedAt) > RefreshReuseGrace {
+			log.Printf("Riuso del refresh token della sessione %d (utente %d): sessione revocata", session.ID, session.UserID)
+			session.Revoke()
+			return nil, &RefreshTokenReusedError{}
+		}
+	}
+	if !session.Active() {
+		return nil, &InvalidRefreshTokenError{}
+	}
+	return &session, nil
+}
+
+/* Verifica che la sessione dell'access token esista, appartenga all'utente e non sia stata revocata */
+func CheckSession(sessionID uint, userID uint) (models.Session, error) {
+	var session models.Session
+	models.GetSessionById(&session, sessionID)
+	if !session.Active() || session.UserID != userID {
+		return session, &SessionRevokedError{}
+	}
+	return session, nil
+}
+
+/* Revoca la sessione a cui appartiene il refresh token (logout dalle pagine HTML) */
+func RevokeRefreshToken(refreshToken string) error {
+	var session models.Session
+	models.GetSessionByRefreshHash(&session, hashToken(refreshToken))
+	if !session.Active() {
+		return nil
+	}
+	return session.Revoke()
+}
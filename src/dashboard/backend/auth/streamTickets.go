@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"sync"
+	"time"
+)
+
+/*
+Ticket per aprire WebSocket e SSE dei dati in tempo reale. Il browser non permette header su
+WebSocket ed EventSource, quindi l'autenticazione deve viaggiare nell'URL, che finisce nei log
+del server e dei proxy: al posto dell'access token si usa un ticket monouso che scade subito.
+I ticket sono in memoria, quindi valgono solo sull'istanza della dashboard che li ha creati
+*/
+const StreamTicketTTL = 30 * time.Second
+
+type streamTicket struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+var (
+	streamTickets   = map[string]streamTicket{}
+	streamTicketsMu sync.Mutex
+)
+
+type InvalidStreamTicketError struct{}
+func (e InvalidStreamTicketError) Error() string { return "Invalid or expired ticket" }
+
+/* Crea un ticket legato all'access token (e quindi alla sessione) della richiesta */
+func IssueStreamTicket(accessToken string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ticket := base64.RawURLEncoding.EncodeToString(b)
+
+	streamTicketsMu.Lock()
+	defer streamTicketsMu.Unlock()
+
+	now := time.Now()
+	for t, st := range streamTickets {
+		if now.After(st.expiresAt) {
+			delete(streamTickets, t)
+		}
+	}
+	streamTickets[ticket] = streamTicket{accessToken: accessToken, expiresAt: now.Add(StreamTicketTTL)}
+	return ticket, nil
+}
+
+/* Consuma il ticket e restituisce l'access token da verificare: un ticket vale una sola volta */
+func RedeemStreamTicket(ticket string) (string, error) {
+	streamTicketsMu.Lock()
+	defer streamTicketsMu.Unlock()
+
+	st, ok := streamTickets[ticket]
+	delete(streamTickets, ticket)
+	if !ok || time.Now().After(st.expiresAt) {
+		return "", &InvalidStreamTicketError{}
+	}
+	return st.accessToken, nil
+}
@@ -0,0 +1,217 @@
+package auth
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/* Valore del claim iss dei token della dashboard */
+const Issuer = "glitchhub-dashboard"
+
+type TokenConfig struct {
+	Algorithm Algorithm
+	// Cartella con le chiavi private, una per file
+	KeysDir string
+	// Ogni quanto viene generata una nuova chiave di firma
+	Rotation time.Duration
+}
+
+func TokenConfigFromEnv() (TokenConfig, error) {
+	cfg := TokenConfig{
+		Algorithm: EdDSA,
+		KeysDir:   "keys",
+		Rotation:  durationFromEnv("JWT_KEY_ROTATION", 7*24*time.Hour),
+	}
+
+	if alg := os.Getenv("JWT_ALGORITHM"); alg != "" {
+		var err error
+		if cfg.Algorithm, err = ParseAlgorithm(alg); err != nil {
+			return cfg, err
+		}
+	}
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		cfg.KeysDir = dir
+	}
+
+	return cfg, nil
+}
+
+/*
+TokenService firma e verifica i JWT con chiavi asimmetriche.
+L'ultima chiave creata firma i nuovi token; le precedenti restano valide per la verifica
+finché possono esistere token firmati con esse (durata dell'access token), poi vengono eliminate.
+Le chiavi pubbliche sono pubblicate in /.well-known/jwks.json, così gli altri servizi
+possono verificare i token senza conoscere alcun segreto.
+*/
+type TokenService struct {
+	cfg TokenConfig
+
+	mu sync.RWMutex
+	// Ordinate dalla più vecchia alla più recente, l'ultima è quella attiva
+	keys []*signingKey
+}
+
+var tokenService *TokenService
+
+/* Inizializza il servizio usato da IssueAccessToken e ParseAccessToken, da chiamare all'avvio */
+func InitTokenService() {
+	cfg, err := TokenConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	tokenService, err = NewTokenService(cfg)
+	if err != nil {
+		log.Fatal("Impossibile caricare le chiavi JWT: ", err)
+	}
+
+	go tokenService.rotateEvery(time.Minute)
+}
+
+func NewTokenService(cfg TokenConfig) (*TokenService, error) {
+	s := &TokenService{cfg: cfg}
+
+	paths, err := filepath.Glob(filepath.Join(cfg.KeysDir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		key, err := loadKey(path)
+		if err != nil {
+			return nil, err
+		}
+		s.keys = append(s.keys, key)
+	}
+	sort.Slice(s.keys, func(i, j int) bool { return s.keys[i].created.Before(s.keys[j].created) })
+
+	if err := s.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+/*
+Genera una nuova chiave se quella attiva è più vecchia dell'intervallo di rotazione
+(o usa un algoritmo diverso da quello configurato) ed elimina le chiavi non più necessarie
+*/
+func (s *TokenService) Rotate(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := s.activeKey()
+	if active == nil || active.alg != s.cfg.Algorithm || now.Sub(active.created) >= s.cfg.Rotation {
+		key, err := generateKey(s.cfg.Algorithm, now)
+		if err != nil {
+			return fmt.Errorf("errore generazione chiave: %w", err)
+		}
+		if err := key.save(s.cfg.KeysDir); err != nil {
+			return fmt.Errorf("errore salvataggio chiave: %w", err)
+		}
+		s.keys = append(s.keys, key)
+		log.Printf("Nuova chiave di firma JWT %s (%s)", key.kid, key.alg)
+	}
+
+	// Una chiave serve finché possono esistere token firmati con essa: fino a quando è stata
+	// sostituita dalla successiva più la durata di un access token
+	var kept []*signingKey
+	for i, key := range s.keys {
+		if i < len(s.keys)-1 && now.Sub(s.keys[i+1].created) > AccessTokenTTL {
+			os.Remove(filepath.Join(s.cfg.KeysDir, key.kid+".pem"))
+			log.Printf("Chiave di firma JWT %s eliminata", key.kid)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	s.keys = kept
+
+	return nil
+}
+
+func (s *TokenService) rotateEvery(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		if err := s.Rotate(now); err != nil {
+			log.Printf("Rotazione chiavi JWT fallita: %v", err)
+		}
+	}
+}
+
+func (s *TokenService) activeKey() *signingKey {
+	if len(s.keys) == 0 {
+		return nil
+	}
+	return s.keys[len(s.keys)-1]
+}
+
+/* Firma i claims con la chiave attiva, indicandone il kid nell'header */
+func (s *TokenService) Sign(claims jwt.MapClaims) (string, error) {
+	s.mu.RLock()
+	key := s.activeKey()
+	s.mu.RUnlock()
+
+	claims["iss"] = Issuer
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.kid
+
+	return token.SignedString(key.private)
+}
+
+/* Verifica firma, algoritmo, emittente e scadenza del token */
+func (s *TokenService) Parse(tokenString string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		key := s.key(kid)
+		if key == nil {
+			return nil, &UnknownKeyError{Kid: kid}
+		}
+		if token.Method.Alg() != key.method().Alg() {
+			return nil, &UnexpectedSigningMethodError{Method: token.Header["alg"]}
+		}
+		return key.public(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || !claims.VerifyIssuer(Issuer, true) || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, &InvalidOrExpiredTokenError{}
+	}
+
+	return claims, nil
+}
+
+func (s *TokenService) key(kid string) *signingKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+/* Chiavi pubbliche valide, dalla più recente */
+func (s *TokenService) JWKS() JWKSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for i := len(s.keys) - 1; i >= 0; i-- {
+		set.Keys = append(set.Keys, s.keys[i].jwk())
+	}
+	return set
+}
+
+func JWKS() JWKSet {
+	return tokenService.JWKS()
+}
@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"gin-test/models"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+/*
+Durata dei token. L'access token dura poco: se viene rubato è utilizzabile solo per qualche minuto
+e la revoca della sessione lo invalida subito. Il refresh token serve a ottenerne uno nuovo.
+Si possono cambiare con ACCESS_TOKEN_TTL e REFRESH_TOKEN_TTL (es. 15m, 168h).
+*/
+var (
+	AccessTokenTTL  = durationFromEnv("ACCESS_TOKEN_TTL", 15*time.Minute)
+	RefreshTokenTTL = durationFromEnv("REFRESH_TOKEN_TTL", 7*24*time.Hour)
+)
+
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		log.Printf("%s non valido (%q), uso %v", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+/* Genera l'access token della sessione. sid identifica la sessione, per poterla revocare */
+func IssueAccessToken(user models.User, sessionID uint) (string, error) {
+	now := time.Now()
+	return tokenService.Sign(jwt.MapClaims{
+		"sub":  strconv.FormatUint(uint64(user.ID), 10),
+		"id":   user.ID,
+		"role": user.Role,
+		"sid":  sessionID,
+		"iat":  now.Unix(),
+		"exp":  now.Add(AccessTokenTTL).Unix(),
+	})
+}
+
+/* Claims dell'access token usati dai middleware */
+type AccessClaims struct {
+	UserID    uint
+	SessionID uint
+	Role      models.Role
+}
+
+/* Verifica l'access token e ne estrae utente e sessione */
+func ParseAccessToken(tokenString string) (*AccessClaims, error) {
+	claims, err := tokenService.Parse(tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	id, okID := claims["id"].(float64)
+	sid, okSID := claims["sid"].(float64)
+	if !okID || !okSID {
+		return nil, &InvalidOrExpiredTokenError{}
+	}
+	role, _ := claims["role"].(string)
+
+	return &AccessClaims{UserID: uint(id), SessionID: uint(sid), Role: models.Role(role)}, nil
+}
@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"fmt"
+	"gin-test/dto"
+	"gin-test/initializers"
+	"gin-test/models"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Regole di alerting e alert del tenant dell'utente autenticato.
+Le regole vengono pubblicate nel bucket KV alert_rules, letto dal servizio di alerting (src/alerting),
+che salva gli alert nella tabella alerts dello schema del tenant
+*/
+
+const (
+	defaultAlertsLimit = 100
+	maxAlertsLimit     = 1000
+)
+
+func applyAlertRuleRequest(rule *models.AlertRule, req dto.AlertRuleRequest) error {
+	if !validSubjectToken.MatchString(req.Metric) {
+		return fmt.Errorf("invalid metric %q", req.Metric)
+	}
+	if req.Gateway != "" && !validSubjectToken.MatchString(req.Gateway) {
+		return fmt.Errorf("invalid gateway %q", req.Gateway)
+	}
+
+	rule.Name = req.Name
+	rule.Type = models.AlertRuleType(req.Type)
+	rule.Metric = req.Metric
+	rule.Field = req.Field
+	rule.Gateway = req.Gateway
+	rule.Operator = req.Operator
+	rule.Threshold = req.Threshold
+	rule.Hysteresis = req.Hysteresis
+	rule.ForSeconds = req.ForSeconds
+	rule.WindowSeconds = req.WindowSeconds
+	rule.Severity = models.AlertSeverity(req.Severity)
+	if rule.Severity == "" {
+		rule.Severity = models.SeverityWarning
+	}
+	rule.Enabled = req.Enabled == nil || *req.Enabled
+
+	return rule.Validate()
+}
+
+/* Regola indicata da :id, solo se appartiene al tenant. Se non esiste risponde 404 */
+func findAlertRule(c *gin.Context, tenant models.Tenant) (models.AlertRule, bool) {
+	var rule models.AlertRule
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid rule id"})
+		return rule, false
+	}
+
+	models.GetTenantAlertRule(&rule, tenant.ID, uint(id))
+	if rule.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Rule not found"})
+		return rule, false
+	}
+	return rule, true
+}
+
+// GET /api/alerts/rules
+func GetAlertRulesAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	rules := []models.AlertRule{}
+	models.GetTenantAlertRules(&rules, tenant.ID)
+
+	c.JSON(http.StatusOK, rules)
+}
+
+// POST /api/alerts/rules
+func CreateAlertRuleAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	var req dto.AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	rule := models.AlertRule{TenantID: tenant.ID}
+	if err := applyAlertRuleRequest(&rule, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := rule.Create(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create rule"})
+		return
+	}
+
+	if err := Provisioner.PublishAlertRule(tenant.NatsID, &rule); err != nil {
+		rule.Delete()
+		alertRulesError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, rule)
+}
+
+// PUT /api/alerts/rules/:id
+func UpdateAlertRuleAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	rule, ok := findAlertRule(c, tenant)
+	if !ok {
+		return
+	}
+
+	var req dto.AlertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	previous := rule
+	if err := applyAlertRuleRequest(&rule, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := rule.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update rule"})
+		return
+	}
+
+	if err := Provisioner.PublishAlertRule(tenant.NatsID, &rule); err != nil {
+		previous.Save()
+		alertRulesError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, rule)
+}
+
+// DELETE /api/alerts/rules/:id
+func DeleteAlertRuleAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	rule, ok := findAlertRule(c, tenant)
+	if !ok {
+		return
+	}
+
+	if err := Provisioner.DeleteAlertRule(tenant.NatsID, rule.ID); err != nil {
+		alertRulesError(c, err)
+		return
+	}
+	if err := rule.Delete(); err != nil {
+		Provisioner.PublishAlertRule(tenant.NatsID, &rule)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete rule"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Rule deleted"})
+}
+
+func alertRulesError(c *gin.Context, err error) {
+	log.Printf("Errore aggiornamento regole di alerting: %v", err)
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Could not update the alerting rules"})
+}
+
+// GET /api/alerts
+/*
+Alert del tenant dal più recente.
+Parametri: status (firing, acknowledged, resolved oppure open = firing e acknowledged), limit (default 100, max 1000)
+*/
+func GetAlertsAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	status := c.Query("status")
+	switch status {
+	case "", "open", models.AlertFiring, models.AlertAcknowledged, models.AlertResolved:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid status: use firing, acknowledged, resolved or open"})
+		return
+	}
+
+	limit := defaultAlertsLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxAlertsLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxAlertsLimit)})
+			return
+		}
+		limit = n
+	}
+
+	db, err := initializers.TenantDB(tenant.NatsID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	alerts := []models.Alert{}
+	if err := models.GetAlerts(db, &alerts, status, limit); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"data": alerts, "count": len(alerts)})
+}
+
+// POST /api/alerts/:id/ack
+/*
+Conferma un alert firing: l'alert resta aperto finché il servizio di alerting non lo risolve,
+ma le notifiche non vengono più ripetute. Solo gli alert firing si possono confermare (409 altrimenti)
+*/
+func AckAlertAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid alert id"})
+		return
+	}
+
+	db, err := initializers.TenantDB(tenant.NatsID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	var alert models.Alert
+	if err := models.GetAlert(db, &alert, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
+		return
+	}
+	if alert.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+		return
+	}
+
+	acked, err := models.AcknowledgeAlert(db, &alert, user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not acknowledge alert"})
+		return
+	}
+	if !acked {
+		c.JSON(http.StatusConflict, gin.H{"error": "Alert is not firing"})
+		return
+	}
+
+	// L'ack è già salvato. Senza l'evento il notifier non lo vede e le escalation continuano
+	if err := Provisioner.PublishAlertEvent(tenant.NatsID, &alert); err != nil {
+		log.Printf("Errore pubblicazione conferma dell'alert %d: %v", alert.ID, err)
+	}
+
+	c.JSON(http.StatusOK, alert)
+}
@@ -1,15 +1,13 @@
 package controllers
 
 import (
+	"gin-test/auth"
 	"gin-test/dto"
 	"gin-test/initializers"
 	"gin-test/models"
 	"net/http"
-	"os"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -42,13 +40,8 @@ func LoginAPI(c *gin.Context) {
 		return
 	}
 
-	// Genera token JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  user.ID,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("SECRET")))
+	// Crea la sessione e genera i token
+	tokens, err := auth.StartSession(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
@@ -56,10 +49,13 @@ func LoginAPI(c *gin.Context) {
 
 	// Body della response
 	response := dto.AuthResponse{
-		Token: tokenString,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
 		User: dto.UserResponse{
 			ID:        user.ID,
 			Username:  user.Username,
+			Role:      string(user.Role),
 			CreatedAt: user.CreatedAt,
 		},
 	}
@@ -72,6 +68,8 @@ func LoginAPI(c *gin.Context) {
 		}
 	}
 
+	setNatsCookie(c, user)
+
 	c.JSON(http.StatusOK, response)
 }
 
@@ -117,13 +115,8 @@ func RegisterAPI(c *gin.Context) {
 		req.TenantID,
 	).First(&user)
 
-	// Genera token JWT
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  user.ID,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	tokenString, err := token.SignedString([]byte(os.Getenv("SECRET")))
+	// Crea la sessione e genera i token
+	tokens, err := auth.StartSession(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate token"})
 		return
@@ -131,10 +124,13 @@ func RegisterAPI(c *gin.Context) {
 
 	// Body della response
 	response := dto.AuthResponse{
-		Token: tokenString,
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
 		User: dto.UserResponse{
 			ID:        user.ID,
 			Username:  user.Username,
+			Role:      string(user.Role),
 			CreatedAt: user.CreatedAt,
 		},
 	}
@@ -147,6 +143,7 @@ func RegisterAPI(c *gin.Context) {
 		}
 	}
 
+	// Niente JWT NATS alla registrazione: il nuovo utente è pending e non può leggere i dati
 	c.JSON(http.StatusCreated, response)
 }
 
@@ -175,6 +172,7 @@ func GetUserProfileAPI(c *gin.Context) {
 	response := dto.UserResponse{
 		ID:        user.ID,
 		Username:  user.Username,
+		Role:      string(user.Role),
 		CreatedAt: user.CreatedAt,
 	}
 
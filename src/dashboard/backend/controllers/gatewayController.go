@@ -0,0 +1,339 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"gin-test/dto"
+	"gin-test/models"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Registro dei gateway e dei dispositivi del tenant dell'utente autenticato.
+Ogni modifica a un gateway viene pubblicata nel bucket KV gateways, letto dal subscriber:
+se non si riesce ad aggiornarlo la modifica viene annullata, così DB e subscriber restano allineati
+*/
+
+func currentTenant(c *gin.Context) (models.Tenant, bool) {
+	u, _ := c.Get("currentUser")
+	tenant := u.(models.User).Tenant
+	if tenant.ID == 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user has no tenant"})
+		return tenant, false
+	}
+	return tenant, true
+}
+
+/* Gateway indicato da :id, solo se appartiene al tenant. Se non esiste risponde 404 */
+func findGateway(c *gin.Context, tenant models.Tenant) (models.Gateway, bool) {
+	var gateway models.Gateway
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid gateway id"})
+		return gateway, false
+	}
+
+	models.GetTenantGateway(&gateway, tenant.ID, uint(id))
+	if gateway.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Gateway not found"})
+		return gateway, false
+	}
+	return gateway, true
+}
+
+func applyGatewayRequest(gateway *models.Gateway, req dto.GatewayRequest) error {
+	if !validSubjectToken.MatchString(req.NatsID) {
+		return fmt.Errorf("invalid natsId %q: only letters, digits, '_' and '-'", req.NatsID)
+	}
+	status, err := models.ParseDeviceStatus(req.Status)
+	if err != nil {
+		return err
+	}
+
+	gateway.NatsID = req.NatsID
+	gateway.Serial = req.Serial
+	gateway.Location = req.Location
+	gateway.Bed = req.Bed
+	gateway.Patient = req.Patient
+	gateway.Status = status
+	gateway.Firmware = req.Firmware
+	return nil
+}
+
+func registryError(c *gin.Context, err error) {
+	log.Printf("Errore aggiornamento registro gateway: %v", err)
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Could not update the gateway registry"})
+}
+
+// GET /api/gateways
+func GetGatewaysAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	gateways := []models.Gateway{}
+	models.GetTenantGateways(&gateways, tenant.ID)
+	for i := range gateways {
+		withConnection(tenant.NatsID, &gateways[i])
+	}
+
+	c.JSON(http.StatusOK, gateways)
+}
+
+// GET /api/gateways/:id
+func GetGatewayAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+	withConnection(tenant.NatsID, &gateway)
+
+	c.JSON(http.StatusOK, gateway)
+}
+
+// POST /api/gateways
+func CreateGatewayAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	var req dto.GatewayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	gateway := models.Gateway{TenantID: tenant.ID}
+	if err := applyGatewayRequest(&gateway, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := gateway.Create()
+	var exists *models.GatewayAlreadyExists
+	if errors.As(err, &exists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create gateway"})
+		return
+	}
+
+	if err := Provisioner.RegisterGateway(tenant.NatsID, &gateway); err != nil {
+		gateway.Delete()
+		registryError(c, err)
+		return
+	}
+
+	gateway.Devices = []models.Device{}
+	withConnection(tenant.NatsID, &gateway)
+	c.JSON(http.StatusCreated, gateway)
+}
+
+// PUT /api/gateways/:id
+func UpdateGatewayAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+
+	var req dto.GatewayRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	previous := gateway
+	if err := applyGatewayRequest(&gateway, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := gateway.Save(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not update gateway: natsId and serial must be unique"})
+		return
+	}
+
+	if err := Provisioner.RegisterGateway(tenant.NatsID, &gateway); err != nil {
+		previous.Save()
+		registryError(c, err)
+		return
+	}
+	// Cambiando natsId la vecchia chiave non vale più
+	if previous.NatsID != gateway.NatsID {
+		if err := Provisioner.UnregisterGateway(tenant.NatsID, previous.NatsID); err != nil {
+			log.Printf("Errore rimozione del gateway %s dal registro: %v", previous.NatsID, err)
+		}
+	}
+
+	withConnection(tenant.NatsID, &gateway)
+	c.JSON(http.StatusOK, gateway)
+}
+
+// DELETE /api/gateways/:id
+func DeleteGatewayAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+
+	if err := Provisioner.UnregisterGateway(tenant.NatsID, gateway.NatsID); err != nil {
+		registryError(c, err)
+		return
+	}
+	if err := gateway.Delete(); err != nil {
+		Provisioner.RegisterGateway(tenant.NatsID, &gateway)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete gateway"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Gateway deleted"})
+}
+
+func applyDeviceRequest(device *models.Device, req dto.DeviceRequest) error {
+	if !validSubjectToken.MatchString(req.Metric) {
+		return fmt.Errorf("invalid metric %q", req.Metric)
+	}
+	status, err := models.ParseDeviceStatus(req.Status)
+	if err != nil {
+		return err
+	}
+
+	device.Serial = req.Serial
+	device.Metric = req.Metric
+	device.Model = req.Model
+	device.Status = status
+	device.Firmware = req.Firmware
+	return nil
+}
+
+/* Dispositivo indicato da :deviceId, solo se appartiene al gateway */
+func findDevice(c *gin.Context, gateway models.Gateway) (models.Device, bool) {
+	var device models.Device
+
+	id, err := strconv.Atoi(c.Param("deviceId"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid device id"})
+		return device, false
+	}
+
+	models.GetGatewayDevice(&device, gateway.ID, uint(id))
+	if device.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return device, false
+	}
+	return device, true
+}
+
+// POST /api/gateways/:id/devices
+func CreateDeviceAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+
+	var req dto.DeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	device := models.Device{GatewayID: gateway.ID}
+	if err := applyDeviceRequest(&device, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	err := device.Create()
+	var exists *models.DeviceAlreadyExists
+	if errors.As(err, &exists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create device"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, device)
+}
+
+// PUT /api/gateways/:id/devices/:deviceId
+func UpdateDeviceAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+	device, ok := findDevice(c, gateway)
+	if !ok {
+		return
+	}
+
+	var req dto.DeviceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+	if err := applyDeviceRequest(&device, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := device.Save(); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Could not update device: serial must be unique"})
+		return
+	}
+
+	c.JSON(http.StatusOK, device)
+}
+
+// DELETE /api/gateways/:id/devices/:deviceId
+func DeleteDeviceAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	gateway, ok := findGateway(c, tenant)
+	if !ok {
+		return
+	}
+	device, ok := findDevice(c, gateway)
+	if !ok {
+		return
+	}
+
+	if err := device.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete device"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device deleted"})
+}
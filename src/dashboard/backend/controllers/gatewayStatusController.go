@@ -0,0 +1,63 @@
+package controllers
+
+import (
+	"gin-test/dto"
+	"gin-test/gatewaystatus"
+	"gin-test/models"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/* Stato di connessione dei gateway, nil se il watcher non è stato avviato (stato sempre unknown) */
+var GatewayStatus *gatewaystatus.Watcher
+
+/* Completa il gateway con lo stato di connessione e l'ultimo heartbeat */
+func withConnection(tenant string, gateway *models.Gateway) {
+	status, ok := GatewayStatus.Get(tenant, gateway.NatsID)
+	if !ok {
+		gateway.Connection = gatewaystatus.Unknown
+		return
+	}
+	gateway.Connection = status.Status
+	gateway.LastSeenAt = &status.LastSeen
+}
+
+/* Listener del watcher: salva l'ultimo heartbeat nel DB ad ogni cambio di stato */
+func SaveGatewayLastSeen(status gatewaystatus.Status) {
+	if status.LastSeen.IsZero() {
+		return
+	}
+	go func() {
+		if err := models.UpdateGatewayLastSeen(status.Tenant, status.GatewayID, status.LastSeen); err != nil {
+			log.Printf("Errore salvataggio ultimo heartbeat del gateway %s: %v", status.GatewayID, err)
+		}
+	}()
+}
+
+func statusMessage(status gatewaystatus.Status) dto.StreamMessage {
+	msg := dto.StreamMessage{
+		Type:      "gateway_status",
+		GatewayID: status.GatewayID,
+		Status:    status.Status,
+	}
+	if !status.LastSeen.IsZero() {
+		msg.Timestamp = status.LastSeen.UnixMilli()
+	}
+	return msg
+}
+
+// GET /api/gateways/status
+/*
+Stato di connessione di tutti i gateway del tenant che hanno inviato heartbeat,
+anche quelli non registrati
+*/
+func GetGatewayStatusAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, GatewayStatus.Tenant(tenant.NatsID))
+}
@@ -1,55 +1,457 @@
 package controllers
 
 import (
+	"database/sql"
 	"fmt"
 	"regexp"
+	"strings"
+	"time"
 
 	"gin-test/initializers"
+	"gin-test/models"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
+var validIdent = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
+
+// Durata dei bucket, es. 30s, 1m, 1h, 1d
+var validBucket = regexp.MustCompile(`^([1-9][0-9]*)(s|m|h|d)$`)
+
+// Numero massimo di bucket restituiti da una singola richiesta (un bucket per ogni gateway).
+// Se la query ne produce di più la risposta contiene i primi, con truncated = true
+const maxBuckets = 10000
+
+// Percentili calcolati di default per ogni bucket
+var defaultPercentiles = []float64{0.5, 0.95}
+
+// Tipi delle colonne che vengono aggregate (gli array, es. i campioni ECG, vengono ignorati)
+var numericTypes = map[string]bool{
+	"smallint":         true,
+	"integer":          true,
+	"bigint":           true,
+	"numeric":          true,
+	"real":             true,
+	"double precision": true,
+}
+
+// Rollup (continuous aggregate <metrica>_<nome>, vedi provisioning/retention.go), dal più grande
+var rollupSizes = []struct {
+	name string
+	size time.Duration
+}{
+	{"1d", 24 * time.Hour},
+	{"1h", time.Hour},
+	{"1m", time.Minute},
+}
+
+type historyQuery struct {
+	tenant      string
+	metric      string
+	gatewayID   string
+	from        *time.Time
+	to          *time.Time
+	limit       int
+	bucket      time.Duration
+	percentiles []float64
+	// Bucket letti dai rollup se possibile (default, tranne con source=raw o percentiles), senza percentili
+	useRollups bool
+}
+
+/*
+Restituisce le letture di una metrica del tenant dell'utente autenticato.
+Le query vengono eseguite con l'utente Postgres del tenant, che non può leggere gli altri schemi.
+Parametri:
+  - metric: obbligatorio
+  - tenant_id: opzionale, se presente deve essere il tenant dell'utente
+  - from, to: intervallo di tempo in formato RFC3339 (from incluso, to escluso)
+  - gateway_id: solo le letture del gateway indicato
+  - limit: numero massimo di letture (default 1000), senza from vengono restituite le ultime
+  - bucket: se presente (es. 1m, 1h) restituisce per ogni bucket e gateway media, minimo, massimo,
+    numero di letture e percentili di ogni colonna numerica. La media mantiene il nome della colonna,
+    gli altri valori hanno il suffisso _min, _max, _p50, ... Senza from vengono considerate le ultime 24 ore.
+    Con auto la durata dipende dall'intervallo (1m fino a un giorno, 1h fino a 60 giorni, poi 1d).
+    source nella risposta indica la tabella letta. Vengono restituiti al massimo 10000 bucket (per tutti
+    i gateway): se sono di più la risposta contiene i più vecchi e truncated è true
+  - source: rollup (default) legge i bucket dal rollup più grande utilizzabile, senza percentili,
+    se la durata è un multiplo di 1m, 1h o 1d, altrimenti li calcola dalle letture grezze.
+    raw li calcola sempre dalle letture grezze, che potrebbero essere già state eliminate
+  - percentiles: percentili da calcolare nei bucket, separati da virgola (default 0.5,0.95, solo dalle
+    letture grezze). Senza source implica raw, con source=rollup è un errore
+*/
 func HistoryGet(c *gin.Context) {
-	tenantQ := c.Query("tenant_id")
-	metric := c.Query("metric")
-	limitQ := c.DefaultQuery("limit", "1000")
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+
+	tenant := user.Tenant.NatsID
+	if tenant == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user has no tenant"})
+		return
+	}
+	if requested := c.Query("tenant_id"); requested != "" && requested != tenant {
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot read data of another tenant"})
+		return
+	}
+
+	q, err := parseHistoryQuery(c, tenant)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	db, err := initializers.TenantDB(tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	columns, err := numericColumns(db, q.tenant, q.metric)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
+		return
+	}
+	if columns == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("unknown metric %s", q.metric)})
+		return
+	}
+
+	var rows *sql.Rows
+	source := q.metric
+	if q.bucket > 0 {
+		var rollup string
+		rollup, err = findRollup(db, q, columns)
+		if err == nil && rollup != "" {
+			source = rollup
+			rows, err = rollupHistory(db, q, rollup, columns)
+		} else if err == nil {
+			rows, err = bucketedHistory(db, q, columns)
+		}
+	} else {
+		rows, err = rawHistory(db, q)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
+		return
+	}
+	defer rows.Close()
 
-	if tenantQ == "" || metric == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "tenant_id and metric are required"})
+	points, err := scanRows(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	validIdent := regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
-	if !validIdent.MatchString(metric) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid metric name"})
+	if q.bucket > 0 {
+		// Le query chiedono un bucket in più del massimo per capire se la serie è stata troncata
+		truncated := len(points) > maxBuckets
+		if truncated {
+			points = points[:maxBuckets]
+		}
+		c.JSON(http.StatusOK, gin.H{"data": points, "count": len(points), "bucket": formatBucket(q.bucket), "source": source, "truncated": truncated})
 		return
 	}
+	c.JSON(http.StatusOK, gin.H{"data": points, "count": len(points)})
+}
+
+func parseHistoryQuery(c *gin.Context, tenant string) (*historyQuery, error) {
+	q := &historyQuery{
+		tenant:      tenant,
+		metric:      c.Query("metric"),
+		gatewayID:   c.Query("gateway_id"),
+		percentiles: defaultPercentiles,
+	}
+
+	if q.metric == "" {
+		return nil, fmt.Errorf("metric is required")
+	}
+	if !validIdent.MatchString(q.tenant) {
+		return nil, fmt.Errorf("invalid tenant_id")
+	}
+	if !validIdent.MatchString(q.metric) {
+		return nil, fmt.Errorf("invalid metric name")
+	}
 
-	limit, err := strconv.Atoi(limitQ)
+	for _, p := range []struct {
+		name string
+		dest **time.Time
+	}{{"from", &q.from}, {"to", &q.to}} {
+		value := c.Query(p.name)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: expected RFC3339 timestamp", p.name)
+		}
+		*p.dest = &t
+	}
+	if q.from != nil && q.to != nil && !q.from.Before(*q.to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "1000"))
 	if err != nil || limit <= 0 {
 		limit = 1000
 	}
 	if limit > 10000 {
 		limit = 10000
 	}
+	q.limit = limit
+
+	if bucket := c.Query("bucket"); bucket != "" {
+		to := time.Now()
+		if q.to != nil {
+			to = *q.to
+		}
+		if q.from == nil {
+			from := to.Add(-24 * time.Hour)
+			q.from = &from
+		}
+
+		if bucket == "auto" {
+			q.bucket = autoBucket(to.Sub(*q.from))
+		} else {
+			q.bucket, err = parseBucket(bucket)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if to.Sub(*q.from)/q.bucket > maxBuckets {
+			return nil, fmt.Errorf("too many buckets: use a larger bucket or a shorter range (max %d)", maxBuckets)
+		}
+	}
 
-	table := metric
+	// Senza source i bucket vengono letti dai rollup quando possibile, tranne se il client chiede
+	// i percentili, che si possono calcolare solo dalle letture grezze
+	percentiles := c.Query("percentiles")
+	switch c.Query("source") {
+	case "":
+		q.useRollups = percentiles == ""
+	case "raw":
+	case "rollup":
+		q.useRollups = true
+	default:
+		return nil, fmt.Errorf("invalid source: expected raw or rollup")
+	}
 
-	query := fmt.Sprintf(`SELECT * FROM (SELECT * FROM %s.%s  ORDER BY time DESC LIMIT %d) AS recent ORDER BY time ASC`, tenantQ, table, limit)
+	if percentiles != "" {
+		if q.useRollups {
+			return nil, fmt.Errorf("percentiles are not available with source=rollup")
+		}
+		q.percentiles = nil
+		for _, s := range strings.Split(percentiles, ",") {
+			p, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil || p <= 0 || p >= 1 {
+				return nil, fmt.Errorf("invalid percentile %q: must be between 0 and 1", s)
+			}
+			q.percentiles = append(q.percentiles, p)
+		}
+	}
 
-	rows, err := initializers.DB.Raw(query).Rows()
+	return q, nil
+}
+
+func parseBucket(value string) (time.Duration, error) {
+	m := validBucket.FindStringSubmatch(value)
+	if m == nil {
+		return 0, fmt.Errorf("invalid bucket %q: expected e.g. 30s, 1m, 1h, 1d", value)
+	}
+
+	n, _ := strconv.Atoi(m[1])
+	unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[m[2]]
+	return time.Duration(n) * unit, nil
+}
+
+// formatBucket è l'inverso di parseBucket, es. 1h e non 1h0m0s
+func formatBucket(bucket time.Duration) string {
+	for _, unit := range []struct {
+		suffix string
+		size   time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}} {
+		if bucket%unit.size == 0 {
+			return fmt.Sprintf("%d%s", bucket/unit.size, unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%ds", bucket/time.Second)
+}
+
+// autoBucket sceglie la durata dei bucket in base all'intervallo richiesto, tra quelle dei rollup
+func autoBucket(span time.Duration) time.Duration {
+	switch {
+	case span <= 24*time.Hour:
+		return time.Minute
+	case span <= 60*24*time.Hour:
+		return time.Hour
+	default:
+		return 24 * time.Hour
+	}
+}
+
+// findRollup restituisce il rollup più grande la cui durata divide quella dei bucket richiesti
+// e che contiene tutte le colonne della metrica, "" se bisogna usare le letture grezze
+// (anche quando il client ha chiesto le letture grezze, o i percentili)
+func findRollup(db *gorm.DB, q *historyQuery, columns []string) (string, error) {
+	if !q.useRollups {
+		return "", nil
+	}
+
+	for _, r := range rollupSizes {
+		if q.bucket%r.size != 0 {
+			continue
+		}
+
+		name := q.metric + "_" + r.name
+		rollupColumns, err := numericColumns(db, q.tenant, name)
+		if err != nil {
+			return "", err
+		}
+		if rollupColumns == nil {
+			continue
+		}
+
+		available := map[string]bool{}
+		for _, col := range rollupColumns {
+			available[col] = true
+		}
+		complete := true
+		for _, col := range columns {
+			if !available[col+"_sum"] || !available[col+"_min"] || !available[col+"_max"] {
+				complete = false
+			}
+		}
+		if complete {
+			return name, nil
+		}
+	}
+	return "", nil
+}
+
+// numericColumns restituisce le colonne numeriche della tabella della metrica, nil se la tabella non esiste
+func numericColumns(db *gorm.DB, tenant string, metric string) ([]string, error) {
+	rows, err := db.Raw(
+		`SELECT column_name, data_type FROM information_schema.columns
+		 WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position`,
+		tenant, metric,
+	).Rows()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("query failed: %v", err)})
-		return
+		return nil, err
 	}
 	defer rows.Close()
 
+	columns := []string{}
+	found := false
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		found = true
+		if numericTypes[dataType] {
+			columns = append(columns, name)
+		}
+	}
+	if !found {
+		return nil, rows.Err()
+	}
+	return columns, rows.Err()
+}
+
+// filters costruisce la clausola WHERE comune alle due query
+func (q *historyQuery) filters() (string, []any) {
+	var conds []string
+	var args []any
+
+	if q.from != nil {
+		conds = append(conds, "time >= ?")
+		args = append(args, *q.from)
+	}
+	if q.to != nil {
+		conds = append(conds, "time < ?")
+		args = append(args, *q.to)
+	}
+	if q.gatewayID != "" {
+		conds = append(conds, "gateway_id = ?")
+		args = append(args, q.gatewayID)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return "WHERE " + strings.Join(conds, " AND "), args
+}
+
+func rawHistory(db *gorm.DB, q *historyQuery) (*sql.Rows, error) {
+	where, args := q.filters()
+
+	// Con from si parte dall'inizio dell'intervallo, altrimenti si prendono le letture più recenti
+	order := "DESC"
+	if q.from != nil {
+		order = "ASC"
+	}
+
+	query := fmt.Sprintf(
+		`SELECT * FROM (SELECT * FROM %s.%s %s ORDER BY time %s LIMIT %d) AS recent ORDER BY time ASC`,
+		q.tenant, q.metric, where, order, q.limit,
+	)
+	return db.Raw(query, args...).Rows()
+}
+
+func bucketedHistory(db *gorm.DB, q *historyQuery, columns []string) (*sql.Rows, error) {
+	where, args := q.filters()
+
+	selects := []string{"time_bucket(?::interval, time) AS time", "gateway_id", "count(*) AS count"}
+	bucketArgs := []any{fmt.Sprintf("%d seconds", int64(q.bucket.Seconds()))}
+
+	for _, col := range columns {
+		selects = append(selects,
+			fmt.Sprintf("avg(%[1]s)::double precision AS %[1]s", col),
+			fmt.Sprintf("min(%[1]s)::double precision AS %[1]s_min", col),
+			fmt.Sprintf("max(%[1]s)::double precision AS %[1]s_max", col),
+		)
+		for _, p := range q.percentiles {
+			selects = append(selects, fmt.Sprintf(
+				"percentile_cont(%g) WITHIN GROUP (ORDER BY %s) AS %s_p%s",
+				p, col, col, strings.ReplaceAll(strconv.FormatFloat(p*100, 'f', -1, 64), ".", "_"),
+			))
+		}
+	}
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s.%s %s GROUP BY 1, gateway_id ORDER BY 1 ASC, gateway_id LIMIT %d`,
+		strings.Join(selects, ", "), q.tenant, q.metric, where, maxBuckets+1,
+	)
+	return db.Raw(query, append(bucketArgs, args...)...).Rows()
+}
+
+// rollupHistory riaggrega i bucket del rollup: la media è pesata sul numero di letture
+func rollupHistory(db *gorm.DB, q *historyQuery, rollup string, columns []string) (*sql.Rows, error) {
+	where, args := q.filters()
+
+	selects := []string{"time_bucket(?::interval, time) AS time", "gateway_id", "sum(count)::bigint AS count"}
+	bucketArgs := []any{fmt.Sprintf("%d seconds", int64(q.bucket.Seconds()))}
+
+	for _, col := range columns {
+		selects = append(selects,
+			fmt.Sprintf("(sum(%[1]s_sum) / sum(count))::double precision AS %[1]s", col),
+			fmt.Sprintf("min(%[1]s_min)::double precision AS %[1]s_min", col),
+			fmt.Sprintf("max(%[1]s_max)::double precision AS %[1]s_max", col),
+		)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT %s FROM %s.%s %s GROUP BY 1, gateway_id ORDER BY 1 ASC, gateway_id LIMIT %d`,
+		strings.Join(selects, ", "), q.tenant, rollup, where, maxBuckets+1,
+	)
+	return db.Raw(query, append(bucketArgs, args...)...).Rows()
+}
+
+func scanRows(rows *sql.Rows) ([]map[string]interface{}, error) {
 	cols, err := rows.Columns()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get columns"})
-		return
+		return nil, fmt.Errorf("failed to get columns")
 	}
 
 	// Build result as slice of maps (flexible for dynamic columns)
@@ -61,8 +463,7 @@ func HistoryGet(c *gin.Context) {
 			valPtrs[i] = &vals[i]
 		}
 		if err := rows.Scan(valPtrs...); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("scan failed: %v", err)})
-			return
+			return nil, fmt.Errorf("scan failed: %v", err)
 		}
 
 		entry := make(map[string]interface{})
@@ -72,5 +473,5 @@ func HistoryGet(c *gin.Context) {
 		points = append(points, entry)
 	}
 
-	c.JSON(http.StatusOK, gin.H{"data": points, "count": len(points)})
+	return points, rows.Err()
 }
@@ -0,0 +1,242 @@
+package controllers
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+func TestParseBucket(t *testing.T) {
+	tests := []struct {
+		value  string
+		bucket time.Duration
+		err    bool
+	}{
+		{value: "30s", bucket: 30 * time.Second},
+		{value: "1m", bucket: time.Minute},
+		{value: "15m", bucket: 15 * time.Minute},
+		{value: "1h", bucket: time.Hour},
+		{value: "7d", bucket: 7 * 24 * time.Hour},
+		{value: "", err: true},
+		{value: "0m", err: true},
+		{value: "01m", err: true},
+		{value: "-1h", err: true},
+		{value: "1.5h", err: true},
+		{value: "1w", err: true},
+		{value: "1h30m", err: true},
+		{value: "auto", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			bucket, err := parseBucket(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("parseBucket(%q) = %v, atteso un errore", tt.value, bucket)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseBucket(%q) = %v", tt.value, err)
+			}
+			if bucket != tt.bucket {
+				t.Errorf("parseBucket(%q) = %v, atteso %v", tt.value, bucket, tt.bucket)
+			}
+			// formatBucket deve restituire la stessa forma accettata da parseBucket
+			if got := formatBucket(bucket); got != tt.value {
+				t.Errorf("formatBucket(%v) = %q, atteso %q", bucket, got, tt.value)
+			}
+		})
+	}
+}
+
+func TestFormatBucket(t *testing.T) {
+	tests := []struct {
+		bucket time.Duration
+		want   string
+	}{
+		{90 * time.Second, "90s"},
+		{90 * time.Minute, "90m"},
+		{24 * time.Hour, "1d"},
+		{36 * time.Hour, "36h"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBucket(tt.bucket); got != tt.want {
+			t.Errorf("formatBucket(%v) = %q, atteso %q", tt.bucket, got, tt.want)
+		}
+	}
+}
+
+func TestAutoBucket(t *testing.T) {
+	const day = 24 * time.Hour
+	tests := []struct {
+		span   time.Duration
+		bucket time.Duration
+	}{
+		{time.Hour, time.Minute},
+		{day, time.Minute},
+		{day + time.Second, time.Hour},
+		{60 * day, time.Hour},
+		{60*day + time.Second, day},
+		{365 * day, day},
+	}
+
+	for _, tt := range tests {
+		if got := autoBucket(tt.span); got != tt.bucket {
+			t.Errorf("autoBucket(%v) = %v, atteso %v", tt.span, got, tt.bucket)
+		}
+	}
+}
+
+func TestParseHistoryQuerySource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name        string
+		query       string
+		useRollups  bool
+		percentiles []float64
+		err         string
+	}{
+		{name: "default", query: "bucket=1h", useRollups: true, percentiles: defaultPercentiles},
+		{name: "rollup", query: "bucket=1h&source=rollup", useRollups: true, percentiles: defaultPercentiles},
+		{name: "raw", query: "bucket=1h&source=raw", percentiles: defaultPercentiles},
+		{name: "percentili senza source", query: "bucket=1h&percentiles=0.9", percentiles: []float64{0.9}},
+		{name: "percentili con raw", query: "bucket=1h&source=raw&percentiles=0.5,0.99", percentiles: []float64{0.5, 0.99}},
+		{name: "percentili con rollup", query: "bucket=1h&source=rollup&percentiles=0.9", err: "percentiles are not available"},
+		{name: "source sconosciuta", query: "bucket=1h&source=cache", err: "invalid source"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/api/history?metric=heart_rate&"+tt.query, nil)
+
+			q, err := parseHistoryQuery(c, "tenant_1")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseHistoryQuery = %v, atteso un errore con %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHistoryQuery = %v", err)
+			}
+			if q.useRollups != tt.useRollups {
+				t.Errorf("useRollups = %v, atteso %v", q.useRollups, tt.useRollups)
+			}
+			if !slices.Equal(q.percentiles, tt.percentiles) {
+				t.Errorf("percentiles = %v, attesi %v", q.percentiles, tt.percentiles)
+			}
+		})
+	}
+}
+
+func TestFindRollup(t *testing.T) {
+	rollupColumns := []string{"bucket", "gateway_id", "readings", "bpm_sum", "bpm_min", "bpm_max"}
+	tables := map[string][]string{
+		"heart_rate_1m": rollupColumns,
+		"heart_rate_1h": rollupColumns,
+		"heart_rate_1d": rollupColumns,
+		// Rollup creato prima che la metrica avesse la colonna spo2
+		"vitals_1m": {"bucket", "gateway_id", "readings", "bpm_sum", "bpm_min", "bpm_max", "spo2_sum", "spo2_min", "spo2_max"},
+		"vitals_1h": rollupColumns,
+	}
+	db := fakeDB(t, tables)
+
+	tests := []struct {
+		name       string
+		metric     string
+		bucket     time.Duration
+		columns    []string
+		useRollups bool
+		want       string
+	}{
+		{name: "rollup non richiesti", metric: "heart_rate", bucket: time.Hour, columns: []string{"bpm"}, want: ""},
+		{name: "bucket di un giorno", metric: "heart_rate", bucket: 24 * time.Hour, columns: []string{"bpm"}, useRollups: true, want: "heart_rate_1d"},
+		{name: "multiplo di un giorno", metric: "heart_rate", bucket: 7 * 24 * time.Hour, columns: []string{"bpm"}, useRollups: true, want: "heart_rate_1d"},
+		{name: "multiplo di un'ora", metric: "heart_rate", bucket: 6 * time.Hour, columns: []string{"bpm"}, useRollups: true, want: "heart_rate_1h"},
+		{name: "multiplo di un minuto", metric: "heart_rate", bucket: 5 * time.Minute, columns: []string{"bpm"}, useRollups: true, want: "heart_rate_1m"},
+		{name: "bucket in secondi", metric: "heart_rate", bucket: 30 * time.Second, columns: []string{"bpm"}, useRollups: true, want: ""},
+		{name: "rollup senza una colonna", metric: "vitals", bucket: time.Hour, columns: []string{"bpm", "spo2"}, useRollups: true, want: "vitals_1m"},
+		{name: "rollup mancanti", metric: "temperature", bucket: time.Hour, columns: []string{"celsius"}, useRollups: true, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &historyQuery{tenant: "tenant_1", metric: tt.metric, bucket: tt.bucket, useRollups: tt.useRollups}
+			got, err := findRollup(db, q, tt.columns)
+			if err != nil {
+				t.Fatalf("findRollup = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("findRollup = %q, atteso %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeDB restituisce un DB che risponde solo alle query su information_schema.columns di numericColumns,
+// con le colonne (tutte double precision, tranne bucket e gateway_id) delle tabelle indicate
+func fakeDB(t *testing.T, tables map[string][]string) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: sql.OpenDB(fakeConnector{tables})}), &gorm.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+type fakeConnector struct{ tables map[string][]string }
+
+func (c fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn(c), nil }
+func (c fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ tables map[string][]string }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "information_schema.columns") || len(args) != 2 {
+		return nil, driver.ErrSkip
+	}
+	rows := &fakeRows{}
+	for _, name := range c.tables[args[1].Value.(string)] {
+		dataType := "double precision"
+		switch name {
+		case "bucket":
+			dataType = "timestamp with time zone"
+		case "gateway_id":
+			dataType = "character varying"
+		}
+		rows.values = append(rows.values, []driver.Value{name, dataType})
+	}
+	return rows, nil
+}
+
+type fakeRows struct{ values [][]driver.Value }
+
+func (r *fakeRows) Columns() []string { return []string{"column_name", "data_type"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
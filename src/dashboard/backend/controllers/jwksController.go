@@ -0,0 +1,15 @@
+package controllers
+
+import (
+	"gin-test/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /.well-known/jwks.json
+// Chiavi pubbliche per verificare i JWT della dashboard da altri servizi
+func JWKSGet(c *gin.Context) {
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, auth.JWKS())
+}
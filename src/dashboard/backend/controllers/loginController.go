@@ -1,16 +1,14 @@
 package controllers
 
 import (
+	"gin-test/auth"
 	"gin-test/views"
 	"gin-test/models"
 	"gin-test/initializers"
 
 
 	"fmt"
-	"time"
-	"os"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 	"net/http"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -61,29 +59,13 @@ func LoginControllerPost(c *gin.Context) {
 		return
 	}
 
-	// Genera JWT
-	generateToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"id":  userFound.ID,
-		"exp": time.Now().Add(time.Hour * 24).Unix(),
-	})
-
-	token, err := generateToken.SignedString([]byte(os.Getenv("SECRET")))
+	// Crea la sessione e invia i token tramite cookies
+	tokens, err := auth.StartSession(userFound, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		loginControllerShowError(c, fmt.Errorf("credenziali invalide %v", err))
 		return
 	}
-
-	// Invia JWT tramite cookies
-	// NOTA: Questo sistema non è sicuro contro attachi di CSRF, ma non importa per il PoC
-	cookie := http.Cookie{
-		Name: "jwt-token",
-		Value: token,
-		MaxAge: 86400,  
-		Secure: true,
-		SameSite: http.SameSiteStrictMode,
-		HttpOnly: true,
-	}
-	c.SetCookieData(&cookie)
+	auth.SetCookies(c, tokens)
 
 	c.Redirect(http.StatusFound, "/") // Riporta alla home
 }
@@ -1,17 +1,20 @@
 package controllers
 
 import (
+	"gin-test/auth"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 func LogoutController(c *gin.Context) {
-	// Rimuove il token JWT
-	c.SetCookieData(&http.Cookie{
-		Name: "jwt-token",
-		MaxAge: -1,
-	})
+	// Revoca la sessione, così i token non sono più utilizzabili anche se copiati
+	if refreshToken, err := c.Cookie(auth.RefreshTokenCookie); err == nil {
+		auth.RevokeRefreshToken(refreshToken)
+	}
+
+	// Rimuove i token JWT
+	auth.ClearCookies(c)
 
 	c.Redirect(http.StatusFound, "/")
-}
\ No newline at end of file
+}
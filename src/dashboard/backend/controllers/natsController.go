@@ -1,8 +1,18 @@
 package controllers
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gin-test/auth"
+	"gin-test/dto"
+	"gin-test/gatewaystatus"
+	"gin-test/models"
+	"gin-test/natsconn"
 	"log"
 	"net/http"
+	"regexp"
+	"strings"
 	"sync"
 	"time"
 
@@ -11,13 +21,102 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-var NatsConn *nats.Conn
+/* Connessioni NATS dei tenant, ognuna con le credenziali del proprio account */
+var NatsConns *natsconn.Manager
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool { return true },
 }
 
+const (
+	// Massimo intervallo di letture passate che si può chiedere al replay
+	maxReplayMinutes = 60
+	// Massimo numero di combinazioni gateway/metrica in una sottoscrizione
+	maxStreamFilters = 100
+	// Tempo massimo per inviare le letture del replay
+	replayTimeout = 30 * time.Second
+	// Letture live tenute da parte durante il replay, oltre vengono scartate le più vecchie
+	maxPendingLive = 10000
+)
+
+// Gateway e metriche diventano token del subject NATS, quindi niente '.', '*' e '>'
+var validSubjectToken = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+/*
+Gli heartbeat dei gateway (sensors.<tenant>.<gateway>.$heartbeat) finiscono nello stesso stream
+delle letture ma non vengono inviati ai client: lo stato dei gateway arriva come gateway_status
+*/
+func isHeartbeat(subject string) bool {
+	return strings.HasSuffix(subject, ".$heartbeat")
+}
+
+/*
+Stato del WebSocket di un client. Il client sceglie cosa ricevere con un messaggio subscribe,
+che può inviare di nuovo in qualsiasi momento per cambiare gateway e metriche
+*/
+type sensorStream struct {
+	nc     *nats.Conn
+	tenant string
+	// Messaggi verso il client, scritti da una goroutine dedicata
+	out *streamQueue
+
+	// Protegge i campi seguenti
+	mu   sync.Mutex
+	subs []*nats.Subscription
+	// Gateway della sottoscrizione per i messaggi gateway_status, nil = tutti
+	gateways map[string]bool
+	// Incrementato ad ogni subscribe, per ignorare i messaggi delle sottoscrizioni precedenti
+	gen int
+	// Durante il replay le letture live vengono messe da parte e inviate alla fine,
+	// saltando quelle già inviate dal replay (stesso Nats-Msg-Id)
+	replaying bool
+	pending   []*nats.Msg
+	replayed  map[string]bool
+}
+
+// POST /api/stream/ticket
+/*
+Ticket monouso, valido auth.StreamTicketTTL, per aprire /api/ws/sensors e /api/sse/sensors
+con il parametro ticket al posto dell'header Authorization
+*/
+func StreamTicketAPI(c *gin.Context) {
+	ticket, err := auth.IssueStreamTicket(c.GetString("accessToken"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create ticket"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ticket": ticket, "expiresIn": int(auth.StreamTicketTTL.Seconds())})
+}
+
+/*
+WebSocket dei dati in tempo reale del tenant dell'utente.
+Dopo la connessione il client invia
+  {"type": "subscribe", "gateways": [...], "metrics": [...], "replay_minutes": N}
+(gateways e metrics vuoti = tutti) e riceve le letture come
+  {"type": "data", "subject": ..., "gateway_id": ..., "metric": ..., "data": {...}, "timestamp": ms}
+Riceve anche lo stato dei gateway richiesti, subito e ad ogni cambio, come
+  {"type": "gateway_status", "gateway_id": ..., "status": "online" | "offline" | "unknown", "timestamp": ultimo heartbeat}
+Con replay_minutes > 0 riceve prima le letture degli ultimi N minuti dallo stream JetStream
+del tenant (con "replay": true), poi {"type": "replay_done"} e infine quelle live.
+Gli errori arrivano come {"type": "error", "error": ...}
+Il browser non permette header sul WebSocket: ci si autentica con il parametro ticket (POST /api/stream/ticket)
+*/
 func SensorStream(c *gin.Context) {
+	// Il tenant è quello dell'utente autenticato, mai un parametro della richiesta
+	u, _ := c.Get("currentUser")
+	tenant := u.(models.User).Tenant.NatsID
+	if tenant == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user has no tenant"})
+		return
+	}
+
+	nc, err := NatsConns.Get(u.(models.User).Tenant)
+	if err != nil {
+		log.Printf("Errore connessione NATS: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "real-time data not available"})
+		return
+	}
+
 	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Printf("Error upgrading connection: %v", err)
@@ -25,34 +124,299 @@ func SensorStream(c *gin.Context) {
 	}
 	defer conn.Close()
 
-	var mu sync.Mutex
+	wsConnections.Add(1)
+	defer wsConnections.Add(-1)
 
-	tenant := c.Param("tenant")
-	subject := "sensors." + tenant + ".>"
+	s := &sensorStream{nc: nc, tenant: tenant, out: newStreamQueue(conn)}
+	go s.out.run()
+	defer s.out.close()
+	defer s.unsubscribe()
 
-	sub, err := NatsConn.Subscribe(subject, func(msg *nats.Msg) {
-		mu.Lock()
-		defer mu.Unlock()
+	stopStatus := GatewayStatus.Listen(func(status gatewaystatus.Status) {
+		if status.Tenant == tenant {
+			s.onStatus(status)
+		}
+	})
+	defer stopStatus()
+
+	// Se il client non risponde ai ping entro wsPongWait la lettura fallisce e la connessione viene chiusa
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
 
-		err := conn.WriteJSON(gin.H{
-			"subject":   msg.Subject,
-			"data":      string(msg.Data),
-			"timestamp": time.Now().UnixMilli(),
-		})
+	for {
+		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("Error writing JSON: %v", err)
+			log.Printf("Client WS disconnesso: %v (%s)", err, s.out.stats())
+			break
 		}
-		//log.Printf(err)
-	})
+
+		var req dto.StreamSubscribeRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.sendError("invalid message: expected JSON")
+			continue
+		}
+		if req.Type != "subscribe" {
+			s.sendError(fmt.Sprintf("unknown message type %q", req.Type))
+			continue
+		}
+		if err := s.subscribe(req); err != nil {
+			s.sendError(err.Error())
+		}
+	}
+}
+
+/* Subject NATS corrispondenti a gateway e metriche richiesti */
+func streamFilters(tenant string, req dto.StreamSubscribeRequest) ([]string, error) {
+	if req.ReplayMinutes < 0 || req.ReplayMinutes > maxReplayMinutes {
+		return nil, fmt.Errorf("replay_minutes must be between 0 and %d", maxReplayMinutes)
+	}
+
+	gateways := req.Gateways
+	if len(gateways) == 0 {
+		gateways = []string{"*"}
+	}
+	metrics := req.Metrics
+	if len(metrics) == 0 {
+		metrics = []string{"*"}
+	}
+
+	for _, token := range append(append([]string{}, req.Gateways...), req.Metrics...) {
+		if !validSubjectToken.MatchString(token) {
+			return nil, fmt.Errorf("invalid gateway or metric %q", token)
+		}
+	}
+	if len(gateways)*len(metrics) > maxStreamFilters {
+		return nil, fmt.Errorf("too many gateway/metric combinations (max %d)", maxStreamFilters)
+	}
+
+	var filters []string
+	for _, gw := range gateways {
+		for _, metric := range metrics {
+			filters = append(filters, "sensors."+tenant+"."+gw+"."+metric)
+		}
+	}
+	return filters, nil
+}
+
+func (s *sensorStream) subscribe(req dto.StreamSubscribeRequest) error {
+	filters, err := streamFilters(s.tenant, req)
+	if err != nil {
+		return err
+	}
+
+	s.unsubscribe()
+
+	s.mu.Lock()
+	s.gen++
+	gen := s.gen
+	s.replaying = req.ReplayMinutes > 0
+	s.pending = nil
+	s.replayed = map[string]bool{}
+	s.gateways = nil
+	if len(req.Gateways) > 0 {
+		s.gateways = map[string]bool{}
+		for _, gw := range req.Gateways {
+			s.gateways[gw] = true
+		}
+	}
+	// Stato attuale dei gateway, poi solo i cambiamenti (onStatus)
+	for _, status := range GatewayStatus.Tenant(s.tenant) {
+		if s.gateways == nil || s.gateways[status.GatewayID] {
+			s.write(statusMessage(status))
+		}
+	}
+	s.mu.Unlock()
+
+	// Le sottoscrizioni live partono prima del replay, così nessuna lettura va persa nel passaggio
+	for _, filter := range filters {
+		sub, err := s.nc.Subscribe(filter, func(msg *nats.Msg) { s.onLive(gen, msg) })
+		if err != nil {
+			s.unsubscribe()
+			return fmt.Errorf("subscribe failed: %v", err)
+		}
+		s.mu.Lock()
+		s.subs = append(s.subs, sub)
+		s.mu.Unlock()
+	}
+
+	if req.ReplayMinutes == 0 {
+		return nil
+	}
+
+	// Anche se il replay fallisce le letture live continuano ad arrivare
+	err = s.replay(gen, filters, time.Duration(req.ReplayMinutes)*time.Minute)
+	s.finishReplay(gen)
 	if err != nil {
+		log.Printf("Replay del tenant %s fallito: %v", s.tenant, err)
+		return fmt.Errorf("replay failed: %v", err)
+	}
+	return nil
+}
+
+func (s *sensorStream) unsubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		sub.Unsubscribe()
+	}
+	s.subs = nil
+}
+
+func (s *sensorStream) onLive(gen int, msg *nats.Msg) {
+	if isHeartbeat(msg.Subject) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+	if s.replaying {
+		if len(s.pending) >= maxPendingLive {
+			s.pending = s.pending[1:]
+		}
+		s.pending = append(s.pending, msg)
 		return
 	}
+	s.write(streamMessage(msg, time.Now(), false))
+}
+
+/*
+Invia le letture degli ultimi minuti con un consumer ordinato ed effimero sullo stream del tenant.
+Termina quando il consumer non ha più messaggi in attesa
+*/
+func (s *sensorStream) replay(gen int, filters []string, window time.Duration) error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	stream, err := js.StreamNameBySubject("sensors." + s.tenant + ".>")
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	var once sync.Once
+	finish := func() { once.Do(func() { close(done) }) }
+
+	sub, err := js.Subscribe("", func(msg *nats.Msg) {
+		meta, err := msg.Metadata()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		current := gen == s.gen && s.replaying
+		if current {
+			if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+				s.replayed[id] = true
+			}
+		}
+		s.mu.Unlock()
+
+		// Il replay aspetta il client invece di scartare letture, le live intanto restano da parte
+		if current && !isHeartbeat(msg.Subject) {
+			s.out.pushWait(streamMessage(msg, meta.Timestamp, true))
+		}
+
+		if meta.NumPending == 0 {
+			finish()
+		}
+	},
+		nats.BindStream(stream),
+		nats.ConsumerFilterSubjects(filters...),
+		nats.OrderedConsumer(),
+		nats.StartTime(time.Now().Add(-window)),
+	)
+	if err != nil {
+		return err
+	}
 	defer sub.Unsubscribe()
 
-	for {
-		if _, _, err := conn.ReadMessage(); err != nil {
-			log.Printf("Client WS disconnesso: %v", err)
-			break
+	// Se non ci sono letture nell'intervallo il callback non viene mai chiamato
+	info, err := sub.ConsumerInfo()
+	if err == nil && info.NumPending == 0 && info.Delivered.Consumer == 0 {
+		finish()
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(replayTimeout):
+		return errors.New("timeout")
+	}
+}
+
+/* Chiude il replay e invia le letture live arrivate nel frattempo */
+func (s *sensorStream) finishReplay(gen int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if gen != s.gen {
+		return
+	}
+
+	s.write(dto.StreamMessage{Type: "replay_done"})
+	for _, msg := range s.pending {
+		if id := msg.Header.Get(nats.MsgIdHdr); id != "" && s.replayed[id] {
+			continue
 		}
+		s.write(streamMessage(msg, time.Now(), false))
 	}
+
+	s.replaying = false
+	s.pending = nil
+	s.replayed = nil
+}
+
+/* Invia il cambio di stato del gateway, se il client lo ha sottoscritto */
+func (s *sensorStream) onStatus(status gatewaystatus.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Prima del primo subscribe il client non ha ancora scelto i gateway
+	if s.gen == 0 || (s.gateways != nil && !s.gateways[status.GatewayID]) {
+		return
+	}
+	s.write(statusMessage(status))
+}
+
+/* Converte la lettura nel messaggio per il client: il payload JSON viene inviato così com'è */
+func streamMessage(msg *nats.Msg, timestamp time.Time, replay bool) dto.StreamMessage {
+	out := dto.StreamMessage{
+		Type:      "data",
+		Subject:   msg.Subject,
+		Timestamp: timestamp.UnixMilli(),
+		Replay:    replay,
+	}
+
+	// sensors.<tenant>.<gateway>.<metrica>
+	if parts := strings.Split(msg.Subject, "."); len(parts) == 4 {
+		out.GatewayID = parts[2]
+		out.Metric = parts[3]
+	}
+
+	if json.Valid(msg.Data) {
+		out.Data = json.RawMessage(msg.Data)
+	} else {
+		out.Data, _ = json.Marshal(string(msg.Data))
+	}
+
+	return out
+}
+
+/* Accoda il messaggio, non blocca mai: va bene anche con s.mu bloccato */
+func (s *sensorStream) write(msg dto.StreamMessage) {
+	s.out.push(msg)
+}
+
+func (s *sensorStream) sendError(message string) {
+	s.write(dto.StreamMessage{Type: "error", Error: message})
 }
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"errors"
+	"gin-test/auth"
+	"gin-test/dto"
+	"gin-test/middlewares"
+	"gin-test/models"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/nats/credentials
+// Nuovo JWT NATS dell'utente, sia nel cookie real_time_data_jwt sia nel body.
+// Il client lo chiama prima di (ri)connettersi al WebSocket di NATS, perché il JWT dura poco
+func NatsCredentialsGet(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+
+	creds, err := auth.SetNatsCookie(c, user)
+	var noTenant *auth.NoTenantError
+	if errors.As(err, &noTenant) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		log.Printf("Errore generazione JWT NATS per l'utente %d: %v", user.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not generate NATS credentials"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dto.NatsCredentialsResponse{
+		JWT:       creds.JWT,
+		Subject:   creds.Subject,
+		ExpiresAt: creds.ExpiresAt,
+	})
+}
+
+// Al login il JWT NATS viene solo impostato nel cookie: se non si riesce a generarlo
+// il login va comunque a buon fine, l'utente userà il WebSocket della dashboard.
+// Il JWT dà accesso diretto ai dati dei sensori, quindi solo i ruoli con data:read lo ricevono:
+// agli altri (es. un utente appena declassato) viene cancellato quello rimasto nel browser
+func setNatsCookie(c *gin.Context, user models.User) {
+	if !middlewares.HasPermission(user.Role, middlewares.PermReadData) {
+		auth.ClearNatsCookie(c)
+		return
+	}
+
+	_, err := auth.SetNatsCookie(c, user)
+	var noTenant *auth.NoTenantError
+	if err != nil && !errors.As(err, &noTenant) {
+		log.Printf("JWT NATS non generato per l'utente %d: %v", user.ID, err)
+	}
+}
@@ -0,0 +1,331 @@
+package controllers
+
+import (
+	"fmt"
+	"gin-test/dto"
+	"gin-test/models"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Canali e regole di instradamento delle notifiche del tenant dell'utente autenticato.
+Vengono pubblicati nel bucket KV notifications, letto dal servizio src/notifier
+*/
+
+const defaultNotificationTimezone = "Europe/Rome"
+
+func notificationsError(c *gin.Context, err error) {
+	log.Printf("Errore aggiornamento configurazione delle notifiche: %v", err)
+	c.JSON(http.StatusBadGateway, gin.H{"error": "Could not update the notification settings"})
+}
+
+func pathID(c *gin.Context) (uint, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid id"})
+		return 0, false
+	}
+	return uint(id), true
+}
+
+func applyChannelRequest(channel *models.NotificationChannel, req dto.NotificationChannelRequest) error {
+	channel.Name = req.Name
+	channel.Type = models.NotificationChannelType(req.Type)
+	channel.URL = req.URL
+	if req.Secret != "" {
+		channel.Secret = req.Secret
+	}
+	channel.Recipients = req.Recipients
+	channel.Subject = req.Subject
+	channel.Enabled = req.Enabled == nil || *req.Enabled
+
+	return channel.Validate()
+}
+
+func applyRouteRequest(route *models.NotificationRoute, tenant models.Tenant, req dto.NotificationRouteRequest) error {
+	var channel models.NotificationChannel
+	models.GetTenantNotificationChannel(&channel, tenant.ID, req.ChannelID)
+	if channel.ID == 0 {
+		return fmt.Errorf("channel %d not found", req.ChannelID)
+	}
+	if req.Metric != "" && !validSubjectToken.MatchString(req.Metric) {
+		return fmt.Errorf("invalid metric %q", req.Metric)
+	}
+	if req.Gateway != "" && !validSubjectToken.MatchString(req.Gateway) {
+		return fmt.Errorf("invalid gateway %q", req.Gateway)
+	}
+
+	route.ChannelID = channel.ID
+	route.MinSeverity = models.AlertSeverity(req.MinSeverity)
+	if route.MinSeverity == "" {
+		route.MinSeverity = models.SeverityWarning
+	}
+	route.Metric = req.Metric
+	route.Gateway = req.Gateway
+	route.DelaySeconds = req.DelaySeconds
+	route.QuietStart = req.QuietStart
+	route.QuietEnd = req.QuietEnd
+	route.QuietBypassSeverity = req.QuietBypassSeverity
+	if route.QuietBypassSeverity == "" {
+		route.QuietBypassSeverity = string(models.SeverityCritical)
+	}
+	route.Timezone = req.Timezone
+	if route.Timezone == "" {
+		route.Timezone = defaultNotificationTimezone
+	}
+	route.SendResolved = req.SendResolved
+	route.Enabled = req.Enabled == nil || *req.Enabled
+
+	return route.Validate()
+}
+
+// GET /api/notifications/channels
+func GetNotificationChannelsAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	channels := []models.NotificationChannel{}
+	models.GetTenantNotificationChannels(&channels, tenant.ID)
+
+	c.JSON(http.StatusOK, channels)
+}
+
+// POST /api/notifications/channels
+func CreateNotificationChannelAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	var req dto.NotificationChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	channel := models.NotificationChannel{TenantID: tenant.ID}
+	if err := applyChannelRequest(&channel, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := channel.Create(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create channel"})
+		return
+	}
+
+	if err := Provisioner.PublishNotificationChannel(tenant.NatsID, &channel); err != nil {
+		channel.Delete()
+		notificationsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, channel)
+}
+
+// PUT /api/notifications/channels/:id
+func UpdateNotificationChannelAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c)
+	if !ok {
+		return
+	}
+
+	var channel models.NotificationChannel
+	models.GetTenantNotificationChannel(&channel, tenant.ID, id)
+	if channel.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	var req dto.NotificationChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	previous := channel
+	if err := applyChannelRequest(&channel, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := channel.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update channel"})
+		return
+	}
+
+	if err := Provisioner.PublishNotificationChannel(tenant.NatsID, &channel); err != nil {
+		previous.Save()
+		notificationsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, channel)
+}
+
+// DELETE /api/notifications/channels/:id
+func DeleteNotificationChannelAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c)
+	if !ok {
+		return
+	}
+
+	var channel models.NotificationChannel
+	models.GetTenantNotificationChannel(&channel, tenant.ID, id)
+	if channel.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Channel not found"})
+		return
+	}
+
+	if routes := models.CountChannelRoutes(channel.ID); routes > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Channel is used by %d routes", routes)})
+		return
+	}
+
+	if err := Provisioner.DeleteNotificationChannel(tenant.NatsID, channel.ID); err != nil {
+		notificationsError(c, err)
+		return
+	}
+	if err := channel.Delete(); err != nil {
+		Provisioner.PublishNotificationChannel(tenant.NatsID, &channel)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete channel"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Channel deleted"})
+}
+
+// GET /api/notifications/routes
+func GetNotificationRoutesAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	routes := []models.NotificationRoute{}
+	models.GetTenantNotificationRoutes(&routes, tenant.ID)
+
+	c.JSON(http.StatusOK, routes)
+}
+
+// POST /api/notifications/routes
+func CreateNotificationRouteAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+
+	var req dto.NotificationRouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	route := models.NotificationRoute{TenantID: tenant.ID}
+	if err := applyRouteRequest(&route, tenant, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := route.Create(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not create route"})
+		return
+	}
+
+	if err := Provisioner.PublishNotificationRoute(tenant.NatsID, &route); err != nil {
+		route.Delete()
+		notificationsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, route)
+}
+
+// PUT /api/notifications/routes/:id
+func UpdateNotificationRouteAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c)
+	if !ok {
+		return
+	}
+
+	var route models.NotificationRoute
+	models.GetTenantNotificationRoute(&route, tenant.ID, id)
+	if route.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	var req dto.NotificationRouteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	previous := route
+	if err := applyRouteRequest(&route, tenant, req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := route.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update route"})
+		return
+	}
+
+	if err := Provisioner.PublishNotificationRoute(tenant.NatsID, &route); err != nil {
+		previous.Save()
+		notificationsError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, route)
+}
+
+// DELETE /api/notifications/routes/:id
+func DeleteNotificationRouteAPI(c *gin.Context) {
+	tenant, ok := currentTenant(c)
+	if !ok {
+		return
+	}
+	id, ok := pathID(c)
+	if !ok {
+		return
+	}
+
+	var route models.NotificationRoute
+	models.GetTenantNotificationRoute(&route, tenant.ID, id)
+	if route.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Route not found"})
+		return
+	}
+
+	if err := Provisioner.DeleteNotificationRoute(tenant.NatsID, route.ID); err != nil {
+		notificationsError(c, err)
+		return
+	}
+	if err := route.Delete(); err != nil {
+		Provisioner.PublishNotificationRoute(tenant.NatsID, &route)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete route"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Route deleted"})
+}
@@ -0,0 +1,222 @@
+package controllers
+
+import (
+	"gin-test/dto"
+	"gin-test/models"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Conservazione dei dati dei tenant (solo platform_admin): rollup, compressione e retention
+delle tabelle TimescaleDB, per tenant e per metrica, e conservazione dei messaggi nello stream
+sensors_<tenant>. Vedi provisioning/retention.go e provisioning/stream.go
+*/
+
+type retentionMetric struct {
+	models.RetentionPolicy
+	// true se la metrica ha una politica propria, false se usa il default del tenant
+	Custom bool `json:"custom"`
+}
+
+/* Tenant indicato da :tenant (natsId). Se non esiste risponde 404 */
+func findRetentionTenant(c *gin.Context) (models.Tenant, bool) {
+	var tenant models.Tenant
+	models.GetTenantByNatsID(&tenant, c.Param("tenant"))
+	if tenant.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return tenant, false
+	}
+	return tenant, true
+}
+
+/* Metrica indicata da :metric, solo se è una tabella del tenant. Se non esiste risponde 404 */
+func findRetentionMetric(c *gin.Context, tenant models.Tenant) (string, bool) {
+	metric := c.Param("metric")
+
+	metrics, err := Provisioner.MetricTables(tenant.NatsID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return "", false
+	}
+	for _, m := range metrics {
+		if m == metric {
+			return metric, true
+		}
+	}
+
+	c.JSON(http.StatusNotFound, gin.H{"error": "Metric not found"})
+	return "", false
+}
+
+// GET /api/admin/retention/:tenant
+func GetRetentionAPI(c *gin.Context) {
+	tenant, ok := findRetentionTenant(c)
+	if !ok {
+		return
+	}
+
+	metrics, err := Provisioner.MetricTables(tenant.NatsID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantDefault := models.EffectiveRetentionPolicy(tenant.ID, "")
+	tenantDefault.Metric = ""
+
+	response := []retentionMetric{}
+	for _, metric := range metrics {
+		policy := models.EffectiveRetentionPolicy(tenant.ID, metric)
+		custom := policy.Metric == metric
+		policy.Metric = metric
+		response = append(response, retentionMetric{RetentionPolicy: policy, Custom: custom})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tenant": tenant.NatsID, "default": tenantDefault, "metrics": response})
+}
+
+// PUT /api/admin/retention/:tenant (default del tenant)
+// PUT /api/admin/retention/:tenant/:metric
+func SetRetentionAPI(c *gin.Context) {
+	tenant, ok := findRetentionTenant(c)
+	if !ok {
+		return
+	}
+	metric := ""
+	if c.Param("metric") != "" {
+		if metric, ok = findRetentionMetric(c, tenant); !ok {
+			return
+		}
+	}
+
+	var req dto.RetentionPolicyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body: rawDays, rollup1mDays, rollup1hDays, rollup1dDays and compressAfterDays are required"})
+		return
+	}
+
+	policy := models.RetentionPolicy{
+		TenantID:          tenant.ID,
+		Metric:            metric,
+		RawDays:           *req.RawDays,
+		Rollup1mDays:      *req.Rollup1mDays,
+		Rollup1hDays:      *req.Rollup1hDays,
+		Rollup1dDays:      *req.Rollup1dDays,
+		CompressAfterDays: *req.CompressAfterDays,
+		StreamDays:        models.DefaultRetentionPolicy.StreamDays,
+	}
+	if req.StreamDays != nil {
+		// Lo stream è uno per tenant
+		if metric != "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "streamDays can only be set in the tenant default"})
+			return
+		}
+		policy.StreamDays = *req.StreamDays
+	}
+	if err := policy.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var previous models.RetentionPolicy
+	models.GetRetentionPolicy(&previous, tenant.ID, metric)
+
+	if err := policy.Save(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not save retention policy"})
+		return
+	}
+
+	if err := applyRetention(&tenant, metric); err != nil {
+		if previous.ID != 0 {
+			previous.Save()
+		} else {
+			policy.Delete()
+		}
+		retentionError(c, &tenant, metric, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// DELETE /api/admin/retention/:tenant (torna a models.DefaultRetentionPolicy)
+// DELETE /api/admin/retention/:tenant/:metric (torna al default del tenant)
+func DeleteRetentionAPI(c *gin.Context) {
+	tenant, ok := findRetentionTenant(c)
+	if !ok {
+		return
+	}
+	metric := ""
+	if c.Param("metric") != "" {
+		if metric, ok = findRetentionMetric(c, tenant); !ok {
+			return
+		}
+	}
+
+	var policy models.RetentionPolicy
+	models.GetRetentionPolicy(&policy, tenant.ID, metric)
+	if policy.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	if err := policy.Delete(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not delete retention policy"})
+		return
+	}
+
+	if err := applyRetention(&tenant, metric); err != nil {
+		policy.ID = 0
+		policy.Save()
+		retentionError(c, &tenant, metric, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy deleted"})
+}
+
+/* Applica la politica alle tabelle e, se è il default del tenant, allo stream del tenant */
+func applyRetention(tenant *models.Tenant, metric string) error {
+	if err := Provisioner.ApplyRetention(tenant, metric); err != nil {
+		return err
+	}
+	if metric != "" {
+		return nil
+	}
+	return applyStreamRetention(tenant)
+}
+
+func applyStreamRetention(tenant *models.Tenant) error {
+	nc, err := NatsConns.Get(*tenant)
+	if err != nil {
+		return err
+	}
+	return Provisioner.ApplyStreamRetention(nc, tenant)
+}
+
+/* Applica la conservazione dei messaggi agli stream di tutti i tenant, ad esempio all'avvio */
+func SyncStreamRetention() {
+	var tenants []models.Tenant
+	models.GetAllTenants(&tenants)
+
+	for _, t := range tenants {
+		// GetAllTenants non carica il seed dell'account, che serve per connettersi
+		var tenant models.Tenant
+		models.GetTenantByNatsID(&tenant, t.NatsID)
+		if err := applyStreamRetention(&tenant); err != nil {
+			log.Printf("Errore conservazione dei messaggi dello stream del tenant %s: %v", tenant.NatsID, err)
+		}
+	}
+}
+
+/* La politica precedente è già stata ripristinata nel DB: la si riapplica, altrimenti resterebbe a metà */
+func retentionError(c *gin.Context, tenant *models.Tenant, metric string, err error) {
+	log.Printf("Errore applicazione conservazione dei dati del tenant %s: %v", tenant.NatsID, err)
+	if err := applyRetention(tenant, metric); err != nil {
+		log.Printf("Errore ripristino conservazione dei dati del tenant %s: %v", tenant.NatsID, err)
+	}
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not apply retention policy"})
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"errors"
+	"gin-test/auth"
+	"gin-test/dto"
+	"gin-test/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// POST /api/refresh
+// Scambia il refresh token con una nuova coppia di token. Il refresh token usato non è più valido
+func RefreshAPI(c *gin.Context) {
+	var req dto.RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	tokens, err := auth.RefreshSession(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	var invalid *auth.InvalidRefreshTokenError
+	var reused *auth.RefreshTokenReusedError
+	if errors.As(err, &invalid) || errors.As(err, &reused) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not refresh token"})
+		return
+	}
+
+	var user models.User
+	models.GetUserById(&user, int(tokens.Session.UserID))
+
+	response := dto.AuthResponse{
+		Token:        tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		ExpiresIn:    int(auth.AccessTokenTTL.Seconds()),
+		User: dto.UserResponse{
+			ID:        user.ID,
+			Username:  user.Username,
+			Role:      string(user.Role),
+			CreatedAt: user.CreatedAt,
+		},
+	}
+
+	if user.Tenant.ID != 0 {
+		response.User.Tenant = &dto.TenantResponse{
+			ID:     user.Tenant.ID,
+			Name:   user.Tenant.Name,
+			NatsID: user.Tenant.NatsID,
+		}
+	}
+
+	setNatsCookie(c, user)
+
+	c.JSON(http.StatusOK, response)
+}
+
+// POST /api/logout
+// Revoca la sessione corrente
+func LogoutAPI(c *gin.Context) {
+	s, _ := c.Get("currentSession")
+	session := s.(models.Session)
+
+	if err := session.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// GET /api/sessions
+// Sessioni attive dell'utente autenticato
+func GetSessionsAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+	s, _ := c.Get("currentSession")
+	current := s.(models.Session)
+
+	var sessions []models.Session
+	models.GetActiveSessions(&sessions, user.ID)
+
+	response := []dto.SessionResponse{}
+	for _, session := range sessions {
+		response = append(response, dto.SessionResponse{
+			ID:         session.ID,
+			UserAgent:  session.UserAgent,
+			IP:         session.IP,
+			CreatedAt:  session.CreatedAt,
+			LastUsedAt: session.LastUsedAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == current.ID,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// DELETE /api/sessions/:id
+// Revoca una sessione dell'utente autenticato (es. rimasta aperta su un'altra postazione)
+func DeleteSessionAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session id"})
+		return
+	}
+
+	var session models.Session
+	models.GetSessionById(&session, uint(id))
+	if !session.Active() || session.UserID != user.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	}
+
+	if err := session.Revoke(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/sessions
+// Revoca tutte le sessioni dell'utente autenticato tranne quella corrente
+func DeleteOtherSessionsAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+	s, _ := c.Get("currentSession")
+	current := s.(models.Session)
+
+	if err := models.RevokeUserSessions(user.ID, current.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// DELETE /api/users/:id/sessions
+// Disconnette un utente da tutte le postazioni. Un amministratore di tenant può farlo solo per il proprio tenant
+func DeleteUserSessionsAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	currentUser := u.(models.User)
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	var user models.User
+	models.GetUserById(&user, id)
+	if user.ID == 0 || (currentUser.Role != models.RolePlatformAdmin && user.TenantID != currentUser.TenantID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := models.RevokeUserSessions(user.ID, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not revoke sessions"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
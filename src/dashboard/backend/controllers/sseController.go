@@ -0,0 +1,176 @@
+package controllers
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"gin-test/dto"
+	"gin-test/models"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Intervallo dei commenti inviati per tenere aperta la connessione attraverso i proxy
+	sseKeepAlive = 15 * time.Second
+	// Attesa suggerita al client prima di riconnettersi, in millisecondi
+	sseRetry = 3000
+	// Letture ricevute da JetStream in attesa di essere scritte sulla risposta
+	sseBufferSize = 256
+)
+
+var (
+	sseConnections  = expvar.NewInt("sse_connections")
+	sseMessagesSent = expvar.NewInt("sse_messages_sent")
+)
+
+// GET /api/sse/sensors
+/*
+Stesse letture del WebSocket come Server-Sent Events, per i client che non possono usare WebSocket.
+Parametri: gateways e metrics (separati da virgola, vuoti = tutti), replay_minutes.
+Ogni evento ha come id il numero di sequenza della lettura nello stream JetStream del tenant:
+riconnettendosi con l'header Last-Event-ID (o il parametro last_event_id) si riparte dalla lettura
+successiva, senza perderne. Come per il WebSocket ci si può autenticare con il parametro ticket:
+il ticket vale una volta, quindi per riconnettersi il client ne chiede uno nuovo e passa last_event_id
+*/
+func SensorEvents(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	user := u.(models.User)
+
+	tenant := user.Tenant.NatsID
+	if tenant == "" {
+		c.JSON(http.StatusForbidden, gin.H{"error": "user has no tenant"})
+		return
+	}
+
+	replayMinutes, _ := strconv.Atoi(c.DefaultQuery("replay_minutes", "0"))
+	req := dto.StreamSubscribeRequest{
+		Type:          "subscribe",
+		Gateways:      splitList(c.Query("gateways")),
+		Metrics:       splitList(c.Query("metrics")),
+		ReplayMinutes: replayMinutes,
+	}
+	filters, err := streamFilters(tenant, req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	start := time.Now()
+	startOpt := nats.DeliverNew()
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		seq, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid Last-Event-ID"})
+			return
+		}
+		startOpt = nats.StartSequence(seq + 1)
+	} else if req.ReplayMinutes > 0 {
+		startOpt = nats.StartTime(start.Add(-time.Duration(req.ReplayMinutes) * time.Minute))
+	}
+
+	nc, err := NatsConns.Get(user.Tenant)
+	if err != nil {
+		log.Printf("Errore connessione NATS: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "real-time data not available"})
+		return
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "real-time data not available"})
+		return
+	}
+	stream, err := js.StreamNameBySubject("sensors." + tenant + ".>")
+	if err != nil {
+		log.Printf("Stream del tenant %s non trovato: %v", tenant, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "real-time data not available"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	msgs := make(chan *nats.Msg, sseBufferSize)
+
+	// Consumer ordinato dedicato alla connessione: se il client è lento il callback aspetta
+	// e JetStream rallenta l'invio (flow control), senza scartare letture
+	sub, err := js.Subscribe("", func(msg *nats.Msg) {
+		select {
+		case msgs <- msg:
+		case <-ctx.Done():
+		}
+	},
+		nats.BindStream(stream),
+		nats.ConsumerFilterSubjects(filters...),
+		nats.OrderedConsumer(),
+		startOpt,
+	)
+	if err != nil {
+		log.Printf("Consumer SSE del tenant %s non creato: %v", tenant, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "real-time data not available"})
+		return
+	}
+	defer sub.Unsubscribe()
+
+	sseConnections.Add(1)
+	defer sseConnections.Add(-1)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Disattiva il buffering di nginx, altrimenti gli eventi arrivano a blocchi
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	w := c.Writer
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+	w.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-keepAlive.C:
+			_, err = fmt.Fprint(w, ": keepalive\n\n")
+
+		case msg := <-msgs:
+			meta, metaErr := msg.Metadata()
+			if metaErr != nil || isHeartbeat(msg.Subject) {
+				continue
+			}
+			data, _ := json.Marshal(streamMessage(msg, meta.Timestamp, meta.Timestamp.Before(start)))
+			_, err = fmt.Fprintf(w, "id: %d\nevent: data\ndata: %s\n\n", meta.Sequence.Stream, data)
+			sseMessagesSent.Add(1)
+		}
+
+		if err != nil {
+			log.Printf("Client SSE disconnesso: %v", err)
+			return
+		}
+		w.Flush()
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,267 @@
+package controllers
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gin-test/dto"
+
+	"github.com/gorilla/websocket"
+)
+
+/* Cosa fare quando la coda di un client lento è piena */
+type QueuePolicy string
+
+const (
+	// Scarta il messaggio più vecchio in coda
+	DropOldest QueuePolicy = "drop_oldest"
+	// Scarta il messaggio nuovo
+	DropNewest QueuePolicy = "drop_newest"
+	// Sostituisce la lettura in coda dello stesso gateway e metrica con quella nuova,
+	// se non c'è scarta la più vecchia: il client riceve meno letture ma sempre le ultime
+	Coalesce QueuePolicy = "coalesce"
+)
+
+const (
+	// Tempo massimo per scrivere un messaggio, oltre il client viene disconnesso
+	wsWriteWait = 10 * time.Second
+	// Tempo massimo senza pong dal client
+	wsPongWait = 60 * time.Second
+	// Intervallo dei ping, minore di wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+	// Dimensione massima dei messaggi del client (solo subscribe)
+	wsMaxMessageSize = 4096
+)
+
+/*
+Configurazione delle code dei WebSocket, da WS_QUEUE_SIZE (default 256 messaggi)
+e WS_QUEUE_POLICY (drop_oldest, drop_newest, coalesce; default coalesce)
+*/
+var (
+	wsQueueSize   = queueSizeFromEnv()
+	wsQueuePolicy = queuePolicyFromEnv()
+)
+
+/* Metriche esposte in /api/debug/vars */
+var (
+	wsConnections       = expvar.NewInt("ws_connections")
+	wsMessagesSent      = expvar.NewInt("ws_messages_sent")
+	wsMessagesDropped   = expvar.NewInt("ws_messages_dropped")
+	wsMessagesCoalesced = expvar.NewInt("ws_messages_coalesced")
+	wsWriteFailures     = expvar.NewInt("ws_write_failures")
+)
+
+func queueSizeFromEnv() int {
+	value := os.Getenv("WS_QUEUE_SIZE")
+	if value == "" {
+		return 256
+	}
+	size, err := strconv.Atoi(value)
+	if err != nil || size <= 0 {
+		log.Printf("WS_QUEUE_SIZE non valido (%q), uso 256", value)
+		return 256
+	}
+	return size
+}
+
+func queuePolicyFromEnv() QueuePolicy {
+	switch policy := QueuePolicy(os.Getenv("WS_QUEUE_POLICY")); policy {
+	case DropOldest, DropNewest, Coalesce:
+		return policy
+	case "":
+		return Coalesce
+	default:
+		log.Printf("WS_QUEUE_POLICY non valido (%q), uso %s", policy, Coalesce)
+		return Coalesce
+	}
+}
+
+/*
+Coda dei messaggi verso un client WebSocket, svuotata da una goroutine dedicata (run).
+Chi produce i messaggi (callback NATS) non aspetta mai il client: se la coda è piena
+viene applicata la policy. I messaggi di controllo (errori, replay_done) non vengono mai scartati.
+*/
+type streamQueue struct {
+	conn   *websocket.Conn
+	size   int
+	policy QueuePolicy
+
+	mu       sync.Mutex
+	messages []dto.StreamMessage
+	closed   bool
+	// Contatori della connessione, per il log alla disconnessione
+	dropped   int
+	coalesced int
+
+	// Segnala alla goroutine di scrittura che ci sono messaggi
+	wake chan struct{}
+	// Segnala a pushWait che si è liberato spazio
+	space chan struct{}
+	done  chan struct{}
+}
+
+func newStreamQueue(conn *websocket.Conn) *streamQueue {
+	return &streamQueue{
+		conn:   conn,
+		size:   wsQueueSize,
+		policy: wsQueuePolicy,
+		wake:   make(chan struct{}, 1),
+		space:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+/* Accoda il messaggio senza bloccare, applicando la policy se la coda è piena */
+func (q *streamQueue) push(msg dto.StreamMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return
+	}
+	defer notify(q.wake)
+
+	if len(q.messages) < q.size || msg.Type != "data" {
+		q.messages = append(q.messages, msg)
+		return
+	}
+
+	switch q.policy {
+	case DropNewest:
+		q.drop()
+		return
+	case Coalesce:
+		for i := len(q.messages) - 1; i >= 0; i-- {
+			if q.messages[i].Type == "data" && q.messages[i].Subject == msg.Subject {
+				q.messages[i] = msg
+				q.coalesced++
+				wsMessagesCoalesced.Add(1)
+				return
+			}
+		}
+	}
+
+	// DropOldest, o Coalesce senza letture dello stesso subject in coda
+	for i, queued := range q.messages {
+		if queued.Type == "data" {
+			q.messages = append(q.messages[:i], q.messages[i+1:]...)
+			q.drop()
+			break
+		}
+	}
+	q.messages = append(q.messages, msg)
+}
+
+func (q *streamQueue) drop() {
+	q.dropped++
+	wsMessagesDropped.Add(1)
+}
+
+/*
+Accoda il messaggio aspettando al massimo wsWriteWait che si liberi spazio.
+Usata dal replay, dove scartare letture lascerebbe buchi nello storico
+*/
+func (q *streamQueue) pushWait(msg dto.StreamMessage) {
+	deadline := time.NewTimer(wsWriteWait)
+	defer deadline.Stop()
+
+	for {
+		q.mu.Lock()
+		if q.closed || len(q.messages) < q.size {
+			q.mu.Unlock()
+			q.push(msg)
+			return
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.space:
+		case <-q.done:
+			return
+		case <-deadline.C:
+			q.push(msg)
+			return
+		}
+	}
+}
+
+func (q *streamQueue) pop() []dto.StreamMessage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	messages := q.messages
+	q.messages = nil
+	notify(q.space)
+	return messages
+}
+
+/* Ferma la goroutine di scrittura, i messaggi ancora in coda vengono scartati */
+func (q *streamQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.done)
+	}
+}
+
+func (q *streamQueue) stats() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return fmt.Sprintf("%d scartati, %d sostituiti", q.dropped, q.coalesced)
+}
+
+/*
+Goroutine di scrittura: unica a scrivere sul WebSocket, invia i messaggi in coda e i ping.
+Se una scrittura non termina entro wsWriteWait il client è troppo lento (o sparito):
+la connessione viene chiusa, così anche la lettura in SensorStream termina
+*/
+func (q *streamQueue) run() {
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-q.done:
+			q.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+
+		case <-ping.C:
+			if err := q.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				q.fail(err)
+				return
+			}
+
+		case <-q.wake:
+			for _, msg := range q.pop() {
+				q.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				if err := q.conn.WriteJSON(msg); err != nil {
+					q.fail(err)
+					return
+				}
+				wsMessagesSent.Add(1)
+			}
+		}
+	}
+}
+
+func (q *streamQueue) fail(err error) {
+	log.Printf("Scrittura WS fallita, client disconnesso: %v", err)
+	wsWriteFailures.Add(1)
+	q.close()
+	q.conn.Close()
+}
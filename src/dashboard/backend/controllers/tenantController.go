@@ -2,6 +2,7 @@ package controllers
 
 import (
 	"gin-test/models"
+	"gin-test/provisioning"
 	"gin-test/views"
 
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"strings"
 )
 
+/* Servizio che crea le risorse NATS e DB dei nuovi tenant, inizializzato nel main */
+var Provisioner *provisioning.Service
+
 func TenantIndexController(c *gin.Context) {
 	u, _ := c.Get("currentUser")
 	user := u.(models.User)
@@ -65,7 +69,7 @@ func TenantCreatePost(c *gin.Context) {
 		NatsID: tenantInput.NatsID,
 	}
 	
-	if err := tenant.Create(); err != nil {
+	if err := Provisioner.Provision(&tenant); err != nil {
 		views.ShowView(c, gin.H{
 			"result": fmt.Sprintf(
 				"Impossibile creare tenant %v (ID %v): %v", 
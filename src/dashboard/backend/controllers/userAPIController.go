@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"gin-test/dto"
+	"gin-test/initializers"
+	"gin-test/models"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GET /api/users
+// Utenti del tenant dell'utente autenticato
+func GetUsersAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	currentUser := u.(models.User)
+
+	var users []models.User
+	initializers.DB.Where("tenant_id = ?", currentUser.TenantID).Order("id").Find(&users)
+
+	response := []dto.UserResponse{}
+	for _, user := range users {
+		response = append(response, dto.UserResponse{
+			ID:        user.ID,
+			Username:  user.Username,
+			Role:      string(user.Role),
+			CreatedAt: user.CreatedAt,
+		})
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// PUT /api/users/:id/role
+// Un amministratore di tenant può cambiare solo i ruoli degli utenti del proprio tenant
+// e non può assegnare (né togliere) il ruolo di amministratore della piattaforma
+func UpdateUserRoleAPI(c *gin.Context) {
+	u, _ := c.Get("currentUser")
+	currentUser := u.(models.User)
+
+	var req dto.RoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+		return
+	}
+
+	role, err := models.ParseRole(req.Role)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user id"})
+		return
+	}
+
+	var user models.User
+	models.GetUserById(&user, id)
+	if user.ID == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if currentUser.Role != models.RolePlatformAdmin {
+		if user.TenantID != currentUser.TenantID {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if role == models.RolePlatformAdmin || user.Role == models.RolePlatformAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only platform admins can manage platform admins"})
+			return
+		}
+	}
+
+	if err := user.SetRole(role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Could not update role"})
+		return
+	}
+
+	c.JSON(http.StatusOK, dto.UserResponse{
+		ID:        user.ID,
+		Username:  user.Username,
+		Role:      string(user.Role),
+		CreatedAt: user.CreatedAt,
+	})
+}
@@ -0,0 +1,16 @@
+package dto
+
+type AlertRuleRequest struct {
+	Name          string  `json:"name" binding:"required"`
+	Type          string  `json:"type" binding:"required"` // threshold, rate_of_change, missing_data
+	Metric        string  `json:"metric" binding:"required"`
+	Field         string  `json:"field"`   // campo del payload, es. spO2
+	Gateway       string  `json:"gateway"` // natsId, vuoto = tutti i gateway
+	Operator      string  `json:"operator"`
+	Threshold     float64 `json:"threshold"`
+	Hysteresis    float64 `json:"hysteresis"`
+	ForSeconds    int     `json:"forSeconds"`
+	WindowSeconds int     `json:"windowSeconds"`
+	Severity      string  `json:"severity"` // info, warning (default), critical
+	Enabled       *bool   `json:"enabled"`  // default true
+}
@@ -2,6 +2,8 @@ package dto
 
 // Response structures
 type AuthResponse struct {
-	Token string       `json:"token"`
-	User  UserResponse `json:"user"`
+	Token        string       `json:"token"`
+	RefreshToken string       `json:"refreshToken"`
+	ExpiresIn    int          `json:"expiresIn"` // durata dell'access token in secondi
+	User         UserResponse `json:"user"`
 }
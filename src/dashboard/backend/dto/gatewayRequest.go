@@ -0,0 +1,19 @@
+package dto
+
+type GatewayRequest struct {
+	NatsID   string `json:"natsId" binding:"required"` // ID usato nei subject
+	Serial   string `json:"serial" binding:"required"`
+	Location string `json:"location"`
+	Bed      string `json:"bed"`
+	Patient  string `json:"patient"`
+	Status   string `json:"status"` // active (default), maintenance, decommissioned
+	Firmware string `json:"firmware"`
+}
+
+type DeviceRequest struct {
+	Serial   string `json:"serial" binding:"required"`
+	Metric   string `json:"metric" binding:"required"`
+	Model    string `json:"model"`
+	Status   string `json:"status"`
+	Firmware string `json:"firmware"`
+}
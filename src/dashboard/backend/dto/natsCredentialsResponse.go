@@ -0,0 +1,9 @@
+package dto
+
+import "time"
+
+type NatsCredentialsResponse struct {
+	JWT       string    `json:"jwt"`
+	Subject   string    `json:"subject"` // unico subject a cui ci si può sottoscrivere
+	ExpiresAt time.Time `json:"expiresAt"`
+}
@@ -0,0 +1,26 @@
+package dto
+
+type NotificationChannelRequest struct {
+	Name       string   `json:"name" binding:"required"`
+	Type       string   `json:"type" binding:"required"` // webhook, email, pager
+	URL        string   `json:"url"`
+	Secret     string   `json:"secret"` // in modifica, vuoto = invariato
+	Recipients []string `json:"recipients"`
+	Subject    string   `json:"subject"`
+	Enabled    *bool    `json:"enabled"` // default true
+}
+
+type NotificationRouteRequest struct {
+	ChannelID    uint   `json:"channelId" binding:"required"`
+	MinSeverity  string `json:"minSeverity"` // info, warning (default), critical
+	Metric       string `json:"metric"`
+	Gateway      string `json:"gateway"`
+	DelaySeconds int    `json:"delaySeconds"`
+	QuietStart   string `json:"quietStart"`
+	QuietEnd     string `json:"quietEnd"`
+	// Severità minima notificata anche durante la fascia di silenzio: info, warning, critical (default) o none
+	QuietBypassSeverity string `json:"quietBypassSeverity"`
+	Timezone            string `json:"timezone"` // default Europe/Rome
+	SendResolved        bool   `json:"sendResolved"`
+	Enabled             *bool  `json:"enabled"` // default true
+}
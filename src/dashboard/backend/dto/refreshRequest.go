@@ -0,0 +1,5 @@
+package dto
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" binding:"required"`
+}
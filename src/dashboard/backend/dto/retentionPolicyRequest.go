@@ -0,0 +1,12 @@
+package dto
+
+// Giorni di conservazione, 0 = per sempre (compressAfterDays 0 = nessuna compressione)
+type RetentionPolicyRequest struct {
+	RawDays           *int `json:"rawDays" binding:"required"`
+	Rollup1mDays      *int `json:"rollup1mDays" binding:"required"`
+	Rollup1hDays      *int `json:"rollup1hDays" binding:"required"`
+	Rollup1dDays      *int `json:"rollup1dDays" binding:"required"`
+	CompressAfterDays *int `json:"compressAfterDays" binding:"required"`
+	// Solo nel default del tenant, default 30
+	StreamDays *int `json:"streamDays"`
+}
@@ -0,0 +1,24 @@
+package dto
+
+import "encoding/json"
+
+// Messaggio inviato dal client sul WebSocket dei sensori
+type StreamSubscribeRequest struct {
+	Type          string   `json:"type"`           // "subscribe"
+	Gateways      []string `json:"gateways"`       // vuoto = tutti i gateway
+	Metrics       []string `json:"metrics"`        // vuoto = tutte le metriche
+	ReplayMinutes int      `json:"replay_minutes"` // letture degli ultimi N minuti da inviare prima di quelle live
+}
+
+// Messaggio inviato dal server sul WebSocket dei sensori
+type StreamMessage struct {
+	Type      string          `json:"type"` // "data", "gateway_status", "replay_done", "subscribed" o "error"
+	Subject   string          `json:"subject,omitempty"`
+	GatewayID string          `json:"gateway_id,omitempty"`
+	Metric    string          `json:"metric,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp int64           `json:"timestamp,omitempty"` // millisecondi
+	Replay    bool            `json:"replay,omitempty"`    // lettura storica inviata dal replay
+	Status    string          `json:"status,omitempty"`    // gateway_status: online, offline o unknown
+	Error     string          `json:"error,omitempty"`
+}
@@ -5,6 +5,7 @@ import "time"
 type UserResponse struct {
 	ID        uint            `json:"id"`
 	Username  string          `json:"username"`
+	Role      string          `json:"role"`
 	Tenant    *TenantResponse `json:"tenant,omitempty"`
 	CreatedAt time.Time       `json:"createdAt"`
 }
@@ -0,0 +1,171 @@
+package gatewaystatus
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"gin-test/natsconn"
+
+	"github.com/nats-io/nats.go"
+)
+
+/*
+Stato di connessione dei gateway, scritto dal subscriber nel bucket KV gateway_status
+(account consumers) in base agli heartbeat: online, oppure offline dopo un periodo di silenzio.
+Il Watcher tiene una copia del bucket aggiornata in tempo reale e avvisa i listener
+quando un gateway cambia stato.
+*/
+
+const bucket = "gateway_status"
+
+const (
+	Online  = "online"
+	Offline = "offline"
+	// Gateway che non ha mai inviato heartbeat (o rimosso dal bucket)
+	Unknown = "unknown"
+)
+
+/* Voce del bucket gateway_status (vedi subscriber/liveness.go) */
+type Status struct {
+	Tenant    string    `json:"tenant"`
+	GatewayID string    `json:"gateway_id"`
+	Status    string    `json:"status"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Da quando il gateway è nello stato attuale
+	Since time.Time `json:"since"`
+	// Letture nel buffer su disco del gateway all'ultimo heartbeat
+	Buffered int `json:"buffered"`
+}
+
+type Watcher struct {
+	bucket *natsconn.BucketWatch
+
+	mu        sync.RWMutex
+	statuses  map[string]Status
+	listeners map[int]func(Status)
+	nextID    int
+}
+
+func key(tenant string, gatewayID string) string {
+	return tenant + "." + gatewayID
+}
+
+/* Si connette con le credenziali dell'account consumers e carica il bucket, creandolo se non esiste */
+func Start(natsURL string, caCert string, creds string) (*Watcher, error) {
+	w := &Watcher{
+		statuses:  map[string]Status{},
+		listeners: map[int]func(Status){},
+	}
+
+	var err error
+	w.bucket, err = natsconn.WatchBucket(natsURL, caCert, creds, &nats.KeyValueConfig{
+		Bucket:      bucket,
+		Description: "Stato di connessione dei gateway",
+		History:     1,
+	}, w.apply)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+func (w *Watcher) apply(entry nats.KeyValueEntry) {
+	var status Status
+	if entry.Operation() == nats.KeyValuePut {
+		if err := json.Unmarshal(entry.Value(), &status); err != nil {
+			log.Printf("Stato del gateway %s ignorato: %v", entry.Key(), err)
+			return
+		}
+	}
+
+	w.mu.Lock()
+	previous, existed := w.statuses[entry.Key()]
+	if entry.Operation() == nats.KeyValuePut {
+		w.statuses[entry.Key()] = status
+	} else {
+		delete(w.statuses, entry.Key())
+		status = previous
+		status.Status = Unknown
+	}
+	var listeners []func(Status)
+	// Gli heartbeat aggiornano last_seen ogni pochi secondi: i listener sentono solo i cambi di stato
+	if !existed || previous.Status != status.Status {
+		for _, fn := range w.listeners {
+			listeners = append(listeners, fn)
+		}
+	}
+	w.mu.Unlock()
+
+	if !existed && status.Status == Unknown {
+		return
+	}
+	for _, fn := range listeners {
+		fn(status)
+	}
+}
+
+/* Stato del gateway del tenant. Con il watcher non avviato (nil) lo stato è sempre sconosciuto */
+func (w *Watcher) Get(tenant string, gatewayID string) (Status, bool) {
+	if w == nil {
+		return Status{}, false
+	}
+
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	status, ok := w.statuses[key(tenant, gatewayID)]
+	return status, ok
+}
+
+/* Stato di tutti i gateway del tenant che hanno inviato almeno un heartbeat, ordinati per ID */
+func (w *Watcher) Tenant(tenant string) []Status {
+	statuses := []Status{}
+	if w == nil {
+		return statuses
+	}
+
+	w.mu.RLock()
+	for _, status := range w.statuses {
+		if status.Tenant == tenant {
+			statuses = append(statuses, status)
+		}
+	}
+	w.mu.RUnlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].GatewayID < statuses[j].GatewayID })
+	return statuses
+}
+
+/*
+Registra fn, chiamata ad ogni cambio di stato di un gateway (di qualsiasi tenant).
+fn non deve bloccare. Restituisce la funzione che rimuove il listener
+*/
+func (w *Watcher) Listen(fn func(Status)) func() {
+	if w == nil {
+		return func() {}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	id := w.nextID
+	w.nextID++
+	w.listeners[id] = fn
+
+	return func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.listeners, id)
+	}
+}
+
+func (w *Watcher) Close() {
+	if w == nil {
+		return
+	}
+	w.bucket.Stop()
+}
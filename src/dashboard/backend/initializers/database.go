@@ -1,8 +1,16 @@
 package initializers
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"os"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgconn"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 )
@@ -10,6 +18,26 @@ import (
 /* Variabile globale usata per accesso al DB*/
 var DB *gorm.DB
 
+/*
+Password dell'utente <tenant>_user: l'HMAC-SHA256 dell'ID del tenant con TENANT_DB_SECRET.
+Subscriber e alerting ricevono lo stesso segreto e ricavano la stessa password, così ogni tenant
+ha la sua senza doverle distribuire. Le password vengono impostate dal provisioning
+*/
+func TenantDBPassword(natsID string) (string, error) {
+	secret := os.Getenv("TENANT_DB_SECRET")
+	if secret == "" {
+		return "", errors.New("TENANT_DB_SECRET non impostata")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(natsID))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+var (
+	tenantDBs   = map[string]*gorm.DB{}
+	tenantDBsMu sync.Mutex
+)
+
 func ConnectDB() {
 	dsn := os.Getenv("DB_URL")
 	var err error
@@ -19,3 +47,37 @@ func ConnectDB() {
 		log.Fatal("Failed to connect to DB:", err)
 	}
 }
+
+/*
+Restituisce la connessione al DB con l'utente <tenant>_user, che può leggere solo lo schema del tenant.
+Host, porta e database sono quelli di DB_URL. Le connessioni vengono aperte alla prima richiesta e riusate.
+*/
+func TenantDB(natsID string) (*gorm.DB, error) {
+	tenantDBsMu.Lock()
+	defer tenantDBsMu.Unlock()
+
+	if db, ok := tenantDBs[natsID]; ok {
+		return db, nil
+	}
+
+	cfg, err := pgconn.ParseConfig(os.Getenv("DB_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("DB_URL non valido: %w", err)
+	}
+
+	password, err := TenantDBPassword(natsID)
+	if err != nil {
+		return nil, err
+	}
+
+	dsn := fmt.Sprintf("host=%s port=%d dbname=%s user=%s_user password=%s sslmode=disable",
+		cfg.Host, cfg.Port, cfg.Database, natsID, password,
+	)
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, fmt.Errorf("connessione al DB del tenant %s fallita: %w", natsID, err)
+	}
+
+	tenantDBs[natsID] = db
+	return db, nil
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"expvar"
+	"gin-test/auth"
 	"gin-test/controllers"
+	"gin-test/gatewaystatus"
 	"gin-test/initializers"
 	"gin-test/middlewares"
 	"gin-test/migrate"
+	"gin-test/natsconn"
+	"gin-test/provisioning"
 	"log"
-	"os"
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/nats-io/nats.go"
 )
 
 func init() {
 	initializers.LoadEnvs()
+	auth.InitTokenService()
 	initializers.ConnectDB()
 	migrate.Migrate()
+	migrate.BootstrapPlatformAdmin()
+	migrate.EncryptAccountSeeds()
 }
 
 func main() {
@@ -26,22 +31,63 @@ func main() {
 
 	initializers.LoadTemplates(router, "templates")
 
-	// NATS
-	creds := os.Getenv("TENANT_1_CREDS")
-	caCert := os.Getenv("TENANT_CA")
-	natsURL := os.Getenv("NATS_URL")
-
-	nc, err := nats.Connect(natsURL,
-		nats.UserCredentials(creds),
-		nats.RootCAs(caCert),
-		nats.Timeout(10*time.Second),
-	)
-	if err != nil {
-		log.Fatal(err)
+	// NATS: una connessione per tenant, aperta al primo utilizzo
+	controllers.NatsConns = natsconn.New(natsconn.ConfigFromEnv())
+	defer controllers.NatsConns.CloseAll()
+
+	// Provisioning dei tenant
+	provisioningConfig := provisioning.ConfigFromEnv()
+	if err := provisioningConfig.Validate(); err != nil {
+		log.Printf("Provisioning dei tenant disabilitato:\n%v", err)
+	}
+	controllers.Provisioner = provisioning.New(provisioningConfig, initializers.DB)
+	// Password degli utenti <tenant>_user, ricavate da TENANT_DB_SECRET come fanno subscriber e alerting
+	if err := controllers.Provisioner.SyncTenantDBPasswords(); err != nil {
+		log.Printf("Impostazione delle password degli utenti dei tenant fallita: %v", err)
+	}
+	// Crea i rollup mancanti e riapplica le politiche di conservazione dei dati, poi la conservazione
+	// dei messaggi negli stream dei tenant
+	go func() {
+		if err := controllers.Provisioner.SyncRetention(); err != nil {
+			log.Printf("Sincronizzazione delle politiche di conservazione dei dati fallita: %v", err)
+		}
+		controllers.SyncStreamRetention()
+	}()
+	if provisioningConfig.Validate() == nil {
+		// Riallinea il registro dei gateway (letto dal subscriber), le regole di alerting e le notifiche con il DB
+		go func() {
+			if err := controllers.Provisioner.SyncGateways(); err != nil {
+				log.Printf("Sincronizzazione del registro dei gateway fallita: %v", err)
+			}
+			if err := controllers.Provisioner.SyncAlertRules(); err != nil {
+				log.Printf("Sincronizzazione delle regole di alerting fallita: %v", err)
+			}
+			if err := controllers.Provisioner.SyncNotifications(); err != nil {
+				log.Printf("Sincronizzazione delle notifiche fallita: %v", err)
+			}
+		}()
+
+		// Stato di connessione dei gateway, scritto dal subscriber in base agli heartbeat
+		watcher, err := gatewaystatus.Start(provisioningConfig.NatsURL, provisioningConfig.CACert, provisioningConfig.ConsumersCreds)
+		if err != nil {
+			log.Printf("Stato dei gateway non disponibile: %v", err)
+		} else {
+			controllers.GatewayStatus = watcher
+			defer watcher.Close()
+			watcher.Listen(controllers.SaveGatewayLastSeen)
+		}
+
+		// Tabelle delle metriche dei tenant, create dagli schemi registrati nel bucket sensor_schemas
+		stopSchemas, err := controllers.Provisioner.WatchMetricSchemas()
+		if err != nil {
+			log.Printf("Creazione automatica delle tabelle delle metriche non disponibile: %v", err)
+		} else {
+			defer stopSchemas()
+		}
 	}
-	defer nc.Close()
 
-	controllers.NatsConn = nc
+	// Chiavi pubbliche dei JWT, per gli altri servizi
+	router.GET("/.well-known/jwks.json", controllers.JWKSGet)
 
 	// ============ API Routes (Angular) ============
 	api := router.Group("/api")
@@ -49,15 +95,77 @@ func main() {
 		// Public API routes
 		api.POST("/login", controllers.LoginAPI)
 		api.POST("/register", controllers.RegisterAPI)
+		api.POST("/refresh", controllers.RefreshAPI)
 		api.GET("/tenants", controllers.GetTenantsAPI)
-		api.GET("/history", controllers.HistoryGet)
-		api.GET("/ws/sensors/:tenant", controllers.SensorStream)
 
 		// Protected API routes
 		protected := api.Group("/")
 		protected.Use(middlewares.APIAuthMiddleware())
 		{
 			protected.GET("/user/profile", controllers.GetUserProfileAPI)
+
+			// Sessioni dell'utente autenticato
+			protected.POST("/logout", controllers.LogoutAPI)
+			protected.GET("/sessions", controllers.GetSessionsAPI)
+			protected.DELETE("/sessions", controllers.DeleteOtherSessionsAPI)
+			protected.DELETE("/sessions/:id", controllers.DeleteSessionAPI)
+
+			// Dati dei sensori: il tenant è sempre quello dell'utente autenticato
+			readData := middlewares.RequirePermission(middlewares.PermReadData)
+			protected.GET("/history", readData, controllers.HistoryGet)
+			protected.POST("/stream/ticket", readData, controllers.StreamTicketAPI)
+			protected.GET("/ws/sensors", readData, controllers.SensorStream)
+			protected.GET("/sse/sensors", readData, controllers.SensorEvents)
+			// JWT per sottoscriversi direttamente a NATS via WebSocket
+			protected.GET("/nats/credentials", readData, controllers.NatsCredentialsGet)
+
+			// Registro di gateway e dispositivi
+			manageDevices := middlewares.RequirePermission(middlewares.PermManageDevices)
+			protected.GET("/gateways", readData, controllers.GetGatewaysAPI)
+			protected.GET("/gateways/status", readData, controllers.GetGatewayStatusAPI)
+			protected.GET("/gateways/:id", readData, controllers.GetGatewayAPI)
+			protected.POST("/gateways", manageDevices, controllers.CreateGatewayAPI)
+			protected.PUT("/gateways/:id", manageDevices, controllers.UpdateGatewayAPI)
+			protected.DELETE("/gateways/:id", manageDevices, controllers.DeleteGatewayAPI)
+			protected.POST("/gateways/:id/devices", manageDevices, controllers.CreateDeviceAPI)
+			protected.PUT("/gateways/:id/devices/:deviceId", manageDevices, controllers.UpdateDeviceAPI)
+			protected.DELETE("/gateways/:id/devices/:deviceId", manageDevices, controllers.DeleteDeviceAPI)
+
+			// Alert e regole di alerting, valutate dal servizio src/alerting
+			manageAlerts := middlewares.RequirePermission(middlewares.PermManageAlerts)
+			protected.GET("/alerts", readData, controllers.GetAlertsAPI)
+			protected.POST("/alerts/:id/ack", middlewares.RequirePermission(middlewares.PermAckAlerts), controllers.AckAlertAPI)
+			protected.GET("/alerts/rules", readData, controllers.GetAlertRulesAPI)
+			protected.POST("/alerts/rules", manageAlerts, controllers.CreateAlertRuleAPI)
+			protected.PUT("/alerts/rules/:id", manageAlerts, controllers.UpdateAlertRuleAPI)
+			protected.DELETE("/alerts/rules/:id", manageAlerts, controllers.DeleteAlertRuleAPI)
+
+			// Canali e instradamento delle notifiche, usati dal servizio src/notifier
+			manageNotifications := middlewares.RequirePermission(middlewares.PermManageNotifications)
+			protected.GET("/notifications/channels", manageNotifications, controllers.GetNotificationChannelsAPI)
+			protected.POST("/notifications/channels", manageNotifications, controllers.CreateNotificationChannelAPI)
+			protected.PUT("/notifications/channels/:id", manageNotifications, controllers.UpdateNotificationChannelAPI)
+			protected.DELETE("/notifications/channels/:id", manageNotifications, controllers.DeleteNotificationChannelAPI)
+			protected.GET("/notifications/routes", manageNotifications, controllers.GetNotificationRoutesAPI)
+			protected.POST("/notifications/routes", manageNotifications, controllers.CreateNotificationRouteAPI)
+			protected.PUT("/notifications/routes/:id", manageNotifications, controllers.UpdateNotificationRouteAPI)
+			protected.DELETE("/notifications/routes/:id", manageNotifications, controllers.DeleteNotificationRouteAPI)
+
+			manageUsers := middlewares.RequirePermission(middlewares.PermManageUsers)
+			protected.GET("/users", manageUsers, controllers.GetUsersAPI)
+			protected.PUT("/users/:id/role", manageUsers, controllers.UpdateUserRoleAPI)
+			protected.DELETE("/users/:id/sessions", manageUsers, controllers.DeleteUserSessionsAPI)
+
+			// Rollup, compressione e retention dei dati dei tenant (TimescaleDB)
+			manageTenants := middlewares.RequirePermission(middlewares.PermManageTenants)
+			protected.GET("/admin/retention/:tenant", manageTenants, controllers.GetRetentionAPI)
+			protected.PUT("/admin/retention/:tenant", manageTenants, controllers.SetRetentionAPI)
+			protected.DELETE("/admin/retention/:tenant", manageTenants, controllers.DeleteRetentionAPI)
+			protected.PUT("/admin/retention/:tenant/:metric", manageTenants, controllers.SetRetentionAPI)
+			protected.DELETE("/admin/retention/:tenant/:metric", manageTenants, controllers.DeleteRetentionAPI)
+
+			// Metriche del server (expvar), es. messaggi WebSocket scartati
+			protected.GET("/debug/vars", manageTenants, gin.WrapH(expvar.Handler()))
 			// ...
 		}
 	}
@@ -82,11 +190,6 @@ func main() {
 	{ // queste parentesi graffe non servono, sono solo per separare visivamente
 		public.GET("/", controllers.IndexControllerGet)
 		public.GET("/logout", controllers.LogoutController)
-
-		public.GET("/tenant/create", controllers.TenantCreateGet)
-		public.POST("/tenant/create", controllers.TenantCreatePost)
-		public.GET("/tenant/list", controllers.TenantListController)
-
 	}
 
 	// Pagine accessibili a utenti autorizzati
@@ -95,7 +198,16 @@ func main() {
 	{
 		private.GET("/user/profile", controllers.GetUserProfile)
 
-		private.GET("/tenant", controllers.TenantIndexController)
+		private.GET("/tenant", middlewares.RequirePermission(middlewares.PermManageUsers), controllers.TenantIndexController)
+	}
+
+	// Pagine riservate agli amministratori della piattaforma
+	platformAdmin := router.Group("/")
+	platformAdmin.Use(middlewares.PrivatePage, middlewares.RequirePermission(middlewares.PermManageTenants))
+	{
+		platformAdmin.GET("/tenant/create", controllers.TenantCreateGet)
+		platformAdmin.POST("/tenant/create", controllers.TenantCreatePost)
+		platformAdmin.GET("/tenant/list", controllers.TenantListController)
 	}
 
 	router.Run()
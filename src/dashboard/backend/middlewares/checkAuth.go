@@ -1,76 +1,95 @@
 package middlewares
 
 import (
-	"fmt"
+	"errors"
+	"gin-test/auth"
 	"gin-test/models"
 	"gin-test/views"
 	"net/http"
-	"os"
-
-	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 type NoTokenError struct {}
 func (e NoTokenError) Error() string { return "Token is missing" }
 
-type UnexpectedSigningMethodError struct {
-	Method any
-}
-func (e UnexpectedSigningMethodError) Error() string { return fmt.Sprintf("Unexpected signing method: %v", e.Method)}
-
-type InvalidOrExpiredTokenError struct {}
-func (e InvalidOrExpiredTokenError) Error() string { return "Invalid or expired token" }
-
 type UserNotFoundError struct {}
 func (e UserNotFoundError) Error() string { return "User not found" }
 
 
 /*
-NOTA: Questo tipo di autenticazione non è sicuro contro attacchi di CSRF!
-Per quanto riguarda il PoC, però, questo è più che sufficiente secondo me
+Verifica l'access token (firma, scadenza, sessione non revocata) e imposta currentUser e currentSession.
+Usata sia dalle pagine HTML (token nel cookie) sia dall'API (token nell'header Authorization)
 */
-func checkAuth(c *gin.Context) error {
-	tokenString, err := c.Cookie("jwt-token")
+func authenticate(c *gin.Context, tokenString string) error {
+	claims, err := auth.ParseAccessToken(tokenString)
 	if err != nil {
-		return &NoTokenError{}
+		return err
 	}
 
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, &UnexpectedSigningMethodError{Method: token.Header["alg"]}
-		}
-		return []byte(os.Getenv("SECRET")), nil
-	})
+	var user models.User
+	models.GetUserById(&user, int(claims.UserID))
+
+	if user.ID == 0 {
+		return &UserNotFoundError{}
+	}
+
+	// Il token vale solo finché la sua sessione non viene revocata (logout o revoca esplicita)
+	session, err := auth.CheckSession(claims.SessionID, user.ID)
 	if err != nil {
 		return err
 	}
 
-	if !token.Valid {
-		return &InvalidOrExpiredTokenError{}
-	}
+	c.Set("currentUser", user)
+	c.Set("currentSession", session)
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok {
-		return &InvalidOrExpiredTokenError{}
+	// Se il ruolo è stato cambiato e non può più leggere i dati, il JWT NATS ancora nel browser va cancellato
+	if _, err := c.Cookie(auth.NatsJWTCookie); err == nil && !HasPermission(user.Role, PermReadData) {
+		auth.ClearNatsCookie(c)
 	}
-	
-	if float64(time.Now().Unix()) > claims["exp"].(float64) {
-		return &InvalidOrExpiredTokenError{}
+
+	return nil
+}
+
+/* Messaggio di errore restituito al client: i dettagli della validazione del JWT non vengono esposti */
+func authErrorMessage(err error) string {
+	var userNotFound *UserNotFoundError
+	var revoked *auth.SessionRevokedError
+	if errors.As(err, &userNotFound) || errors.As(err, &revoked) {
+		return err.Error()
 	}
+	return auth.InvalidOrExpiredTokenError{}.Error()
+}
 
-	var user models.User
-	models.GetUserById(&user, int(claims["id"].(float64)))
+/*
+NOTA: Questo tipo di autenticazione non è sicuro contro attacchi di CSRF!
+Per quanto riguarda il PoC, però, questo è più che sufficiente secondo me
+*/
+func checkAuth(c *gin.Context) error {
+	tokenString, err := c.Cookie(auth.AccessTokenCookie)
+	if err == nil {
+		err = authenticate(c, tokenString)
+		if err == nil {
+			return nil
+		}
+	} else {
+		err = &NoTokenError{}
+	}
 
-	if user.ID == 0 {
-		return &UserNotFoundError{}
+	// Access token mancante, scaduto o revocato: prova a rinnovarlo con il refresh token
+	refreshToken, cookieErr := c.Cookie(auth.RefreshTokenCookie)
+	if cookieErr != nil {
+		return err
 	}
 
-	c.Set("currentUser", user)
+	tokens, err := auth.RefreshSession(refreshToken, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		auth.ClearCookies(c)
+		return err
+	}
+	auth.SetCookies(c, tokens)
 
-	return nil
+	return authenticate(c, tokens.AccessToken)
 }
 
 func PublicPage(c *gin.Context) {
@@ -98,56 +117,53 @@ func PrivatePage(c *gin.Context) {
 	c.Next()
 }
 
+/*
+Route che accettano il ticket monouso come parametro (auth.IssueStreamTicket), perché
+WebSocket ed EventSource del browser non permettono di impostare header
+*/
+var streamTicketRoutes = map[string]bool{
+	"/api/ws/sensors":  true,
+	"/api/sse/sensors": true,
+}
+
 // Check auth header (inserito da Angular tramite HTTPInterceptor)
 func APIAuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
-			return
-		}
 
 		// Extract token from "Bearer <token>"
 		tokenString := ""
-		if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
-			tokenString = authHeader[7:]
-		} else {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
-			return
-		}
-
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (any, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, &UnexpectedSigningMethodError{Method: token.Header["alg"]}
+		switch {
+		case authHeader != "":
+			if len(authHeader) > 7 && authHeader[:7] == "Bearer " {
+				tokenString = authHeader[7:]
+			} else {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization format"})
+				return
 			}
-			return []byte(os.Getenv("SECRET")), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			return
-		}
-
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		case c.Query("token") != "":
+			// L'URL finisce nei log: l'access token non è accettato come parametro
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Access token not allowed in the query string: use the Authorization header or a ticket from POST /api/stream/ticket"})
 			return
-		}
-
-		if float64(time.Now().Unix()) > claims["exp"].(float64) {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Token expired"})
+		case c.Query("ticket") != "" && streamTicketRoutes[c.FullPath()]:
+			token, err := auth.RedeemStreamTicket(c.Query("ticket"))
+			if err != nil {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+				return
+			}
+			tokenString = token
+		default:
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			return
 		}
 
-		var user models.User
-		models.GetUserById(&user, int(claims["id"].(float64)))
-
-		if user.ID == 0 {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "User not found"})
+		if err := authenticate(c, tokenString); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": authErrorMessage(err)})
 			return
 		}
+		// Serve per creare i ticket dei WebSocket e SSE (POST /api/stream/ticket)
+		c.Set("accessToken", tokenString)
 
-		c.Set("currentUser", user)
 		c.Next()
 	}
 }
@@ -0,0 +1,74 @@
+package middlewares
+
+import (
+	"gin-test/models"
+	"gin-test/views"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type Permission string
+
+const (
+	// Creare e vedere tutti i tenant
+	PermManageTenants Permission = "tenants:manage"
+	// Vedere gli utenti del proprio tenant e cambiarne il ruolo
+	PermManageUsers Permission = "users:manage"
+	// Registrare e configurare gateway e dispositivi del proprio tenant
+	PermManageDevices Permission = "devices:manage"
+	// Leggere i dati dei sensori (storico e tempo reale) del proprio tenant
+	PermReadData Permission = "data:read"
+	// Configurare le regole di alerting del proprio tenant
+	PermManageAlerts Permission = "alerts:manage"
+	// Confermare gli alert del proprio tenant (es. il personale di reparto, che ha solo la lettura dei dati)
+	PermAckAlerts Permission = "alerts:ack"
+	// Configurare canali e instradamento delle notifiche degli alert del proprio tenant
+	PermManageNotifications Permission = "notifications:manage"
+)
+
+/* Matrice dei permessi: ogni ruolo ha solo i permessi elencati */
+var rolePermissions = map[models.Role][]Permission{
+	models.RolePlatformAdmin:  {PermManageTenants, PermManageUsers, PermManageDevices, PermManageAlerts, PermAckAlerts, PermManageNotifications, PermReadData},
+	models.RoleTenantAdmin:    {PermManageUsers, PermManageDevices, PermManageAlerts, PermAckAlerts, PermManageNotifications, PermReadData},
+	models.RoleDeviceOperator: {PermManageDevices, PermManageAlerts, PermAckAlerts, PermReadData},
+	models.RoleViewer:         {PermAckAlerts, PermReadData},
+	models.RolePending:        {},
+}
+
+type ForbiddenError struct {
+	Permission Permission
+}
+func (e ForbiddenError) Error() string { return "Missing permission " + string(e.Permission) }
+
+func HasPermission(role models.Role, perm Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Blocca la richiesta se l'utente non ha il permesso indicato.
+Va usato dopo APIAuthMiddleware (route /api) o PrivatePage (pagine HTML), che impostano currentUser.
+*/
+func RequirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u, exists := c.Get("currentUser")
+		if exists && HasPermission(u.(models.User).Role, perm) {
+			c.Next()
+			return
+		}
+
+		if strings.HasPrefix(c.Request.URL.Path, "/api") {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ForbiddenError{Permission: perm}.Error()})
+			return
+		}
+
+		c.AbortWithStatus(http.StatusForbidden)
+		views.ErrorView(c, gin.H{"debug": ForbiddenError{Permission: perm}.Error()})
+	}
+}
@@ -0,0 +1,54 @@
+package middlewares
+
+import (
+	"testing"
+
+	"gin-test/models"
+)
+
+func TestRolePermissions(t *testing.T) {
+	permissions := []Permission{
+		PermManageTenants,
+		PermManageUsers,
+		PermManageDevices,
+		PermReadData,
+		PermManageAlerts,
+		PermAckAlerts,
+		PermManageNotifications,
+	}
+
+	// Permessi attesi di ogni ruolo, tutti gli altri devono essere negati
+	tests := []struct {
+		role    models.Role
+		allowed []Permission
+	}{
+		{models.RolePlatformAdmin, permissions},
+		{models.RoleTenantAdmin, []Permission{PermManageUsers, PermManageDevices, PermReadData, PermManageAlerts, PermAckAlerts, PermManageNotifications}},
+		{models.RoleDeviceOperator, []Permission{PermManageDevices, PermReadData, PermManageAlerts, PermAckAlerts}},
+		{models.RoleViewer, []Permission{PermReadData, PermAckAlerts}},
+		{models.RolePending, nil},
+		{models.Role("sconosciuto"), nil},
+		{models.Role(""), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			allowed := map[Permission]bool{}
+			for _, p := range tt.allowed {
+				allowed[p] = true
+			}
+			for _, p := range permissions {
+				if got := HasPermission(tt.role, p); got != allowed[p] {
+					t.Errorf("HasPermission(%s, %s) = %v, atteso %v", tt.role, p, got, allowed[p])
+				}
+			}
+		})
+	}
+
+	// Ogni ruolo definito deve comparire nella matrice, anche senza permessi
+	for _, role := range models.Roles {
+		if _, ok := rolePermissions[role]; !ok {
+			t.Errorf("ruolo %s mancante nella matrice dei permessi", role)
+		}
+	}
+}
@@ -3,10 +3,73 @@ package migrate
 import (
 	"gin-test/initializers"
 	"gin-test/models"
+	"log"
+	"os"
 )
 
 func Migrate() {
 	// Usa i modelli come riferimento per creare le tabelle sul DB
 	initializers.DB.AutoMigrate(&models.User{})
 	initializers.DB.AutoMigrate(&models.Tenant{})
+	initializers.DB.AutoMigrate(&models.Session{})
+	initializers.DB.AutoMigrate(&models.Gateway{})
+	initializers.DB.AutoMigrate(&models.Device{})
+	initializers.DB.AutoMigrate(&models.AlertRule{})
+	initializers.DB.AutoMigrate(&models.NotificationChannel{})
+	initializers.DB.AutoMigrate(&models.NotificationRoute{})
+	initializers.DB.AutoMigrate(&models.RetentionPolicy{})
+}
+
+/*
+Assegna il ruolo platform_admin all'utente PLATFORM_ADMIN_USERNAME del tenant PLATFORM_ADMIN_TENANT (nats_id),
+così da avere il primo amministratore senza modificare il DB a mano.
+Lo username è unico solo nel tenant e la registrazione è aperta: servono entrambi.
+Non fa niente se esiste già un platform_admin, quindi ai riavvii successivi non promuove nessuno
+*/
+func BootstrapPlatformAdmin() {
+	username := os.Getenv("PLATFORM_ADMIN_USERNAME")
+	tenantID := os.Getenv("PLATFORM_ADMIN_TENANT")
+	if username == "" && tenantID == "" {
+		return
+	}
+	if username == "" || tenantID == "" {
+		log.Printf("Per creare il primo platform_admin servono sia PLATFORM_ADMIN_USERNAME che PLATFORM_ADMIN_TENANT")
+		return
+	}
+
+	var admins int64
+	if err := initializers.DB.Model(&models.User{}).Where("role = ?", models.RolePlatformAdmin).Count(&admins).Error; err != nil {
+		log.Printf("Impossibile controllare se esiste un platform_admin: %v", err)
+		return
+	}
+	if admins > 0 {
+		return
+	}
+
+	var tenant models.Tenant
+	models.GetTenantByNatsID(&tenant, tenantID)
+	if tenant.ID == 0 {
+		log.Printf("Impossibile assegnare il ruolo platform_admin: il tenant %s non esiste", tenantID)
+		return
+	}
+
+	var user models.User
+	initializers.DB.Where("tenant_id = ? AND username = ?", tenant.ID, username).Find(&user)
+	if user.ID == 0 {
+		log.Printf("Impossibile assegnare il ruolo platform_admin: l'utente %s del tenant %s non esiste", username, tenantID)
+		return
+	}
+
+	if err := initializers.DB.Model(&user).Update("role", models.RolePlatformAdmin).Error; err != nil {
+		log.Printf("Impossibile assegnare il ruolo platform_admin a %s (%s): %v", username, tenantID, err)
+		return
+	}
+	log.Printf("Assegnato il ruolo platform_admin a %s (%s)", username, tenantID)
+}
+
+/* Cifra con TENANT_SEED_KEY i seed degli account NATS salvati in chiaro dalle versioni precedenti */
+func EncryptAccountSeeds() {
+	if err := models.EncryptAccountSeeds(); err != nil {
+		log.Printf("Impossibile cifrare i seed degli account dei tenant: %v", err)
+	}
 }
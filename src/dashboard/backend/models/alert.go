@@ -0,0 +1,69 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+/* Stato di un alert */
+const (
+	AlertFiring       = "firing"
+	AlertAcknowledged = "acknowledged"
+	AlertResolved     = "resolved"
+)
+
+/*
+Alert aperto dal servizio di alerting, salvato nella tabella alerts dello schema del tenant.
+Le funzioni ricevono la connessione del tenant (initializers.TenantDB)
+*/
+type Alert struct {
+	ID				int64		`json:"id"`
+	RuleID			uint		`json:"ruleId"`
+	RuleName		string		`json:"ruleName"`
+	GatewayID		string		`json:"gatewayId"`
+	Metric			string		`json:"metric"`
+	Severity		string		`json:"severity"`
+	Status			string		`json:"status"`
+	Message			string		`json:"message"`
+	Value			float64		`json:"value"`
+	Threshold		float64		`json:"threshold"`
+	FiredAt			time.Time	`json:"firedAt"`
+	AcknowledgedAt	*time.Time	`json:"acknowledgedAt"`
+	AcknowledgedBy	*string		`json:"acknowledgedBy"`
+	ResolvedAt		*time.Time	`json:"resolvedAt"`
+}
+
+/* Alert del tenant dal più recente. status vuoto = tutti, "open" = firing e acknowledged */
+func GetAlerts(db *gorm.DB, alerts *[]Alert, status string, limit int) error {
+	query := db.Order("fired_at DESC").Limit(limit)
+	switch status {
+	case "":
+	case "open":
+		query = query.Where("status <> ?", AlertResolved)
+	default:
+		query = query.Where("status = ?", status)
+	}
+	return query.Find(alerts).Error
+}
+
+/* Alert del tenant, ID = 0 se non esiste */
+func GetAlert(db *gorm.DB, alert *Alert, id int64) error {
+	return db.Where("id = ?", id).Find(alert).Error
+}
+
+/* Conferma l'alert se è ancora firing. Restituisce false se era già confermato o risolto */
+func AcknowledgeAlert(db *gorm.DB, alert *Alert, username string) (bool, error) {
+	now := time.Now()
+	result := db.Model(alert).
+		Where("status = ?", AlertFiring).
+		Updates(map[string]any{"status": AlertAcknowledged, "acknowledged_at": now, "acknowledged_by": username})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false, result.Error
+	}
+
+	alert.Status = AlertAcknowledged
+	alert.AcknowledgedAt = &now
+	alert.AcknowledgedBy = &username
+	return true, nil
+}
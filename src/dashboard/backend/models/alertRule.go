@@ -0,0 +1,111 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"gin-test/initializers"
+)
+
+/* Tipo di regola di alerting, valutata dal servizio src/alerting */
+type AlertRuleType string
+
+const (
+	// Il campo supera la soglia per almeno ForSeconds
+	RuleThreshold AlertRuleType = "threshold"
+	// La variazione al minuto del campo, calcolata su WindowSeconds, supera la soglia per almeno ForSeconds
+	RuleRateOfChange AlertRuleType = "rate_of_change"
+	// Nessuna lettura della metrica dal gateway per WindowSeconds
+	RuleMissingData AlertRuleType = "missing_data"
+)
+
+type AlertSeverity string
+
+const (
+	SeverityInfo     AlertSeverity = "info"
+	SeverityWarning  AlertSeverity = "warning"
+	SeverityCritical AlertSeverity = "critical"
+)
+
+/*
+Regola di alerting di un tenant, es. blood_oxygen.spO2 < 92 per 60 secondi.
+Ogni regola viene pubblicata anche nel bucket KV alert_rules, letto dal servizio di alerting
+*/
+type AlertRule struct {
+	ID				uint			`json:"id" gorm:"primary_key"`
+	TenantID		uint			`json:"tenantId" gorm:"not null;index"`
+	Tenant			Tenant			`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Name			string			`json:"name" gorm:"not null"`
+	Type			AlertRuleType	`json:"type" gorm:"not null"`
+	Metric			string			`json:"metric" gorm:"not null"`
+	Field			string			`json:"field"` // campo del payload, es. spO2 (non serve per missing_data)
+	Gateway			string			`json:"gateway"` // natsId del gateway, vuoto = tutti
+	Operator		string			`json:"operator"` // <, <=, >, >=
+	Threshold		float64			`json:"threshold"`
+	Hysteresis		float64			`json:"hysteresis"` // margine oltre la soglia per risolvere l'alert
+	ForSeconds		int				`json:"forSeconds"`
+	WindowSeconds	int				`json:"windowSeconds"`
+	Severity		AlertSeverity	`json:"severity" gorm:"not null"`
+	Enabled			bool			`json:"enabled" gorm:"not null"`
+	CreatedAt		time.Time		`json:"createdAt"`
+	UpdatedAt		time.Time		`json:"updatedAt"`
+}
+
+/* Controlla che la regola sia valutabile dal servizio di alerting */
+func (rule *AlertRule) Validate() error {
+	switch rule.Type {
+	case RuleThreshold, RuleRateOfChange:
+		if rule.Field == "" {
+			return errors.New("field is required")
+		}
+		switch rule.Operator {
+		case "<", "<=", ">", ">=":
+		default:
+			return fmt.Errorf("invalid operator %q: use <, <=, > or >=", rule.Operator)
+		}
+		if rule.Hysteresis < 0 || rule.ForSeconds < 0 {
+			return errors.New("hysteresis and forSeconds cannot be negative")
+		}
+		if rule.Type == RuleRateOfChange && rule.WindowSeconds <= 0 {
+			return errors.New("windowSeconds is required")
+		}
+	case RuleMissingData:
+		if rule.WindowSeconds <= 0 {
+			return errors.New("windowSeconds is required")
+		}
+	default:
+		return fmt.Errorf("invalid type %q: use threshold, rate_of_change or missing_data", rule.Type)
+	}
+
+	switch rule.Severity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return fmt.Errorf("invalid severity %q: use info, warning or critical", rule.Severity)
+	}
+	return nil
+}
+
+func (rule *AlertRule) Create() error {
+	return initializers.DB.Create(rule).Error
+}
+
+func (rule *AlertRule) Save() error {
+	return initializers.DB.Save(rule).Error
+}
+
+func (rule *AlertRule) Delete() error {
+	return initializers.DB.Delete(rule).Error
+}
+
+/* Regola del tenant, ID = 0 se non esiste */
+func GetTenantAlertRule(rule *AlertRule, tenantID uint, id uint) {
+	initializers.DB.Where("tenant_id = ? AND id = ?", tenantID, id).Find(rule)
+}
+
+func GetTenantAlertRules(rules *[]AlertRule, tenantID uint) {
+	initializers.DB.Where("tenant_id = ?", tenantID).Order("id").Find(rules)
+}
+
+func GetAllAlertRules(rules *[]AlertRule) {
+	initializers.DB.Preload("Tenant").Find(rules)
+}
@@ -0,0 +1,49 @@
+package models
+
+import (
+	"time"
+	"gin-test/initializers"
+)
+
+/* Sensore collegato a un gateway. Metric è la metrica che invia (es. heart_rate) */
+type Device struct {
+	ID			uint			`json:"id" gorm:"primary_key"`
+	GatewayID	uint			`json:"gatewayId" gorm:"not null;index"`
+	Serial		string			`json:"serial" gorm:"not null;uniqueIndex"`
+	Metric		string			`json:"metric" gorm:"not null"`
+	Model		string			`json:"model"`
+	Status		DeviceStatus	`json:"status" gorm:"not null;default:active"`
+	Firmware	string			`json:"firmware"`
+	LastSeenAt	*time.Time		`json:"lastSeenAt"`
+	CreatedAt	time.Time		`json:"createdAt"`
+	UpdatedAt	time.Time		`json:"updatedAt"`
+}
+
+type DeviceAlreadyExists struct {}
+func (e *DeviceAlreadyExists) Error() string {
+	return "device already exists"
+}
+
+func (device *Device) Create() error {
+	var deviceFound Device
+	initializers.DB.Where("serial = ?", device.Serial).Find(&deviceFound)
+
+	if deviceFound.ID != 0 {
+		return &DeviceAlreadyExists{}
+	}
+
+	return initializers.DB.Create(device).Error
+}
+
+func (device *Device) Save() error {
+	return initializers.DB.Save(device).Error
+}
+
+func (device *Device) Delete() error {
+	return initializers.DB.Delete(device).Error
+}
+
+/* Dispositivo del gateway, ID = 0 se non esiste */
+func GetGatewayDevice(device *Device, gatewayID uint, id uint) {
+	initializers.DB.Where("gateway_id = ? AND id = ?", gatewayID, id).Find(device)
+}
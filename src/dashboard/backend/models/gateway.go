@@ -0,0 +1,109 @@
+package models
+
+import (
+	"fmt"
+	"time"
+	"gin-test/initializers"
+)
+
+/* Stato di un gateway o di un dispositivo */
+type DeviceStatus string
+
+const (
+	// In uso: le letture vengono accettate
+	StatusActive DeviceStatus = "active"
+	// Fermo per manutenzione: le letture vengono ancora accettate
+	StatusMaintenance DeviceStatus = "maintenance"
+	// Dismesso: le letture vengono trattate come quelle di un gateway non registrato
+	StatusDecommissioned DeviceStatus = "decommissioned"
+)
+
+var DeviceStatuses = []DeviceStatus{StatusActive, StatusMaintenance, StatusDecommissioned}
+
+type InvalidStatusError struct {
+	Status string
+}
+func (e *InvalidStatusError) Error() string {
+	return fmt.Sprintf("stato non valido: %q", e.Status)
+}
+
+func ParseDeviceStatus(s string) (DeviceStatus, error) {
+	if s == "" {
+		return StatusActive, nil
+	}
+	for _, status := range DeviceStatuses {
+		if string(status) == s {
+			return status, nil
+		}
+	}
+	return "", &InvalidStatusError{Status: s}
+}
+
+/*
+Gateway installato presso un tenant (es. box al letto del paziente).
+NatsID è l'ID che il gateway usa nei subject (sensors.<tenant>.<gateway>.<metrica>) e nella colonna gateway_id
+*/
+type Gateway struct {
+	ID			uint			`json:"id" gorm:"primary_key"`
+	TenantID	uint			`json:"tenantId" gorm:"not null;uniqueIndex:idx_gateway_tenant_nats_id"`
+	Tenant		Tenant			`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	NatsID		string			`json:"natsId" gorm:"not null;uniqueIndex:idx_gateway_tenant_nats_id"`
+	Serial		string			`json:"serial" gorm:"not null;uniqueIndex"`
+	Location	string			`json:"location"` // es. reparto e stanza
+	Bed			string			`json:"bed"`
+	Patient		string			`json:"patient"` // riferimento al paziente assegnato, non dati anagrafici
+	Status		DeviceStatus	`json:"status" gorm:"not null;default:active"`
+	Firmware	string			`json:"firmware"`
+	LastSeenAt	*time.Time		`json:"lastSeenAt"` // ultimo heartbeat ricevuto
+	Connection	string			`json:"connection" gorm:"-"` // online, offline o unknown, dal bucket gateway_status
+	Devices		[]Device		`json:"devices" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	CreatedAt	time.Time		`json:"createdAt"`
+	UpdatedAt	time.Time		`json:"updatedAt"`
+}
+
+type GatewayAlreadyExists struct {}
+func (e *GatewayAlreadyExists) Error() string {
+	return "gateway already exists"
+}
+
+func (gateway *Gateway) Create() error {
+	var gatewayFound Gateway
+	initializers.DB.Where("(tenant_id = ? AND nats_id = ?) OR serial = ?",
+		gateway.TenantID, gateway.NatsID, gateway.Serial,
+	).Find(&gatewayFound)
+
+	if gatewayFound.ID != 0 {
+		return &GatewayAlreadyExists{}
+	}
+
+	return initializers.DB.Create(gateway).Error
+}
+
+func (gateway *Gateway) Save() error {
+	return initializers.DB.Omit("Devices").Save(gateway).Error
+}
+
+func (gateway *Gateway) Delete() error {
+	return initializers.DB.Select("Devices").Delete(gateway).Error
+}
+
+/* Gateway del tenant con i suoi dispositivi, ID = 0 se non esiste */
+func GetTenantGateway(gateway *Gateway, tenantID uint, id uint) {
+	initializers.DB.Preload("Devices").Where("tenant_id = ? AND id = ?", tenantID, id).Find(gateway)
+}
+
+func GetTenantGateways(gateways *[]Gateway, tenantID uint) {
+	initializers.DB.Preload("Devices").Where("tenant_id = ?", tenantID).Order("nats_id").Find(gateways)
+}
+
+func GetAllGateways(gateways *[]Gateway) {
+	initializers.DB.Preload("Tenant").Find(gateways)
+}
+
+/* Salva l'istante dell'ultimo heartbeat del gateway, così resta disponibile anche senza NATS */
+func UpdateGatewayLastSeen(tenantNatsID string, gatewayNatsID string, lastSeen time.Time) error {
+	tenantID := initializers.DB.Model(&Tenant{}).Select("id").Where("nats_id = ?", tenantNatsID)
+	return initializers.DB.Model(&Gateway{}).
+		Where("tenant_id = (?) AND nats_id = ?", tenantID, gatewayNatsID).
+		Update("last_seen_at", lastSeen).Error
+}
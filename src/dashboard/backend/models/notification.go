@@ -0,0 +1,193 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"time"
+	"gin-test/initializers"
+)
+
+/* Canale con cui il servizio src/notifier invia le notifiche degli alert */
+type NotificationChannelType string
+
+const (
+	// POST firmato (HMAC-SHA256) verso un URL, con retry
+	ChannelWebhook NotificationChannelType = "webhook"
+	// Email via SMTP
+	ChannelEmail NotificationChannelType = "email"
+	// Messaggio NATS su pager.<tenant>.<subject>, per le integrazioni con i cercapersone
+	ChannelPager NotificationChannelType = "pager"
+)
+
+var pagerSubject = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+type NotificationChannel struct {
+	ID			uint					`json:"id" gorm:"primary_key"`
+	TenantID	uint					`json:"tenantId" gorm:"not null;index"`
+	Tenant		Tenant					`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Name		string					`json:"name" gorm:"not null"`
+	Type		NotificationChannelType	`json:"type" gorm:"not null"`
+	URL			string					`json:"url"` // webhook
+	Secret		string					`json:"-"` // chiave di firma del webhook, non viene mai restituita
+	Recipients	[]string				`json:"recipients" gorm:"serializer:json"` // email
+	Subject		string					`json:"subject"` // pager
+	Enabled		bool					`json:"enabled" gorm:"not null"`
+	CreatedAt	time.Time				`json:"createdAt"`
+	UpdatedAt	time.Time				`json:"updatedAt"`
+}
+
+/* Controlla che il canale abbia la configurazione richiesta dal suo tipo */
+func (channel *NotificationChannel) Validate() error {
+	switch channel.Type {
+	case ChannelWebhook:
+		u, err := url.Parse(channel.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q", channel.URL)
+		}
+		if len(channel.Secret) < 16 {
+			return errors.New("secret must be at least 16 characters")
+		}
+	case ChannelEmail:
+		if len(channel.Recipients) == 0 {
+			return errors.New("recipients is required")
+		}
+		for _, r := range channel.Recipients {
+			if _, err := mail.ParseAddress(r); err != nil {
+				return fmt.Errorf("invalid recipient %q", r)
+			}
+		}
+	case ChannelPager:
+		if !pagerSubject.MatchString(channel.Subject) {
+			return fmt.Errorf("invalid subject %q", channel.Subject)
+		}
+	default:
+		return fmt.Errorf("invalid type %q: use webhook, email or pager", channel.Type)
+	}
+	return nil
+}
+
+func (channel *NotificationChannel) Create() error {
+	return initializers.DB.Create(channel).Error
+}
+
+func (channel *NotificationChannel) Save() error {
+	return initializers.DB.Save(channel).Error
+}
+
+func (channel *NotificationChannel) Delete() error {
+	return initializers.DB.Delete(channel).Error
+}
+
+/* Canale del tenant, ID = 0 se non esiste */
+func GetTenantNotificationChannel(channel *NotificationChannel, tenantID uint, id uint) {
+	initializers.DB.Where("tenant_id = ? AND id = ?", tenantID, id).Find(channel)
+}
+
+func GetTenantNotificationChannels(channels *[]NotificationChannel, tenantID uint) {
+	initializers.DB.Where("tenant_id = ?", tenantID).Order("id").Find(channels)
+}
+
+func GetAllNotificationChannels(channels *[]NotificationChannel) {
+	initializers.DB.Preload("Tenant").Find(channels)
+}
+
+/*
+Regola di instradamento: gli alert del tenant con severità almeno MinSeverity (ed eventualmente
+di una metrica o di un gateway) vengono notificati sul canale.
+Con DelaySeconds > 0 la regola è un'escalation: notifica solo se dopo il ritardo l'alert è ancora
+firing, cioè nessun operatore l'ha confermato. Durante la fascia di silenzio (QuietStart-QuietEnd,
+es. 22:00-07:00) le notifiche vengono rimandate alla fine della fascia, tranne quelle degli alert
+con severità almeno QuietBypassSeverity (default critical, "none" = nessuna eccezione)
+*/
+/* QuietBypassSeverity delle regole in cui la fascia di silenzio vale anche per gli alert critical */
+const QuietBypassNone = "none"
+
+type NotificationRoute struct {
+	ID				uint				`json:"id" gorm:"primary_key"`
+	TenantID		uint				`json:"tenantId" gorm:"not null;index"`
+	Tenant			Tenant				`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	ChannelID		uint				`json:"channelId" gorm:"not null;index"`
+	Channel			NotificationChannel	`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	MinSeverity		AlertSeverity		`json:"minSeverity" gorm:"not null"`
+	Metric			string				`json:"metric"` // vuoto = tutte
+	Gateway			string				`json:"gateway"` // natsId, vuoto = tutti
+	DelaySeconds	int					`json:"delaySeconds"`
+	QuietStart		string				`json:"quietStart"` // HH:MM, vuoto = nessuna fascia di silenzio
+	QuietEnd		string				`json:"quietEnd"`
+	QuietBypassSeverity	string			`json:"quietBypassSeverity" gorm:"not null;default:critical"`
+	Timezone		string				`json:"timezone" gorm:"not null"`
+	SendResolved	bool				`json:"sendResolved"` // notifica anche la risoluzione
+	Enabled			bool				`json:"enabled" gorm:"not null"`
+	CreatedAt		time.Time			`json:"createdAt"`
+	UpdatedAt		time.Time			`json:"updatedAt"`
+}
+
+func (route *NotificationRoute) Validate() error {
+	switch route.MinSeverity {
+	case SeverityInfo, SeverityWarning, SeverityCritical:
+	default:
+		return fmt.Errorf("invalid minSeverity %q: use info, warning or critical", route.MinSeverity)
+	}
+	if route.DelaySeconds < 0 {
+		return errors.New("delaySeconds cannot be negative")
+	}
+	if _, err := time.LoadLocation(route.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone %q", route.Timezone)
+	}
+
+	switch AlertSeverity(route.QuietBypassSeverity) {
+	case SeverityInfo, SeverityWarning, SeverityCritical, QuietBypassNone:
+	default:
+		return fmt.Errorf("invalid quietBypassSeverity %q: use info, warning, critical or none", route.QuietBypassSeverity)
+	}
+
+	if route.QuietStart == "" && route.QuietEnd == "" {
+		return nil
+	}
+	start, err := time.Parse("15:04", route.QuietStart)
+	if err != nil {
+		return fmt.Errorf("invalid quietStart %q: use HH:MM", route.QuietStart)
+	}
+	end, err := time.Parse("15:04", route.QuietEnd)
+	if err != nil {
+		return fmt.Errorf("invalid quietEnd %q: use HH:MM", route.QuietEnd)
+	}
+	if start.Equal(end) {
+		return errors.New("quietStart and quietEnd must be different")
+	}
+	return nil
+}
+
+func (route *NotificationRoute) Create() error {
+	return initializers.DB.Create(route).Error
+}
+
+func (route *NotificationRoute) Save() error {
+	return initializers.DB.Save(route).Error
+}
+
+func (route *NotificationRoute) Delete() error {
+	return initializers.DB.Delete(route).Error
+}
+
+/* Regola del tenant, ID = 0 se non esiste */
+func GetTenantNotificationRoute(route *NotificationRoute, tenantID uint, id uint) {
+	initializers.DB.Where("tenant_id = ? AND id = ?", tenantID, id).Find(route)
+}
+
+func GetTenantNotificationRoutes(routes *[]NotificationRoute, tenantID uint) {
+	initializers.DB.Where("tenant_id = ?", tenantID).Order("id").Find(routes)
+}
+
+func GetAllNotificationRoutes(routes *[]NotificationRoute) {
+	initializers.DB.Preload("Tenant").Find(routes)
+}
+
+func CountChannelRoutes(channelID uint) int64 {
+	var count int64
+	initializers.DB.Model(&NotificationRoute{}).Where("channel_id = ?", channelID).Count(&count)
+	return count
+}
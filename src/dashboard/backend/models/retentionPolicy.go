@@ -0,0 +1,128 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"gin-test/initializers"
+)
+
+/*
+Conservazione dei dati di una metrica del tenant: le letture grezze, i rollup (continuous aggregate
+TimescaleDB a 1 minuto, 1 ora e 1 giorno) e dopo quanti giorni comprimere le letture grezze.
+Metric vuoto è il default del tenant. 0 giorni = per sempre (CompressAfterDays 0 = nessuna compressione).
+StreamDays è la conservazione dei messaggi nello stream sensors_<tenant>, unico per tutte le metriche:
+vale solo nel default del tenant.
+Viene applicata dal provisioning (provisioning/retention.go e provisioning/stream.go)
+*/
+type RetentionPolicy struct {
+	ID					uint		`json:"-" gorm:"primary_key"`
+	TenantID			uint		`json:"-" gorm:"not null;uniqueIndex:retention_tenant_metric"`
+	Tenant				Tenant		`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Metric				string		`json:"metric" gorm:"not null;uniqueIndex:retention_tenant_metric"`
+	RawDays				int			`json:"rawDays"`
+	Rollup1mDays		int			`json:"rollup1mDays"`
+	Rollup1hDays		int			`json:"rollup1hDays"`
+	Rollup1dDays		int			`json:"rollup1dDays"`
+	CompressAfterDays	int			`json:"compressAfterDays"`
+	StreamDays			int			`json:"streamDays" gorm:"not null;default:30"`
+	CreatedAt			time.Time	`json:"-"`
+	UpdatedAt			time.Time	`json:"-"`
+}
+
+/* Usata per i tenant e le metriche senza una politica salvata */
+var DefaultRetentionPolicy = RetentionPolicy{
+	RawDays:			30,
+	Rollup1mDays:		90,
+	Rollup1hDays:		365,
+	Rollup1dDays:		0,
+	CompressAfterDays:	7,
+	StreamDays:			30,
+}
+
+/*
+Giorni minimi di ogni livello (se non è per sempre): ogni livello deve conservare i dati
+per tutta la finestra di aggiornamento del rollup calcolato da lui (vedi provisioning/retention.go)
+*/
+const (
+	minRawDays      = 2
+	minRollup1mDays = 4
+	minRollup1hDays = 8
+)
+
+func (policy *RetentionPolicy) Validate() error {
+	levels := []struct {
+		name string
+		days int
+		min  int
+	}{
+		{"rawDays", policy.RawDays, minRawDays},
+		{"rollup1mDays", policy.Rollup1mDays, minRollup1mDays},
+		{"rollup1hDays", policy.Rollup1hDays, minRollup1hDays},
+		{"rollup1dDays", policy.Rollup1dDays, 1},
+	}
+
+	for i, level := range levels {
+		if level.days < 0 {
+			return fmt.Errorf("%s cannot be negative", level.name)
+		}
+		if level.days > 0 && level.days < level.min {
+			return fmt.Errorf("%s must be 0 (forever) or at least %d", level.name, level.min)
+		}
+		// I rollup più grossi non possono scadere prima di quelli più fini
+		if i > 0 {
+			prev := levels[i-1]
+			if prev.days == 0 && level.days > 0 || level.days > 0 && level.days < prev.days {
+				return fmt.Errorf("%s must be 0 (forever) or at least %s", level.name, prev.name)
+			}
+		}
+	}
+
+	if policy.CompressAfterDays < 0 {
+		return errors.New("compressAfterDays cannot be negative")
+	}
+	if policy.CompressAfterDays > 0 && policy.RawDays > 0 && policy.CompressAfterDays >= policy.RawDays {
+		return errors.New("compressAfterDays must be less than rawDays")
+	}
+	if policy.StreamDays < 0 {
+		return errors.New("streamDays cannot be negative")
+	}
+	return nil
+}
+
+/* Crea la politica o aggiorna quella dello stesso tenant e metrica */
+func (policy *RetentionPolicy) Save() error {
+	var existing RetentionPolicy
+	GetRetentionPolicy(&existing, policy.TenantID, policy.Metric)
+	policy.ID = existing.ID
+	policy.CreatedAt = existing.CreatedAt
+	return initializers.DB.Save(policy).Error
+}
+
+func (policy *RetentionPolicy) Delete() error {
+	return initializers.DB.Delete(policy).Error
+}
+
+/* Politica salvata per il tenant e la metrica ("" = default del tenant), ID = 0 se non esiste */
+func GetRetentionPolicy(policy *RetentionPolicy, tenantID uint, metric string) {
+	initializers.DB.Where("tenant_id = ? AND metric = ?", tenantID, metric).Find(policy)
+}
+
+func GetTenantRetentionPolicies(policies *[]RetentionPolicy, tenantID uint) {
+	initializers.DB.Where("tenant_id = ?", tenantID).Order("metric").Find(policies)
+}
+
+/* Politica applicata alla metrica: quella della metrica, altrimenti il default del tenant, altrimenti DefaultRetentionPolicy */
+func EffectiveRetentionPolicy(tenantID uint, metric string) RetentionPolicy {
+	for _, m := range []string{metric, ""} {
+		var policy RetentionPolicy
+		GetRetentionPolicy(&policy, tenantID, m)
+		if policy.ID != 0 {
+			return policy
+		}
+	}
+
+	policy := DefaultRetentionPolicy
+	policy.TenantID = tenantID
+	return policy
+}
@@ -0,0 +1,43 @@
+package models
+
+import "fmt"
+
+/* Ruolo di un utente della dashboard. I permessi di ogni ruolo sono in middlewares/permissions.go */
+type Role string
+
+const (
+	// Gestisce tutti i tenant (team operativo)
+	RolePlatformAdmin Role = "platform_admin"
+	// Gestisce utenti e dispositivi del proprio tenant
+	RoleTenantAdmin Role = "tenant_admin"
+	// Gestisce i dispositivi del proprio tenant e legge i dati
+	RoleDeviceOperator Role = "device_operator"
+	// Legge solo i dati del proprio tenant (es. personale medico)
+	RoleViewer Role = "viewer"
+	// Registrato ma non ancora approvato da un amministratore del tenant: nessun permesso
+	RolePending Role = "pending"
+)
+
+/*
+Ruolo assegnato ai nuovi utenti. La registrazione è aperta e il tenant lo sceglie l'utente,
+quindi non deve dare accesso ai dati finché un amministratore non assegna un altro ruolo
+*/
+const DefaultRole = RolePending
+
+var Roles = []Role{RolePlatformAdmin, RoleTenantAdmin, RoleDeviceOperator, RoleViewer, RolePending}
+
+type InvalidRoleError struct {
+	Role string
+}
+func (e *InvalidRoleError) Error() string {
+	return fmt.Sprintf("ruolo non valido: %q", e.Role)
+}
+
+func ParseRole(s string) (Role, error) {
+	for _, r := range Roles {
+		if string(r) == s {
+			return r, nil
+		}
+	}
+	return "", &InvalidRoleError{Role: s}
+}
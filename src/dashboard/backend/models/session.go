@@ -0,0 +1,100 @@
+package models
+
+import (
+	"time"
+	"gin-test/initializers"
+)
+
+/*
+Sessione di login di un utente. Il refresh token non viene salvato, solo il suo hash SHA-256.
+Ad ogni refresh il token cambia: quello precedente viene tenuto per riconoscerne il riuso
+(segno che il token è stato rubato), nel qual caso la sessione viene revocata.
+RotatedAt è l'istante dell'ultima rotazione, per accettare il token precedente ancora per poco (vedi auth/sessions.go)
+*/
+type Session struct {
+	ID        			uint		`json:"id" gorm:"primary_key"`
+	UserID				uint		`json:"-" gorm:"index"`
+	User				User		`json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	RefreshTokenHash	string		`json:"-" gorm:"uniqueIndex"`
+	PreviousTokenHash	string		`json:"-" gorm:"index"`
+	RotatedAt			time.Time	`json:"-"`
+	UserAgent			string		`json:"userAgent"`
+	IP					string		`json:"ip"`
+	ExpiresAt			time.Time	`json:"expiresAt"`
+	LastUsedAt			time.Time	`json:"lastUsedAt"`
+	RevokedAt			*time.Time	`json:"-"`
+	CreatedAt 			time.Time	`json:"createdAt"`
+	UpdatedAt 			time.Time	`json:"-"`
+}
+
+func (session *Session) Active() bool {
+	return session.ID != 0 && session.RevokedAt == nil && time.Now().Before(session.ExpiresAt)
+}
+
+func (session *Session) Create() error {
+	return initializers.DB.Create(session).Error
+}
+
+/*
+Sostituisce il refresh token currentHash con newHash solo se è ancora quello salvato e la sessione non è revocata,
+con un unico UPDATE condizionato: di due refresh concorrenti che leggono la stessa sessione solo uno la ruota.
+Restituisce false se la sessione è cambiata nel frattempo
+*/
+func (session *Session) Rotate(currentHash string, newHash string, userAgent string, ip string) (bool, error) {
+	now := time.Now()
+	result := initializers.DB.Model(&Session{}).
+		Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL", session.ID, currentHash).
+		Updates(map[string]any{
+			"previous_token_hash": currentHash,
+			"refresh_token_hash":  newHash,
+			"rotated_at":          now,
+			"last_used_at":        now,
+			"user_agent":          userAgent,
+			"ip":                  ip,
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+
+	session.PreviousTokenHash = currentHash
+	session.RefreshTokenHash = newHash
+	session.RotatedAt = now
+	session.LastUsedAt = now
+	session.UserAgent = userAgent
+	session.IP = ip
+	return true, nil
+}
+
+func (session *Session) Revoke() error {
+	now := time.Now()
+	session.RevokedAt = &now
+	return initializers.DB.Model(session).Update("revoked_at", now).Error
+}
+
+func GetSessionById(session *Session, id uint) {
+	initializers.DB.Where("id = ?", id).Find(session)
+}
+
+func GetSessionByRefreshHash(session *Session, hash string) {
+	initializers.DB.Where("refresh_token_hash = ?", hash).Find(session)
+}
+
+func GetSessionByPreviousHash(session *Session, hash string) {
+	initializers.DB.Where("previous_token_hash = ?", hash).Find(session)
+}
+
+/* Sessioni non revocate e non scadute dell'utente, dalla più recente */
+func GetActiveSessions(sessions *[]Session, userID uint) {
+	initializers.DB.Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now(),
+					).Order("last_used_at DESC").Find(sessions)
+}
+
+/* Revoca tutte le sessioni attive dell'utente, tranne quella indicata (0 per revocarle tutte) */
+func RevokeUserSessions(userID uint, except uint) error {
+	return initializers.DB.Model(&Session{}).
+		Where("user_id = ? AND revoked_at IS NULL AND id <> ?", userID, except).
+		Update("revoked_at", time.Now()).Error
+}
@@ -1,6 +1,15 @@
 package models
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"time"
 	"gin-test/initializers"
 )
@@ -9,6 +18,10 @@ type Tenant struct {
 	ID        	uint   `json:"id" gorm:"primary_key"`
 	NatsID		string `json:"nats_id" gorm:"unique"`
 	Name	  	string `json:"name"`
+	// Account NATS creato dal provisioning. Il seed serve a firmare i JWT degli utenti del tenant
+	// ed è cifrato con TENANT_SEED_KEY: va letto con AccountSeed e scritto con SetAccountSeed
+	NatsAccount		string `json:"nats_account"`
+	NatsAccountSeed	string `json:"-"`
 	CreatedAt 	time.Time
 	UpdatedAt 	time.Time
 }
@@ -30,7 +43,7 @@ func (tenant *Tenant) Create() (err error) {
 	tenant.CreatedAt = time.Now()
 	tenant.UpdatedAt = time.Now()
 
-	initializers.DB.Create(tenant)
+	err = initializers.DB.Create(tenant).Error
 	return
 }
 
@@ -41,6 +54,87 @@ func (tenant Tenant) GetAllUsers(users *[]User) () {
 	return
 }
 
+func GetTenantByNatsID(tenant *Tenant, natsID string) {
+	initializers.DB.Where("nats_id = ?", natsID).Find(&tenant)
+}
+
 func GetAllTenants(tenants *[]Tenant) (result any) {
 	return initializers.DB.Select("ID", "NatsID", "Name").Find(&tenants)
-}
\ No newline at end of file
+}
+
+/* Prefisso dei seed cifrati, seguito da nonce e testo cifrato AES-GCM in base64 */
+const encryptedSeedPrefix = "v1:"
+
+/* Chiave AES-256 dei seed degli account: TENANT_SEED_KEY, 64 caratteri esadecimali */
+func seedCipher() (cipher.AEAD, error) {
+	key, err := hex.DecodeString(os.Getenv("TENANT_SEED_KEY"))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("TENANT_SEED_KEY deve essere una chiave di 32 byte in esadecimale")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/* Cifra il seed dell'account NATS del tenant, l'ID del tenant è nei dati autenticati */
+func (tenant *Tenant) SetAccountSeed(seed string) error {
+	aead, err := seedCipher()
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(seed), []byte(tenant.NatsID))
+	tenant.NatsAccountSeed = encryptedSeedPrefix + base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+/* Seed dell'account NATS del tenant in chiaro, "" se il tenant non ne ha uno */
+func (tenant *Tenant) AccountSeed() (string, error) {
+	if tenant.NatsAccountSeed == "" {
+		return "", nil
+	}
+	if !strings.HasPrefix(tenant.NatsAccountSeed, encryptedSeedPrefix) {
+		return "", fmt.Errorf("seed dell'account del tenant %s non cifrato", tenant.NatsID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(tenant.NatsAccountSeed, encryptedSeedPrefix))
+	if err != nil {
+		return "", err
+	}
+	aead, err := seedCipher()
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("seed dell'account del tenant %s non valido", tenant.NatsID)
+	}
+	seed, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(tenant.NatsID))
+	if err != nil {
+		return "", fmt.Errorf("decifratura del seed dell'account del tenant %s fallita: %w", tenant.NatsID, err)
+	}
+	return string(seed), nil
+}
+
+/*
+Cifra i seed salvati in chiaro dalle versioni precedenti. Senza TENANT_SEED_KEY i seed restano
+in chiaro e non vengono usati (vedi AccountSeed)
+*/
+func EncryptAccountSeeds() error {
+	var tenants []Tenant
+	initializers.DB.Where("nats_account_seed <> '' AND nats_account_seed NOT LIKE ?", encryptedSeedPrefix+"%").Find(&tenants)
+
+	for _, tenant := range tenants {
+		if err := tenant.SetAccountSeed(tenant.NatsAccountSeed); err != nil {
+			return err
+		}
+		if err := initializers.DB.Model(&tenant).Update("nats_account_seed", tenant.NatsAccountSeed).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
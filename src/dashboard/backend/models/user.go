@@ -12,6 +12,7 @@ type User struct {
 	Tenant 		Tenant		`gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
 	Username  	string 		`json:"username" gorm:"index:unique_index,unique"`
 	Password  	string 		`json:"password"`
+	Role		Role		`json:"role" gorm:"not null;default:pending"`
 	CreatedAt 	time.Time
 	UpdatedAt 	time.Time
 }
@@ -42,10 +43,15 @@ func (user User) Create() error {
 		return err
 	}
 
+	if user.Role == "" {
+		user.Role = DefaultRole
+	}
+
 	user = User{
 		Username: user.Username,
 		Password: string(passwordHash),
 		TenantID: user.TenantID,
+		Role: user.Role,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
@@ -57,3 +63,8 @@ func (user User) Create() error {
 func GetUserById(user *User, id int)  {
 	initializers.DB.Preload("Tenant").Where("id = ?", id).Find(&user)
 }
+
+func (user *User) SetRole(role Role) error {
+	user.Role = role
+	return initializers.DB.Model(user).Update("role", role).Error
+}
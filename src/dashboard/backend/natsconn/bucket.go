@@ -0,0 +1,76 @@
+package natsconn
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+/* Connessione dedicata al watcher di un bucket KV, vedi WatchBucket */
+type BucketWatch struct {
+	nc      *nats.Conn
+	watcher nats.KeyWatcher
+}
+
+/*
+Si connette con creds (es. l'account consumers) e segue il bucket cfg.Bucket, creandolo con cfg se non esiste.
+apply riceve tutte le voci del bucket prima che WatchBucket ritorni, poi gli aggiornamenti da una goroutine,
+finché non viene chiamato Stop
+*/
+func WatchBucket(natsURL string, caCert string, creds string, cfg *nats.KeyValueConfig, apply func(nats.KeyValueEntry)) (*BucketWatch, error) {
+	nc, err := nats.Connect(natsURL,
+		nats.UserCredentials(creds),
+		nats.RootCAs(caCert),
+		nats.Timeout(10*time.Second),
+		nats.MaxReconnects(-1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("errore connessione a NATS: %w", err)
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("errore ottenimento JetStream: %w", err)
+	}
+
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(cfg)
+	}
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("errore apertura bucket %s: %w", cfg.Bucket, err)
+	}
+
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("errore watch bucket %s: %w", cfg.Bucket, err)
+	}
+
+	// Il primo nil sul canale indica che i valori iniziali sono stati ricevuti tutti
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		apply(entry)
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				apply(entry)
+			}
+		}
+	}()
+
+	return &BucketWatch{nc: nc, watcher: watcher}, nil
+}
+
+/* Ferma il watcher e chiude la connessione */
+func (b *BucketWatch) Stop() {
+	b.watcher.Stop()
+	b.nc.Close()
+}
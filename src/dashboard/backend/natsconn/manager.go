@@ -0,0 +1,259 @@
+package natsconn
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gin-test/auth"
+	"gin-test/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+type Config struct {
+	NatsURL string
+	CACert  string
+	// Ogni quanto vengono controllate le connessioni aperte
+	HealthInterval time.Duration
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		NatsURL:        os.Getenv("NATS_URL"),
+		CACert:         os.Getenv("TENANT_CA"),
+		HealthInterval: 30 * time.Second,
+	}
+}
+
+type NoTenantError struct{}
+func (e NoTenantError) Error() string { return "Tenant NATS ID mancante" }
+
+/*
+Manager tiene una connessione NATS per ogni tenant, ognuna con le credenziali dell'account del tenant,
+così ogni connessione vede solo i dati del proprio tenant.
+Le connessioni vengono aperte alla prima richiesta e riusate; quelle chiuse (es. credenziali revocate)
+vengono rimosse dal controllo periodico e riaperte alla richiesta successiva.
+La connessione viene aperta senza tenere mu, così un tenant lento o irraggiungibile non blocca gli altri;
+le richieste dello stesso tenant che arrivano nel frattempo aspettano il risultato della stessa apertura.
+*/
+type Manager struct {
+	cfg Config
+
+	mu      sync.Mutex
+	conns   map[string]*nats.Conn
+	dialing map[string]*dial
+
+	stop chan struct{}
+}
+
+/* Apertura in corso della connessione di un tenant: nc ed err sono validi dopo la chiusura di done */
+type dial struct {
+	done chan struct{}
+	nc   *nats.Conn
+	err  error
+	// Close o CloseAll chiamati durante l'apertura: la connessione va chiusa appena aperta
+	canceled bool
+}
+
+type ManagerClosedError struct{}
+func (e ManagerClosedError) Error() string { return "Connessione NATS chiusa durante l'apertura" }
+
+func New(cfg Config) *Manager {
+	m := &Manager{
+		cfg:     cfg,
+		conns:   map[string]*nats.Conn{},
+		dialing: map[string]*dial{},
+		stop:    make(chan struct{}),
+	}
+	if cfg.HealthInterval > 0 {
+		go m.healthCheck()
+	}
+	return m
+}
+
+/* Restituisce la connessione del tenant, aprendola se non esiste o è stata chiusa */
+func (m *Manager) Get(tenant models.Tenant) (*nats.Conn, error) {
+	if tenant.NatsID == "" {
+		return nil, &NoTenantError{}
+	}
+
+	m.mu.Lock()
+	if nc, ok := m.conns[tenant.NatsID]; ok {
+		if !nc.IsClosed() {
+			m.mu.Unlock()
+			return nc, nil
+		}
+		delete(m.conns, tenant.NatsID)
+	}
+	if d, ok := m.dialing[tenant.NatsID]; ok {
+		m.mu.Unlock()
+		<-d.done
+		return d.nc, d.err
+	}
+	d := &dial{done: make(chan struct{})}
+	m.dialing[tenant.NatsID] = d
+	m.mu.Unlock()
+
+	nc, err := m.connect(tenant)
+
+	m.mu.Lock()
+	delete(m.dialing, tenant.NatsID)
+	if err == nil && d.canceled {
+		nc.Close()
+		nc, err = nil, &ManagerClosedError{}
+	}
+	if err == nil {
+		m.conns[tenant.NatsID] = nc
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		d.err = fmt.Errorf("connessione NATS del tenant %s fallita: %w", tenant.NatsID, err)
+	} else {
+		d.nc = nc
+		log.Printf("Connessione NATS del tenant %s aperta", tenant.NatsID)
+	}
+	close(d.done)
+	return d.nc, d.err
+}
+
+/*
+Credenziali del tenant: il file <NATS_ID>_CREDS se c'è (es. TENANT_1_CREDS),
+altrimenti un utente generato con la chiave dell'account salvata dal provisioning
+*/
+func (m *Manager) credentials(tenant models.Tenant) (nats.Option, error) {
+	if creds := os.Getenv(strings.ToUpper(tenant.NatsID) + "_CREDS"); creds != "" {
+		return nats.UserCredentials(creds), nil
+	}
+
+	userJWT, seed, err := auth.IssueNatsServiceUser(tenant)
+	if err != nil {
+		return nil, err
+	}
+	return nats.UserJWTAndSeed(userJWT, string(seed)), nil
+}
+
+func (m *Manager) connect(tenant models.Tenant) (*nats.Conn, error) {
+	creds, err := m.credentials(tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	natsID := tenant.NatsID
+	return nats.Connect(m.cfg.NatsURL,
+		creds,
+		nats.RootCAs(m.cfg.CACert),
+		nats.Name("dashboard-backend-"+natsID),
+		nats.Timeout(10*time.Second),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("Connessione NATS del tenant %s persa: %v", natsID, err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Printf("Connessione NATS del tenant %s ristabilita", natsID)
+		}),
+	)
+}
+
+/* Chiude la connessione del tenant, ad esempio quando il tenant viene eliminato */
+func (m *Manager) Close(natsID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if nc, ok := m.conns[natsID]; ok {
+		nc.Close()
+		delete(m.conns, natsID)
+	}
+	if d, ok := m.dialing[natsID]; ok {
+		d.canceled = true
+	}
+}
+
+/* Chiude tutte le connessioni e ferma il controllo periodico */
+func (m *Manager) CloseAll() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.stop:
+	default:
+		close(m.stop)
+	}
+
+	for natsID, nc := range m.conns {
+		// Drain consegna i messaggi già ricevuti prima di chiudere
+		if err := nc.Drain(); err != nil && !errors.Is(err, nats.ErrConnectionClosed) {
+			nc.Close()
+		}
+		delete(m.conns, natsID)
+	}
+	for _, d := range m.dialing {
+		d.canceled = true
+	}
+}
+
+/* Stato delle connessioni aperte, per diagnostica */
+func (m *Manager) Status() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := map[string]string{}
+	for natsID, nc := range m.conns {
+		status[natsID] = nc.Status().String()
+	}
+	return status
+}
+
+func (m *Manager) healthCheck() {
+	ticker := time.NewTicker(m.cfg.HealthInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.checkConnections()
+		}
+	}
+}
+
+/*
+Rimuove le connessioni chiuse e verifica con un ping quelle connesse.
+Quelle in riconnessione vengono lasciate al client NATS, che riprova da solo
+*/
+func (m *Manager) checkConnections() {
+	m.mu.Lock()
+	conns := make(map[string]*nats.Conn, len(m.conns))
+	for natsID, nc := range m.conns {
+		conns[natsID] = nc
+	}
+	m.mu.Unlock()
+
+	for natsID, nc := range conns {
+		switch {
+		case nc.IsClosed():
+			log.Printf("Connessione NATS del tenant %s chiusa, verrà riaperta alla prossima richiesta", natsID)
+			m.remove(natsID, nc)
+		case nc.IsConnected():
+			if err := nc.FlushTimeout(5 * time.Second); err != nil {
+				log.Printf("Connessione NATS del tenant %s non risponde: %v", natsID, err)
+			}
+		}
+	}
+}
+
+/* Rimuove la connessione solo se nel frattempo non è stata sostituita da Get */
+func (m *Manager) remove(natsID string, nc *nats.Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.conns[natsID] == nc {
+		delete(m.conns, natsID)
+	}
+}
@@ -0,0 +1,180 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gin-test/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV (account consumers) con le regole di alerting, letto dal servizio di alerting.
+// La chiave è <tenant>.<id regola>
+const alertRulesBucket = "alert_rules"
+
+var alertRulesBucketConfig = &nats.KeyValueConfig{
+	Bucket:      alertRulesBucket,
+	Description: "Regole di alerting dei tenant",
+	History:     5,
+}
+
+// Voce del bucket alert_rules (vedi alerting/rules.go)
+type alertRuleEntry struct {
+	ID            uint    `json:"id"`
+	Tenant        string  `json:"tenant"`
+	Name          string  `json:"name"`
+	Type          string  `json:"type"`
+	Metric        string  `json:"metric"`
+	Field         string  `json:"field"`
+	Gateway       string  `json:"gateway"`
+	Operator      string  `json:"operator"`
+	Threshold     float64 `json:"threshold"`
+	Hysteresis    float64 `json:"hysteresis"`
+	ForSeconds    int     `json:"for_seconds"`
+	WindowSeconds int     `json:"window_seconds"`
+	Severity      string  `json:"severity"`
+	Enabled       bool    `json:"enabled"`
+}
+
+func alertRuleKey(tenantID string, ruleID uint) string {
+	return fmt.Sprintf("%s.%d", tenantID, ruleID)
+}
+
+func alertRuleData(tenantID string, rule *models.AlertRule) ([]byte, error) {
+	return json.Marshal(alertRuleEntry{
+		ID:            rule.ID,
+		Tenant:        tenantID,
+		Name:          rule.Name,
+		Type:          string(rule.Type),
+		Metric:        rule.Metric,
+		Field:         rule.Field,
+		Gateway:       rule.Gateway,
+		Operator:      rule.Operator,
+		Threshold:     rule.Threshold,
+		Hysteresis:    rule.Hysteresis,
+		ForSeconds:    rule.ForSeconds,
+		WindowSeconds: rule.WindowSeconds,
+		Severity:      string(rule.Severity),
+		Enabled:       rule.Enabled,
+	})
+}
+
+// PublishAlertRule pubblica la regola (o la sua nuova versione) nel bucket alert_rules
+func (s *Service) PublishAlertRule(tenantID string, rule *models.AlertRule) error {
+	data, err := alertRuleData(tenantID, rule)
+	if err != nil {
+		return err
+	}
+
+	return s.withBucket(alertRulesBucket, alertRulesBucketConfig, func(kv nats.KeyValue) error {
+		_, err := kv.Put(alertRuleKey(tenantID, rule.ID), data)
+		return err
+	})
+}
+
+func (s *Service) DeleteAlertRule(tenantID string, ruleID uint) error {
+	return s.withBucket(alertRulesBucket, alertRulesBucketConfig, func(kv nats.KeyValue) error {
+		return kv.Delete(alertRuleKey(tenantID, ruleID))
+	})
+}
+
+// SyncAlertRules allinea il bucket alle regole salvate nel DB
+func (s *Service) SyncAlertRules() error {
+	var rules []models.AlertRule
+	models.GetAllAlertRules(&rules)
+
+	return s.withBucket(alertRulesBucket, alertRulesBucketConfig, func(kv nats.KeyValue) error {
+		saved := map[string]bool{}
+		for _, rule := range rules {
+			key := alertRuleKey(rule.Tenant.NatsID, rule.ID)
+			saved[key] = true
+
+			data, err := alertRuleData(rule.Tenant.NatsID, &rule)
+			if err != nil {
+				return err
+			}
+			if _, err := kv.Put(key, data); err != nil {
+				return err
+			}
+		}
+
+		keys, err := kv.Keys()
+		if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+			return err
+		}
+		for _, key := range keys {
+			if !saved[key] {
+				if err := kv.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Evento pubblicato su alerts.<tenant>.<gateway>.<regola> (vedi alerting/store.go)
+type alertEvent struct {
+	ID             int64      `json:"id"`
+	Tenant         string     `json:"tenant"`
+	RuleID         uint       `json:"rule_id"`
+	RuleName       string     `json:"rule_name"`
+	GatewayID      string     `json:"gateway_id"`
+	Metric         string     `json:"metric"`
+	Severity       string     `json:"severity"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message"`
+	Value          float64    `json:"value"`
+	Threshold      float64    `json:"threshold"`
+	FiredAt        time.Time  `json:"fired_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *string    `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+// PublishAlertEvent pubblica il cambio di stato dell'alert (es. la conferma di un operatore)
+// nello stream ALERTS, come fa il servizio di alerting per firing e resolved
+func (s *Service) PublishAlertEvent(tenantID string, alert *models.Alert) error {
+	event := alertEvent{
+		ID:             alert.ID,
+		Tenant:         tenantID,
+		RuleID:         alert.RuleID,
+		RuleName:       alert.RuleName,
+		GatewayID:      alert.GatewayID,
+		Metric:         alert.Metric,
+		Severity:       alert.Severity,
+		Status:         alert.Status,
+		Message:        alert.Message,
+		Value:          alert.Value,
+		Threshold:      alert.Threshold,
+		FiredAt:        alert.FiredAt,
+		AcknowledgedAt: alert.AcknowledgedAt,
+		AcknowledgedBy: alert.AcknowledgedBy,
+		ResolvedAt:     alert.ResolvedAt,
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	nc, err := s.connect(s.cfg.ConsumersCreds)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("errore ottenimento JetStream: %w", err)
+	}
+
+	subject := fmt.Sprintf("alerts.%s.%s.%d", tenantID, alert.GatewayID, alert.RuleID)
+	msgID := fmt.Sprintf("%s.%d.%s", tenantID, alert.ID, alert.Status)
+	if _, err := js.Publish(subject, data, nats.MsgId(msgID)); err != nil {
+		return fmt.Errorf("errore pubblicazione su %s: %w", subject, err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package provisioning
+
+import (
+	"fmt"
+	"strings"
+
+	"gin-test/initializers"
+	"gin-test/models"
+
+	"gorm.io/gorm"
+)
+
+// Stesse tabelle e permessi di database/schema/tables.sql. {{tenant}} viene sostituito con l'ID del tenant
+var createTenantSQL = []string{
+	`CREATE SCHEMA {{tenant}}`,
+
+	`CREATE TABLE {{tenant}}.heart_rate (
+		time        TIMESTAMPTZ       NOT NULL,
+		gateway_id  VARCHAR           NOT NULL,
+		msg_id      VARCHAR           NOT NULL,
+		bpm         INTEGER           NOT NULL CHECK (bpm > 0),
+		UNIQUE (msg_id, time)
+	)`,
+	`CREATE TABLE {{tenant}}.blood_oxygen (
+		time        TIMESTAMPTZ       NOT NULL,
+		gateway_id  VARCHAR           NOT NULL,
+		msg_id      VARCHAR           NOT NULL,
+		spo2        NUMERIC(5,2)      NOT NULL CHECK (spo2 >= 0 AND spo2 <= 100),
+		UNIQUE (msg_id, time)
+	)`,
+	`SELECT create_hypertable('{{tenant}}.heart_rate', 'time')`,
+	`SELECT create_hypertable('{{tenant}}.blood_oxygen', 'time')`,
+	`CREATE TABLE {{tenant}}.alerts (
+		id              BIGSERIAL         PRIMARY KEY,
+		rule_id         BIGINT            NOT NULL,
+		rule_name       VARCHAR           NOT NULL,
+		gateway_id      VARCHAR           NOT NULL,
+		metric          VARCHAR           NOT NULL,
+		severity        VARCHAR           NOT NULL,
+		status          VARCHAR           NOT NULL CHECK (status IN ('firing', 'acknowledged', 'resolved')),
+		message         VARCHAR           NOT NULL,
+		value           DOUBLE PRECISION  NOT NULL,
+		threshold       DOUBLE PRECISION  NOT NULL,
+		fired_at        TIMESTAMPTZ       NOT NULL,
+		acknowledged_at TIMESTAMPTZ,
+		acknowledged_by VARCHAR,
+		resolved_at     TIMESTAMPTZ
+	)`,
+	`CREATE UNIQUE INDEX alerts_open_idx ON {{tenant}}.alerts (rule_id, gateway_id) WHERE status <> 'resolved'`,
+
+	// La password viene impostata da setTenantPasswordSQL
+	`CREATE USER {{tenant}}_user`,
+	`GRANT USAGE ON SCHEMA {{tenant}} TO {{tenant}}_user`,
+	`GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA {{tenant}} TO {{tenant}}_user`,
+	`GRANT USAGE ON ALL SEQUENCES IN SCHEMA {{tenant}} TO {{tenant}}_user`,
+	`ALTER DEFAULT PRIVILEGES IN SCHEMA {{tenant}} GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO {{tenant}}_user`,
+	`ALTER ROLE {{tenant}}_user SET search_path TO {{tenant}}, public`,
+}
+
+// Password di <tenant>_user (initializers.TenantDBPassword), esadecimale quindi si può inserire nello statement
+const setTenantPasswordSQL = `ALTER ROLE {{tenant}}_user WITH PASSWORD '%s'`
+
+var dropTenantSQL = []string{
+	`DROP SCHEMA IF EXISTS {{tenant}} CASCADE`,
+	// Rimuove i privilegi di default, altrimenti il ruolo non può essere eliminato
+	`DROP OWNED BY {{tenant}}_user`,
+	`DROP USER {{tenant}}_user`,
+}
+
+// createDatabase crea schema, tabelle e utente del tenant in un'unica transazione
+func (s *Service) createDatabase(tenantID string) error {
+	password, err := initializers.TenantDBPassword(tenantID)
+	if err != nil {
+		return err
+	}
+
+	statements := append([]string{}, createTenantSQL...)
+	statements = append(statements, fmt.Sprintf(setTenantPasswordSQL, password))
+	return s.execAll(statements, tenantID)
+}
+
+func (s *Service) dropDatabase(tenantID string) error {
+	return s.execAll(dropTenantSQL, tenantID)
+}
+
+// SyncTenantDBPasswords imposta la password di <tenant>_user di tutti i tenant, ad esempio per quelli
+// creati da database/schema/tables.sql (senza password) o dopo aver cambiato TENANT_DB_SECRET
+func (s *Service) SyncTenantDBPasswords() error {
+	var tenants []models.Tenant
+	models.GetAllTenants(&tenants)
+
+	for _, tenant := range tenants {
+		if !validTenantID.MatchString(tenant.NatsID) {
+			return &InvalidTenantID{NatsID: tenant.NatsID}
+		}
+		password, err := initializers.TenantDBPassword(tenant.NatsID)
+		if err != nil {
+			return err
+		}
+		if err := s.execAll([]string{fmt.Sprintf(setTenantPasswordSQL, password)}, tenant.NatsID); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.NatsID, err)
+		}
+	}
+	return nil
+}
+
+// execAll esegue gli statement in una transazione. tenantID è già stato validato, quindi si può
+// inserire direttamente negli statement (gli identificatori non si possono passare come parametri)
+func (s *Service) execAll(statements []string, tenantID string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for _, stmt := range statements {
+			if err := tx.Exec(strings.ReplaceAll(stmt, "{{tenant}}", tenantID)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,94 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+
+	"gin-test/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV (account consumers) con i gateway registrati, letto dal subscriber per scartare
+// o mettere in quarantena le letture dei gateway sconosciuti. La chiave è <tenant>.<gateway>
+const gatewaysBucket = "gateways"
+
+var gatewaysBucketConfig = &nats.KeyValueConfig{
+	Bucket:      gatewaysBucket,
+	Description: "Gateway registrati dalla dashboard",
+	History:     5,
+}
+
+// Voce del bucket gateways (vedi subscriber/gateways.go)
+type gatewayEntry struct {
+	Tenant    string              `json:"tenant"`
+	GatewayID string              `json:"gateway_id"`
+	Status    models.DeviceStatus `json:"status"`
+}
+
+func gatewayKey(tenantID string, gatewayID string) string {
+	return tenantID + "." + gatewayID
+}
+
+// RegisterGateway pubblica il gateway (o il suo nuovo stato) nel bucket gateways
+func (s *Service) RegisterGateway(tenantID string, gateway *models.Gateway) error {
+	data, err := json.Marshal(gatewayEntry{
+		Tenant:    tenantID,
+		GatewayID: gateway.NatsID,
+		Status:    gateway.Status,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.withBucket(gatewaysBucket, gatewaysBucketConfig, func(kv nats.KeyValue) error {
+		_, err := kv.Put(gatewayKey(tenantID, gateway.NatsID), data)
+		return err
+	})
+}
+
+func (s *Service) UnregisterGateway(tenantID string, gatewayID string) error {
+	return s.withBucket(gatewaysBucket, gatewaysBucketConfig, func(kv nats.KeyValue) error {
+		return kv.Delete(gatewayKey(tenantID, gatewayID))
+	})
+}
+
+// SyncGateways allinea il bucket ai gateway salvati nel DB, ad esempio se è stato cancellato
+// o se un aggiornamento non è andato a buon fine
+func (s *Service) SyncGateways() error {
+	var gateways []models.Gateway
+	models.GetAllGateways(&gateways)
+
+	return s.withBucket(gatewaysBucket, gatewaysBucketConfig, func(kv nats.KeyValue) error {
+		registered := map[string]bool{}
+		for _, gateway := range gateways {
+			key := gatewayKey(gateway.Tenant.NatsID, gateway.NatsID)
+			registered[key] = true
+
+			data, err := json.Marshal(gatewayEntry{
+				Tenant:    gateway.Tenant.NatsID,
+				GatewayID: gateway.NatsID,
+				Status:    gateway.Status,
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := kv.Put(key, data); err != nil {
+				return err
+			}
+		}
+
+		keys, err := kv.Keys()
+		if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+			return err
+		}
+		for _, key := range keys {
+			if !registered[key] {
+				if err := kv.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
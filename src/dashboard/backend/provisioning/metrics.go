@@ -0,0 +1,217 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"gin-test/models"
+	"gin-test/natsconn"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV del registro degli schemi delle metriche (account consumers), letto dal subscriber
+// per validare e salvare le letture. La chiave è il nome della metrica
+const schemasBucket = "sensor_schemas"
+
+// Stessa configurazione del subscriber (subscriber/schema/registry.go), che registra gli schemi di default
+var schemasBucketConfig = &nats.KeyValueConfig{
+	Bucket:      schemasBucket,
+	Description: "Schemi delle metriche dei sensori",
+	History:     5,
+}
+
+// Tipi delle colonne per i tipi dei campi dello schema
+var metricColumnTypes = map[string]string{
+	"int":     "BIGINT",
+	"float":   "DOUBLE PRECISION",
+	"string":  "VARCHAR",
+	"bool":    "BOOLEAN",
+	"float[]": "DOUBLE PRECISION[]",
+}
+
+// Nomi di tabelle e colonne: vengono inseriti direttamente negli statement
+var validIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// metricSchema è la parte dello schema di una metrica (vedi subscriber/schema/schema.go) che serve
+// a creare la tabella delle letture
+type metricSchema struct {
+	Metric string `json:"metric"`
+	Table  string `json:"table"`
+	Fields []struct {
+		Name     string `json:"name"`
+		Type     string `json:"type"`
+		Column   string `json:"column"`
+		Optional bool   `json:"optional"`
+	} `json:"fields"`
+}
+
+func parseMetricSchema(data []byte) (*metricSchema, error) {
+	var schema metricSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+	if schema.Table == "" {
+		schema.Table = schema.Metric
+	}
+	if !validIdentifier.MatchString(schema.Table) {
+		return nil, fmt.Errorf("nome tabella %q non valido", schema.Table)
+	}
+	if len(schema.Fields) == 0 {
+		return nil, errors.New("nessun campo definito")
+	}
+
+	for i := range schema.Fields {
+		f := &schema.Fields[i]
+		if f.Column == "" {
+			f.Column = strings.ToLower(f.Name)
+		}
+		if !validIdentifier.MatchString(f.Column) {
+			return nil, fmt.Errorf("nome colonna %q non valido", f.Column)
+		}
+		if _, ok := metricColumnTypes[f.Type]; !ok {
+			return nil, fmt.Errorf("campo %s: tipo %q non supportato", f.Name, f.Type)
+		}
+	}
+	return &schema, nil
+}
+
+// createMetricTable crea la hypertable della metrica nello schema del tenant, con le colonne
+// time, gateway_id e msg_id più una per ogni campo. Se la tabella esiste già aggiunge le colonne
+// mancanti, sempre nullable perché la tabella può contenere letture. Non cambia il tipo delle colonne
+// esistenti. Restituisce true se ha creato la tabella
+func (s *Service) createMetricTable(tenantID string, schema *metricSchema) (bool, error) {
+	table := tenantID + "." + schema.Table
+
+	var exists bool
+	if err := s.db.Raw(`SELECT to_regclass(?) IS NOT NULL`, table).Scan(&exists).Error; err != nil {
+		return false, err
+	}
+
+	if !exists {
+		columns := []string{
+			"time TIMESTAMPTZ NOT NULL",
+			"gateway_id VARCHAR NOT NULL",
+			"msg_id VARCHAR NOT NULL",
+		}
+		for _, f := range schema.Fields {
+			column := f.Column + " " + metricColumnTypes[f.Type]
+			if !f.Optional {
+				column += " NOT NULL"
+			}
+			columns = append(columns, column)
+		}
+		// UNIQUE (msg_id, time) rende idempotenti le insert del subscriber
+		columns = append(columns, "UNIQUE (msg_id, time)")
+
+		statements := []string{
+			fmt.Sprintf(`CREATE TABLE %s (%s)`, table, strings.Join(columns, ", ")),
+			fmt.Sprintf(`SELECT create_hypertable('%s', 'time')`, table),
+			fmt.Sprintf(`GRANT SELECT, INSERT, UPDATE, DELETE ON %s TO %s_user`, table, tenantID),
+		}
+		if err := s.execAll(statements, tenantID); err != nil {
+			return false, fmt.Errorf("tabella %s: %w", table, err)
+		}
+		log.Printf("Tabella %s creata dallo schema della metrica %s", table, schema.Metric)
+		return true, nil
+	}
+
+	var existing []string
+	err := s.db.Raw(
+		`SELECT column_name FROM information_schema.columns WHERE table_schema = ? AND table_name = ?`,
+		tenantID, schema.Table,
+	).Scan(&existing).Error
+	if err != nil {
+		return false, err
+	}
+	have := map[string]bool{}
+	for _, c := range existing {
+		have[c] = true
+	}
+
+	var statements []string
+	for _, f := range schema.Fields {
+		if !have[f.Column] {
+			statements = append(statements, fmt.Sprintf(`ALTER TABLE %s ADD COLUMN %s %s`, table, f.Column, metricColumnTypes[f.Type]))
+		}
+	}
+	if len(statements) == 0 {
+		return false, nil
+	}
+	if err := s.execAll(statements, tenantID); err != nil {
+		return false, fmt.Errorf("tabella %s: %w", table, err)
+	}
+	log.Printf("Tabella %s aggiornata dallo schema della metrica %s", table, schema.Metric)
+	return false, nil
+}
+
+// createMetricTables crea le tabelle di tutte le metriche registrate nello schema del nuovo tenant.
+// Va chiamata con s.mu, che protegge s.schemas
+func (s *Service) createMetricTables(tenantID string) error {
+	for _, schema := range s.schemas {
+		if _, err := s.createMetricTable(tenantID, schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchMetricSchemas segue il registro degli schemi: quando una metrica viene registrata o modificata
+// crea o aggiorna la sua tabella (e i rollup) nello schema di ogni tenant, così una nuova metrica
+// richiede solo una voce nel bucket. Gli schemi eliminati non cancellano le tabelle.
+// Restituisce la funzione che ferma il watcher
+func (s *Service) WatchMetricSchemas() (func(), error) {
+	watch, err := natsconn.WatchBucket(s.cfg.NatsURL, s.cfg.CACert, s.cfg.ConsumersCreds, schemasBucketConfig, s.applyMetricSchema)
+	if err != nil {
+		return nil, err
+	}
+	return watch.Stop, nil
+}
+
+func (s *Service) applyMetricSchema(entry nats.KeyValueEntry) {
+	if entry.Operation() != nats.KeyValuePut {
+		s.mu.Lock()
+		delete(s.schemas, entry.Key())
+		s.mu.Unlock()
+		log.Printf("Schema %s rimosso dal registro: le tabelle dei tenant restano", entry.Key())
+		return
+	}
+
+	schema, err := parseMetricSchema(entry.Value())
+	if err != nil {
+		log.Printf("Schema %s ignorato: %v", entry.Key(), err)
+		return
+	}
+
+	// Sotto s.mu un provisioning in corso vede lo schema, oppure il suo tenant è già nel DB
+	s.mu.Lock()
+	s.schemas[entry.Key()] = schema
+	var tenants []models.Tenant
+	models.GetAllTenants(&tenants)
+	var newTables []models.Tenant
+	for _, tenant := range tenants {
+		if !validTenantID.MatchString(tenant.NatsID) {
+			continue
+		}
+		created, err := s.createMetricTable(tenant.NatsID, schema)
+		if err != nil {
+			log.Printf("Errore creazione tabella della metrica %s del tenant %s: %v", schema.Metric, tenant.NatsID, err)
+			continue
+		}
+		if created {
+			newTables = append(newTables, tenant)
+		}
+	}
+	s.mu.Unlock()
+
+	// Rollup e retention delle tabelle nuove. I rollup esistenti non includono le colonne aggiunte
+	for _, tenant := range newTables {
+		if err := s.ApplyRetention(&tenant, schema.Table); err != nil {
+			log.Printf("Errore conservazione dei dati della metrica %s del tenant %s: %v", schema.Metric, tenant.NatsID, err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/jwt/v2"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	// Bucket KV (account consumers) con i tenant da cui il subscriber prende i dati
+	tenantsBucket = "tenants"
+
+	claimsUpdateSubject = "$SYS.REQ.CLAIMS.UPDATE"
+	claimsDeleteSubject = "$SYS.REQ.CLAIMS.DELETE"
+	claimsLookupSubject = "$SYS.REQ.ACCOUNT.%s.CLAIMS.LOOKUP"
+
+	requestTimeout = 5 * time.Second
+)
+
+type account struct {
+	publicKey string
+	seed      string
+	keys      nkeys.KeyPair
+}
+
+func newAccount() (*account, error) {
+	kp, err := nkeys.CreateAccount()
+	if err != nil {
+		return nil, fmt.Errorf("errore creazione chiavi account: %w", err)
+	}
+	publicKey, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	seed, err := kp.Seed()
+	if err != nil {
+		return nil, err
+	}
+
+	return &account{publicKey: publicKey, seed: string(seed), keys: kp}, nil
+}
+
+func sensorsSubject(tenantID string) string {
+	return "sensors." + tenantID + ".>"
+}
+
+// Stream del tenant con le letture dei gateway
+func sensorsStream(tenantID string) string {
+	return "sensors_" + tenantID
+}
+
+// Prefisso con cui l'account consumers vede l'API JetStream del tenant
+func apiPrefix(tenantID string) string {
+	return tenantID + ".$JS.API"
+}
+
+// createAccount firma con la chiave dell'operatore il JWT del nuovo account e lo pubblica sul resolver.
+// Export e limiti sono gli stessi degli account tenant_1 e tenant_2 creati con nsc
+func (s *Service) createAccount(tenantID string, acc *account) error {
+	claims := jwt.NewAccountClaims(acc.publicKey)
+	claims.Name = tenantID
+	claims.Exports.Add(
+		&jwt.Export{
+			Name:         "JSAPI_" + tenantID,
+			Subject:      "$JS.API.>",
+			Type:         jwt.Service,
+			ResponseType: jwt.ResponseTypeSingleton,
+		},
+		&jwt.Export{
+			Name:     "Export_" + tenantID,
+			Subject:  jwt.Subject(sensorsSubject(tenantID)),
+			Type:     jwt.Stream,
+			TokenReq: true,
+		},
+	)
+	claims.Limits.JetStreamLimits = jwt.JetStreamLimits{
+		MemoryStorage:        1_000_000_000,
+		DiskStorage:          5_000_000_000,
+		Streams:              10,
+		Consumer:             jwt.NoLimit,
+		MaxAckPending:        jwt.NoLimit,
+		MemoryMaxStreamBytes: jwt.NoLimit,
+		DiskMaxStreamBytes:   jwt.NoLimit,
+	}
+
+	token, err := s.signAccount(claims)
+	if err != nil {
+		return err
+	}
+
+	return s.pushClaims(claimsUpdateSubject, token)
+}
+
+// deleteAccount elimina l'account dal resolver (richiede allow_delete nella configurazione del server)
+func (s *Service) deleteAccount(acc *account) error {
+	operator, err := nkeys.FromSeed([]byte(s.cfg.OperatorSeed))
+	if err != nil {
+		return fmt.Errorf("seed operatore non valido: %w", err)
+	}
+	operatorKey, err := operator.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	claims := jwt.NewGenericClaims(operatorKey)
+	claims.Data["accounts"] = []string{acc.publicKey}
+	token, err := claims.Encode(operator)
+	if err != nil {
+		return fmt.Errorf("errore firma richiesta di eliminazione: %w", err)
+	}
+
+	return s.pushClaims(claimsDeleteSubject, token)
+}
+
+// importTenant aggiunge all'account consumers gli import dell'API JetStream e dello stream del tenant.
+// Restituisce il JWT precedente dell'account consumers, per il rollback
+func (s *Service) importTenant(tenantID string, acc *account) (string, error) {
+	previous, err := s.lookupAccount(s.cfg.ConsumersAccount)
+	if err != nil {
+		return "", err
+	}
+
+	claims, err := jwt.DecodeAccountClaims(previous)
+	if err != nil {
+		return "", fmt.Errorf("JWT account consumers non valido: %w", err)
+	}
+
+	// L'export dei dati richiede un activation token firmato dall'account del tenant
+	subject := sensorsSubject(tenantID)
+	activation := jwt.NewActivationClaims(s.cfg.ConsumersAccount)
+	activation.Name = subject
+	activation.ImportSubject = jwt.Subject(subject)
+	activation.ImportType = jwt.Stream
+	activationToken, err := activation.Encode(acc.keys)
+	if err != nil {
+		return "", fmt.Errorf("errore firma activation token: %w", err)
+	}
+
+	claims.Imports.Add(
+		&jwt.Import{
+			Name:         "$JS.API.>",
+			Subject:      "$JS.API.>",
+			Account:      acc.publicKey,
+			LocalSubject: jwt.RenamingSubject(apiPrefix(tenantID) + ".>"),
+			Type:         jwt.Service,
+		},
+		&jwt.Import{
+			Name:    subject,
+			Subject: jwt.Subject(subject),
+			Account: acc.publicKey,
+			Token:   activationToken,
+			Type:    jwt.Stream,
+		},
+	)
+
+	token, err := s.signAccount(claims)
+	if err != nil {
+		return "", err
+	}
+
+	if err := s.pushClaims(claimsUpdateSubject, token); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+// restoreConsumers ripubblica il JWT precedente dell'account consumers. Va firmato di nuovo:
+// il resolver scarta i JWT emessi prima di quello che ha già salvato
+func (s *Service) restoreConsumers(previous string) error {
+	claims, err := jwt.DecodeAccountClaims(previous)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.signAccount(claims)
+	if err != nil {
+		return err
+	}
+
+	return s.pushClaims(claimsUpdateSubject, token)
+}
+
+func (s *Service) signAccount(claims *jwt.AccountClaims) (string, error) {
+	operator, err := nkeys.FromSeed([]byte(s.cfg.OperatorSeed))
+	if err != nil {
+		return "", fmt.Errorf("seed operatore non valido: %w", err)
+	}
+
+	token, err := claims.Encode(operator)
+	if err != nil {
+		return "", fmt.Errorf("errore firma JWT account %s: %w", claims.Name, err)
+	}
+	return token, nil
+}
+
+// Risposta del server alle richieste $SYS.REQ.CLAIMS.*
+type claimsResponse struct {
+	Error *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error,omitempty"`
+}
+
+// pushClaims invia un JWT al resolver tramite l'account di sistema
+func (s *Service) pushClaims(subject string, token string) error {
+	nc, err := s.connect(s.cfg.SystemCreds)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(subject, []byte(token), requestTimeout)
+	if err != nil {
+		return fmt.Errorf("errore richiesta %s: %w", subject, err)
+	}
+
+	var resp claimsResponse
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return fmt.Errorf("risposta non valida a %s: %w", subject, err)
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s rifiutata (%d): %s", subject, resp.Error.Code, resp.Error.Description)
+	}
+	return nil
+}
+
+func (s *Service) lookupAccount(publicKey string) (string, error) {
+	nc, err := s.connect(s.cfg.SystemCreds)
+	if err != nil {
+		return "", err
+	}
+	defer nc.Close()
+
+	msg, err := nc.Request(fmt.Sprintf(claimsLookupSubject, publicKey), nil, requestTimeout)
+	if err != nil {
+		return "", fmt.Errorf("errore lettura JWT account %s: %w", publicKey, err)
+	}
+	if len(msg.Data) == 0 {
+		return "", fmt.Errorf("account %s non trovato sul resolver", publicKey)
+	}
+	return string(msg.Data), nil
+}
+
+// Voce del bucket tenants letto dal subscriber (vedi subscriber/tenants.go)
+type tenantSource struct {
+	NatsID    string `json:"nats_id"`
+	Stream    string `json:"stream"`
+	APIPrefix string `json:"api_prefix"`
+}
+
+// addSource registra il tenant nel bucket tenants: il subscriber aggiunge la sorgente sensors_<tenant>
+// a CONSUMING_SENSORS appena riceve la nuova chiave
+func (s *Service) addSource(tenantID string) error {
+	data, err := json.Marshal(tenantSource{
+		NatsID:    tenantID,
+		Stream:    sensorsStream(tenantID),
+		APIPrefix: apiPrefix(tenantID),
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.withTenantsBucket(func(kv nats.KeyValue) error {
+		_, err := kv.Put(tenantID, data)
+		return err
+	})
+}
+
+func (s *Service) removeSource(tenantID string) error {
+	return s.withTenantsBucket(func(kv nats.KeyValue) error {
+		return kv.Delete(tenantID)
+	})
+}
+
+func (s *Service) withTenantsBucket(fn func(kv nats.KeyValue) error) error {
+	return s.withBucket(tenantsBucket, nil, fn)
+}
+
+// withBucket apre il bucket nell'account consumers. Se non esiste viene creato con create,
+// oppure, con create nil, restituisce un errore
+func (s *Service) withBucket(bucket string, create *nats.KeyValueConfig, fn func(kv nats.KeyValue) error) error {
+	nc, err := s.connect(s.cfg.ConsumersCreds)
+	if err != nil {
+		return err
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("errore ottenimento JetStream: %w", err)
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		if create == nil {
+			return fmt.Errorf("bucket %s non trovato: il subscriber è stato avviato?", bucket)
+		}
+		kv, err = js.CreateKeyValue(create)
+	}
+	if err != nil {
+		return fmt.Errorf("errore apertura bucket %s: %w", bucket, err)
+	}
+
+	if err := fn(kv); err != nil {
+		return fmt.Errorf("errore aggiornamento bucket %s: %w", bucket, err)
+	}
+	return nil
+}
+
+func (s *Service) connect(creds string) (*nats.Conn, error) {
+	nc, err := nats.Connect(s.cfg.NatsURL,
+		nats.UserCredentials(creds),
+		nats.RootCAs(s.cfg.CACert),
+		nats.Timeout(10*time.Second),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("errore connessione a NATS: %w", err)
+	}
+	return nc, nil
+}
@@ -0,0 +1,175 @@
+package provisioning
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"gin-test/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV (account consumers) con canali e regole di instradamento delle notifiche, letto
+// dal notifier. Le chiavi sono <tenant>.channel.<id> e <tenant>.route.<id>
+const notificationsBucket = "notifications"
+
+var notificationsBucketConfig = &nats.KeyValueConfig{
+	Bucket:      notificationsBucket,
+	Description: "Canali e regole di notifica dei tenant",
+	History:     5,
+}
+
+// Voci del bucket notifications (vedi notifier/config.go)
+type notificationChannelEntry struct {
+	ID         uint     `json:"id"`
+	Tenant     string   `json:"tenant"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	URL        string   `json:"url,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	Enabled    bool     `json:"enabled"`
+}
+
+type notificationRouteEntry struct {
+	ID           uint   `json:"id"`
+	Tenant       string `json:"tenant"`
+	ChannelID    uint   `json:"channel_id"`
+	MinSeverity  string `json:"min_severity"`
+	Metric       string `json:"metric,omitempty"`
+	Gateway      string `json:"gateway,omitempty"`
+	DelaySeconds int    `json:"delay_seconds"`
+	QuietStart   string `json:"quiet_start,omitempty"`
+	QuietEnd     string `json:"quiet_end,omitempty"`
+	QuietBypass  string `json:"quiet_bypass_severity"`
+	Timezone     string `json:"timezone"`
+	SendResolved bool   `json:"send_resolved"`
+	Enabled      bool   `json:"enabled"`
+}
+
+func notificationChannelKey(tenantID string, channelID uint) string {
+	return fmt.Sprintf("%s.channel.%d", tenantID, channelID)
+}
+
+func notificationRouteKey(tenantID string, routeID uint) string {
+	return fmt.Sprintf("%s.route.%d", tenantID, routeID)
+}
+
+func notificationChannelData(tenantID string, channel *models.NotificationChannel) ([]byte, error) {
+	return json.Marshal(notificationChannelEntry{
+		ID:         channel.ID,
+		Tenant:     tenantID,
+		Name:       channel.Name,
+		Type:       string(channel.Type),
+		URL:        channel.URL,
+		Secret:     channel.Secret,
+		Recipients: channel.Recipients,
+		Subject:    channel.Subject,
+		Enabled:    channel.Enabled,
+	})
+}
+
+func notificationRouteData(tenantID string, route *models.NotificationRoute) ([]byte, error) {
+	return json.Marshal(notificationRouteEntry{
+		ID:           route.ID,
+		Tenant:       tenantID,
+		ChannelID:    route.ChannelID,
+		MinSeverity:  string(route.MinSeverity),
+		Metric:       route.Metric,
+		Gateway:      route.Gateway,
+		DelaySeconds: route.DelaySeconds,
+		QuietStart:   route.QuietStart,
+		QuietEnd:     route.QuietEnd,
+		QuietBypass:  route.QuietBypassSeverity,
+		Timezone:     route.Timezone,
+		SendResolved: route.SendResolved,
+		Enabled:      route.Enabled,
+	})
+}
+
+func (s *Service) putNotification(key string, data []byte) error {
+	return s.withBucket(notificationsBucket, notificationsBucketConfig, func(kv nats.KeyValue) error {
+		_, err := kv.Put(key, data)
+		return err
+	})
+}
+
+func (s *Service) deleteNotification(key string) error {
+	return s.withBucket(notificationsBucket, notificationsBucketConfig, func(kv nats.KeyValue) error {
+		return kv.Delete(key)
+	})
+}
+
+// PublishNotificationChannel pubblica il canale (o la sua nuova versione) nel bucket notifications
+func (s *Service) PublishNotificationChannel(tenantID string, channel *models.NotificationChannel) error {
+	data, err := notificationChannelData(tenantID, channel)
+	if err != nil {
+		return err
+	}
+	return s.putNotification(notificationChannelKey(tenantID, channel.ID), data)
+}
+
+func (s *Service) DeleteNotificationChannel(tenantID string, channelID uint) error {
+	return s.deleteNotification(notificationChannelKey(tenantID, channelID))
+}
+
+// PublishNotificationRoute pubblica la regola (o la sua nuova versione) nel bucket notifications
+func (s *Service) PublishNotificationRoute(tenantID string, route *models.NotificationRoute) error {
+	data, err := notificationRouteData(tenantID, route)
+	if err != nil {
+		return err
+	}
+	return s.putNotification(notificationRouteKey(tenantID, route.ID), data)
+}
+
+func (s *Service) DeleteNotificationRoute(tenantID string, routeID uint) error {
+	return s.deleteNotification(notificationRouteKey(tenantID, routeID))
+}
+
+// SyncNotifications allinea il bucket ai canali e alle regole salvati nel DB
+func (s *Service) SyncNotifications() error {
+	var channels []models.NotificationChannel
+	models.GetAllNotificationChannels(&channels)
+	var routes []models.NotificationRoute
+	models.GetAllNotificationRoutes(&routes)
+
+	return s.withBucket(notificationsBucket, notificationsBucketConfig, func(kv nats.KeyValue) error {
+		saved := map[string]bool{}
+		put := func(key string, data []byte, err error) error {
+			if err != nil {
+				return err
+			}
+			saved[key] = true
+			_, err = kv.Put(key, data)
+			return err
+		}
+
+		for _, channel := range channels {
+			data, err := notificationChannelData(channel.Tenant.NatsID, &channel)
+			if err := put(notificationChannelKey(channel.Tenant.NatsID, channel.ID), data, err); err != nil {
+				return err
+			}
+		}
+		for _, route := range routes {
+			data, err := notificationRouteData(route.Tenant.NatsID, &route)
+			if err := put(notificationRouteKey(route.Tenant.NatsID, route.ID), data, err); err != nil {
+				return err
+			}
+		}
+
+		keys, err := kv.Keys()
+		if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+			return err
+		}
+		for _, key := range keys {
+			if !saved[key] {
+				if err := kv.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
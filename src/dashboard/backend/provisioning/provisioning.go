@@ -0,0 +1,205 @@
+package provisioning
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sync"
+
+	"gin-test/models"
+
+	"gorm.io/gorm"
+)
+
+/*
+Il servizio di provisioning crea tutto quello che serve a un nuovo tenant:
+  - schema, hypertable e utente <tenant>_user su TimescaleDB
+  - account NATS con gli export di $JS.API e di sensors.<tenant>.>, importati dall'account consumers
+  - voce nel bucket KV tenants, da cui il subscriber aggiunge la sorgente allo stream CONSUMING_SENSORS
+  - riga nella tabella tenants della dashboard
+
+Se un passo fallisce vengono annullati quelli già eseguiti, in ordine inverso.
+*/
+
+// Config contiene le credenziali usate dal servizio. Viene letta dalle variabili d'ambiente con ConfigFromEnv
+type Config struct {
+	NatsURL string
+	CACert  string
+	// Seed dell'operatore (SO...), firma i JWT degli account
+	OperatorSeed string
+	// Credenziali di un utente dell'account di sistema, per pubblicare i JWT sul resolver
+	SystemCreds string
+	// Credenziali dell'utente dataconsumer, per registrare il tenant nel bucket tenants
+	ConsumersCreds string
+	// Chiave pubblica dell'account consumers
+	ConsumersAccount string
+}
+
+func ConfigFromEnv() Config {
+	return Config{
+		NatsURL:          os.Getenv("NATS_URL"),
+		CACert:           os.Getenv("TENANT_CA"),
+		OperatorSeed:     os.Getenv("NATS_OPERATOR_SEED"),
+		SystemCreds:      os.Getenv("NATS_SYSTEM_CREDS"),
+		ConsumersCreds:   os.Getenv("NATS_CONSUMERS_CREDS"),
+		ConsumersAccount: os.Getenv("NATS_CONSUMERS_ACCOUNT"),
+	}
+}
+
+func (cfg Config) Validate() error {
+	var errs []error
+	required := []struct{ env, value string }{
+		{"NATS_URL", cfg.NatsURL},
+		{"TENANT_CA", cfg.CACert},
+		{"NATS_OPERATOR_SEED", cfg.OperatorSeed},
+		{"NATS_SYSTEM_CREDS", cfg.SystemCreds},
+		{"NATS_CONSUMERS_CREDS", cfg.ConsumersCreds},
+		{"NATS_CONSUMERS_ACCOUNT", cfg.ConsumersAccount},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs = append(errs, fmt.Errorf("variabile d'ambiente %s non impostata", r.env))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// L'ID del tenant viene usato come nome dello schema, del ruolo Postgres e come token dei subject NATS
+var validTenantID = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+
+type InvalidTenantID struct {
+	NatsID string
+}
+
+func (e *InvalidTenantID) Error() string {
+	return fmt.Sprintf("ID tenant non valido: %q (ammessi lettere minuscole, cifre e _, deve iniziare con una lettera)", e.NatsID)
+}
+
+type Service struct {
+	cfg Config
+	db  *gorm.DB
+	// Il JWT dell'account consumers viene letto e riscritto: un provisioning alla volta
+	mu sync.Mutex
+	// Rollup e policy di TimescaleDB: una modifica alla volta (vedi ApplyRetention)
+	retentionMu sync.Mutex
+	// Schemi delle metriche registrati, per metrica (vedi WatchMetricSchemas). Protetto da mu
+	schemas map[string]*metricSchema
+}
+
+func New(cfg Config, db *gorm.DB) *Service {
+	return &Service{cfg: cfg, db: db, schemas: map[string]*metricSchema{}}
+}
+
+// Provision crea le risorse del tenant e infine la riga nella tabella tenants.
+// In caso di successo tenant contiene anche la chiave pubblica e il seed cifrato del nuovo account NATS.
+func (s *Service) Provision(tenant *models.Tenant) error {
+	if err := s.cfg.Validate(); err != nil {
+		return fmt.Errorf("provisioning non configurato: %w", err)
+	}
+	if !validTenantID.MatchString(tenant.NatsID) {
+		return &InvalidTenantID{NatsID: tenant.NatsID}
+	}
+
+	// Il controllo va fatto sotto lock, altrimenti due richieste per lo stesso tenant passano entrambe
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var existing models.Tenant
+	models.GetTenantByNatsID(&existing, tenant.NatsID)
+	if existing.ID != 0 {
+		return &models.TenantAlreadyExists{}
+	}
+
+	acc, err := newAccount()
+	if err != nil {
+		return err
+	}
+
+	var consumersJWT string
+
+	steps := []step{
+		{
+			name: "database",
+			do:   func() error { return s.createDatabase(tenant.NatsID) },
+			undo: func() error { return s.dropDatabase(tenant.NatsID) },
+		},
+		{
+			// Il rollback del database elimina anche queste tabelle
+			name: "tabelle delle metriche",
+			do:   func() error { return s.createMetricTables(tenant.NatsID) },
+		},
+		{
+			// Il tenant è nuovo, quindi senza politiche salvate: si applicano quelle di default.
+			// Il rollback del database elimina anche rollup e policy
+			name: "rollup e retention",
+			do:   func() error { return s.ApplyRetention(tenant, "") },
+		},
+		{
+			name: "account NATS",
+			do:   func() error { return s.createAccount(tenant.NatsID, acc) },
+			undo: func() error { return s.deleteAccount(acc) },
+		},
+		{
+			name: "import nell'account consumers",
+			do: func() (err error) {
+				consumersJWT, err = s.importTenant(tenant.NatsID, acc)
+				return err
+			},
+			undo: func() error { return s.restoreConsumers(consumersJWT) },
+		},
+		{
+			name: "registrazione nel bucket " + tenantsBucket,
+			do:   func() error { return s.addSource(tenant.NatsID) },
+			undo: func() error { return s.removeSource(tenant.NatsID) },
+		},
+		{
+			name: "tenant dashboard",
+			do: func() error {
+				tenant.NatsAccount = acc.publicKey
+				if err := tenant.SetAccountSeed(acc.seed); err != nil {
+					return err
+				}
+				return tenant.Create()
+			},
+		},
+	}
+
+	if err := run(steps); err != nil {
+		return fmt.Errorf("provisioning tenant %s fallito: %w", tenant.NatsID, err)
+	}
+
+	log.Printf("Provisioning tenant %s completato (account %s)", tenant.NatsID, acc.publicKey)
+	return nil
+}
+
+// step è un passo del provisioning, con la relativa operazione di rollback (opzionale)
+type step struct {
+	name string
+	do   func() error
+	undo func() error
+}
+
+// run esegue i passi in ordine. Al primo errore annulla i passi già eseguiti, dall'ultimo al primo
+func run(steps []step) error {
+	for i, st := range steps {
+		err := st.do()
+		if err == nil {
+			continue
+		}
+
+		err = fmt.Errorf("%s: %w", st.name, err)
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].undo == nil {
+				continue
+			}
+			if undoErr := steps[j].undo(); undoErr != nil {
+				log.Printf("Rollback di %s fallito: %v", steps[j].name, undoErr)
+				err = errors.Join(err, fmt.Errorf("rollback %s: %w", steps[j].name, undoErr))
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package provisioning
+
+import (
+	"fmt"
+	"log"
+
+	"gin-test/models"
+)
+
+// Rollup delle letture: continuous aggregate TimescaleDB <metrica>_<nome> nello schema del tenant,
+// con per ogni bucket e gateway count e, per ogni colonna numerica, <colonna>_sum, _min e _max.
+// 1h e 1d sono calcolati dal rollup precedente, non dalla tabella grezza
+type rollup struct {
+	name   string
+	bucket string
+	source string // rollup da cui è calcolato, "" = tabella grezza
+	// Finestra aggiornata dalla policy: le letture più vecchie di startOffset arrivate in ritardo
+	// (es. dal buffer offline di un gateway) non finiscono nel rollup. Il livello sorgente deve
+	// conservare i dati per più di startOffset (vedi models.RetentionPolicy.Validate)
+	startOffset string
+	endOffset   string
+	schedule    string
+}
+
+var rollups = []rollup{
+	{name: "1m", bucket: "1 minute", startOffset: "1 day", endOffset: "1 minute", schedule: "1 minute"},
+	{name: "1h", bucket: "1 hour", source: "1m", startOffset: "3 days", endOffset: "1 hour", schedule: "30 minutes"},
+	{name: "1d", bucket: "1 day", source: "1h", startOffset: "7 days", endOffset: "1 day", schedule: "1 hour"},
+}
+
+// Tipi delle colonne aggregate nei rollup, come in controllers/historyController.go
+var rollupColumnTypes = map[string]bool{
+	"smallint":         true,
+	"integer":          true,
+	"bigint":           true,
+	"numeric":          true,
+	"real":             true,
+	"double precision": true,
+}
+
+// MetricTables restituisce le metriche del tenant, cioè le sue hypertable
+func (s *Service) MetricTables(tenantID string) ([]string, error) {
+	var metrics []string
+	err := s.db.Raw(
+		`SELECT hypertable_name FROM timescaledb_information.hypertables WHERE hypertable_schema = ? ORDER BY 1`,
+		tenantID,
+	).Scan(&metrics).Error
+	return metrics, err
+}
+
+func (s *Service) numericColumns(tenantID string, table string) ([]string, error) {
+	var columns []struct {
+		ColumnName string
+		DataType   string
+	}
+	err := s.db.Raw(
+		`SELECT column_name, data_type FROM information_schema.columns
+		 WHERE table_schema = ? AND table_name = ? ORDER BY ordinal_position`,
+		tenantID, table,
+	).Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var numeric []string
+	for _, c := range columns {
+		if rollupColumnTypes[c.DataType] {
+			numeric = append(numeric, c.ColumnName)
+		}
+	}
+	return numeric, nil
+}
+
+// ApplyRetention crea i rollup mancanti e applica compressione e retention alla metrica del tenant,
+// o a tutte le sue metriche se metric è vuoto. Le politiche sono quelle salvate nel DB
+// (models.EffectiveRetentionPolicy). Si può ripetere: gli oggetti esistenti vengono riusati
+func (s *Service) ApplyRetention(tenant *models.Tenant, metric string) error {
+	if !validTenantID.MatchString(tenant.NatsID) {
+		return &InvalidTenantID{NatsID: tenant.NatsID}
+	}
+
+	s.retentionMu.Lock()
+	defer s.retentionMu.Unlock()
+
+	metrics, err := s.MetricTables(tenant.NatsID)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range metrics {
+		if metric != "" && m != metric {
+			continue
+		}
+		policy := models.EffectiveRetentionPolicy(tenant.ID, m)
+		if err := s.applyMetricRetention(tenant.NatsID, m, &policy); err != nil {
+			return fmt.Errorf("metrica %s: %w", m, err)
+		}
+	}
+	return nil
+}
+
+// SyncRetention applica le politiche di conservazione a tutti i tenant, ad esempio per creare
+// i rollup dei tenant esistenti o delle metriche aggiunte dal registro degli schemi
+func (s *Service) SyncRetention() error {
+	var tenants []models.Tenant
+	models.GetAllTenants(&tenants)
+
+	for _, tenant := range tenants {
+		if err := s.ApplyRetention(&tenant, ""); err != nil {
+			return fmt.Errorf("tenant %s: %w", tenant.NatsID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Service) applyMetricRetention(tenantID string, metric string, policy *models.RetentionPolicy) error {
+	table := tenantID + "." + metric
+
+	columns, err := s.numericColumns(tenantID, metric)
+	if err != nil {
+		return err
+	}
+	// Senza colonne numeriche (es. solo campioni ECG) non c'è niente da aggregare
+	if len(columns) > 0 {
+		if err := s.createRollups(tenantID, metric, columns); err != nil {
+			return err
+		}
+	}
+
+	if err := s.setCompression(tenantID, metric, policy.CompressAfterDays); err != nil {
+		return err
+	}
+
+	retention := map[string]int{table: policy.RawDays}
+	if len(columns) > 0 {
+		retention[table+"_1m"] = policy.Rollup1mDays
+		retention[table+"_1h"] = policy.Rollup1hDays
+		retention[table+"_1d"] = policy.Rollup1dDays
+	}
+	for relation, days := range retention {
+		if err := s.setRetention(relation, days); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createRollups crea i continuous aggregate mancanti della metrica, con la loro policy di aggiornamento.
+// Policy e GRANT vengono riapplicati anche ai rollup esistenti: se la creazione si è interrotta
+// dopo la vista, la chiamata successiva completa i passi mancanti
+func (s *Service) createRollups(tenantID string, metric string, columns []string) error {
+	for _, r := range rollups {
+		view := fmt.Sprintf("%s.%s_%s", tenantID, metric, r.name)
+
+		var exists bool
+		if err := s.db.Raw(`SELECT to_regclass(?) IS NOT NULL`, view).Scan(&exists).Error; err != nil {
+			return err
+		}
+
+		var statements []string
+		if !exists {
+			bucket := fmt.Sprintf("time_bucket('%s', time)", r.bucket)
+			selects := bucket + " AS time, gateway_id"
+			source := tenantID + "." + metric
+			if r.source == "" {
+				selects += ", count(*) AS count"
+				for _, col := range columns {
+					selects += fmt.Sprintf(", sum(%[1]s)::double precision AS %[1]s_sum, min(%[1]s)::double precision AS %[1]s_min, max(%[1]s)::double precision AS %[1]s_max", col)
+				}
+			} else {
+				source += "_" + r.source
+				selects += ", sum(count)::bigint AS count"
+				for _, col := range columns {
+					selects += fmt.Sprintf(", sum(%[1]s_sum) AS %[1]s_sum, min(%[1]s_min) AS %[1]s_min, max(%[1]s_max) AS %[1]s_max", col)
+				}
+			}
+
+			// materialized_only = false: le query vedono anche le letture non ancora materializzate
+			statements = append(statements, fmt.Sprintf(`CREATE MATERIALIZED VIEW %s WITH (timescaledb.continuous, timescaledb.materialized_only = false) AS
+				SELECT %s FROM %s GROUP BY %s, gateway_id WITH NO DATA`, view, selects, source, bucket))
+		}
+		statements = append(statements,
+			fmt.Sprintf(`SELECT add_continuous_aggregate_policy('%s', start_offset => INTERVAL '%s', end_offset => INTERVAL '%s', schedule_interval => INTERVAL '%s', if_not_exists => true)`,
+				view, r.startOffset, r.endOffset, r.schedule),
+			fmt.Sprintf(`GRANT SELECT ON %s TO %s_user`, view, tenantID),
+		)
+
+		for _, stmt := range statements {
+			if err := s.db.Exec(stmt).Error; err != nil {
+				return fmt.Errorf("rollup %s: %w", view, err)
+			}
+		}
+		if !exists {
+			log.Printf("Rollup %s creato", view)
+		}
+	}
+	return nil
+}
+
+// setCompression comprime i chunk delle letture grezze più vecchi di days giorni, 0 = nessuna compressione.
+// I chunk già compressi restano compressi
+func (s *Service) setCompression(tenantID string, metric string, days int) error {
+	table := tenantID + "." + metric
+	if err := s.db.Exec(fmt.Sprintf(`SELECT remove_compression_policy('%s', if_exists => true)`, table)).Error; err != nil {
+		return err
+	}
+	if days == 0 {
+		return nil
+	}
+
+	// Le impostazioni non si possono cambiare se ci sono già chunk compressi
+	var enabled bool
+	err := s.db.Raw(
+		`SELECT compression_enabled FROM timescaledb_information.hypertables WHERE hypertable_schema = ? AND hypertable_name = ?`,
+		tenantID, metric,
+	).Scan(&enabled).Error
+	if err != nil {
+		return err
+	}
+
+	var statements []string
+	if !enabled {
+		// msg_id nell'ordinamento: le colonne del vincolo UNIQUE (msg_id, time) devono essere nel segmentby o nell'orderby
+		statements = append(statements, fmt.Sprintf(
+			`ALTER TABLE %s SET (timescaledb.compress, timescaledb.compress_segmentby = 'gateway_id', timescaledb.compress_orderby = 'time DESC, msg_id')`, table))
+	}
+	statements = append(statements, fmt.Sprintf(`SELECT add_compression_policy('%s', compress_after => INTERVAL '%d days')`, table, days))
+
+	for _, stmt := range statements {
+		if err := s.db.Exec(stmt).Error; err != nil {
+			return fmt.Errorf("compressione %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// setRetention elimina i dati della tabella o del rollup più vecchi di days giorni, 0 = per sempre
+func (s *Service) setRetention(relation string, days int) error {
+	if err := s.db.Exec(fmt.Sprintf(`SELECT remove_retention_policy('%s', if_exists => true)`, relation)).Error; err != nil {
+		return err
+	}
+	if days == 0 {
+		return nil
+	}
+
+	stmt := fmt.Sprintf(`SELECT add_retention_policy('%s', drop_after => INTERVAL '%d days')`, relation, days)
+	if err := s.db.Exec(stmt).Error; err != nil {
+		return fmt.Errorf("retention %s: %w", relation, err)
+	}
+	return nil
+}
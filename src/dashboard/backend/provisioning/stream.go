@@ -0,0 +1,63 @@
+package provisioning
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"gin-test/models"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ApplyStreamRetention imposta la conservazione dei messaggi dello stream sensors_<tenant> secondo la
+// politica di default del tenant (StreamDays). nc è una connessione all'account del tenant (vedi natsconn).
+// Se lo stream non esiste lo crea con la stessa configurazione usata dai gateway (publisher/gateway/init.go),
+// che lo creano solo se manca e non ne modificano la configurazione
+func (s *Service) ApplyStreamRetention(nc *nats.Conn, tenant *models.Tenant) error {
+	if !validTenantID.MatchString(tenant.NatsID) {
+		return &InvalidTenantID{NatsID: tenant.NatsID}
+	}
+
+	js, err := nc.JetStream(nats.MaxWait(requestTimeout))
+	if err != nil {
+		return fmt.Errorf("errore ottenimento JetStream: %w", err)
+	}
+
+	policy := models.EffectiveRetentionPolicy(tenant.ID, "")
+	maxAge := time.Duration(policy.StreamDays) * 24 * time.Hour
+	name := sensorsStream(tenant.NatsID)
+
+	info, err := js.StreamInfo(name)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(&nats.StreamConfig{
+			Name:       name,
+			Subjects:   []string{sensorsSubject(tenant.NatsID)},
+			Storage:    nats.FileStorage,
+			Replicas:   1,
+			Retention:  nats.LimitsPolicy,
+			MaxAge:     maxAge,
+			MaxMsgSize: 1024 * 1024,
+		})
+		if err != nil {
+			return fmt.Errorf("errore creazione stream %s: %w", name, err)
+		}
+		log.Printf("Stream %s creato (conservazione %d giorni)", name, policy.StreamDays)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("errore lettura stream %s: %w", name, err)
+	}
+
+	if info.Config.MaxAge == maxAge {
+		return nil
+	}
+	config := info.Config
+	config.MaxAge = maxAge
+	if _, err := js.UpdateStream(&config); err != nil {
+		return fmt.Errorf("errore aggiornamento stream %s: %w", name, err)
+	}
+	log.Printf("Stream %s: conservazione impostata a %d giorni", name, policy.StreamDays)
+	return nil
+}
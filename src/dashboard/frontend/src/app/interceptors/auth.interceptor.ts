@@ -7,7 +7,7 @@ import {
   HttpErrorResponse,
 } from '@angular/common/http';
 import { Observable, throwError } from 'rxjs';
-import { catchError } from 'rxjs/operators';
+import { catchError, switchMap } from 'rxjs/operators';
 import { Router } from '@angular/router';
 import { AuthService } from '../services/auth.service';
 
@@ -33,7 +33,27 @@ export class AuthInterceptor implements HttpInterceptor {
 
     return next.handle(request).pipe(
       catchError((error: HttpErrorResponse) => {
-        if (error.status === 401 && !request.url.includes('/auth/')) {
+        const isAuthRequest = ['/login', '/register', '/refresh', '/logout'].some((path) =>
+          request.url.endsWith(path),
+        );
+
+        if (error.status === 401 && !isAuthRequest) {
+          // Access token scaduto: prova a rinnovarlo e ripete la richiesta una sola volta
+          if (this.authService.canRefresh()) {
+            return this.authService.refresh().pipe(
+              switchMap((response) =>
+                next.handle(
+                  request.clone({ setHeaders: { Authorization: `Bearer ${response.token}` } }),
+                ),
+              ),
+              catchError((refreshError) => {
+                this.authService.logout();
+                this.router.navigate(['/login']);
+                return throwError(() => refreshError);
+              }),
+            );
+          }
+
           // Se token scaduto torna su login
           this.authService.logout();
           this.router.navigate(['/login']);
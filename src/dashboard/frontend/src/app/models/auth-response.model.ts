@@ -5,5 +5,7 @@ import { User } from './user.model';
  */
 export interface AuthResponse {
   token: string;
+  refreshToken: string;
+  expiresIn: number; // durata dell'access token in secondi
   user: User;
 }
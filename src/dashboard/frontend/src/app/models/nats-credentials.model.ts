@@ -0,0 +1,9 @@
+/**
+ * Credenziali per connettersi direttamente a NATS via WebSocket.
+ * Il JWT viene impostato anche nel cookie real_time_data_jwt, letto dal server NATS.
+ */
+export interface NatsCredentials {
+  jwt: string;
+  subject: string; // unico subject a cui ci si può sottoscrivere
+  expiresAt: string;
+}
@@ -9,10 +9,40 @@ export interface Sensor {
   unit: string;
 }
 
+/**
+ * Messaggio inviato al WebSocket per scegliere gateway e metriche (vuoti = tutti)
+ * e chiedere le letture degli ultimi minuti prima di quelle live.
+ */
+export interface StreamSubscribeRequest {
+  type: 'subscribe';
+  gateways?: string[];
+  metrics?: string[];
+  replay_minutes?: number;
+}
+
+/**
+ * Ticket monouso per aprire il WebSocket (POST /api/stream/ticket), valido expiresIn secondi.
+ */
+export interface StreamTicketResponse {
+  ticket: string;
+  expiresIn: number;
+}
+
+/**
+ * Messaggio ricevuto dal WebSocket. 'data' è il payload JSON della lettura.
+ * I messaggi 'gateway_status' indicano lo stato di connessione del gateway in 'status'
+ * e l'ultimo heartbeat in 'timestamp'.
+ */
 export interface RawSensorReading {
-  data: string;
-  subject: string;
-  timestamp: number;
+  type: 'data' | 'gateway_status' | 'replay_done' | 'error';
+  subject?: string;
+  gateway_id?: string;
+  metric?: string;
+  data?: any;
+  timestamp?: number;
+  replay?: boolean;
+  status?: 'online' | 'offline' | 'unknown';
+  error?: string;
 }
 
 export interface SensorReading {
@@ -27,6 +57,8 @@ export interface SensorReading {
 export interface HistoryApiResponse {
   count: number;
   data: HistoricReading[];
+  // Presente con i bucket: true se il backend ha restituito solo i primi bucket dell'intervallo
+  truncated?: boolean;
 }
 
 
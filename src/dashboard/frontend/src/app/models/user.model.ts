@@ -1,5 +1,10 @@
 import { Tenant } from './tenant.model';
 
+/**
+ * Ruoli degli utenti, i permessi sono verificati dal backend
+ */
+export type UserRole = 'platform_admin' | 'tenant_admin' | 'device_operator' | 'viewer' | 'pending';
+
 /**
  * Type custom per l'oggetto utente
  */
@@ -8,6 +13,7 @@ export interface User {
   tenantId: number;
   tenant: Tenant;
   username: string;
+  role: UserRole;
   password?: string; // Opzionale perchè lo escludo nella response
   createdAt: string;
   updatedAt: string;
@@ -1,12 +1,13 @@
 import { Injectable, signal, computed, effect, inject } from '@angular/core';
 import { HttpClient } from '@angular/common/http';
 import { Router } from '@angular/router';
-import { Observable, tap } from 'rxjs';
+import { Observable, of, tap, finalize, shareReplay } from 'rxjs';
 import { environment } from '../../environments/environment';
 import { User } from '../models/user.model';
 import { LoginRequest } from '../models/login-request.model';
 import { RegisterRequest } from '../models/register-request.model';
 import { AuthResponse } from '../models/auth-response.model';
+import { NatsCredentials } from '../models/nats-credentials.model';
 
 @Injectable({
   providedIn: 'root',
@@ -23,6 +24,10 @@ export class AuthService {
 
   private currentUserSignal = signal<User | null>(null);
   private tokenSignal = signal<string | null>(null);
+  private refreshTokenSignal = signal<string | null>(null);
+
+  // Refresh in corso, condiviso tra le richieste che ricevono 401 nello stesso momento
+  private refreshInProgress: Observable<AuthResponse> | null = null;
 
   // === SIGNALS PUBBLICI IN SOLA LETTURA ===
   // Esposti ai componenti per la sottoscrizione reattiva
@@ -48,29 +53,37 @@ export class AuthService {
       const user = this.currentUserSignal();
 
       // Salva in localStorage solo se entrambi i valori sono presenti
+      const refreshToken = this.refreshTokenSignal();
+
       if (token && user) {
         localStorage.setItem('token', token);
         localStorage.setItem('user', JSON.stringify(user));
       }
+      if (refreshToken) {
+        localStorage.setItem('refreshToken', refreshToken);
+      }
     });
   }
 
   /**
    * Ripristina la sessione utente dal localStorage al caricamento dell'app.
-   * Verifica che il token non sia scaduto prima di ripristinare la sessione.
+   * Verifica che il token non sia scaduto prima di ripristinare la sessione:
+   * un access token scaduto va bene se c'è un refresh token, verrà rinnovato alla prima richiesta.
    */
   private loadFromStorage(): void {
     const token = localStorage.getItem('token');
     const userStr = localStorage.getItem('user');
+    const refreshToken = localStorage.getItem('refreshToken');
 
     if (token && userStr) {
       try {
         const user = JSON.parse(userStr) as User;
 
         // Verifica la validità temporale del token JWT
-        if (this.isTokenValid(token)) {
-          // Token valido: ripristina la sessione
+        if (this.isTokenValid(token) || refreshToken) {
+          // Token valido o rinnovabile: ripristina la sessione
           this.tokenSignal.set(token);
+          this.refreshTokenSignal.set(refreshToken);
           this.currentUserSignal.set(user);
         } else {
           // Token scaduto: pulisce i dati obsoleti
@@ -90,7 +103,7 @@ export class AuthService {
    * @param token - Token JWT da validare
    * @returns true se il token non è scaduto, false altrimenti
    */
-  private isTokenValid(token: string): boolean {
+  isTokenValid(token: string): boolean {
     try {
       // Il JWT è composto da 3 parti separate da '.': header.payload.signature
       // Decodifica il payload da Base64
@@ -110,6 +123,7 @@ export class AuthService {
    */
   private clearStorage(): void {
     localStorage.removeItem('token');
+    localStorage.removeItem('refreshToken');
     localStorage.removeItem('user');
   }
 
@@ -123,10 +137,7 @@ export class AuthService {
    */
   login(request: LoginRequest): Observable<AuthResponse> {
     return this.http.post<AuthResponse>(`${this.apiUrl}/login`, request).pipe(
-      tap((response) => {
-        this.tokenSignal.set(response.token);
-        this.currentUserSignal.set(response.user);
-      }),
+      tap((response) => this.setSession(response)),
     );
   }
 
@@ -140,13 +151,87 @@ export class AuthService {
    */
   register(request: RegisterRequest): Observable<AuthResponse> {
     return this.http.post<AuthResponse>(`${this.apiUrl}/register`, request).pipe(
-      tap((response) => {
-        this.tokenSignal.set(response.token);
-        this.currentUserSignal.set(response.user);
-      }),
+      tap((response) => this.setSession(response)),
     );
   }
 
+  /**
+   * Salva token e utente restituiti da login, registrazione e refresh.
+   */
+  private setSession(response: AuthResponse): void {
+    this.tokenSignal.set(response.token);
+    this.refreshTokenSignal.set(response.refreshToken);
+    this.currentUserSignal.set(response.user);
+  }
+
+  /**
+   * Ottiene un nuovo access token con il refresh token.
+   * Il refresh token viene ruotato: quello vecchio non è più valido.
+   * Le chiamate concorrenti condividono la stessa richiesta.
+   *
+   * @returns Observable con i nuovi token
+   */
+  refresh(): Observable<AuthResponse> {
+    const refreshToken = this.refreshTokenSignal();
+    if (!refreshToken) {
+      throw new Error('Refresh token non disponibile');
+    }
+
+    if (!this.refreshInProgress) {
+      this.refreshInProgress = this.http
+        .post<AuthResponse>(`${this.apiUrl}/refresh`, { refreshToken })
+        .pipe(
+          tap((response) => this.setSession(response)),
+          finalize(() => (this.refreshInProgress = null)),
+          shareReplay(1),
+        );
+    }
+    return this.refreshInProgress;
+  }
+
+  /**
+   * Restituisce un access token valido, rinnovandolo se è scaduto.
+   * Serve per le connessioni che non passano dall'interceptor (WebSocket).
+   */
+  validToken(): Observable<string | null> {
+    const token = this.tokenSignal();
+    if (token && this.isTokenValid(token)) {
+      return of(token);
+    }
+    if (!this.refreshTokenSignal()) {
+      return of(null);
+    }
+    return new Observable<string | null>((subscriber) => {
+      this.refresh().subscribe({
+        next: (response) => {
+          subscriber.next(response.token);
+          subscriber.complete();
+        },
+        error: () => {
+          subscriber.next(null);
+          subscriber.complete();
+        },
+      });
+    });
+  }
+
+  /**
+   * Indica se è disponibile un refresh token.
+   */
+  canRefresh(): boolean {
+    return !!this.refreshTokenSignal();
+  }
+
+  /**
+   * Richiede un nuovo JWT NATS, salvato dal backend nel cookie real_time_data_jwt.
+   * Va chiamato prima di connettersi a NATS via WebSocket, il JWT dura pochi minuti.
+   *
+   * @returns Observable con JWT, subject consentito e scadenza
+   */
+  natsCredentials(): Observable<NatsCredentials> {
+    return this.http.get<NatsCredentials>(`${this.apiUrl}/nats/credentials`);
+  }
+
   /**
    * Aggiorna i dati del profilo utente dal backend.
    * Utile quando i dati potrebbero essere cambiati lato server
@@ -169,7 +254,13 @@ export class AuthService {
    * reindirizza alla pagina di login.
    */
   logout(): void {
+    // Revoca la sessione lato server, così il token non è più utilizzabile anche se copiato
+    if (this.tokenSignal()) {
+      this.http.post(`${this.apiUrl}/logout`, {}).subscribe({ error: () => {} });
+    }
+
     this.tokenSignal.set(null);
+    this.refreshTokenSignal.set(null);
     this.currentUserSignal.set(null);
     this.clearStorage();
     this.router.navigate(['/login']);
@@ -1,7 +1,7 @@
 import { Injectable, inject, signal, computed, OnDestroy } from '@angular/core';
 import { HttpClient, HttpParams } from '@angular/common/http';
 import { tap, catchError, of } from 'rxjs';
-import { HistoricReading, HistoryApiResponse, RawSensorReading, Sensor, SensorReading } from '../models/sensor.model';
+import { HistoricReading, HistoryApiResponse, RawSensorReading, Sensor, SensorReading, StreamSubscribeRequest, StreamTicketResponse } from '../models/sensor.model';
 import { Tenant } from '../models/tenant.model';
 import { environment } from '../../environments/environment';
 import { AuthService } from './auth.service';
@@ -28,6 +28,12 @@ export class SensorDataService implements OnDestroy {
    */
   private readonly MAX_LIVE_READINGS = 60;
 
+  /**
+   * Minuti di letture passate chieste al WebSocket all'apertura, così il grafico
+   * live non parte vuoto. Con una lettura ogni 5 secondi riempiono il buffer.
+   */
+  private readonly REPLAY_MINUTES = 5;
+
   // === SIGNALS - STATO WEBSOCKET (dati real-time) ===
   
   private selectedSensorSignal = signal<Sensor | null>(null);
@@ -114,25 +120,23 @@ export class SensorDataService implements OnDestroy {
    * @returns - reading del sensore adattato al formato interno o null
    */
   private parseMessage(raw: RawSensorReading): SensorReading | null {
+    if (!raw.subject || raw.data === undefined) return null;
+
     const subjectInfo = this.parseSubject(raw.subject);
     if (!subjectInfo) return null;
 
-    try {
-      const data = JSON.parse(raw.data);
-      const value = this.extractValue(data, subjectInfo.sensorType);
-
-      return {
-        tenant: subjectInfo.tenant,
-        gateway: subjectInfo.gateway,
-        sensorType: subjectInfo.sensorType,
-        data: data,
-        value: value,
-        timestamp: new Date(raw.timestamp)
-      };
-    } catch (e) {
-      console.error('Errore nel parsing dei dati del messaggio:', e);
-      return null;
-    }
+    // Il payload arriva già come oggetto JSON
+    const data = raw.data;
+    const value = this.extractValue(data, subjectInfo.sensorType);
+
+    return {
+      tenant: subjectInfo.tenant,
+      gateway: subjectInfo.gateway,
+      sensorType: subjectInfo.sensorType,
+      data: data,
+      value: value,
+      timestamp: new Date(raw.timestamp ?? Date.now())
+    };
   }
 
   /**
@@ -187,6 +191,18 @@ private transformHistoricData(
   }));
 }
 
+/**
+ * Sceglie la durata dei bucket per restare sotto i ~500 punti per grafico.
+ * @param minutes - ampiezza dell'intervallo richiesto
+ * @returns - durata del bucket (es. '5m', '1h') o null per le letture singole
+ */
+private historyBucket(minutes: number): string | null {
+  if (minutes <= 360) return null;
+  const bucketMinutes = Math.ceil(minutes / 500);
+  if (bucketMinutes < 60) return `${bucketMinutes}m`;
+  return `${Math.ceil(bucketMinutes / 60)}h`;
+}
+
 /**
  * Recupera dati storici dall'API.
  */
@@ -207,15 +223,27 @@ getHistoricData(sensor: Sensor, minutes: number = 60): void {
 
   const readingsPerMinute = 12;
   const limit = minutes * readingsPerMinute;
+  const from = new Date(Date.now() - minutes * 60_000);
 
-  const params = new HttpParams()
-    .set('tenant_id', tenant.natsId.toString())  
+  // Il tenant viene ricavato dal token lato backend
+  let params = new HttpParams()
     .set('metric', sensor.sensorType)         
+    .set('from', from.toISOString())
     .set('limit', limit.toString());          
 
+  // Oltre le 6 ore chiede al backend le medie per bucket invece delle singole letture.
+  // Il grafico non chiede i percentili, quindi le medie vengono dai rollup
+  const bucket = this.historyBucket(minutes);
+  if (bucket) {
+    params = params.set('bucket', bucket);
+  }
+
   this.http.get<HistoryApiResponse>(`${this.apiUrl}/history`, { params })
     .pipe(
       tap((response) => {
+        if (response.truncated) {
+          console.warn(`Dati storici di ${sensor.sensorType} troncati: il backend ha restituito solo i primi ${response.count} bucket`);
+        }
         const readings = this.transformHistoricData(
           response.data, 
           sensor, 
@@ -254,8 +282,26 @@ getHistoricData(sensor: Sensor, minutes: number = 60): void {
       return;
     }
 
-    const wsEndpoint = `${this.wsUrl}/ws/sensors/${tenant.natsId}`;
-    console.log('Connessione a:', wsEndpoint);
+    // Il browser non permette header sul WebSocket: l'URL contiene un ticket monouso,
+    // chiesto con una richiesta HTTP normale (l'interceptor aggiunge e rinnova il token)
+    this.http.post<StreamTicketResponse>(`${this.apiUrl}/stream/ticket`, {}).subscribe({
+      next: (response) => {
+        // Nel frattempo potrebbe essere stato selezionato un altro sensore
+        if (this.selectedSensorSignal() !== sensor) {
+          return;
+        }
+        this.openSocket(sensor, response.ticket);
+      },
+      error: () => this.wsErrorSignal.set('Utente non autenticato'),
+    });
+  }
+
+  /**
+   * Apre la connessione WebSocket autenticata con il ticket indicato.
+   */
+  private openSocket(sensor: Sensor, ticket: string): void {
+    const wsEndpoint = `${this.wsUrl}/ws/sensors?ticket=${encodeURIComponent(ticket)}`;
+    console.log('Connessione a:', `${this.wsUrl}/ws/sensors`);
     console.log('Filtro per tipo sensore:', sensor.sensorType);
 
     try {
@@ -265,6 +311,14 @@ getHistoricData(sensor: Sensor, minutes: number = 60): void {
         console.log('WebSocket connesso');
         this.wsConnectedSignal.set(true);
         this.wsErrorSignal.set(null);
+
+        // Chiede solo la metrica del sensore selezionato, partendo dagli ultimi minuti
+        const request: StreamSubscribeRequest = {
+          type: 'subscribe',
+          metrics: [sensor.sensorType],
+          replay_minutes: this.REPLAY_MINUTES,
+        };
+        this.socket?.send(JSON.stringify(request));
       };
 
       // Ricezione nuovo messaggio (lettura sensore)
@@ -272,6 +326,14 @@ getHistoricData(sensor: Sensor, minutes: number = 60): void {
         try {
           // Parse del JSON grezzo dal server
           const raw: RawSensorReading = JSON.parse(event.data);
+
+          if (raw.type === 'error') {
+            console.error('Errore dal WebSocket:', raw.error);
+            return;
+          }
+          if (raw.type !== 'data') {
+            return;
+          }
           
           // Trasforma in lettura strutturata
           const parsed = this.parseMessage(raw);
@@ -6,13 +6,17 @@ CREATE SCHEMA IF NOT EXISTS tenant_2;
 CREATE TABLE IF NOT EXISTS tenant_1.heart_rate (
     time        TIMESTAMPTZ       NOT NULL,
     gateway_id  VARCHAR           NOT NULL,
-    bpm         INTEGER           NOT NULL CHECK (bpm > 0)
+    msg_id      VARCHAR           NOT NULL, -- header Nats-Msg-Id della lettura
+    bpm         INTEGER           NOT NULL CHECK (bpm > 0),
+    UNIQUE (msg_id, time) -- rende idempotenti le insert (il vincolo deve includere la colonna di partizionamento)
 );
 
 CREATE TABLE IF NOT EXISTS tenant_1.blood_oxygen (
     time        TIMESTAMPTZ       NOT NULL,
     gateway_id  VARCHAR           NOT NULL,
-    spo2        NUMERIC(5,2)      NOT NULL CHECK (spo2 >= 0 AND spo2 <= 100)
+    msg_id      VARCHAR           NOT NULL,
+    spo2        NUMERIC(5,2)      NOT NULL CHECK (spo2 >= 0 AND spo2 <= 100),
+    UNIQUE (msg_id, time)
 );
 
 
@@ -20,16 +24,41 @@ SELECT create_hypertable('tenant_1.heart_rate', 'time');
 
 SELECT create_hypertable('tenant_1.blood_oxygen', 'time');
 
+-- Alert del servizio di alerting
+CREATE TABLE IF NOT EXISTS tenant_1.alerts (
+    id              BIGSERIAL         PRIMARY KEY,
+    rule_id         BIGINT            NOT NULL,
+    rule_name       VARCHAR           NOT NULL,
+    gateway_id      VARCHAR           NOT NULL,
+    metric          VARCHAR           NOT NULL,
+    severity        VARCHAR           NOT NULL,
+    status          VARCHAR           NOT NULL CHECK (status IN ('firing', 'acknowledged', 'resolved')),
+    message         VARCHAR           NOT NULL,
+    value           DOUBLE PRECISION  NOT NULL,
+    threshold       DOUBLE PRECISION  NOT NULL,
+    fired_at        TIMESTAMPTZ       NOT NULL,
+    acknowledged_at TIMESTAMPTZ,
+    acknowledged_by VARCHAR,
+    resolved_at     TIMESTAMPTZ
+);
+
+-- Un solo alert aperto per regola e gateway (deduplicazione del servizio di alerting)
+CREATE UNIQUE INDEX IF NOT EXISTS alerts_open_idx ON tenant_1.alerts (rule_id, gateway_id) WHERE status <> 'resolved';
+
 CREATE TABLE IF NOT EXISTS tenant_2.heart_rate (
     time        TIMESTAMPTZ       NOT NULL,
     gateway_id  VARCHAR           NOT NULL,
-    bpm         INTEGER           NOT NULL CHECK (bpm > 0)
+    msg_id      VARCHAR           NOT NULL,
+    bpm         INTEGER           NOT NULL CHECK (bpm > 0),
+    UNIQUE (msg_id, time)
 );
 
 CREATE TABLE IF NOT EXISTS tenant_2.blood_oxygen (
     time        TIMESTAMPTZ       NOT NULL,
     gateway_id  VARCHAR           NOT NULL,
-    spo2        NUMERIC(5,2)      NOT NULL CHECK (spo2 >= 0 AND spo2 <= 100)
+    msg_id      VARCHAR           NOT NULL,
+    spo2        NUMERIC(5,2)      NOT NULL CHECK (spo2 >= 0 AND spo2 <= 100),
+    UNIQUE (msg_id, time)
 );
 
 
@@ -37,20 +66,43 @@ SELECT create_hypertable('tenant_2.heart_rate', 'time');
 
 SELECT create_hypertable('tenant_2.blood_oxygen', 'time');
 
+-- Alert del servizio di alerting
+CREATE TABLE IF NOT EXISTS tenant_2.alerts (
+    id              BIGSERIAL         PRIMARY KEY,
+    rule_id         BIGINT            NOT NULL,
+    rule_name       VARCHAR           NOT NULL,
+    gateway_id      VARCHAR           NOT NULL,
+    metric          VARCHAR           NOT NULL,
+    severity        VARCHAR           NOT NULL,
+    status          VARCHAR           NOT NULL CHECK (status IN ('firing', 'acknowledged', 'resolved')),
+    message         VARCHAR           NOT NULL,
+    value           DOUBLE PRECISION  NOT NULL,
+    threshold       DOUBLE PRECISION  NOT NULL,
+    fired_at        TIMESTAMPTZ       NOT NULL,
+    acknowledged_at TIMESTAMPTZ,
+    acknowledged_by VARCHAR,
+    resolved_at     TIMESTAMPTZ
+);
+
+-- Un solo alert aperto per regola e gateway (deduplicazione del servizio di alerting)
+CREATE UNIQUE INDEX IF NOT EXISTS alerts_open_idx ON tenant_2.alerts (rule_id, gateway_id) WHERE status <> 'resolved';
+
 REVOKE ALL ON SCHEMA public FROM PUBLIC;
 
 -- Creazione tenant_1 e utente
-CREATE USER tenant_1_user WITH PASSWORD 'user';
+CREATE USER tenant_1_user; -- password impostata dalla dashboard all'avvio (TENANT_DB_SECRET)
 GRANT USAGE ON SCHEMA tenant_1 TO tenant_1_user;
 GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA tenant_1 TO tenant_1_user;
+GRANT USAGE ON ALL SEQUENCES IN SCHEMA tenant_1 TO tenant_1_user;
 ALTER DEFAULT PRIVILEGES IN SCHEMA tenant_1
 GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO tenant_1_user;
 ALTER ROLE tenant_1_user SET search_path TO tenant_1, public;
 
 -- Creazione tenant_2 e utente
-CREATE USER tenant_2_user WITH PASSWORD 'user';
+CREATE USER tenant_2_user; -- password impostata dalla dashboard all'avvio (TENANT_DB_SECRET)
 GRANT USAGE ON SCHEMA tenant_2 TO tenant_2_user;
 GRANT SELECT, INSERT, UPDATE, DELETE ON ALL TABLES IN SCHEMA tenant_2 TO tenant_2_user;
+GRANT USAGE ON ALL SEQUENCES IN SCHEMA tenant_2 TO tenant_2_user;
 ALTER DEFAULT PRIVILEGES IN SCHEMA tenant_2
 GRANT SELECT, INSERT, UPDATE, DELETE ON TABLES TO tenant_2_user;
 ALTER ROLE tenant_2_user SET search_path TO tenant_2, public;
@@ -66,4 +118,4 @@ CREATE TABLE IF NOT EXISTS tenants(
     updated_at  TIMESTAMPTZ
 );
 
-INSERT INTO tenants(nats_id, name) VALUES ('tenant_1', 'Tenant 1');
+INSERT INTO tenants(nats_id, name) VALUES ('tenant_1', 'Tenant 1'), ('tenant_2', 'Tenant 2');
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Notification è il contenuto inviato sui canali: il JSON del webhook e del pager,
+// il testo dell'email
+type Notification struct {
+	// <tenant>.<alert>.<regola>.<stato>, uguale in tutti i tentativi: chi riceve può scartare i doppioni
+	ID         string `json:"id"`
+	Tenant     string `json:"tenant"`
+	Channel    string `json:"channel"`
+	Escalation bool   `json:"escalation"`
+	Alert      *Alert `json:"alert"`
+}
+
+// sender invia una notifica su un tipo di canale. Gli errori PermanentError non vengono ritentati
+type sender interface {
+	send(ctx context.Context, ch Channel, n *Notification) error
+}
+
+// PermanentError indica un errore che non si risolve ritentando (es. webhook che risponde 400)
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+func permanent(format string, args ...any) error {
+	return &PermanentError{Err: fmt.Errorf(format, args...)}
+}
+
+func isPermanent(err error) bool {
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr)
+}
+
+// title è l'oggetto dell'email, es. "[CRITICAL] Desaturazione - gateway gw_1"
+func (n *Notification) title() string {
+	a := n.Alert
+	prefix := strings.ToUpper(a.Severity)
+	switch {
+	case a.Status == StatusResolved:
+		prefix = "RISOLTO"
+	case n.Escalation:
+		prefix = "ESCALATION " + prefix
+	}
+	return fmt.Sprintf("[%s] %s - gateway %s", prefix, a.RuleName, a.GatewayID)
+}
+
+// text è il corpo dell'email
+func (n *Notification) text() string {
+	a := n.Alert
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", a.Message)
+	fmt.Fprintf(&b, "Tenant: %s\n", a.Tenant)
+	fmt.Fprintf(&b, "Gateway: %s\n", a.GatewayID)
+	fmt.Fprintf(&b, "Regola: %s (%s)\n", a.RuleName, a.Metric)
+	fmt.Fprintf(&b, "Severità: %s\n", a.Severity)
+	fmt.Fprintf(&b, "Stato: %s\n", a.Status)
+	fmt.Fprintf(&b, "Valore: %g (soglia %g)\n", a.Value, a.Threshold)
+	fmt.Fprintf(&b, "Aperto: %s\n", a.FiredAt.Format(time.RFC3339))
+	if a.AcknowledgedAt != nil && a.AcknowledgedBy != nil {
+		fmt.Fprintf(&b, "Confermato da %s: %s\n", *a.AcknowledgedBy, a.AcknowledgedAt.Format(time.RFC3339))
+	}
+	if a.ResolvedAt != nil {
+		fmt.Fprintf(&b, "Risolto: %s\n", a.ResolvedAt.Format(time.RFC3339))
+	}
+	if n.Escalation && a.Status == StatusFiring {
+		b.WriteString("\nL'alert non è stato confermato da nessun operatore.\n")
+	}
+	return b.String()
+}
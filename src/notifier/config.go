@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV con canali e regole di instradamento, scritti dalla dashboard.
+// Le chiavi sono <tenant>.channel.<id> e <tenant>.route.<id>
+const configBucket = "notifications"
+
+// Tipi di canale
+const (
+	WebhookChannel = "webhook"
+	EmailChannel   = "email"
+	PagerChannel   = "pager"
+)
+
+type Channel struct {
+	ID         uint     `json:"id"`
+	Tenant     string   `json:"tenant"`
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	URL        string   `json:"url,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Recipients []string `json:"recipients,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	Enabled    bool     `json:"enabled"`
+}
+
+// Route instrada gli alert del tenant verso un canale. Con DelaySeconds > 0 è un'escalation:
+// notifica solo se l'alert è ancora firing dopo il ritardo. Durante la fascia di silenzio
+// (QuietStart-QuietEnd nel fuso Timezone) le notifiche vengono rimandate alla fine della fascia,
+// tranne quelle degli alert con severità almeno QuietBypass
+type Route struct {
+	ID           uint   `json:"id"`
+	Tenant       string `json:"tenant"`
+	ChannelID    uint   `json:"channel_id"`
+	MinSeverity  string `json:"min_severity"`
+	Metric       string `json:"metric,omitempty"`
+	Gateway      string `json:"gateway,omitempty"`
+	DelaySeconds int    `json:"delay_seconds"`
+	QuietStart   string `json:"quiet_start,omitempty"`
+	QuietEnd     string `json:"quiet_end,omitempty"`
+	// Severità minima notificata anche nella fascia di silenzio, "none" = nessuna.
+	// Vuoto (regole scritte dalle versioni precedenti) = critical
+	QuietBypass  string `json:"quiet_bypass_severity,omitempty"`
+	Timezone     string `json:"timezone"`
+	SendResolved bool   `json:"send_resolved"`
+	Enabled      bool   `json:"enabled"`
+
+	location *time.Location
+}
+
+var severities = map[string]int{"info": 0, "warning": 1, "critical": 2}
+
+const quietBypassNone = "none"
+
+func (r *Route) validate() error {
+	if _, ok := severities[r.MinSeverity]; !ok {
+		return fmt.Errorf("severità non valida: %q", r.MinSeverity)
+	}
+	if r.DelaySeconds < 0 {
+		return errors.New("delay_seconds non può essere negativo")
+	}
+	if r.QuietBypass == "" {
+		r.QuietBypass = "critical"
+	}
+	if _, ok := severities[r.QuietBypass]; !ok && r.QuietBypass != quietBypassNone {
+		return fmt.Errorf("quiet_bypass_severity non valida: %q", r.QuietBypass)
+	}
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return fmt.Errorf("fuso orario non valido: %q", r.Timezone)
+	}
+	r.location = loc
+
+	if r.QuietStart == "" && r.QuietEnd == "" {
+		return nil
+	}
+	if _, err := time.Parse("15:04", r.QuietStart); err != nil {
+		return fmt.Errorf("quiet_start non valido: %q", r.QuietStart)
+	}
+	if _, err := time.Parse("15:04", r.QuietEnd); err != nil {
+		return fmt.Errorf("quiet_end non valido: %q", r.QuietEnd)
+	}
+	return nil
+}
+
+func (r *Route) matches(a *Alert) bool {
+	return r.Enabled && r.Tenant == a.Tenant &&
+		severities[a.Severity] >= severities[r.MinSeverity] &&
+		(r.Metric == "" || r.Metric == a.Metric) &&
+		(r.Gateway == "" || r.Gateway == a.GatewayID)
+}
+
+// due restituisce l'istante in cui la regola deve notificare l'alert: dopo il ritardo
+// dell'escalation e, se la severità non basta a ignorarla, fuori dalla fascia di silenzio
+func (r *Route) due(a *Alert) time.Time {
+	at := a.FiredAt.Add(time.Duration(r.DelaySeconds) * time.Second)
+	if r.QuietStart == "" || r.bypassesQuiet(a.Severity) {
+		return at
+	}
+
+	local := at.In(r.location)
+	start := clock(local, r.QuietStart)
+	end := clock(local, r.QuietEnd)
+
+	if start.Before(end) {
+		// Fascia nello stesso giorno, es. 13:00-15:00
+		if !local.Before(start) && local.Before(end) {
+			return end
+		}
+		return at
+	}
+	// Fascia a cavallo della mezzanotte, es. 22:00-07:00
+	if !local.Before(start) {
+		return end.AddDate(0, 0, 1)
+	}
+	if local.Before(end) {
+		return end
+	}
+	return at
+}
+
+func (r *Route) bypassesQuiet(severity string) bool {
+	if r.QuietBypass == quietBypassNone {
+		return false
+	}
+	return severities[severity] >= severities[r.QuietBypass]
+}
+
+// clock restituisce l'ora hh:mm del giorno di day, nel suo fuso
+func clock(day time.Time, hhmm string) time.Time {
+	t, _ := time.Parse("15:04", hhmm)
+	return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, day.Location())
+}
+
+// Config contiene canali e regole di tutti i tenant, aggiornati dal bucket notifications
+type Config struct {
+	mu       sync.RWMutex
+	channels map[string]Channel
+	routes   map[string]*Route
+}
+
+// target è una regola con il suo canale
+type target struct {
+	route   *Route
+	channel Channel
+}
+
+func channelKey(tenantId string, id uint) string {
+	return fmt.Sprintf("%s.channel.%d", tenantId, id)
+}
+
+// targets restituisce le regole abilitate che riguardano l'alert, con il loro canale, in ordine di id
+func (c *Config) targets(a *Alert) []target {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	var targets []target
+	for _, r := range c.routes {
+		if !r.matches(a) {
+			continue
+		}
+		ch, ok := c.channels[channelKey(r.Tenant, r.ChannelID)]
+		if !ok || !ch.Enabled {
+			continue
+		}
+		targets = append(targets, target{route: r, channel: ch})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].route.ID < targets[j].route.ID })
+	return targets
+}
+
+func (c *Config) apply(entry nats.KeyValueEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := entry.Key()
+	if entry.Operation() != nats.KeyValuePut {
+		delete(c.channels, key)
+		delete(c.routes, key)
+		return
+	}
+
+	// <tenant>.channel.<id> o <tenant>.route.<id>
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 {
+		log.Printf("Voce %s ignorata: chiave non valida", key)
+		return
+	}
+
+	switch parts[1] {
+	case "channel":
+		var ch Channel
+		if err := json.Unmarshal(entry.Value(), &ch); err != nil || channelKey(ch.Tenant, ch.ID) != key {
+			log.Printf("Canale %s ignorato: voce non valida", key)
+			return
+		}
+		switch ch.Type {
+		case WebhookChannel, EmailChannel, PagerChannel:
+		default:
+			log.Printf("Canale %s ignorato: tipo %q non supportato", key, ch.Type)
+			return
+		}
+		c.channels[key] = ch
+
+	case "route":
+		r := &Route{}
+		if err := json.Unmarshal(entry.Value(), r); err != nil || fmt.Sprintf("%s.route.%d", r.Tenant, r.ID) != key {
+			log.Printf("Regola %s ignorata: voce non valida", key)
+			return
+		}
+		if err := r.validate(); err != nil {
+			log.Printf("Regola %s ignorata: %v", key, err)
+			return
+		}
+		c.routes[key] = r
+
+	default:
+		log.Printf("Voce %s ignorata: chiave non valida", key)
+	}
+}
+
+// watchConfig carica canali e regole e continua ad aggiornarli finché ctx non viene annullato.
+// Ritorna dopo aver caricato le voci esistenti
+func watchConfig(ctx context.Context, js nats.JetStreamContext) (*Config, error) {
+	kv, err := openBucket(js, &nats.KeyValueConfig{
+		Bucket:      configBucket,
+		Description: "Canali e regole di notifica dei tenant",
+		History:     5,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Config{channels: map[string]Channel{}, routes: map[string]*Route{}}
+	if _, err := watchBucket(ctx, kv, c.apply); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	log.Printf("Configurazione caricata: %d canali, %d regole", len(c.channels), len(c.routes))
+	c.mu.RUnlock()
+
+	return c, nil
+}
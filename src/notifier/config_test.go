@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteDue(t *testing.T) {
+	rome, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(day int, hhmm string) time.Time {
+		hm, _ := time.Parse("15:04", hhmm)
+		return time.Date(2026, time.March, day, hm.Hour(), hm.Minute(), 0, 0, rome)
+	}
+
+	tests := []struct {
+		name       string
+		quietStart string
+		quietEnd   string
+		bypass     string
+		delay      int
+		severity   string
+		firedAt    time.Time
+		due        time.Time
+	}{
+		// Fascia a cavallo della mezzanotte
+		{name: "prima della fascia", quietStart: "22:00", quietEnd: "07:00", firedAt: at(10, "21:59"), due: at(10, "21:59")},
+		{name: "inizio della fascia", quietStart: "22:00", quietEnd: "07:00", firedAt: at(10, "22:00"), due: at(11, "07:00")},
+		{name: "prima di mezzanotte", quietStart: "22:00", quietEnd: "07:00", firedAt: at(10, "23:30"), due: at(11, "07:00")},
+		{name: "dopo mezzanotte", quietStart: "22:00", quietEnd: "07:00", firedAt: at(11, "02:00"), due: at(11, "07:00")},
+		{name: "fine della fascia", quietStart: "22:00", quietEnd: "07:00", firedAt: at(11, "07:00"), due: at(11, "07:00")},
+		{name: "dopo la fascia", quietStart: "22:00", quietEnd: "07:00", firedAt: at(11, "12:00"), due: at(11, "12:00")},
+		{name: "ritardo che entra nella fascia", quietStart: "22:00", quietEnd: "07:00", delay: 900, firedAt: at(10, "21:50"), due: at(11, "07:00")},
+		{name: "ritardo che esce dalla fascia", quietStart: "22:00", quietEnd: "07:00", delay: 3600, firedAt: at(11, "06:30"), due: at(11, "07:30")},
+		{name: "fine del mese", quietStart: "22:00", quietEnd: "07:00", firedAt: at(31, "23:00"), due: time.Date(2026, time.April, 1, 7, 0, 0, 0, rome)},
+		// Nella notte del 29 marzo l'ora legale salta dalle 02:00 alle 03:00
+		{name: "cambio dell'ora", quietStart: "22:00", quietEnd: "07:00", firedAt: at(28, "23:00"), due: at(29, "07:00")},
+
+		// Fascia nello stesso giorno
+		{name: "dentro la fascia diurna", quietStart: "13:00", quietEnd: "15:00", firedAt: at(10, "14:00"), due: at(10, "15:00")},
+		{name: "fuori dalla fascia diurna", quietStart: "13:00", quietEnd: "15:00", firedAt: at(10, "15:00"), due: at(10, "15:00")},
+		{name: "prima della fascia diurna", quietStart: "13:00", quietEnd: "15:00", firedAt: at(10, "12:59"), due: at(10, "12:59")},
+
+		// Severità che ignora la fascia
+		{name: "critical ignora la fascia", quietStart: "22:00", quietEnd: "07:00", severity: "critical", firedAt: at(10, "23:30"), due: at(10, "23:30")},
+		{name: "critical con bypass none", quietStart: "22:00", quietEnd: "07:00", bypass: quietBypassNone, severity: "critical", firedAt: at(10, "23:30"), due: at(11, "07:00")},
+		{name: "warning con bypass warning", quietStart: "22:00", quietEnd: "07:00", bypass: "warning", severity: "warning", firedAt: at(10, "23:30"), due: at(10, "23:30")},
+
+		{name: "senza fascia", delay: 300, firedAt: at(10, "23:30"), due: at(10, "23:35")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Route{
+				MinSeverity:  "info",
+				DelaySeconds: tt.delay,
+				QuietStart:   tt.quietStart,
+				QuietEnd:     tt.quietEnd,
+				QuietBypass:  tt.bypass,
+				Timezone:     "Europe/Rome",
+			}
+			if err := r.validate(); err != nil {
+				t.Fatal(err)
+			}
+			severity := tt.severity
+			if severity == "" {
+				severity = "warning"
+			}
+
+			// FiredAt arriva in UTC dall'alerting
+			due := r.due(&Alert{Severity: severity, FiredAt: tt.firedAt.UTC()})
+			if !due.Equal(tt.due) {
+				t.Errorf("due = %v, atteso %v", due.In(rome), tt.due)
+			}
+		})
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// Stream degli eventi degli alert, creato dal servizio di alerting
+	alertsStream  = "ALERTS"
+	alertsSubject = "alerts.>"
+
+	// Bucket KV con le notifiche già inviate, chiave <tenant>.<alert>.<regola>.<stato>.
+	// Evita i doppioni quando un evento viene riconsegnato
+	sentBucket = "notifications_sent"
+	sentTTL    = 30 * 24 * time.Hour
+
+	// Attesa prima di ritentare una notifica fallita
+	retryDelay = 30 * time.Second
+	// Consegne oltre le quali si smette di ritentare le notifiche di risoluzione
+	maxResolvedDeliveries = 20
+)
+
+// Stati di un alert
+const (
+	StatusFiring       = "firing"
+	StatusAcknowledged = "acknowledged"
+	StatusResolved     = "resolved"
+)
+
+// Alert è il payload degli eventi su alerts.<tenant>.<gateway>.<regola> (vedi alerting/store.go)
+type Alert struct {
+	ID             int64      `json:"id"`
+	Tenant         string     `json:"tenant"`
+	RuleID         uint       `json:"rule_id"`
+	RuleName       string     `json:"rule_name"`
+	GatewayID      string     `json:"gateway_id"`
+	Metric         string     `json:"metric"`
+	Severity       string     `json:"severity"`
+	Status         string     `json:"status"`
+	Message        string     `json:"message"`
+	Value          float64    `json:"value"`
+	Threshold      float64    `json:"threshold"`
+	FiredAt        time.Time  `json:"fired_at"`
+	AcknowledgedAt *time.Time `json:"acknowledged_at,omitempty"`
+	AcknowledgedBy *string    `json:"acknowledged_by,omitempty"`
+	ResolvedAt     *time.Time `json:"resolved_at,omitempty"`
+}
+
+// Dispatcher instrada gli eventi degli alert verso i canali dei tenant.
+//
+// Un evento firing resta in attesa (NakWithDelay) finché ci sono regole da notificare più tardi,
+// cioè escalation o notifiche rimandate dalla fascia di silenzio. Ad ogni riconsegna l'ultimo
+// evento dell'alert nello stream dice se è ancora firing: se è stato confermato o risolto le
+// notifiche in attesa vengono annullate. Lo stato è tutto in JetStream, quindi sopravvive ai riavvii
+type Dispatcher struct {
+	js      nats.JetStreamContext
+	config  *Config
+	sent    nats.KeyValue
+	senders map[string]sender
+}
+
+func newDispatcher(js nats.JetStreamContext, config *Config, senders map[string]sender) (*Dispatcher, error) {
+	if _, err := js.StreamInfo(alertsStream); err != nil {
+		return nil, fmt.Errorf("stream %s (il servizio di alerting è stato avviato?): %v", alertsStream, err)
+	}
+
+	kv, err := openBucket(js, &nats.KeyValueConfig{
+		Bucket:      sentBucket,
+		Description: "Notifiche degli alert già inviate",
+		History:     1,
+		TTL:         sentTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Dispatcher{js: js, config: config, sent: kv, senders: senders}, nil
+}
+
+// configConsumer crea il consumer durevole. Al primo avvio parte dagli eventi nuovi, per non
+// notificare alert vecchi. MaxDeliver è illimitato perché le escalation riconsegnano l'evento
+func configConsumer(js nats.JetStreamContext, durable string) error {
+	_, err := js.ConsumerInfo(alertsStream, durable)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, nats.ErrConsumerNotFound) {
+		return err
+	}
+
+	_, err = js.AddConsumer(alertsStream, &nats.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: alertsSubject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		DeliverPolicy: nats.DeliverNewPolicy,
+		AckWait:       30 * time.Second,
+		MaxDeliver:    -1,
+		MaxAckPending: 10000,
+	})
+	return err
+}
+
+// Attesa dopo un errore di fetch, raddoppiata a ogni errore consecutivo fino a fetchRetryMaxDelay
+const (
+	fetchRetryDelay    = 500 * time.Millisecond
+	fetchRetryMaxDelay = 10 * time.Second
+)
+
+// consume elabora gli eventi finché ctx non viene annullato
+func (d *Dispatcher) consume(ctx context.Context, durable string, batchSize int) {
+	sub, err := d.js.PullSubscribe(alertsSubject, durable, nats.Bind(alertsStream, durable))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer sub.Unsubscribe()
+
+	log.Printf("Notifier in ascolto su %s... premi Ctrl+C per uscire", alertsStream)
+
+	delay := fetchRetryDelay
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(batchSize, nats.MaxWait(2*time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			// Errori come la connessione chiusa ritornano subito: senza attesa il ciclo girerebbe a vuoto
+			log.Printf("Errore fetch, nuovo tentativo tra %s: %v", delay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, fetchRetryMaxDelay)
+			continue
+		}
+		delay = fetchRetryDelay
+
+		for _, msg := range msgs {
+			d.handle(ctx, msg)
+		}
+	}
+}
+
+func (d *Dispatcher) handle(ctx context.Context, msg *nats.Msg) {
+	var a Alert
+	if err := json.Unmarshal(msg.Data, &a); err != nil || a.Tenant == "" {
+		log.Printf("Evento su %s scartato: payload non valido", msg.Subject)
+		msg.Term()
+		return
+	}
+
+	// I canali lenti (retry dei webhook) possono superare l'AckWait
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+
+	var next time.Time
+	switch a.Status {
+	case StatusFiring:
+		next = d.firing(ctx, msg, &a)
+	case StatusResolved:
+		next = d.resolved(ctx, msg, &a)
+	default:
+		// acknowledged: le escalation in attesa si annullano alla prossima riconsegna
+	}
+
+	if next.IsZero() {
+		msg.Ack()
+		return
+	}
+	delay := time.Until(next)
+	if delay < time.Second {
+		delay = time.Second
+	}
+	msg.NakWithDelay(delay)
+}
+
+// firing notifica le regole già scadute e restituisce quando riconsegnare l'evento (zero = mai)
+func (d *Dispatcher) firing(ctx context.Context, msg *nats.Msg, a *Alert) time.Time {
+	if !d.stillFiring(msg.Subject, a) {
+		return time.Time{}
+	}
+
+	now := time.Now()
+	var next time.Time
+	for _, t := range d.config.targets(a) {
+		due := t.route.due(a)
+		if due.After(now) {
+			next = earliest(next, due)
+			continue
+		}
+		if err := d.deliver(ctx, t, a); err != nil {
+			next = earliest(next, now.Add(retryDelay))
+		}
+	}
+	return next
+}
+
+// resolved notifica la risoluzione alle regole con send_resolved che avevano notificato l'alert
+func (d *Dispatcher) resolved(ctx context.Context, msg *nats.Msg, a *Alert) time.Time {
+	if meta, err := msg.Metadata(); err == nil && meta.NumDelivered > maxResolvedDeliveries {
+		log.Printf("Notifiche di risoluzione dell'alert %s.%d abbandonate dopo %d tentativi", a.Tenant, a.ID, maxResolvedDeliveries)
+		return time.Time{}
+	}
+
+	var next time.Time
+	for _, t := range d.config.targets(a) {
+		if !t.route.SendResolved || !d.delivered(sentKey(a, t.route, StatusFiring)) {
+			continue
+		}
+		if err := d.deliver(ctx, t, a); err != nil {
+			next = earliest(next, time.Now().Add(retryDelay))
+		}
+	}
+	return next
+}
+
+// stillFiring controlla che l'ultimo evento sul subject sia dell'alert e ancora firing, cioè che
+// non sia stato confermato o risolto. Per regola e gateway c'è al massimo un alert aperto, quindi
+// se l'ultimo evento è di un alert più recente questo è già stato risolto
+func (d *Dispatcher) stillFiring(subject string, a *Alert) bool {
+	raw, err := d.js.GetLastMsg(alertsStream, subject)
+	if err != nil {
+		log.Printf("Errore lettura ultimo evento su %s: %v", subject, err)
+		return true
+	}
+
+	var last Alert
+	if err := json.Unmarshal(raw.Data, &last); err != nil {
+		return true
+	}
+	return last.ID == a.ID && last.Status == StatusFiring
+}
+
+func sentKey(a *Alert, r *Route, status string) string {
+	return fmt.Sprintf("%s.%d.%d.%s", a.Tenant, a.ID, r.ID, status)
+}
+
+func (d *Dispatcher) delivered(key string) bool {
+	_, err := d.sent.Get(key)
+	return err == nil
+}
+
+// deliver invia la notifica sul canale della regola, se non è già stata inviata.
+// Gli errori permanenti vengono solo registrati: ritentare non servirebbe
+func (d *Dispatcher) deliver(ctx context.Context, t target, a *Alert) error {
+	key := sentKey(a, t.route, a.Status)
+	if d.delivered(key) {
+		return nil
+	}
+
+	n := &Notification{
+		ID:         key,
+		Tenant:     a.Tenant,
+		Channel:    t.channel.Name,
+		Escalation: t.route.DelaySeconds > 0,
+		Alert:      a,
+	}
+	err := d.senders[t.channel.Type].send(ctx, t.channel, n)
+	if err != nil && !isPermanent(err) {
+		log.Printf("Notifica %s sul canale %s (%s) fallita, nuovo tentativo tra %s: %v", key, t.channel.Name, t.channel.Type, retryDelay, err)
+		return err
+	}
+
+	if err != nil {
+		log.Printf("Notifica %s sul canale %s (%s) scartata: %v", key, t.channel.Name, t.channel.Type, err)
+	} else {
+		log.Printf("Notifica %s inviata sul canale %s (%s)", key, t.channel.Name, t.channel.Type)
+	}
+	if _, err := d.sent.Put(key, []byte(time.Now().Format(time.RFC3339))); err != nil {
+		log.Printf("Errore salvataggio notifica %s: %v", key, err)
+	}
+	return nil
+}
+
+func earliest(a time.Time, b time.Time) time.Time {
+	if a.IsZero() || b.Before(a) {
+		return b
+	}
+	return a
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// emailSender invia la notifica via SMTP. Se il server lo supporta la connessione passa a TLS
+// (STARTTLS); l'autenticazione è usata solo se è configurato un utente
+type emailSender struct {
+	addr     string
+	from     string
+	username string
+	password string
+	timeout  time.Duration
+}
+
+func (e *emailSender) send(ctx context.Context, ch Channel, n *Notification) error {
+	if e.addr == "" {
+		return permanent("server SMTP non configurato")
+	}
+	host, _, err := net.SplitHostPort(e.addr)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	dialer := net.Dialer{Timeout: e.timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(e.timeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.username, e.password, host)); err != nil {
+			return smtpError(err)
+		}
+	}
+
+	if err := c.Mail(e.from); err != nil {
+		return smtpError(err)
+	}
+	for _, rcpt := range ch.Recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return smtpError(err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(e.message(ch, n)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return c.Quit()
+}
+
+func (e *emailSender) message(ch Channel, n *Notification) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", e.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(ch.Recipients, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", n.title()))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@glitchhub>\r\n", n.ID)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(n.text(), "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// smtpError rende permanenti i rifiuti 5xx del server (es. destinatario inesistente)
+func smtpError(err error) error {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) && protoErr.Code >= 500 {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// openBucket restituisce il bucket cfg.Bucket, creandolo con cfg se non esiste
+func openBucket(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("errore apertura bucket %s: %v", cfg.Bucket, err)
+	}
+	return kv, nil
+}
+
+// watchBucket passa ad apply tutte le voci del bucket e ritorna quando le ha ricevute tutte.
+// Gli aggiornamenti successivi vengono passati ad apply da una goroutine finché ctx non viene
+// annullato o il watcher restituito non viene fermato
+func watchBucket(ctx context.Context, kv nats.KeyValue, apply func(nats.KeyValueEntry)) (nats.KeyWatcher, error) {
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, fmt.Errorf("errore watch bucket %s: %v", kv.Bucket(), err)
+	}
+
+	// Il primo nil sul canale indica che i valori iniziali sono stati ricevuti tutti
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		apply(entry)
+	}
+
+	go func() {
+		defer watcher.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case entry, ok := <-watcher.Updates():
+				if !ok {
+					return
+				}
+				if entry != nil {
+					apply(entry)
+				}
+			}
+		}
+	}()
+
+	return watcher, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	_ "time/tzdata" // fusi orari delle fasce di silenzio, anche senza tzdata nell'immagine
+
+	"github.com/nats-io/nats.go"
+)
+
+func main() {
+
+	natsURL := flag.String("nats-url", "localhost:4222", "NATS server URL")
+	credsPath := flag.String("creds", "dataconsumer.creds", "Credenziali NATS dell'account consumers")
+	durable := flag.String("durable", "notifier", "Nome del pull consumer durevole")
+	batchSize := flag.Int("batch-size", 20, "Numero massimo di eventi per fetch")
+	smtpAddr := flag.String("smtp-addr", "localhost:1025", "Server SMTP host:porta, vuoto = email disabilitate")
+	smtpFrom := flag.String("smtp-from", "alert@glitchhubteam.it", "Mittente delle email")
+	smtpUsername := flag.String("smtp-username", "", "Utente SMTP (la password va in SMTP_PASSWORD), vuoto = nessuna autenticazione")
+	timeout := flag.Duration("timeout", 10*time.Second, "Timeout di ogni invio")
+	webhookRetries := flag.Int("webhook-retries", 3, "Tentativi ripetuti di un webhook fallito, prima di riprovare più tardi")
+
+	flag.Parse()
+
+	if *batchSize <= 0 || *timeout <= 0 || *webhookRetries < 0 {
+		log.Fatal("batch-size e timeout devono essere positivi, webhook-retries non negativo")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	nc, err := getNatsConnection(*natsURL, "glitchhubteam.it", *credsPath)
+	if err != nil {
+		log.Fatalf("Errore connessione NATS: %v", err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Errore ottenimento JetStream: %v", err)
+	}
+
+	config, err := watchConfig(ctx, js)
+	if err != nil {
+		log.Fatalf("Errore configurazione delle notifiche: %v", err)
+	}
+
+	senders := map[string]sender{
+		WebhookChannel: newWebhookSender(*timeout, *webhookRetries),
+		EmailChannel: &emailSender{
+			addr:     *smtpAddr,
+			from:     *smtpFrom,
+			username: *smtpUsername,
+			password: os.Getenv("SMTP_PASSWORD"),
+			timeout:  *timeout,
+		},
+		PagerChannel: &pagerSender{nc: nc, timeout: *timeout},
+	}
+
+	dispatcher, err := newDispatcher(js, config, senders)
+	if err != nil {
+		log.Fatalf("Errore avvio notifier: %v", err)
+	}
+	if err := configConsumer(js, *durable); err != nil {
+		log.Fatalf("Errore configurazione consumer: %v", err)
+	}
+
+	dispatcher.consume(ctx, *durable, *batchSize)
+	nc.Drain()
+}
+
+func getNatsConnection(natsURL string, servername string, credsPath string) (*nats.Conn, error) {
+	opts := nats.GetDefaultOptions()
+	opts.Url = natsURL
+
+	certPool := x509.NewCertPool()
+	caData, err := os.ReadFile("certs/ca.pem") //ca.pem da prendere da BITWARDEN
+	if err != nil {
+		log.Fatalf("Errore lettura file: %v", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(caData); !ok {
+		log.Fatal("Impossibile aggiungere il certificato CA al pool: il formato potrebbe essere errato")
+	}
+
+	opts.TLSConfig = &tls.Config{
+		RootCAs:    certPool,
+		ServerName: servername,
+	}
+	opts.MaxReconnect = -1
+
+	err = nats.UserCredentials(credsPath)(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.Connect()
+}
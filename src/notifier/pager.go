@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// pagerSender invia la notifica come request NATS su pager.<tenant>.<subject>. L'integrazione
+// con i cercapersone deve rispondere (anche con un messaggio vuoto) per confermare la ricezione:
+// senza risposta la notifica viene ritentata
+type pagerSender struct {
+	nc      *nats.Conn
+	timeout time.Duration
+}
+
+func (p *pagerSender) send(ctx context.Context, ch Channel, n *Notification) error {
+	data, err := json.Marshal(n)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	subject := fmt.Sprintf("pager.%s.%s", n.Tenant, ch.Subject)
+	if _, err := p.nc.RequestWithContext(ctx, subject, data); err != nil {
+		return fmt.Errorf("%s: %w", subject, err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header delle richieste dei webhook. La firma è l'HMAC-SHA256, con il secret del canale,
+// di "<timestamp>.<body>": chi riceve la ricalcola e scarta le richieste con timestamp vecchi
+const (
+	headerDelivery  = "X-GlitchHub-Delivery"
+	headerTimestamp = "X-GlitchHub-Timestamp"
+	headerSignature = "X-GlitchHub-Signature"
+)
+
+// webhookSender invia la notifica in POST, ritentando con backoff esponenziale
+// gli errori di rete, le risposte 5xx e le 429
+type webhookSender struct {
+	client  *http.Client
+	retries int
+	backoff time.Duration
+}
+
+func newWebhookSender(timeout time.Duration, retries int) *webhookSender {
+	return &webhookSender{
+		client:  &http.Client{Timeout: timeout},
+		retries: retries,
+		backoff: time.Second,
+	}
+}
+
+func (w *webhookSender) send(ctx context.Context, ch Channel, n *Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	delay := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, ch, n.ID, body)
+		if err == nil || isPermanent(err) || attempt >= w.retries {
+			return err
+		}
+
+		log.Printf("Webhook %s (%s), tentativo %d fallito: %v", ch.Name, n.ID, attempt+1, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *webhookSender) post(ctx context.Context, ch Channel, id string, body []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ch.URL, bytes.NewReader(body))
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(headerDelivery, id)
+	req.Header.Set(headerTimestamp, timestamp)
+	req.Header.Set(headerSignature, "sha256="+sign(ch.Secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("risposta %s", resp.Status)
+	default:
+		return permanent("risposta %s", resp.Status)
+	}
+}
+
+func sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
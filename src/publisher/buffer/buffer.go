@@ -0,0 +1,375 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Policy indica cosa fare quando il buffer raggiunge la dimensione massima
+type Policy string
+
+const (
+	// Elimina i segmenti più vecchi per fare spazio alle nuove letture
+	DropOldest Policy = "drop-oldest"
+	// Scarta le nuove letture finché il buffer non viene svuotato
+	DropNewest Policy = "drop-newest"
+)
+
+const (
+	segmentExt         = ".seg"
+	defaultSegmentSize = 1024 * 1024 // 1 MB
+)
+
+var ErrBufferFull = errors.New("buffer pieno: lettura scartata")
+
+func ParsePolicy(s string) (Policy, error) {
+	switch Policy(s) {
+	case DropOldest, DropNewest:
+		return Policy(s), nil
+	case "":
+		return DropOldest, nil
+	default:
+		return "", fmt.Errorf("policy di eviction non valida: %q (ammesse: %s, %s)", s, DropOldest, DropNewest)
+	}
+}
+
+// Record è una lettura in attesa di essere pubblicata.
+// MsgID viene salvato insieme alla lettura così le ripubblicazioni vengono deduplicate da JetStream.
+type Record struct {
+	Subject string `json:"subject"`
+	MsgID   string `json:"msg_id,omitempty"`
+	Data    []byte `json:"data"`
+}
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+// Buffer è una coda persistente su disco composta da file di segmento append-only.
+// I record vengono scritti nel segmento più recente e consumati a partire dal più vecchio,
+// così l'ordine di pubblicazione originale viene mantenuto anche dopo un riavvio.
+type Buffer struct {
+	mu          sync.Mutex
+	dir         string
+	maxBytes    int64
+	segmentSize int64
+	policy      Policy
+
+	segments []segment // ordinati dal più vecchio al più recente
+	size     int64
+	records  int
+	active   *os.File // segmento aperto in scrittura (l'ultimo di segments)
+	draining uint64   // id del segmento in fase di svuotamento, 0 se nessuno
+	nextID   uint64
+	dropped  uint64
+}
+
+// Open apre (o crea) il buffer nella cartella indicata, recuperando i segmenti già presenti
+func Open(dir string, maxBytes int64, policy Policy) (*Buffer, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("dimensione massima del buffer non valida: %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("impossibile creare la cartella del buffer: %v", err)
+	}
+
+	b := &Buffer{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		segmentSize: min(defaultSegmentSize, maxBytes),
+		policy:      policy,
+		nextID:      1,
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != segmentExt {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			os.Remove(filepath.Join(dir, e.Name()))
+			continue
+		}
+		seg := segment{id: id, size: int64(len(data)), records: len(splitLines(data))}
+		b.segments = append(b.segments, seg)
+		b.size += seg.size
+		b.records += seg.records
+		b.nextID = max(b.nextID, id+1)
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i].id < b.segments[j].id })
+
+	return b, nil
+}
+
+func (b *Buffer) path(id uint64) string {
+	return filepath.Join(b.dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// Empty indica se non ci sono letture in attesa
+func (b *Buffer) Empty() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size == 0
+}
+
+// Len restituisce il numero di letture in attesa
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.records
+}
+
+// Size restituisce i byte occupati su disco dalle letture in attesa
+func (b *Buffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// Dropped restituisce il numero di letture perse a causa del limite di dimensione
+func (b *Buffer) Dropped() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.dropped
+}
+
+// Append accoda una lettura. Se il buffer è pieno applica la policy di eviction.
+func (b *Buffer) Append(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	n := int64(len(line))
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if n > b.maxBytes {
+		b.dropped++
+		return ErrBufferFull
+	}
+
+	for b.size+n > b.maxBytes {
+		if b.policy == DropNewest || !b.evictOldest() {
+			b.dropped++
+			return ErrBufferFull
+		}
+	}
+
+	if b.active == nil || b.segments[len(b.segments)-1].size+n > b.segmentSize {
+		if err := b.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := b.active.Write(line); err != nil {
+		return fmt.Errorf("errore scrittura segmento: %v", err)
+	}
+	if err := b.active.Sync(); err != nil {
+		return fmt.Errorf("errore sync segmento: %v", err)
+	}
+
+	b.segments[len(b.segments)-1].size += n
+	b.segments[len(b.segments)-1].records++
+	b.size += n
+	b.records++
+
+	return nil
+}
+
+// rotate chiude il segmento attivo e ne apre uno nuovo. Da chiamare con il lock acquisito.
+func (b *Buffer) rotate() error {
+	if b.active != nil {
+		b.active.Close()
+		b.active = nil
+	}
+
+	id := b.nextID
+	f, err := os.OpenFile(b.path(id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("impossibile creare il segmento: %v", err)
+	}
+
+	b.nextID++
+	b.active = f
+	b.segments = append(b.segments, segment{id: id})
+
+	return nil
+}
+
+// evictOldest elimina il segmento più vecchio che non è in fase di svuotamento.
+// Da chiamare con il lock acquisito. Restituisce false se non c'è nulla da eliminare.
+func (b *Buffer) evictOldest() bool {
+	for i, seg := range b.segments {
+		if seg.id == b.draining {
+			continue
+		}
+		if b.active != nil && i == len(b.segments)-1 {
+			b.active.Close()
+			b.active = nil
+		}
+
+		os.Remove(b.path(seg.id))
+		b.size -= seg.size
+		b.records -= seg.records
+		b.dropped += uint64(seg.records)
+		b.segments = append(b.segments[:i], b.segments[i+1:]...)
+		return true
+	}
+
+	return false
+}
+
+// removeSegment toglie un segmento dall'indice. Da chiamare con il lock acquisito.
+func (b *Buffer) removeSegment(id uint64) {
+	for i := range b.segments {
+		if b.segments[i].id == id {
+			b.size -= b.segments[i].size
+			b.records -= b.segments[i].records
+			b.segments = append(b.segments[:i], b.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+func splitLines(data []byte) [][]byte {
+	var lines [][]byte
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) > 0 {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Drain pubblica le letture in attesa in ordine, un segmento alla volta, tramite publish.
+// Si ferma al primo errore lasciando nel buffer le letture non ancora pubblicate.
+// Restituisce il numero di letture pubblicate.
+func (b *Buffer) Drain(publish func(Record) error) (int, error) {
+	sent := 0
+
+	for {
+		b.mu.Lock()
+		if len(b.segments) == 0 {
+			b.mu.Unlock()
+			return sent, nil
+		}
+		seg := b.segments[0]
+		if b.active != nil && len(b.segments) == 1 {
+			// Le nuove letture devono finire in un segmento successivo
+			b.active.Close()
+			b.active = nil
+		}
+		b.draining = seg.id
+		b.mu.Unlock()
+
+		n, err := b.drainSegment(seg, publish)
+		sent += n
+
+		b.mu.Lock()
+		b.draining = 0
+		b.mu.Unlock()
+
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+func (b *Buffer) drainSegment(seg segment, publish func(Record) error) (int, error) {
+	path := b.path(seg.id)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("errore lettura segmento: %v", err)
+	}
+	lines := splitLines(data)
+
+	sent := 0
+	for i, line := range lines {
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			// Riga corrotta (es. scrittura interrotta da un crash): viene scartata
+			continue
+		}
+
+		if err := publish(r); err != nil {
+			if rewriteErr := b.rewriteSegment(seg.id, lines[i:]); rewriteErr != nil {
+				return sent, rewriteErr
+			}
+			return sent, err
+		}
+		sent++
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	os.Remove(path)
+	b.removeSegment(seg.id)
+
+	return sent, nil
+}
+
+// rewriteSegment sostituisce il segmento con le sole righe non ancora pubblicate
+func (b *Buffer) rewriteSegment(id uint64, remaining [][]byte) error {
+	path := b.path(id)
+	tmp := path + ".tmp"
+
+	content := append(bytes.Join(remaining, []byte{'\n'}), '\n')
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("errore riscrittura segmento: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("errore riscrittura segmento: %v", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i := range b.segments {
+		if b.segments[i].id == id {
+			b.size += int64(len(content)) - b.segments[i].size
+			b.records += len(remaining) - b.segments[i].records
+			b.segments[i].size = int64(len(content))
+			b.segments[i].records = len(remaining)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Close chiude il segmento attivo. Le letture in attesa restano su disco.
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.active != nil {
+		err := b.active.Close()
+		b.active = nil
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package buffer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// record restituisce la lettura numero i, che ha i anche nel payload
+func record(i int) Record {
+	return Record{Subject: "sensors.tenant_1.gw_1.heart_rate", MsgID: fmt.Sprintf("msg-%d", i), Data: []byte(fmt.Sprintf(`{"seq":%d,"bpm":72}`, i))}
+}
+
+// seq restituisce il numero della lettura creata da record
+func seq(t *testing.T, r Record) int {
+	t.Helper()
+	var payload struct {
+		Seq int `json:"seq"`
+	}
+	if err := json.Unmarshal(r.Data, &payload); err != nil {
+		t.Fatal(err)
+	}
+	return payload.Seq
+}
+
+// lineSize è lo spazio occupato su disco da un record, newline compreso
+func lineSize(t *testing.T, r Record) int64 {
+	t.Helper()
+	line, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(len(line)) + 1
+}
+
+func drainSeqs(t *testing.T, b *Buffer) []int {
+	t.Helper()
+	var seqs []int
+	if _, err := b.Drain(func(r Record) error {
+		seqs = append(seqs, seq(t, r))
+		return nil
+	}); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	return seqs
+}
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		full    []int // letture per cui Append restituisce ErrBufferFull
+		drained []int
+	}{
+		{"drop-oldest", DropOldest, nil, []int{3, 4, 5}},
+		{"drop-newest", DropNewest, []int{4, 5}, []int{1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := lineSize(t, record(1))
+			b, err := Open(t.TempDir(), 3*size, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer b.Close()
+			// Un segmento per lettura, così drop-oldest può eliminarle una alla volta
+			b.segmentSize = size
+
+			var full []int
+			for i := 1; i <= 5; i++ {
+				err := b.Append(record(i))
+				if errors.Is(err, ErrBufferFull) {
+					full = append(full, i)
+				} else if err != nil {
+					t.Fatalf("Append(%d): %v", i, err)
+				}
+			}
+
+			if !slices.Equal(full, tt.full) {
+				t.Errorf("ErrBufferFull per %v, atteso %v", full, tt.full)
+			}
+			if b.Len() != 3 || b.Size() != 3*size {
+				t.Errorf("Len = %d, Size = %d, attesi 3 e %d", b.Len(), b.Size(), 3*size)
+			}
+			if b.Dropped() != 2 {
+				t.Errorf("Dropped = %d, atteso 2", b.Dropped())
+			}
+			if seqs := drainSeqs(t, b); !slices.Equal(seqs, tt.drained) {
+				t.Errorf("Drain = %v, atteso %v", seqs, tt.drained)
+			}
+			if !b.Empty() {
+				t.Error("buffer non vuoto dopo Drain")
+			}
+		})
+	}
+}
+
+func TestAppendTooLarge(t *testing.T) {
+	r := record(1)
+	b, err := Open(t.TempDir(), lineSize(t, r)-1, DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if err := b.Append(r); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("Append = %v, atteso ErrBufferFull", err)
+	}
+	if b.Dropped() != 1 || !b.Empty() {
+		t.Errorf("Dropped = %d, Empty = %v, attesi 1 e true", b.Dropped(), b.Empty())
+	}
+}
+
+// Se publish fallisce il segmento viene riscritto con le sole letture non pubblicate,
+// che restano nel buffer anche dopo averlo riaperto
+func TestDrainRewrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		failAt    int // lettura su cui publish fallisce
+		sent      int
+		remaining []int
+	}{
+		{"prima lettura", 1, 0, []int{1, 2, 3, 4}},
+		{"a metà", 3, 2, []int{3, 4}},
+		{"ultima lettura", 4, 3, []int{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			b, err := Open(dir, 1024*1024, DropOldest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 1; i <= 4; i++ {
+				if err := b.Append(record(i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			failure := errors.New("NATS non raggiungibile")
+			sent, err := b.Drain(func(r Record) error {
+				if seq(t, r) == tt.failAt {
+					return failure
+				}
+				return nil
+			})
+			if !errors.Is(err, failure) {
+				t.Fatalf("Drain = %v, atteso %v", err, failure)
+			}
+			if sent != tt.sent {
+				t.Errorf("pubblicate %d, attese %d", sent, tt.sent)
+			}
+			if b.Len() != len(tt.remaining) {
+				t.Errorf("Len = %d, atteso %d", b.Len(), len(tt.remaining))
+			}
+			size := b.Size()
+			b.Close()
+
+			reopened, err := Open(dir, 1024*1024, DropOldest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			if reopened.Len() != len(tt.remaining) || reopened.Size() != size {
+				t.Errorf("dopo la riapertura Len = %d, Size = %d, attesi %d e %d", reopened.Len(), reopened.Size(), len(tt.remaining), size)
+			}
+			if seqs := drainSeqs(t, reopened); !slices.Equal(seqs, tt.remaining) {
+				t.Errorf("Drain = %v, atteso %v", seqs, tt.remaining)
+			}
+		})
+	}
+}
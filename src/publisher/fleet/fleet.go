@@ -0,0 +1,264 @@
+package fleet
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gateway/buffer"
+	"gateway/gateway"
+	sensor "gateway/sensorData"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultCAFile     = "certs/ca.pem" //ca.pem da prendere da BITWARDEN
+	DefaultServerName = "glitchhubteam.it"
+	DefaultInterval   = 5 * time.Second
+	// Intervallo degli heartbeat, con cui il subscriber capisce se il gateway è online
+	DefaultHeartbeatInterval = 10 * time.Second
+
+	DefaultBufferDir      = "data/buffer"
+	DefaultBufferMaxBytes = 64 * 1024 * 1024 // 64 MB per gateway
+)
+
+// Fleet descrive l'insieme dei gateway simulati dal publisher
+type Fleet struct {
+	Buffer   BufferConfig    `json:"buffer"`
+	Gateways []GatewayConfig `json:"gateways"`
+}
+
+// BufferConfig configura il buffer offline. Ogni gateway usa una sottocartella <dir>/<tenant>_<gateway_id>
+type BufferConfig struct {
+	Dir      string `json:"dir,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+	// drop-oldest (default) oppure drop-newest
+	Policy string `json:"policy,omitempty"`
+}
+
+type GatewayConfig struct {
+	Tenant    string `json:"tenant"`
+	GatewayID string `json:"gateway_id"`
+	// Se vuoti vengono usati i valori di default (gateway/<gateway_id>.creds, certs/ca.pem, glitchhubteam.it)
+	CredsFile  string `json:"creds_file,omitempty"`
+	CAFile     string `json:"ca_file,omitempty"`
+	ServerName string `json:"tls_server_name,omitempty"`
+	// Intervallo usato dai sensori che non ne specificano uno proprio
+	PublishInterval Duration `json:"publish_interval,omitempty"`
+	// Intervallo degli heartbeat su sensors.<tenant>.<gateway_id>.$heartbeat
+	HeartbeatInterval Duration       `json:"heartbeat_interval,omitempty"`
+	Sensors           []SensorConfig `json:"sensors"`
+}
+
+type SensorConfig struct {
+	Type     string   `json:"type"`
+	Name     string   `json:"name,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// Duration permette di scrivere gli intervalli nel file come stringhe ("5s", "1m30s")
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durata non valida %s: usare una stringa come \"5s\"", data)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Load legge e valida il file di configurazione della flotta
+func Load(path string) (*Fleet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("errore lettura file flotta: %v", err)
+	}
+
+	var fleet Fleet
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&fleet); err != nil {
+		return nil, fmt.Errorf("errore parsing file flotta %s: %v", path, err)
+	}
+
+	fleet.applyDefaults()
+	if err := fleet.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &fleet, nil
+}
+
+// Default ricrea la flotta storica: un gateway per tenant, con gli stessi sensori per tutti
+func Default(gateways int, sensorTypes []string, interval time.Duration) *Fleet {
+	var fleet Fleet
+	for i := 0; i < gateways; i++ {
+		gw := GatewayConfig{
+			Tenant:          fmt.Sprintf("tenant_%d", i+1),
+			GatewayID:       fmt.Sprintf("gateway%d", i+1),
+			PublishInterval: Duration(interval),
+		}
+		for _, t := range sensorTypes {
+			gw.Sensors = append(gw.Sensors, SensorConfig{Type: t})
+		}
+		fleet.Gateways = append(fleet.Gateways, gw)
+	}
+
+	fleet.applyDefaults()
+	return &fleet
+}
+
+func (f *Fleet) applyDefaults() {
+	if f.Buffer.Dir == "" {
+		f.Buffer.Dir = DefaultBufferDir
+	}
+	if f.Buffer.MaxBytes == 0 {
+		f.Buffer.MaxBytes = DefaultBufferMaxBytes
+	}
+	if f.Buffer.Policy == "" {
+		f.Buffer.Policy = string(buffer.DropOldest)
+	}
+
+	for i := range f.Gateways {
+		gw := &f.Gateways[i]
+		if gw.CredsFile == "" {
+			gw.CredsFile = fmt.Sprintf("gateway/%s.creds", gw.GatewayID)
+		}
+		if gw.CAFile == "" {
+			gw.CAFile = DefaultCAFile
+		}
+		if gw.ServerName == "" {
+			gw.ServerName = DefaultServerName
+		}
+		if gw.PublishInterval == 0 {
+			gw.PublishInterval = Duration(DefaultInterval)
+		}
+		if gw.HeartbeatInterval == 0 {
+			gw.HeartbeatInterval = Duration(DefaultHeartbeatInterval)
+		}
+		for j := range gw.Sensors {
+			if gw.Sensors[j].Interval == 0 {
+				gw.Sensors[j].Interval = gw.PublishInterval
+			}
+		}
+	}
+}
+
+// Validate controlla l'intera flotta e riporta tutti gli errori trovati, non solo il primo
+func (f *Fleet) Validate() error {
+	var errs []error
+
+	if len(f.Gateways) == 0 {
+		errs = append(errs, errors.New("nessun gateway configurato"))
+	}
+	if f.Buffer.MaxBytes < 0 {
+		errs = append(errs, fmt.Errorf("buffer: max_bytes negativo"))
+	}
+	if _, err := buffer.ParsePolicy(f.Buffer.Policy); err != nil {
+		errs = append(errs, fmt.Errorf("buffer: %v", err))
+	}
+
+	seen := map[string]int{}
+	for i, gw := range f.Gateways {
+		where := fmt.Sprintf("gateways[%d] (%s/%s)", i, gw.Tenant, gw.GatewayID)
+
+		if err := validateToken(gw.Tenant); err != nil {
+			errs = append(errs, fmt.Errorf("%s: tenant %v", where, err))
+		}
+		if err := validateToken(gw.GatewayID); err != nil {
+			errs = append(errs, fmt.Errorf("%s: gateway_id %v", where, err))
+		}
+
+		key := gw.Tenant + "." + gw.GatewayID
+		if first, dup := seen[key]; dup {
+			errs = append(errs, fmt.Errorf("%s: duplicato di gateways[%d]", where, first))
+		} else {
+			seen[key] = i
+		}
+
+		if _, err := os.Stat(gw.CredsFile); err != nil {
+			errs = append(errs, fmt.Errorf("%s: creds_file: %v", where, err))
+		}
+		if _, err := os.Stat(gw.CAFile); err != nil {
+			errs = append(errs, fmt.Errorf("%s: ca_file: %v", where, err))
+		}
+		if gw.PublishInterval < 0 {
+			errs = append(errs, fmt.Errorf("%s: publish_interval negativo", where))
+		}
+		if gw.HeartbeatInterval < 0 {
+			errs = append(errs, fmt.Errorf("%s: heartbeat_interval negativo", where))
+		}
+
+		if len(gw.Sensors) == 0 {
+			errs = append(errs, fmt.Errorf("%s: nessun sensore configurato", where))
+		}
+		for j, s := range gw.Sensors {
+			if _, err := sensor.New(s.Type, s.Name, time.Duration(s.Interval)); err != nil {
+				errs = append(errs, fmt.Errorf("%s: sensors[%d]: %v", where, j, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateToken verifica che il valore possa essere usato come token di un subject NATS
+func validateToken(token string) error {
+	if token == "" {
+		return errors.New("mancante")
+	}
+	if strings.ContainsAny(token, ".*> \t\r\n") {
+		return fmt.Errorf("%q contiene caratteri non ammessi in un subject NATS", token)
+	}
+	return nil
+}
+
+// Configs converte la flotta nelle configurazioni usate dal package gateway
+func (f *Fleet) Configs() ([]gateway.Config, error) {
+	policy, err := buffer.ParsePolicy(f.Buffer.Policy)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make([]gateway.Config, 0, len(f.Gateways))
+	for _, gw := range f.Gateways {
+		cfg := gateway.Config{
+			TenantID:   gw.Tenant,
+			GatewayID:  gw.GatewayID,
+			CredsPath:  gw.CredsFile,
+			CAPath:     gw.CAFile,
+			ServerName: gw.ServerName,
+			Heartbeat:  time.Duration(gw.HeartbeatInterval),
+			Buffer: gateway.BufferConfig{
+				Dir:      filepath.Join(f.Buffer.Dir, gw.Tenant+"_"+gw.GatewayID),
+				MaxBytes: f.Buffer.MaxBytes,
+				Policy:   policy,
+			},
+		}
+
+		for _, s := range gw.Sensors {
+			sns, err := sensor.New(s.Type, s.Name, time.Duration(s.Interval))
+			if err != nil {
+				return nil, err
+			}
+			cfg.Sensors = append(cfg.Sensors, sns)
+		}
+
+		configs = append(configs, cfg)
+	}
+
+	return configs, nil
+}
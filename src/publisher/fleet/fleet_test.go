@@ -0,0 +1,87 @@
+package fleet
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validFleet restituisce una flotta valida con due gateway, con creds e CA in dir
+func validFleet(t *testing.T) *Fleet {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"gw_1.creds", "gw_2.creds", "ca.pem"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &Fleet{}
+	for _, id := range []string{"gw_1", "gw_2"} {
+		f.Gateways = append(f.Gateways, GatewayConfig{
+			Tenant:    "tenant_1",
+			GatewayID: id,
+			CredsFile: filepath.Join(dir, id+".creds"),
+			CAFile:    filepath.Join(dir, "ca.pem"),
+			Sensors:   []SensorConfig{{Type: "heart_rate"}, {Type: "blood_oxygen", Interval: Duration(time.Second)}},
+		})
+	}
+	f.applyDefaults()
+	return f
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(f *Fleet)
+		// Parti attese nel messaggio di errore, nessuna se la flotta è valida
+		errs []string
+	}{
+		{"valida", func(f *Fleet) {}, nil},
+		{"nessun gateway", func(f *Fleet) { f.Gateways = nil }, []string{"nessun gateway configurato"}},
+		{"policy del buffer", func(f *Fleet) { f.Buffer.Policy = "drop-random" }, []string{"buffer: policy di eviction non valida"}},
+		{"max_bytes negativo", func(f *Fleet) { f.Buffer.MaxBytes = -1 }, []string{"buffer: max_bytes negativo"}},
+		{"tenant mancante", func(f *Fleet) { f.Gateways[0].Tenant = "" }, []string{"gateways[0] (/gw_1): tenant mancante"}},
+		{"gateway_id con un punto", func(f *Fleet) { f.Gateways[1].GatewayID = "gw.2" }, []string{"gateways[1] (tenant_1/gw.2): gateway_id", "caratteri non ammessi"}},
+		{"wildcard nel tenant", func(f *Fleet) { f.Gateways[0].Tenant = "tenant_*" }, []string{"caratteri non ammessi"}},
+		{"gateway duplicato", func(f *Fleet) { f.Gateways[1].GatewayID = "gw_1" }, []string{"gateways[1] (tenant_1/gw_1): duplicato di gateways[0]"}},
+		{"stesso gateway_id in un altro tenant", func(f *Fleet) { f.Gateways[1].Tenant = "tenant_2"; f.Gateways[1].GatewayID = "gw_1" }, nil},
+		{"creds mancanti", func(f *Fleet) { f.Gateways[0].CredsFile = "non/esiste.creds" }, []string{"gateways[0] (tenant_1/gw_1): creds_file"}},
+		{"CA mancante", func(f *Fleet) { f.Gateways[1].CAFile = "non/esiste.pem" }, []string{"gateways[1] (tenant_1/gw_2): ca_file"}},
+		{"publish_interval negativo", func(f *Fleet) { f.Gateways[1].PublishInterval = Duration(-time.Second) }, []string{"gateways[1] (tenant_1/gw_2): publish_interval negativo"}},
+		{"heartbeat negativo", func(f *Fleet) { f.Gateways[0].HeartbeatInterval = Duration(-time.Second) }, []string{"heartbeat_interval negativo"}},
+		{"nessun sensore", func(f *Fleet) { f.Gateways[0].Sensors = nil }, []string{"gateways[0] (tenant_1/gw_1): nessun sensore configurato"}},
+		{"sensore sconosciuto", func(f *Fleet) { f.Gateways[0].Sensors[1].Type = "glucose" }, []string{"sensors[1]: tipo di sensore non registrato: glucose"}},
+		{"intervallo del sensore negativo", func(f *Fleet) { f.Gateways[1].Sensors[0].Interval = Duration(-time.Second) }, []string{"gateways[1] (tenant_1/gw_2): sensors[0]: intervallo di campionamento non valido"}},
+		{
+			"tutti gli errori, non solo il primo",
+			func(f *Fleet) { f.Gateways[0].Tenant = ""; f.Gateways[1].Sensors = nil },
+			[]string{"tenant mancante", "nessun sensore configurato"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := validFleet(t)
+			tt.modify(f)
+
+			err := f.Validate()
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("Validate = %v, atteso nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate = nil, atteso un errore con %q", tt.errs)
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate = %q, non contiene %q", err, want)
+				}
+			}
+		})
+	}
+}
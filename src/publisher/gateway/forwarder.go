@@ -0,0 +1,153 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"gateway/buffer"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Ogni quanto il forwarder prova a svuotare il buffer (oltre che a ogni riconnessione)
+const drainInterval = 2 * time.Second
+
+// forwarder pubblica le letture su JetStream oppure, se NATS non è raggiungibile,
+// le salva nel buffer su disco e le ripubblica in ordine quando la connessione torna
+type forwarder struct {
+	nc  *nats.Conn
+	js  nats.JetStreamContext
+	buf *buffer.Buffer
+	cfg Config
+
+	streamReady atomic.Bool
+	wake        chan struct{}
+}
+
+func newForwarder(nc *nats.Conn, js nats.JetStreamContext, buf *buffer.Buffer, cfg Config) *forwarder {
+	fw := &forwarder{
+		nc:   nc,
+		js:   js,
+		buf:  buf,
+		cfg:  cfg,
+		wake: make(chan struct{}, 1),
+	}
+
+	nc.SetReconnectHandler(func(nc *nats.Conn) {
+		log.Printf("Gateway %s riconnesso a %s", cfg.GatewayID, nc.ConnectedUrl())
+		fw.notify()
+	})
+
+	return fw
+}
+
+func (fw *forwarder) subject(metric string) string {
+	return "sensors." + fw.cfg.TenantID + "." + fw.cfg.GatewayID + "." + metric
+}
+
+// Ultimo token del subject degli heartbeat, che non è una metrica: il subscriber non lo salva sul database
+const heartbeatMetric = "$heartbeat"
+
+type heartbeat struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Letture in attesa nel buffer su disco
+	Buffered int `json:"buffered"`
+}
+
+func (fw *forwarder) notify() {
+	select {
+	case fw.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send pubblica la lettura su JetStream con l'header Nats-Msg-Id: se la stessa lettura viene inviata
+// più volte (retry, ripubblicazione dal buffer) il server la salva una sola volta entro la duplicate_window
+func (fw *forwarder) send(r buffer.Record) error {
+	_, err := fw.js.Publish(r.Subject, r.Data, nats.MsgId(r.MsgID))
+	return err
+}
+
+// publish invia la lettura. Restituisce true se è stata pubblicata subito, false se è finita nel buffer (o è andata persa).
+// Se nel buffer ci sono letture arretrate anche quelle nuove vengono accodate, per non alterare l'ordine della serie temporale.
+func (fw *forwarder) publish(r buffer.Record) bool {
+	if fw.streamReady.Load() && fw.nc.IsConnected() && fw.buf.Empty() {
+		err := fw.send(r)
+		if err == nil {
+			return true
+		}
+		log.Printf("Gateway %s: errore pubblicazione su %s, lettura salvata nel buffer: %v", fw.cfg.GatewayID, r.Subject, err)
+		fw.notify()
+	}
+
+	if err := fw.buf.Append(r); err != nil {
+		if errors.Is(err, buffer.ErrBufferFull) {
+			log.Printf("Gateway %s: %v (letture perse finora: %d)", fw.cfg.GatewayID, err, fw.buf.Dropped())
+		} else {
+			log.Printf("Gateway %s: errore scrittura nel buffer: %v", fw.cfg.GatewayID, err)
+		}
+	}
+
+	return false
+}
+
+// run svuota periodicamente il buffer finché il processo è attivo
+func (fw *forwarder) run() {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-fw.wake:
+		}
+
+		if !fw.nc.IsConnected() {
+			continue
+		}
+
+		if !fw.streamReady.Load() {
+			if err := configStreams(fw.js, fw.cfg.TenantID); err != nil {
+				log.Printf("Gateway %s: errore configurazione stream: %v", fw.cfg.GatewayID, err)
+				continue
+			}
+			fw.streamReady.Store(true)
+		}
+
+		if fw.buf.Empty() {
+			continue
+		}
+
+		pending := fw.buf.Len()
+		sent, err := fw.buf.Drain(fw.send)
+		if err != nil {
+			log.Printf("Gateway %s: svuotamento buffer interrotto dopo %d/%d letture: %v", fw.cfg.GatewayID, sent, pending, err)
+			continue
+		}
+		log.Printf("Gateway %s: ripubblicate %d letture dal buffer", fw.cfg.GatewayID, sent)
+	}
+}
+
+// heartbeats pubblica un heartbeat ogni cfg.Heartbeat finché il processo è attivo.
+// Gli heartbeat non passano dal buffer: se NATS non è raggiungibile non ha senso inviarli dopo
+func (fw *forwarder) heartbeats() {
+	ticker := time.NewTicker(fw.cfg.Heartbeat)
+	defer ticker.Stop()
+
+	subject := fw.subject(heartbeatMetric)
+	for ; ; <-ticker.C {
+		if !fw.streamReady.Load() || !fw.nc.IsConnected() {
+			continue
+		}
+
+		data, err := json.Marshal(heartbeat{Timestamp: time.Now(), Buffered: fw.buf.Len()})
+		if err != nil {
+			continue
+		}
+		if _, err := fw.js.Publish(subject, data); err != nil {
+			log.Printf("Gateway %s: errore invio heartbeat: %v", fw.cfg.GatewayID, err)
+		}
+	}
+}
@@ -3,8 +3,9 @@ package gateway
 import (
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"gateway/buffer"
 	sensor "gateway/sensorData"
 	"log"
 	"os"
@@ -14,28 +15,60 @@ import (
 	"github.com/nats-io/nats.go"
 )
 
-func Init(natsURL string, tenantID string, gatewayId string, wg *sync.WaitGroup) {
+// Config contiene tutto il necessario per avviare un gateway
+type Config struct {
+	TenantID   string
+	GatewayID  string
+	CredsPath  string
+	CAPath     string
+	ServerName string
+	Sensors    []sensor.Sensor
+	Buffer     BufferConfig
+	// Intervallo degli heartbeat
+	Heartbeat time.Duration
+}
+
+// BufferConfig configura il buffer su disco usato quando NATS non è raggiungibile
+type BufferConfig struct {
+	Dir      string
+	MaxBytes int64
+	Policy   buffer.Policy
+}
+
+func Init(natsURL string, cfg Config, wg *sync.WaitGroup) {
 	defer wg.Done()
-	nc, err := getNatsConnection(natsURL, "glitchhubteam.it", gatewayId)
+	nc, err := getNatsConnection(natsURL, cfg)
 	if err != nil {
 		panic(err)
 	}
 	defer nc.Close()
 
-	js, err := configStreams(nc, tenantID)
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Errore ottenimento JetStream: %v", err)
+	}
+
+	buf, err := buffer.Open(cfg.Buffer.Dir, cfg.Buffer.MaxBytes, cfg.Buffer.Policy)
 	if err != nil {
-		log.Fatalf("Errore configurazione stream: %v", err)
+		log.Fatalf("Errore apertura buffer del gateway %s: %v", cfg.GatewayID, err)
 	}
+	defer buf.Close()
+
+	// Lo stream viene configurato dal forwarder appena la connessione è disponibile:
+	// nel frattempo le letture finiscono nel buffer
+	fw := newForwarder(nc, js, buf, cfg)
+	go fw.run()
+	go fw.heartbeats()
 
-	start(&js, tenantID, gatewayId)
+	start(fw, cfg.GatewayID, cfg.Sensors)
 }
 
-func getNatsConnection(natsURL string, servername string, gatewayId string) (*nats.Conn, error) {
+func getNatsConnection(natsURL string, cfg Config) (*nats.Conn, error) {
 	opts := nats.GetDefaultOptions()
 	opts.Url = natsURL
 
 	certPool := x509.NewCertPool()
-	caData, err := os.ReadFile("certs/ca.pem") //ca.pem da prendere da BITWARDEN
+	caData, err := os.ReadFile(cfg.CAPath) //ca.pem da prendere da BITWARDEN
 	if err != nil {
 		log.Fatalf("Errore lettura file: %v", err)
 	}
@@ -45,20 +78,25 @@ func getNatsConnection(natsURL string, servername string, gatewayId string) (*na
 
 	opts.TLSConfig = &tls.Config{
 		RootCAs:    certPool,
-		ServerName: servername,
+		ServerName: cfg.ServerName,
 	}
 
 	opts.AsyncErrorCB = func(nc *nats.Conn, sub *nats.Subscription, err error) {
-		log.Printf("[ERRORE ASINCRONO] Gateway %s: %v", gatewayId, err)
+		log.Printf("[ERRORE ASINCRONO] Gateway %s: %v", cfg.GatewayID, err)
 	}
 
 	opts.DisconnectedErrCB = func(nc *nats.Conn, err error) {
-		log.Printf("Gateway %s disconnesso: %v", gatewayId, err)
+		log.Printf("Gateway %s disconnesso: %v", cfg.GatewayID, err)
 	}
 
-	credsPath := fmt.Sprintf("gateway/%s.creds", gatewayId)
+	// Il gateway non deve mai arrendersi: finché NATS non torna raggiungibile le letture vanno nel buffer.
+	// Il buffer di riconnessione del client è disabilitato, così le Publish falliscono subito
+	// invece di restare in memoria.
+	opts.RetryOnFailedConnect = true
+	opts.MaxReconnect = -1
+	opts.ReconnectBufSize = -1
 
-	err = nats.UserCredentials(credsPath)(&opts)
+	err = nats.UserCredentials(cfg.CredsPath)(&opts)
 	if err != nil {
 		return nil, err
 	}
@@ -71,7 +109,10 @@ func getNatsConnection(natsURL string, servername string, gatewayId string) (*na
 	return nc, nil
 }
 
-func configStreams(nc *nats.Conn, tenantId string) (nats.JetStreamContext, error) {
+// configStreams crea lo stream del tenant se non esiste. La conservazione dei messaggi è gestita
+// dalla dashboard (politica di conservazione dei dati del tenant), quindi uno stream esistente
+// non viene modificato anche se la sua configurazione è diversa
+func configStreams(js nats.JetStreamContext, tenantId string) error {
 	streamName := "sensors_" + tenantId
 
 	ONE_MONTH := 30 * 24 * time.Hour
@@ -83,50 +124,62 @@ func configStreams(nc *nats.Conn, tenantId string) (nats.JetStreamContext, error
 		Storage:    nats.FileStorage,
 		Replicas:   1, // Possibilità di scalare in futuro
 		Retention:  nats.LimitsPolicy,
-		MaxAge:     ONE_MONTH, // 30 giorni di conservazione dei messaggi
+		MaxAge:     ONE_MONTH, // 30 giorni, finché la dashboard non applica la politica del tenant
 		MaxMsgSize: ONE_MB,    // Limite di 1 MB per messaggio
 	}
 
-	js, err := nc.JetStream()
+	_, err := js.AddStream(streamConfig)
+	if errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("errore ottenimento JetStream: %v", err)
+		return fmt.Errorf("errore creazione stream: %v", err)
 	}
 
-	_, err = js.AddStream(streamConfig)
-	if err != nil {
-		return nil, fmt.Errorf("errore creazione stream: %v", err)
+	return nil
+}
+
+// start avvia un ciclo di lettura e pubblicazione indipendente per ogni sensore del gateway
+func start(fw *forwarder, gatewayId string, sensors []sensor.Sensor) {
+	var wg sync.WaitGroup
+
+	for _, s := range sensors {
+		wg.Add(1)
+		go func(s sensor.Sensor) {
+			defer wg.Done()
+			runSensor(fw, gatewayId, s)
+		}(s)
 	}
 
-	return js, nil
+	wg.Wait()
 }
 
-func start(js *nats.JetStreamContext, tenantId string, gatewayId string) {
-	for {
-		hrData := sensor.SimulateHeartRate()
-		spO2Data := sensor.SimulateSpO2()
+func runSensor(fw *forwarder, gatewayId string, s sensor.Sensor) {
+	subject := fw.subject(s.Metric())
 
-		hrMsg, err := json.Marshal(hrData)
-		if err != nil {
-			panic(err)
-		}
+	ticker := time.NewTicker(s.Interval())
+	defer ticker.Stop()
 
-		spO2Msg, err := json.Marshal(spO2Data)
+	for ; ; <-ticker.C {
+		readAt := time.Now()
+		msg, err := s.Read()
 		if err != nil {
-			panic(err)
+			log.Printf("Gateway %s: errore lettura sensore %s: %v", gatewayId, s.Name(), err)
+			continue
 		}
 
-		_, err = (*js).Publish("sensors."+tenantId+"."+gatewayId+".heart_rate", hrMsg)
-		if err != nil {
-			log.Fatalf("Errore pubblicazione messaggio: %v", err)
+		record := buffer.Record{
+			Subject: subject,
+			MsgID:   msgID(gatewayId, s, readAt),
+			Data:    msg,
 		}
-
-		_, err = (*js).Publish("sensors."+tenantId+"."+gatewayId+".blood_oxygen", spO2Msg)
-		if err != nil {
-			log.Fatalf("Errore pubblicazione messaggio: %v", err)
+		if fw.publish(record) {
+			fmt.Printf("Gateway %s sent %s (%s): %s\n", gatewayId, s.Metric(), s.Name(), msg)
 		}
-
-		fmt.Printf("Gateway %s sent Heart Rate: %d BPM, SpO2: %.1f%%\n", gatewayId, hrData.BPM, spO2Data.SpO2)
-
-		time.Sleep(5 * time.Second)
 	}
 }
+
+// msgID identifica in modo deterministico una lettura: <gateway>.<sensore>.<timestamp in ns>
+func msgID(gatewayId string, s sensor.Sensor, readAt time.Time) string {
+	return fmt.Sprintf("%s.%s.%d", gatewayId, s.Name(), readAt.UnixNano())
+}
@@ -2,26 +2,62 @@ package main
 
 import (
 	"flag"
-	"fmt"
+	"gateway/fleet"
 	"gateway/gateway"
+	sensor "gateway/sensorData"
+	"log"
+	"strings"
 	"sync"
+	"time"
 )
 
 func main() {
 
 	natsURL := flag.String("nats-url", "localhost:4222", "NATS server URL")
+	fleetPath := flag.String("fleet", "", "File JSON che descrive la flotta di gateway da simulare (vedi fleet.example.json)")
+	sensorList := flag.String("sensors", "heart_rate,blood_oxygen",
+		"Senza -fleet: sensori collegati a ogni gateway, separati da virgola (disponibili: "+strings.Join(sensor.Available(), ", ")+")")
+	interval := flag.Duration("interval", fleet.DefaultInterval, "Senza -fleet: intervallo di campionamento dei sensori")
 
 	flag.Parse()
 
+	f, err := loadFleet(*fleetPath, *sensorList, *interval)
+	if err != nil {
+		log.Fatalf("Configurazione flotta non valida:\n%v", err)
+	}
+
+	configs, err := f.Configs()
+	if err != nil {
+		log.Fatalf("Errore configurazione sensori: %v", err)
+	}
+
 	var wg sync.WaitGroup
 
-	for i := 0; i < 2; i++ {
+	for _, cfg := range configs {
 		wg.Add(1)
-		tenantId := fmt.Sprintf("tenant_%d", i+1)
-		gatewayId := fmt.Sprintf("gateway%d", i+1)
-
-		go gateway.Init(*natsURL, tenantId, gatewayId, &wg)
+		go gateway.Init(*natsURL, cfg, &wg)
 	}
 
 	wg.Wait()
 }
+
+// loadFleet carica la flotta dal file indicato oppure, se non specificato, usa i due gateway di default
+func loadFleet(path string, sensorList string, interval time.Duration) (*fleet.Fleet, error) {
+	if path != "" {
+		return fleet.Load(path)
+	}
+
+	var sensorTypes []string
+	for _, metric := range strings.Split(sensorList, ",") {
+		if metric = strings.TrimSpace(metric); metric != "" {
+			sensorTypes = append(sensorTypes, metric)
+		}
+	}
+
+	f := fleet.Default(2, sensorTypes, interval)
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
@@ -29,3 +29,64 @@ func SimulateSpO2() PulseOxData {
 	spO2 := minSpO2 + rand.Float64()*(maxSpO2-minSpO2)
 	return PulseOxData{SpO2: math.Round(spO2*10) / 10, Timestamp: time.Now()}
 }
+
+type TemperatureData struct {
+	Celsius   float64   `json:"celsius"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type BloodPressureData struct {
+	Systolic  int       `json:"systolic"`
+	Diastolic int       `json:"diastolic"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type RespirationRateData struct {
+	BreathsPerMinute int       `json:"breathsPerMinute"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+// ECGData contiene un breve frammento di tracciato campionato a SampleRate Hz
+type ECGData struct {
+	SampleRate int       `json:"sampleRate"`
+	Samples    []float64 `json:"samples"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+func SimulateTemperature() TemperatureData {
+	maxTemp := 39.5
+	minTemp := 35.5
+	temp := minTemp + rand.Float64()*(maxTemp-minTemp)
+	return TemperatureData{Celsius: math.Round(temp*10) / 10, Timestamp: time.Now()}
+}
+
+func SimulateBloodPressure() BloodPressureData {
+	systolic := rand.Intn(160-90) + 90
+	diastolic := rand.Intn(100-60) + 60
+	if diastolic >= systolic {
+		diastolic = systolic - 20
+	}
+	return BloodPressureData{Systolic: systolic, Diastolic: diastolic, Timestamp: time.Now()}
+}
+
+func SimulateRespirationRate() RespirationRateData {
+	maxRR := 25
+	minRR := 10
+	rr := rand.Intn(maxRR-minRR) + minRR
+	return RespirationRateData{BreathsPerMinute: rr, Timestamp: time.Now()}
+}
+
+// SimulateECG genera un secondo di tracciato: un'onda sinusoidale con un picco (complesso QRS) e un po' di rumore
+func SimulateECG() ECGData {
+	sampleRate := 125
+	samples := make([]float64, sampleRate)
+	for i := range samples {
+		t := float64(i) / float64(sampleRate)
+		v := 0.1*math.Sin(2*math.Pi*t) + (rand.Float64()-0.5)*0.05
+		if i >= sampleRate/2-2 && i <= sampleRate/2+2 {
+			v += 1.0 - math.Abs(float64(i-sampleRate/2))*0.3
+		}
+		samples[i] = math.Round(v*1000) / 1000
+	}
+	return ECGData{SampleRate: sampleRate, Samples: samples, Timestamp: time.Now()}
+}
@@ -0,0 +1,121 @@
+package sensor
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sensor rappresenta un dispositivo collegato al gateway.
+// Ogni sensore viene letto periodicamente dal gateway, che pubblica il payload
+// restituito da Read sul subject sensors.<tenant>.<gateway>.<Metric()>
+type Sensor interface {
+	// Nome del dispositivo (usato solo per i log)
+	Name() string
+	// Token del subject NATS che identifica il tipo di misura (es. heart_rate)
+	Metric() string
+	// Intervallo di campionamento
+	Interval() time.Duration
+	// Esegue una lettura e restituisce il payload da pubblicare
+	Read() ([]byte, error)
+}
+
+// Factory crea un sensore con il nome e l'intervallo di campionamento indicati
+type Factory func(name string, interval time.Duration) Sensor
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Factory{}
+)
+
+type UnknownSensorError struct {
+	Metric string
+}
+
+func (e *UnknownSensorError) Error() string {
+	return fmt.Sprintf("tipo di sensore non registrato: %s", e.Metric)
+}
+
+// Register rende disponibile un nuovo tipo di sensore.
+// Da chiamare nella funzione init() del file che implementa il sensore.
+func Register(metric string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if _, exists := registry[metric]; exists {
+		panic("sensore già registrato: " + metric)
+	}
+	registry[metric] = factory
+}
+
+// New crea un sensore del tipo indicato. Se name è vuoto viene usato il nome della metrica.
+func New(metric string, name string, interval time.Duration) (Sensor, error) {
+	registryMu.RLock()
+	factory, ok := registry[metric]
+	registryMu.RUnlock()
+
+	if !ok {
+		return nil, &UnknownSensorError{Metric: metric}
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("intervallo di campionamento non valido per %s: %v", metric, interval)
+	}
+	if name == "" {
+		name = metric
+	}
+
+	return factory(name, interval), nil
+}
+
+// Available restituisce i tipi di sensore registrati, in ordine alfabetico
+func Available() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	metrics := make([]string, 0, len(registry))
+	for metric := range registry {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	return metrics
+}
+
+// simulatedSensor è un sensore simulato che genera letture tramite una funzione
+type simulatedSensor struct {
+	name     string
+	metric   string
+	interval time.Duration
+	simulate func() any
+}
+
+func (s *simulatedSensor) Name() string            { return s.name }
+func (s *simulatedSensor) Metric() string          { return s.metric }
+func (s *simulatedSensor) Interval() time.Duration { return s.interval }
+
+func (s *simulatedSensor) Read() ([]byte, error) {
+	return json.Marshal(s.simulate())
+}
+
+// registerSimulated registra un sensore simulato basato su una funzione di generazione dati
+func registerSimulated[T any](metric string, simulate func() T) {
+	Register(metric, func(name string, interval time.Duration) Sensor {
+		return &simulatedSensor{
+			name:     name,
+			metric:   metric,
+			interval: interval,
+			simulate: func() any { return simulate() },
+		}
+	})
+}
+
+func init() {
+	registerSimulated("heart_rate", SimulateHeartRate)
+	registerSimulated("blood_oxygen", SimulateSpO2)
+	registerSimulated("temperature", SimulateTemperature)
+	registerSimulated("blood_pressure", SimulateBloodPressure)
+	registerSimulated("respiration_rate", SimulateRespirationRate)
+	registerSimulated("ecg", SimulateECG)
+}
@@ -0,0 +1,192 @@
+// Comando per ispezionare e ripubblicare i messaggi della dead-letter queue DLQ_SENSORS.
+//
+//	go run ./cmd/dlq -action list
+//	go run ./cmd/dlq -action replay -seq 42
+//	go run ./cmd/dlq -action replay            (tutti i messaggi)
+//	go run ./cmd/dlq -action delete -seq 42
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	dlqStreamName    = "DLQ_SENSORS"
+	dlqSubjectPrefix = "dlq."
+
+	dlqHeaderPrefix       = "Dlq-"
+	dlqOriginalSubjectHdr = "Dlq-Original-Subject"
+	dlqOriginalMsgIdHdr   = "Dlq-Original-Msg-Id"
+)
+
+func main() {
+	natsURL := flag.String("nats-url", "localhost:4222", "NATS server URL")
+	credsPath := flag.String("creds", "dataconsumer.creds", "File .creds dell'utente data consumer")
+	action := flag.String("action", "list", "Operazione da eseguire: list, replay, delete")
+	seq := flag.Uint64("seq", 0, "Sequenza del messaggio nella DLQ (0 = tutti)")
+	showData := flag.Bool("data", false, "Con -action list mostra anche il payload")
+
+	flag.Parse()
+
+	nc, err := getNatsConnection(*natsURL, "glitchhubteam.it", *credsPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Fatalf("Errore ottenimento JetStream: %v", err)
+	}
+
+	sequences, err := selectSequences(js, *seq)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *action {
+	case "list":
+		err = list(js, sequences, *showData)
+	case "replay":
+		err = forEach(js, sequences, replay)
+	case "delete":
+		err = forEach(js, sequences, func(js nats.JetStreamContext, msg *nats.RawStreamMsg) error {
+			return js.DeleteMsg(dlqStreamName, msg.Sequence)
+		})
+	default:
+		err = fmt.Errorf("azione non supportata: %s", *action)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// selectSequences restituisce la sequenza richiesta oppure tutte quelle presenti nello stream
+func selectSequences(js nats.JetStreamContext, seq uint64) ([]uint64, error) {
+	if seq != 0 {
+		return []uint64{seq}, nil
+	}
+
+	info, err := js.StreamInfo(dlqStreamName)
+	if err != nil {
+		return nil, fmt.Errorf("errore lettura stream %s: %v", dlqStreamName, err)
+	}
+
+	var sequences []uint64
+	for s := info.State.FirstSeq; s <= info.State.LastSeq && info.State.Msgs > 0; s++ {
+		sequences = append(sequences, s)
+	}
+	return sequences, nil
+}
+
+func list(js nats.JetStreamContext, sequences []uint64, showData bool) error {
+	found := 0
+	for _, seq := range sequences {
+		msg, err := js.GetMsg(dlqStreamName, seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found++
+
+		fmt.Printf("#%d [%s] %s\n", msg.Sequence, msg.Time.Format("2006-01-02 15:04:05"), msg.Header.Get(dlqOriginalSubjectHdr))
+		for key, values := range msg.Header {
+			if strings.HasPrefix(key, dlqHeaderPrefix) && key != dlqOriginalSubjectHdr {
+				fmt.Printf("    %s: %s\n", key, strings.Join(values, ", "))
+			}
+		}
+		if showData {
+			fmt.Printf("    Payload: %s\n", msg.Data)
+		}
+	}
+
+	fmt.Printf("%d messaggi nella DLQ\n", found)
+	return nil
+}
+
+func forEach(js nats.JetStreamContext, sequences []uint64, action func(nats.JetStreamContext, *nats.RawStreamMsg) error) error {
+	done := 0
+	for _, seq := range sequences {
+		msg, err := js.GetMsg(dlqStreamName, seq)
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := action(js, msg); err != nil {
+			return fmt.Errorf("messaggio #%d: %v", seq, err)
+		}
+		done++
+	}
+
+	fmt.Printf("%d messaggi elaborati\n", done)
+	return nil
+}
+
+// replay ripubblica il messaggio sul subject originale e lo rimuove dalla DLQ.
+// Gli header Dlq-* vengono rimossi tranne Dlq-Original-Msg-Id, che il subscriber usa come chiave
+// di deduplicazione al posto di Nats-Msg-Id (che verrebbe scartato dallo stream come duplicato)
+func replay(js nats.JetStreamContext, msg *nats.RawStreamMsg) error {
+	subject := msg.Header.Get(dlqOriginalSubjectHdr)
+	if subject == "" {
+		subject = strings.TrimPrefix(msg.Subject, dlqSubjectPrefix)
+	}
+
+	out := nats.NewMsg(subject)
+	for key, values := range msg.Header {
+		if strings.HasPrefix(key, dlqHeaderPrefix) && key != dlqOriginalMsgIdHdr {
+			continue
+		}
+		out.Header[key] = values
+	}
+	out.Data = msg.Data
+
+	if _, err := js.PublishMsg(out); err != nil {
+		return fmt.Errorf("ripubblicazione su %s fallita: %v", subject, err)
+	}
+	if err := js.DeleteMsg(dlqStreamName, msg.Sequence); err != nil {
+		return fmt.Errorf("ripubblicato su %s ma non rimosso dalla DLQ: %v", subject, err)
+	}
+
+	fmt.Printf("#%d ripubblicato su %s\n", msg.Sequence, subject)
+	return nil
+}
+
+func getNatsConnection(natsURL string, servername string, credsPath string) (*nats.Conn, error) {
+	opts := nats.GetDefaultOptions()
+	opts.Url = natsURL
+
+	certPool := x509.NewCertPool()
+	caData, err := os.ReadFile("certs/ca.pem") //ca.pem da prendere da BITWARDEN
+	if err != nil {
+		log.Fatalf("Errore lettura file: %v", err)
+	}
+	if ok := certPool.AppendCertsFromPEM(caData); !ok {
+		log.Fatal("Impossibile aggiungere il certificato CA al pool: il formato potrebbe essere errato")
+	}
+
+	opts.TLSConfig = &tls.Config{
+		RootCAs:    certPool,
+		ServerName: servername,
+	}
+
+	err = nats.UserCredentials(credsPath)(&opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return opts.Connect()
+}
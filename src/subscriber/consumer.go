@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	streamName      = "CONSUMING_SENSORS"
+	consumerSubject = "sensors.>"
+)
+
+// ConsumerConfig contiene i parametri del pull consumer durevole condiviso dai worker
+type ConsumerConfig struct {
+	Durable string
+	// Numero massimo di messaggi richiesti a ogni fetch
+	BatchSize int
+	// Tempo massimo di attesa di un fetch quando non ci sono abbastanza messaggi
+	MaxWait time.Duration
+	// Tempo entro cui un messaggio va confermato prima di essere riconsegnato
+	AckWait time.Duration
+	// Numero massimo di consegne di uno stesso messaggio
+	MaxDeliver int
+	// Numero massimo di messaggi consegnati e non ancora confermati, per tutti i worker
+	MaxAckPending int
+	// Cosa fare delle letture dei gateway non registrati: accept, reject o quarantine
+	UnregisteredPolicy string
+}
+
+func (cfg ConsumerConfig) Validate() error {
+	if cfg.Durable == "" {
+		return errors.New("nome del consumer durevole mancante")
+	}
+	if cfg.BatchSize <= 0 {
+		return fmt.Errorf("batch size non valido: %d", cfg.BatchSize)
+	}
+	if cfg.MaxWait <= 0 || cfg.AckWait <= 0 {
+		return errors.New("max-wait e ack-wait devono essere positivi")
+	}
+	if cfg.AckWait <= cfg.MaxWait {
+		return errors.New("ack-wait deve essere maggiore di max-wait, altrimenti i messaggi vengono riconsegnati prima di essere elaborati")
+	}
+	if cfg.MaxDeliver == 0 || cfg.MaxDeliver < -1 {
+		return fmt.Errorf("max-deliver non valido: %d", cfg.MaxDeliver)
+	}
+	if cfg.MaxAckPending < cfg.BatchSize {
+		return errors.New("max-ack-pending deve essere almeno pari al batch size")
+	}
+	switch cfg.UnregisteredPolicy {
+	case AcceptUnregistered, RejectUnregistered, QuarantineUnregistered:
+	default:
+		return fmt.Errorf("unregistered-policy non valida: %q (accept, reject, quarantine)", cfg.UnregisteredPolicy)
+	}
+	return nil
+}
+
+// configConsumer crea il consumer durevole oppure ne aggiorna la configurazione se esiste già
+func configConsumer(js nats.JetStreamContext, cfg ConsumerConfig) error {
+	consumerConfig := &nats.ConsumerConfig{
+		Durable:       cfg.Durable,
+		FilterSubject: consumerSubject,
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       cfg.AckWait,
+		MaxDeliver:    cfg.MaxDeliver,
+		MaxAckPending: cfg.MaxAckPending,
+		MaxWaiting:    512,
+	}
+
+	_, err := js.ConsumerInfo(streamName, cfg.Durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(streamName, consumerConfig)
+	case err == nil:
+		_, err = js.UpdateConsumer(streamName, consumerConfig)
+	}
+	if err != nil {
+		return fmt.Errorf("errore creazione consumer %s: %v", cfg.Durable, err)
+	}
+
+	return nil
+}
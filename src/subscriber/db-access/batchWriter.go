@@ -0,0 +1,188 @@
+package dbaccess
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Le righe vengono raggruppate per tenant, tabella e colonne: se lo schema di una metrica
+// cambia mentre un batch è in corso, le righe nuove finiscono in un batch separato
+type batchKey struct {
+	tenantId string
+	table    string
+	columns  string
+}
+
+type pendingRow struct {
+	values []any
+	done   func(error)
+}
+
+// BatchWriter accumula le letture per tenant e tabella e le scrive con COPY
+// quando il batch raggiunge maxRows oppure ogni flushInterval.
+// La callback done di ogni riga viene chiamata solo dopo il commit (o il fallimento) della scrittura,
+// così il chiamante può confermare il messaggio NATS solo quando il dato è davvero salvato.
+type BatchWriter struct {
+	pools         *Pools
+	maxRows       int
+	flushInterval time.Duration
+
+	mu      sync.Mutex
+	batches map[batchKey][]pendingRow
+}
+
+func NewBatchWriter(pools *Pools, maxRows int, flushInterval time.Duration) *BatchWriter {
+	return &BatchWriter{
+		pools:         pools,
+		maxRows:       maxRows,
+		flushInterval: flushInterval,
+		batches:       map[batchKey][]pendingRow{},
+	}
+}
+
+// Add accoda una riga. Se il batch è pieno la scrittura avviene subito, nel goroutine del chiamante.
+func (w *BatchWriter) Add(row Row, done func(error)) {
+	if err := row.validate(); err != nil {
+		done(err)
+		return
+	}
+
+	key := batchKey{tenantId: row.TenantID, table: row.Table, columns: strings.Join(row.Columns, ",")}
+
+	w.mu.Lock()
+	w.batches[key] = append(w.batches[key], pendingRow{values: row.Values, done: done})
+	var full []pendingRow
+	if len(w.batches[key]) >= w.maxRows {
+		full = w.batches[key]
+		delete(w.batches, key)
+	}
+	w.mu.Unlock()
+
+	if full != nil {
+		w.write(key, full)
+	}
+}
+
+// Run scrive periodicamente i batch parziali finché il contesto non viene cancellato
+func (w *BatchWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			w.Flush()
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// Flush scrive tutte le righe in attesa
+func (w *BatchWriter) Flush() {
+	w.mu.Lock()
+	batches := w.batches
+	w.batches = map[batchKey][]pendingRow{}
+	w.mu.Unlock()
+
+	for key, rows := range batches {
+		w.write(key, rows)
+	}
+}
+
+func (w *BatchWriter) write(key batchKey, rows []pendingRow) {
+	ctx := context.Background()
+
+	err := w.copyRows(ctx, key, rows)
+	if err == nil {
+		for _, row := range rows {
+			row.done(nil)
+		}
+		return
+	}
+
+	// Una sola riga non valida (es. vincolo CHECK violato) fa fallire l'intero COPY:
+	// si riprova riga per riga per non bloccare le letture corrette
+	log.Printf("Scrittura batch %s.%s di %d righe fallita, riprovo riga per riga: %v", key.tenantId, key.table, len(rows), err)
+	for _, row := range rows {
+		row.done(w.insertRow(ctx, key, row))
+	}
+}
+
+// copyRows carica le righe con COPY in una tabella temporanea e poi le inserisce nella tabella finale.
+// Il passaggio intermedio serve perché COPY non supporta ON CONFLICT: le letture già presenti (stesso msg_id)
+// vengono ignorate e la scrittura rimane idempotente.
+func (w *BatchWriter) copyRows(ctx context.Context, key batchKey, rows []pendingRow) error {
+	pool, err := w.pools.Get(ctx, key.tenantId)
+	if err != nil {
+		return err
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("impossibile connettersi al database: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	columns := strings.Split(key.columns, ",")
+	table := pgx.Identifier{key.table}.Sanitize()
+	staging := "staging_" + key.table
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(
+		"CREATE TEMP TABLE %s (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP",
+		pgx.Identifier{staging}.Sanitize(), table,
+	))
+	if err != nil {
+		return fmt.Errorf("creazione tabella temporanea fallita: %v", err)
+	}
+
+	values := make([][]any, len(rows))
+	for i, row := range rows {
+		values[i] = row.values
+	}
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{staging}, columns, pgx.CopyFromRows(values))
+	if err != nil {
+		return fmt.Errorf("COPY fallita: %v", err)
+	}
+
+	columnList := quoteColumns(columns)
+	_, err = tx.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (%s) SELECT %s FROM %s ON CONFLICT (msg_id, time) DO NOTHING",
+		table, columnList, columnList, pgx.Identifier{staging}.Sanitize(),
+	))
+	if err != nil {
+		return fmt.Errorf("Inserimento fallito: %v", err)
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (w *BatchWriter) insertRow(ctx context.Context, key batchKey, row pendingRow) error {
+	pool, err := w.pools.Get(ctx, key.tenantId)
+	if err != nil {
+		return err
+	}
+
+	columns := strings.Split(key.columns, ",")
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s) VALUES (%s) ON CONFLICT (msg_id, time) DO NOTHING",
+		pgx.Identifier{key.table}.Sanitize(), quoteColumns(columns), strings.Join(placeholders, ", "),
+	)
+	_, err = pool.Exec(ctx, query, row.values...)
+	if err != nil {
+		return fmt.Errorf("Inserimento fallito: %w", err)
+	}
+	return nil
+}
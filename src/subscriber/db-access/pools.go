@@ -0,0 +1,69 @@
+package dbaccess
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Pools mantiene un pool di connessioni per ogni tenant, creato alla prima richiesta.
+// Ogni tenant usa il proprio utente Postgres (<tenant>_user), che vede solo il proprio schema.
+type Pools struct {
+	dbURL  string
+	secret string
+
+	mu    sync.Mutex
+	pools map[string]*pgxpool.Pool
+}
+
+// secret è TENANT_DB_SECRET, da cui la dashboard ricava le password degli utenti dei tenant
+func NewPools(dbURL string, secret string) *Pools {
+	return &Pools{
+		dbURL:  dbURL,
+		secret: secret,
+		pools:  map[string]*pgxpool.Pool{},
+	}
+}
+
+// tenantPassword restituisce la password di <tenant>_user: l'HMAC-SHA256 dell'ID del tenant
+// con TENANT_DB_SECRET, come in dashboard/backend/initializers/database.go
+func tenantPassword(secret string, tenantId string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(tenantId))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (p *Pools) Get(ctx context.Context, tenantId string) (*pgxpool.Pool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pool, ok := p.pools[tenantId]; ok {
+		return pool, nil
+	}
+
+	tenantUsername := fmt.Sprintf("%s_user", tenantId)
+	url := fmt.Sprintf("postgres://%s:%s@%s/sensors_db?sslmode=disable", tenantUsername, tenantPassword(p.secret, tenantId), p.dbURL)
+
+	pool, err := pgxpool.New(ctx, url)
+	if err != nil {
+		return nil, fmt.Errorf("impossibile creare il pool per %s: %v", tenantId, err)
+	}
+
+	p.pools[tenantId] = pool
+	return pool, nil
+}
+
+func (p *Pools) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for tenantId, pool := range p.pools {
+		pool.Close()
+		delete(p.pools, tenantId)
+	}
+}
@@ -1,57 +1,49 @@
 package dbaccess
 
 import (
-	"context"
+	"errors"
 	"fmt"
-	sensor "subscriber/sensorData"
+	"strings"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 )
 
-func isSupportedTablename(tablename string) bool {
-	return tablename == "heart_rate" || tablename == "blood_oxygen"
+// Row è una lettura pronta per essere scritta nella tabella Table dello schema del tenant.
+// Values contiene un valore per ogni colonna di Columns, nello stesso ordine.
+type Row struct {
+	TenantID string
+	Table    string
+	Columns  []string
+	Values   []any
 }
 
-func InsertHeartRateData(tenantId string, tablename string, gatewayId string, hrData sensor.HearthRateData, dbURL string) error {
-	if !isSupportedTablename(tablename) {
-		return fmt.Errorf("Tabella non supportata: %s", tablename)
+func (row Row) validate() error {
+	if row.Table == "" || len(row.Columns) == 0 {
+		return errors.New("riga senza tabella o colonne")
 	}
-
-	tenantUsername := fmt.Sprintf("%s_user", tenantId)
-	urlExample := fmt.Sprintf("postgres://%s:user@%s/sensors_db?sslmode=disable", tenantUsername, dbURL)
-	conn, err := pgx.Connect(context.Background(), urlExample)
-	if err != nil {
-		return fmt.Errorf("impossibile connettersi al database: %v", err)
-	}
-	defer conn.Close(context.Background())
-
-	query := fmt.Sprintf("INSERT INTO %s (time, gateway_id, bpm) VALUES ($1, $2, $3)", tablename)
-	_, err = conn.Exec(context.Background(), query, hrData.Timestamp, gatewayId, hrData.BPM)
-
-	if err != nil {
-		return fmt.Errorf("Inserimento fallito: %v", err)
+	if len(row.Columns) != len(row.Values) {
+		return fmt.Errorf("numero di valori errato per %s: attesi %d, ricevuti %d", row.Table, len(row.Columns), len(row.Values))
 	}
 	return nil
 }
 
-func InsertSpO2Data(tenantId string, tablename string, gatewayId string, spO2Data sensor.PulseOxData, dbURL string) error {
-	if !isSupportedTablename(tablename) {
-		return fmt.Errorf("Tabella non supportata: %s", tablename)
+// quoteColumns restituisce la lista di colonne già quotata, pronta per essere inserita nella query
+func quoteColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = pgx.Identifier{c}.Sanitize()
 	}
+	return strings.Join(quoted, ", ")
+}
 
-	tenantUsername := fmt.Sprintf("%s_user", tenantId)
-	urlExample := fmt.Sprintf("postgres://%s:user@%s/sensors_db?sslmode=disable", tenantUsername, dbURL)
-	conn, err := pgx.Connect(context.Background(), urlExample)
-	if err != nil {
-		return fmt.Errorf("impossibile connettersi al database: %v", err)
-	}
-	defer conn.Close(context.Background())
-
-	query := fmt.Sprintf("INSERT INTO %s (time, gateway_id, spO2) VALUES ($1, $2, $3)", tablename)
-	_, err = conn.Exec(context.Background(), query, spO2Data.Timestamp, gatewayId, spO2Data.SpO2)
-
-	if err != nil {
-		return fmt.Errorf("Inserimento fallito: %v", err)
+// IsPermanent indica se l'errore di scrittura dipende dai dati (valori fuori dominio, vincoli violati)
+// e quindi si ripresenterebbe identico a ogni nuovo tentativo
+func IsPermanent(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
 	}
-	return nil
+	// Classe 22: data exception, classe 23: integrity constraint violation
+	return strings.HasPrefix(pgErr.Code, "22") || strings.HasPrefix(pgErr.Code, "23")
 }
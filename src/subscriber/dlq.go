@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	dbaccess "subscriber/db-access"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	dlqStreamName    = "DLQ_SENSORS"
+	dlqSubjectPrefix = "dlq."
+
+	// Header aggiunti ai messaggi finiti nella dead-letter queue
+	DlqReasonHdr           = "Dlq-Reason"
+	DlqConsumerHdr         = "Dlq-Consumer"
+	DlqDeliveryCountHdr    = "Dlq-Delivery-Count"
+	DlqOriginalSubjectHdr  = "Dlq-Original-Subject"
+	DlqOriginalSequenceHdr = "Dlq-Original-Sequence"
+	DlqOriginalMsgIdHdr    = "Dlq-Original-Msg-Id"
+	DlqFailedAtHdr         = "Dlq-Failed-At"
+)
+
+// PermanentError indica un errore che non si risolve riconsegnando il messaggio (payload malformato, metrica sconosciuta...)
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+func permanent(format string, args ...any) error {
+	return &PermanentError{Err: fmt.Errorf(format, args...)}
+}
+
+func isPermanent(err error) bool {
+	var permanentErr *PermanentError
+	return errors.As(err, &permanentErr) || dbaccess.IsPermanent(err)
+}
+
+// configDLQStream crea lo stream che raccoglie i messaggi che il subscriber non riesce a elaborare
+func configDLQStream(js nats.JetStreamContext) error {
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:      dlqStreamName,
+		Subjects:  []string{dlqSubjectPrefix + ">"},
+		Storage:   nats.FileStorage,
+		Retention: nats.LimitsPolicy,
+		MaxAge:    30 * 24 * time.Hour,
+	})
+	if err != nil {
+		return fmt.Errorf("errore creazione stream %s: %v", dlqStreamName, err)
+	}
+	return nil
+}
+
+// deadLetterQueue sposta nello stream DLQ_SENSORS i messaggi falliti, annotandoli con il motivo del fallimento
+type deadLetterQueue struct {
+	js         nats.JetStreamContext
+	durable    string
+	maxDeliver int
+}
+
+// fail decide cosa fare di un messaggio non elaborato: gli errori permanenti e quelli all'ultima consegna
+// finiscono nella DLQ, gli altri ricevono un NAK e vengono riconsegnati
+func (q *deadLetterQueue) fail(msg *nats.Msg, consumerId string, err error) {
+	if !isPermanent(err) && !q.lastDelivery(msg) {
+		msg.Nak()
+		return
+	}
+
+	deliveries := uint64(1)
+	var sequence uint64
+	if meta, metaErr := msg.Metadata(); metaErr == nil {
+		deliveries = meta.NumDelivered
+		sequence = meta.Sequence.Stream
+	}
+
+	if dlqErr := q.publish(msg.Subject, msg.Header, msg.Data, err.Error(), consumerId, deliveries, sequence); dlqErr != nil {
+		// Se non si riesce a scrivere nella DLQ il messaggio non deve andare perso: verrà riconsegnato
+		log.Printf("Consumer %s: errore invio in DLQ di [%s]: %v", consumerId, msg.Subject, dlqErr)
+		msg.Nak()
+		return
+	}
+
+	fmt.Printf("Consumer %s: messaggio [%s] spostato in DLQ: %v\n", consumerId, msg.Subject, err)
+	msg.Term()
+}
+
+func (q *deadLetterQueue) lastDelivery(msg *nats.Msg) bool {
+	if q.maxDeliver <= 0 {
+		return false
+	}
+	meta, err := msg.Metadata()
+	if err != nil {
+		return false
+	}
+	return meta.NumDelivered >= uint64(q.maxDeliver)
+}
+
+func (q *deadLetterQueue) publish(subject string, header nats.Header, data []byte, reason string, consumerId string, deliveries uint64, sequence uint64) error {
+	dlqMsg := nats.NewMsg(dlqSubjectPrefix + subject)
+	for key, values := range header {
+		dlqMsg.Header[key] = values
+	}
+	// Il Nats-Msg-Id originale deduplicherebbe i messaggi nella DLQ: viene conservato solo per il replay
+	dlqMsg.Header.Del(nats.MsgIdHdr)
+	if id := header.Get(nats.MsgIdHdr); id != "" {
+		dlqMsg.Header.Set(DlqOriginalMsgIdHdr, id)
+	}
+
+	dlqMsg.Header.Set(DlqReasonHdr, reason)
+	dlqMsg.Header.Set(DlqConsumerHdr, q.durable+"/"+consumerId)
+	dlqMsg.Header.Set(DlqDeliveryCountHdr, strconv.FormatUint(deliveries, 10))
+	dlqMsg.Header.Set(DlqOriginalSubjectHdr, subject)
+	dlqMsg.Header.Set(DlqOriginalSequenceHdr, strconv.FormatUint(sequence, 10))
+	dlqMsg.Header.Set(DlqFailedAtHdr, time.Now().UTC().Format(time.RFC3339))
+	dlqMsg.Data = data
+
+	_, err := q.js.PublishMsg(dlqMsg)
+	return err
+}
+
+// Advisory pubblicato dal server quando un messaggio supera MaxDeliver senza essere confermato
+// (ad esempio perché il worker che lo elaborava è crashato prima dell'ack)
+type maxDeliveriesAdvisory struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	StreamSeq  uint64 `json:"stream_seq"`
+	Deliveries uint64 `json:"deliveries"`
+}
+
+// watchMaxDeliveries sposta nella DLQ i messaggi che hanno esaurito i tentativi di consegna.
+// I worker si iscrivono nello stesso queue group, così ogni advisory viene gestito una sola volta.
+func (q *deadLetterQueue) watchMaxDeliveries(nc *nats.Conn, consumerId string) (*nats.Subscription, error) {
+	subject := fmt.Sprintf("$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES.%s.%s", streamName, q.durable)
+
+	return nc.QueueSubscribe(subject, "dlq-advisories", func(m *nats.Msg) {
+		var advisory maxDeliveriesAdvisory
+		if err := json.Unmarshal(m.Data, &advisory); err != nil {
+			log.Printf("Advisory MAX_DELIVERIES non valido: %v", err)
+			return
+		}
+
+		raw, err := q.js.GetMsg(streamName, advisory.StreamSeq)
+		if err != nil {
+			// Il messaggio è già stato confermato o rimosso
+			return
+		}
+
+		reason := fmt.Sprintf("superato il numero massimo di consegne (%d) senza conferma", advisory.Deliveries)
+		if err := q.publish(raw.Subject, raw.Header, raw.Data, reason, consumerId, advisory.Deliveries, advisory.StreamSeq); err != nil {
+			log.Printf("Errore invio in DLQ del messaggio %d: %v", advisory.StreamSeq, err)
+			return
+		}
+
+		if err := q.js.DeleteMsg(streamName, advisory.StreamSeq); err != nil {
+			log.Printf("Errore rimozione del messaggio %d da %s: %v", advisory.StreamSeq, streamName, err)
+		}
+		fmt.Printf("Messaggio [%s] spostato in DLQ: %s\n", raw.Subject, reason)
+	})
+}
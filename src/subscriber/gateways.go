@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+
+	"subscriber/kvwatch"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV con i gateway registrati dalla dashboard. La chiave è <tenant>.<gateway>,
+// il valore un gatewayEntry in JSON
+const gatewaysBucket = "gateways"
+
+// Cosa fare delle letture di un gateway non registrato (o dismesso)
+const (
+	// Le letture vengono scritte comunque (comportamento precedente al registro)
+	AcceptUnregistered = "accept"
+	// Le letture vengono scartate
+	RejectUnregistered = "reject"
+	// Le letture finiscono nella DLQ: registrato il gateway si possono ripubblicare con cmd/dlq
+	QuarantineUnregistered = "quarantine"
+)
+
+// Stato con cui il gateway è stato dismesso: le sue letture sono trattate come non registrate
+const gatewayDecommissioned = "decommissioned"
+
+type gatewayEntry struct {
+	Tenant    string `json:"tenant"`
+	GatewayID string `json:"gateway_id"`
+	Status    string `json:"status"`
+}
+
+// UnregisteredGatewayError indica una lettura di un gateway che non è nel registro
+type UnregisteredGatewayError struct {
+	Tenant  string
+	Gateway string
+}
+
+func (e *UnregisteredGatewayError) Error() string {
+	return fmt.Sprintf("gateway %s del tenant %s non registrato", e.Gateway, e.Tenant)
+}
+
+// gatewayRegistry contiene i gateway del bucket gateways, mantenuti aggiornati in tempo reale
+type gatewayRegistry struct {
+	mu       sync.RWMutex
+	gateways map[string]gatewayEntry
+
+	watcher nats.KeyWatcher
+}
+
+// openGateways crea il bucket se non esiste e avvia il watcher
+func openGateways(js nats.JetStreamContext) (*gatewayRegistry, error) {
+	kv, err := kvwatch.Open(js, &nats.KeyValueConfig{
+		Bucket:      gatewaysBucket,
+		Description: "Gateway registrati dalla dashboard",
+		History:     5,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	r := &gatewayRegistry{gateways: map[string]gatewayEntry{}}
+	if r.watcher, err = kvwatch.Watch(kv, r.apply); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *gatewayRegistry) apply(entry nats.KeyValueEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(r.gateways, entry.Key())
+		return
+	}
+
+	var gateway gatewayEntry
+	if err := json.Unmarshal(entry.Value(), &gateway); err != nil {
+		log.Printf("Gateway %s ignorato: %v", entry.Key(), err)
+		return
+	}
+	r.gateways[entry.Key()] = gateway
+}
+
+// Registered indica se il gateway è registrato e non dismesso
+func (r *gatewayRegistry) Registered(tenantId string, gatewayId string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	gateway, ok := r.gateways[tenantId+"."+gatewayId]
+	return ok && gateway.Status != gatewayDecommissioned
+}
+
+func (r *gatewayRegistry) Stop() error {
+	return r.watcher.Stop()
+}
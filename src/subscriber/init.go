@@ -1,24 +1,24 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
 	"strings"
 	"sync"
-	"syscall"
+	"time"
 
 	dbaccess "subscriber/db-access"
-	sensor "subscriber/sensorData"
+	"subscriber/schema"
 
 	"github.com/nats-io/nats.go"
 )
 
-func InitSubscriber(natsURL string, consumerId string, credsPath string, dbURL string, wg *sync.WaitGroup) {
+func InitSubscriber(ctx context.Context, natsURL string, consumerId string, credsPath string, writer *dbaccess.BatchWriter, liveness *livenessTracker, cfg ConsumerConfig, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	nc, err := getNatsConnection(natsURL, "glitchhubteam.it", credsPath)
@@ -32,30 +32,44 @@ func InitSubscriber(natsURL string, consumerId string, credsPath string, dbURL s
 		log.Fatalf("Errore creazione contesto JetStream: %v", err)
 	}
 
-	start(&js, consumerId, dbURL)
+	err = configDLQStream(js)
+	if err != nil {
+		log.Fatalf("Errore configurazione DLQ: %v", err)
+	}
+
+	err = configConsumer(js, cfg)
+	if err != nil {
+		log.Fatalf("Errore configurazione consumer: %v", err)
+	}
+
+	registry, err := schema.Open(js)
+	if err != nil {
+		log.Fatalf("Errore apertura registro degli schemi: %v", err)
+	}
+	defer registry.Stop()
+
+	gateways, err := openGateways(js)
+	if err != nil {
+		log.Fatalf("Errore apertura registro dei gateway: %v", err)
+	}
+	defer gateways.Stop()
+
+	dlq := &deadLetterQueue{js: js, durable: cfg.Durable, maxDeliver: cfg.MaxDeliver}
+	advisorySub, err := dlq.watchMaxDeliveries(nc, consumerId)
+	if err != nil {
+		log.Fatalf("Errore sottoscrizione advisory MAX_DELIVERIES: %v", err)
+	}
+	defer advisorySub.Unsubscribe()
+
+	start(ctx, js, consumerId, writer, registry, gateways, liveness, dlq, cfg)
 	nc.Drain()
 }
 
+// configStream crea lo stream che raccoglie i dati dei tenant. Le sorgenti sono gestite da watchTenants
 func configStream(nc *nats.Conn) (nats.JetStreamContext, error) {
 	streamConfig := &nats.StreamConfig{
-		Name:     "CONSUMING_SENSORS",
-		Subjects: []string{"sensors.>"},
-		Sources: []*nats.StreamSource{
-			{
-				Name:          "ExportTenant1Data",
-				FilterSubject: "sensors.tenant_1.>",
-				External: &nats.ExternalStream{
-					APIPrefix: "tenant_1.$JS.API",
-				},
-			},
-			{
-				Name:          "ExportTenant2Data",
-				FilterSubject: "sensors.tenant_2.>",
-				External: &nats.ExternalStream{
-					APIPrefix: "tenant_2.$JS.API",
-				},
-			},
-		},
+		Name:      streamName,
+		Subjects:  []string{consumerSubject},
 		Retention: nats.WorkQueuePolicy,
 	}
 
@@ -64,32 +78,30 @@ func configStream(nc *nats.Conn) (nats.JetStreamContext, error) {
 		return nil, fmt.Errorf("errore ottenimento JetStream: %v", err)
 	}
 
-	_, err = js.AddStream(streamConfig)
-	if err != nil {
-		return nil, fmt.Errorf("errore creazione stream: %v", err)
+	_, err = js.StreamInfo(streamName)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		_, err = js.AddStream(streamConfig)
+		if err != nil {
+			return nil, fmt.Errorf("errore creazione stream: %v", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("errore lettura stream: %v", err)
 	}
 
 	return js, nil
 }
 
-func unmurshallSpo2Data(data []byte) (sensor.PulseOxData, error) {
-	var spO2Data sensor.PulseOxData
-	err := json.Unmarshal(data, &spO2Data)
-	if err != nil {
-		return sensor.PulseOxData{}, err
+// messageId restituisce la chiave di deduplicazione della lettura: l'header Nats-Msg-Id impostato dal gateway
+// oppure, per i gateway che non lo inviano, una chiave derivata da gateway, metrica e timestamp della lettura
+func messageId(msg *nats.Msg, gatewayId string, tablename string, timestamp time.Time) string {
+	if id := msg.Header.Get(nats.MsgIdHdr); id != "" {
+		return id
 	}
-
-	return spO2Data, nil
-}
-
-func unmurshallHeartRateData(data []byte) (sensor.HearthRateData, error) {
-	var hrData sensor.HearthRateData
-	err := json.Unmarshal(data, &hrData)
-	if err != nil {
-		return sensor.HearthRateData{}, err
+	// Messaggio ripubblicato dalla DLQ
+	if id := msg.Header.Get(DlqOriginalMsgIdHdr); id != "" {
+		return id
 	}
-
-	return hrData, nil
+	return fmt.Sprintf("%s.%s.%d", gatewayId, tablename, timestamp.UnixNano())
 }
 
 func getNatsConnection(natsURL string, servername string, credsPath string) (*nats.Conn, error) {
@@ -123,67 +135,161 @@ func getNatsConnection(natsURL string, servername string, credsPath string) (*na
 	return nc, nil
 }
 
-func start(js *nats.JetStreamContext, consumerId string, dbURL string) {
-	queueName := "sensor-subscribers"
-	subject := "sensors.>"
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
-
-	// Push consumer(attuale): i messaggi vengono spinti verso i subscriber indipendentemente dalla loro disponibilità, con il rischio di sovraccaricarli
-	// Pull consumer: i subscriber richiedono esplicitamente i messaggi al server, che li invia solo quando sono pronti a riceverli, evitando sovraccarichi
-	sub, err := (*js).QueueSubscribe(subject, queueName, func(msg *nats.Msg) {
-		subjectParts := strings.Split(msg.Subject, ".")
-		if len(subjectParts) < 4 {
-			fmt.Printf("Subject non valido: %s\n", msg.Subject)
-			return
-		}
+// parseMessage valida il messaggio con lo schema registrato per la sua metrica
+// e lo converte nella riga da scrivere nello schema del tenant.
+// Gli errori restituiti sono permanenti: riconsegnare il messaggio non cambierebbe il risultato.
+func parseMessage(msg *nats.Msg, registry *schema.Registry) (dbaccess.Row, error) {
+	subjectParts := strings.Split(msg.Subject, ".")
+	if len(subjectParts) < 4 {
+		return dbaccess.Row{}, permanent("subject non valido: %s", msg.Subject)
+	}
 
-		tenantId := subjectParts[1]
-		gatewayId := subjectParts[2]
-		tablename := subjectParts[3]
+	tenantId := subjectParts[1]
+	gatewayId := subjectParts[2]
+	metric := subjectParts[3]
 
-		switch tablename {
-		case "heart_rate":
-			hrData, err := unmurshallHeartRateData(msg.Data)
-			if err != nil {
-				fmt.Printf("Errore nel parsing dei dati di Heart Rate: %v\n", err)
-				msg.Nak()
-				return
-			}
-			err = dbaccess.InsertHeartRateData(tenantId, tablename, gatewayId, hrData, dbURL)
-			if err != nil {
-				fmt.Printf("Errore nell'inserimento dei dati di Heart Rate nel database: %v\n", err)
-				return
-			}
-			msg.Ack()
-		case "blood_oxygen":
-			spO2Data, err := unmurshallSpo2Data(msg.Data)
-			if err != nil {
-				fmt.Printf("Errore nel parsing dei dati di SpO2: %v\n", err)
-				return
-			}
-			err = dbaccess.InsertSpO2Data(tenantId, tablename, gatewayId, spO2Data, dbURL)
-			if err != nil {
-				fmt.Printf("Errore nell'inserimento dei dati di SpO2 nel database: %v\n", err)
-				msg.Nak()
-				return
-			}
-			msg.Ack()
-		default:
-			fmt.Printf("Tipo di dato non supportato: %s\n", tablename)
-			return
-		}
+	s, ok := registry.Get(metric)
+	if !ok {
+		return dbaccess.Row{}, permanent("tipo di dato non supportato: %s", metric)
+	}
 
-		fmt.Printf("Ricevuto su [%s], consumer%s: %s\n", msg.Subject, consumerId, string(msg.Data))
-	}, nats.ManualAck())
+	timestamp, values, err := s.Decode(msg.Data)
+	if err != nil {
+		return dbaccess.Row{}, permanent("%v", err)
+	}
+
+	msgId := messageId(msg, gatewayId, metric, timestamp)
+	return dbaccess.Row{
+		TenantID: tenantId,
+		Table:    s.Table,
+		Columns:  s.Columns(),
+		Values:   append([]any{timestamp, gatewayId, msgId}, values...),
+	}, nil
+}
+
+// checkGateway restituisce un UnregisteredGatewayError se la lettura viene da un gateway non registrato
+// e la policy non è accept
+func checkGateway(msg *nats.Msg, gateways *gatewayRegistry, unregisteredPolicy string) error {
+	if unregisteredPolicy == AcceptUnregistered {
+		return nil
+	}
+
+	subjectParts := strings.Split(msg.Subject, ".")
+	if len(subjectParts) < 4 {
+		// Il subject non valido viene segnalato da parseMessage
+		return nil
+	}
+
+	tenantId, gatewayId := subjectParts[1], subjectParts[2]
+	if gateways.Registered(tenantId, gatewayId) {
+		return nil
+	}
+	return &UnregisteredGatewayError{Tenant: tenantId, Gateway: gatewayId}
+}
+
+// processHeartbeat registra l'heartbeat nel bucket gateway_status. Gli heartbeat dei gateway
+// non registrati vengono scartati con qualsiasi policy diversa da accept, mai messi in quarantena
+func processHeartbeat(msg *nats.Msg, consumerId string, gateways *gatewayRegistry, liveness *livenessTracker, dlq *deadLetterQueue, unregisteredPolicy string) {
+	if err := checkGateway(msg, gateways, unregisteredPolicy); err != nil {
+		msg.Term()
+		return
+	}
+
+	if err := liveness.heartbeat(msg); err != nil {
+		fmt.Printf("Consumer %s: heartbeat [%s]: %v\n", consumerId, msg.Subject, err)
+		dlq.fail(msg, consumerId, err)
+		return
+	}
+
+	if err := msg.Ack(); err != nil {
+		log.Printf("Consumer %s: errore ack su [%s]: %v", consumerId, msg.Subject, err)
+	}
+}
+
+// Attesa dopo un errore di fetch, raddoppiata a ogni errore consecutivo fino a fetchRetryMaxDelay
+const (
+	fetchRetryDelay    = 500 * time.Millisecond
+	fetchRetryMaxDelay = 10 * time.Second
+)
+
+// Pull consumer: i subscriber richiedono esplicitamente i messaggi al server in batch,
+// che li invia solo quando sono pronti a riceverli, evitando sovraccarichi
+func start(ctx context.Context, js nats.JetStreamContext, consumerId string, writer *dbaccess.BatchWriter, registry *schema.Registry, gateways *gatewayRegistry, liveness *livenessTracker, dlq *deadLetterQueue, cfg ConsumerConfig) {
+	sub, err := js.PullSubscribe(consumerSubject, cfg.Durable, nats.Bind(streamName, cfg.Durable))
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer sub.Unsubscribe()
 
-	fmt.Println("Client in ascolto... premi Ctrl+C per uscire")
+	fmt.Printf("Consumer %s in ascolto... premi Ctrl+C per uscire\n", consumerId)
+
+	delay := fetchRetryDelay
+	for ctx.Err() == nil {
+		msgs, err := sub.Fetch(cfg.BatchSize, nats.MaxWait(cfg.MaxWait))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			// Errori come la connessione chiusa ritornano subito: senza attesa il ciclo girerebbe a vuoto
+			log.Printf("Consumer %s: errore fetch, nuovo tentativo tra %s: %v", consumerId, delay, err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, fetchRetryMaxDelay)
+			continue
+		}
+		delay = fetchRetryDelay
+		if len(msgs) == 0 {
+			continue
+		}
+
+		processBatch(msgs, consumerId, writer, registry, gateways, liveness, dlq, cfg.UnregisteredPolicy)
+	}
+
+	// Scrive (e conferma) le letture ancora in attesa prima di chiudere la connessione
+	writer.Flush()
+	fmt.Printf("Chiusura consumer %s in corso...\n", consumerId)
+}
+
+// processBatch passa le letture del batch al writer. Ogni messaggio viene confermato solo dopo che
+// il batch che lo contiene è stato scritto sul database. I messaggi falliti ricevono un NAK e vengono
+// riconsegnati, oppure finiscono nella DLQ se l'errore è permanente o i tentativi sono esauriti.
+// Le letture dei gateway non registrati vengono gestite secondo unregisteredPolicy,
+// gli heartbeat aggiornano lo stato del gateway e non vengono scritti sul database.
+func processBatch(msgs []*nats.Msg, consumerId string, writer *dbaccess.BatchWriter, registry *schema.Registry, gateways *gatewayRegistry, liveness *livenessTracker, dlq *deadLetterQueue, unregisteredPolicy string) {
+	for _, msg := range msgs {
+		if isHeartbeat(msg.Subject) {
+			processHeartbeat(msg, consumerId, gateways, liveness, dlq, unregisteredPolicy)
+			continue
+		}
+
+		if err := checkGateway(msg, gateways, unregisteredPolicy); err != nil {
+			if unregisteredPolicy == RejectUnregistered {
+				fmt.Printf("Consumer %s: lettura [%s] scartata: %v\n", consumerId, msg.Subject, err)
+				msg.Term()
+			} else {
+				dlq.fail(msg, consumerId, &PermanentError{Err: err})
+			}
+			continue
+		}
 
-	<-sigCh
+		row, err := parseMessage(msg, registry)
+		if err != nil {
+			fmt.Printf("Consumer %s: %v\n", consumerId, err)
+			dlq.fail(msg, consumerId, err)
+			continue
+		}
+
+		writer.Add(row, func(err error) {
+			if err != nil {
+				fmt.Printf("Consumer %s: errore nell'inserimento di [%s] nel database: %v\n", consumerId, msg.Subject, err)
+				dlq.fail(msg, consumerId, err)
+				return
+			}
 
-	fmt.Println("\nChiusura in corso...")
+			if err := msg.Ack(); err != nil {
+				log.Printf("Consumer %s: errore ack su [%s]: %v", consumerId, msg.Subject, err)
+				return
+			}
+			fmt.Printf("Ricevuto su [%s], consumer%s: %s\n", msg.Subject, consumerId, string(msg.Data))
+		})
+	}
 }
@@ -0,0 +1,48 @@
+// Package kvwatch apre i bucket KV di JetStream e ne segue le voci
+package kvwatch
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Open restituisce il bucket cfg.Bucket, creandolo con cfg se non esiste
+func Open(js nats.JetStreamContext, cfg *nats.KeyValueConfig) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(cfg.Bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(cfg)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("errore apertura bucket %s: %v", cfg.Bucket, err)
+	}
+	return kv, nil
+}
+
+// Watch passa ad apply tutte le voci del bucket e ritorna quando le ha ricevute tutte.
+// Gli aggiornamenti successivi vengono passati ad apply da una goroutine, finché il watcher
+// restituito non viene fermato
+func Watch(kv nats.KeyValue, apply func(nats.KeyValueEntry)) (nats.KeyWatcher, error) {
+	watcher, err := kv.WatchAll()
+	if err != nil {
+		return nil, fmt.Errorf("errore watch bucket %s: %v", kv.Bucket(), err)
+	}
+
+	// Il primo nil sul canale indica che i valori iniziali sono stati ricevuti tutti
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		apply(entry)
+	}
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry != nil {
+				apply(entry)
+			}
+		}
+	}()
+
+	return watcher, nil
+}
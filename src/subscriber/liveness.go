@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"subscriber/kvwatch"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV con lo stato di connessione dei gateway, letto dalla dashboard.
+// La chiave è <tenant>.<gateway>, il valore un gatewayStatus in JSON
+const gatewayStatusBucket = "gateway_status"
+
+// Ultimo token del subject degli heartbeat: sensors.<tenant>.<gateway>.$heartbeat
+const heartbeatMetric = "$heartbeat"
+
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+// Tentativi di aggiornare una chiave modificata nel frattempo da un altro subscriber
+const maxStatusUpdates = 5
+
+type gatewayStatus struct {
+	Tenant    string    `json:"tenant"`
+	GatewayID string    `json:"gateway_id"`
+	Status    string    `json:"status"`
+	LastSeen  time.Time `json:"last_seen"`
+	// Da quando il gateway è nello stato attuale
+	Since time.Time `json:"since"`
+	// Letture nel buffer su disco del gateway all'ultimo heartbeat
+	Buffered int `json:"buffered"`
+}
+
+// Payload degli heartbeat del publisher
+type heartbeat struct {
+	Timestamp time.Time `json:"timestamp"`
+	Buffered  int       `json:"buffered"`
+}
+
+// livenessTracker registra gli heartbeat dei gateway nel bucket gateway_status e segna offline
+// quelli che tacciono da più di offlineAfter. Ogni scrittura controlla la revisione della chiave,
+// così più subscriber (che ricevono heartbeat diversi dalla work queue) possono condividere il bucket.
+type livenessTracker struct {
+	kv           nats.KeyValue
+	offlineAfter time.Duration
+
+	mu sync.Mutex
+	// Stato dei gateway come letto dal watcher, usato per trovare quelli silenziosi
+	statuses map[string]gatewayStatus
+	watcher  nats.KeyWatcher
+}
+
+func isHeartbeat(subject string) bool {
+	return strings.HasSuffix(subject, "."+heartbeatMetric)
+}
+
+// openLiveness crea il bucket se non esiste e avvia il watcher
+func openLiveness(js nats.JetStreamContext, offlineAfter time.Duration) (*livenessTracker, error) {
+	kv, err := kvwatch.Open(js, &nats.KeyValueConfig{
+		Bucket:      gatewayStatusBucket,
+		Description: "Stato di connessione dei gateway",
+		History:     1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &livenessTracker{
+		kv:           kv,
+		offlineAfter: offlineAfter,
+		statuses:     map[string]gatewayStatus{},
+	}
+	if t.watcher, err = kvwatch.Watch(kv, t.apply); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *livenessTracker) apply(entry nats.KeyValueEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(t.statuses, entry.Key())
+		return
+	}
+
+	var status gatewayStatus
+	if err := json.Unmarshal(entry.Value(), &status); err != nil {
+		log.Printf("Stato del gateway %s ignorato: %v", entry.Key(), err)
+		return
+	}
+	t.statuses[entry.Key()] = status
+}
+
+// heartbeat registra l'heartbeat del gateway. L'istante è quello del gateway, se manca quello
+// di arrivo nello stream: gli heartbeat arretrati (es. dopo un riavvio del subscriber)
+// aggiornano last_seen ma non riportano online il gateway
+func (t *livenessTracker) heartbeat(msg *nats.Msg) error {
+	subjectParts := strings.Split(msg.Subject, ".")
+	if len(subjectParts) != 4 {
+		return permanent("subject non valido: %s", msg.Subject)
+	}
+	tenantId, gatewayId := subjectParts[1], subjectParts[2]
+
+	var hb heartbeat
+	if err := json.Unmarshal(msg.Data, &hb); err != nil {
+		return permanent("heartbeat non valido: %v", err)
+	}
+	if hb.Timestamp.IsZero() {
+		if meta, err := msg.Metadata(); err == nil {
+			hb.Timestamp = meta.Timestamp
+		} else {
+			hb.Timestamp = time.Now()
+		}
+	}
+
+	return t.update(tenantId+"."+gatewayId, func(current *gatewayStatus) *gatewayStatus {
+		if current != nil && !hb.Timestamp.After(current.LastSeen) {
+			return nil
+		}
+
+		next := gatewayStatus{
+			Tenant:    tenantId,
+			GatewayID: gatewayId,
+			Status:    statusOffline,
+			LastSeen:  hb.Timestamp,
+			Since:     hb.Timestamp,
+			Buffered:  hb.Buffered,
+		}
+		if time.Since(hb.Timestamp) < t.offlineAfter {
+			next.Status = statusOnline
+		}
+		if current != nil && current.Status == next.Status {
+			next.Since = current.Since
+		}
+		if current == nil || current.Status != next.Status {
+			log.Printf("Gateway %s del tenant %s %s", gatewayId, tenantId, next.Status)
+		}
+		return &next
+	})
+}
+
+// update legge la chiave, calcola il nuovo stato con change e lo scrive solo se la chiave
+// non è cambiata nel frattempo, altrimenti riprova. Con change che restituisce nil non scrive nulla
+func (t *livenessTracker) update(key string, change func(current *gatewayStatus) *gatewayStatus) error {
+	for attempt := 0; attempt < maxStatusUpdates; attempt++ {
+		var current *gatewayStatus
+		var revision uint64
+
+		entry, err := t.kv.Get(key)
+		switch {
+		case err == nil:
+			current = &gatewayStatus{}
+			if err := json.Unmarshal(entry.Value(), current); err != nil {
+				current = nil
+			}
+			revision = entry.Revision()
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			return err
+		}
+
+		next := change(current)
+		if next == nil {
+			return nil
+		}
+		data, err := json.Marshal(next)
+		if err != nil {
+			return err
+		}
+
+		if revision == 0 {
+			_, err = t.kv.Create(key, data)
+		} else {
+			_, err = t.kv.Update(key, data, revision)
+		}
+		// ErrKeyExists: un altro subscriber ha scritto la chiave dopo la lettura
+		if !errors.Is(err, nats.ErrKeyExists) {
+			return err
+		}
+	}
+	return fmt.Errorf("stato del gateway %s modificato troppe volte durante l'aggiornamento", key)
+}
+
+// run segna offline i gateway senza heartbeat da più di offlineAfter, finché ctx non viene annullato
+func (t *livenessTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(max(t.offlineAfter/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, key := range t.silent() {
+			err := t.update(key, func(current *gatewayStatus) *gatewayStatus {
+				if current == nil || current.Status != statusOnline || time.Since(current.LastSeen) < t.offlineAfter {
+					return nil
+				}
+				next := *current
+				next.Status = statusOffline
+				next.Since = time.Now()
+				log.Printf("Gateway %s del tenant %s offline: nessun heartbeat da %s", next.GatewayID, next.Tenant, time.Since(next.LastSeen).Round(time.Second))
+				return &next
+			})
+			if err != nil {
+				log.Printf("Errore aggiornamento stato del gateway %s: %v", key, err)
+			}
+		}
+	}
+}
+
+// silent restituisce le chiavi dei gateway online senza heartbeat da più di offlineAfter
+func (t *livenessTracker) silent() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var keys []string
+	for key, status := range t.statuses {
+		if status.Status == statusOnline && time.Since(status.LastSeen) >= t.offlineAfter {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (t *livenessTracker) Stop() error {
+	return t.watcher.Stop()
+}
@@ -1,25 +1,97 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
+
+	dbaccess "subscriber/db-access"
 )
 
 func main() {
 
 	natsURL := flag.String("nats-url", "localhost:4222", "NATS server URL")
 	dbURL := flag.String("db-url", "localhost:5432", "Database URL")
+	workers := flag.Int("workers", 3, "Numero di worker che consumano in parallelo")
+
+	var cfg ConsumerConfig
+	flag.StringVar(&cfg.Durable, "durable", "sensor-subscribers", "Nome del pull consumer durevole")
+	flag.IntVar(&cfg.BatchSize, "batch-size", 100, "Numero massimo di messaggi per fetch")
+	flag.DurationVar(&cfg.MaxWait, "max-wait", 2*time.Second, "Attesa massima di un fetch")
+	flag.DurationVar(&cfg.AckWait, "ack-wait", 30*time.Second, "Tempo concesso per confermare un messaggio")
+	flag.IntVar(&cfg.MaxDeliver, "max-deliver", 5, "Numero massimo di consegne di un messaggio (-1 = illimitate)")
+	flag.IntVar(&cfg.MaxAckPending, "max-ack-pending", 1000, "Numero massimo di messaggi in attesa di conferma")
+	flag.StringVar(&cfg.UnregisteredPolicy, "unregistered-policy", AcceptUnregistered, "Letture dei gateway non registrati nel bucket gateways: accept, reject (scartate) o quarantine (DLQ)")
+
+	offlineAfter := flag.Duration("offline-after", 30*time.Second, "Silenzio dopo cui un gateway senza heartbeat viene segnato offline")
+
+	flushSize := flag.Int("flush-size", 500, "Numero di righe per tenant e tabella che fa scattare la scrittura sul database")
+	flushInterval := flag.Duration("flush-interval", time.Second, "Intervallo massimo tra due scritture sul database")
 
 	flag.Parse()
 
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Configurazione consumer non valida: %v", err)
+	}
+	if *flushSize <= 0 || *flushInterval <= 0 {
+		log.Fatal("flush-size e flush-interval devono essere positivi")
+	}
+	if *offlineAfter <= 0 {
+		log.Fatal("offline-after deve essere positivo")
+	}
+	if cfg.AckWait <= cfg.MaxWait+*flushInterval {
+		log.Fatal("ack-wait deve essere maggiore di max-wait + flush-interval, altrimenti i messaggi vengono riconsegnati prima di essere scritti")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	dbSecret := os.Getenv("TENANT_DB_SECRET")
+	if dbSecret == "" {
+		log.Fatal("TENANT_DB_SECRET non impostata: serve per le password degli utenti dei tenant")
+	}
+	pools := dbaccess.NewPools(*dbURL, dbSecret)
+	defer pools.Close()
+
+	writer := dbaccess.NewBatchWriter(pools, *flushSize, *flushInterval)
+	go writer.Run(ctx)
+
+	// Connessione dedicata al watcher dei tenant, che aggiorna le sorgenti dello stream
+	nc, err := getNatsConnection(*natsURL, "glitchhubteam.it", "dataconsumer.creds")
+	if err != nil {
+		log.Fatalf("Errore connessione NATS: %v", err)
+	}
+	defer nc.Close()
+
+	js, err := configStream(nc)
+	if err != nil {
+		log.Fatalf("Errore creazione contesto JetStream: %v", err)
+	}
+	if err := watchTenants(ctx, js); err != nil {
+		log.Fatalf("Errore registro dei tenant: %v", err)
+	}
+
+	// Stato di connessione dei gateway, condiviso dai worker
+	liveness, err := openLiveness(js, *offlineAfter)
+	if err != nil {
+		log.Fatalf("Errore apertura stato dei gateway: %v", err)
+	}
+	defer liveness.Stop()
+	go liveness.run(ctx)
+
 	var wg sync.WaitGroup
 
-	for i := 0; i < 3; i++ {
+	for i := 0; i < *workers; i++ {
 		wg.Add(1)
 		consumerId := fmt.Sprintf("C%d", i+1)
 
-		go InitSubscriber(*natsURL, consumerId, "dataconsumer.creds", *dbURL, &wg)
+		go InitSubscriber(ctx, *natsURL, consumerId, "dataconsumer.creds", writer, liveness, cfg, &wg)
 	}
 
 	wg.Wait()
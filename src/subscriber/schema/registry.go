@@ -0,0 +1,137 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"sync"
+
+	"subscriber/kvwatch"
+	"subscriber/schemas"
+
+	"github.com/nats-io/nats.go"
+)
+
+const Bucket = "sensor_schemas"
+
+func ptr(v float64) *float64 { return &v }
+
+// Schemi registrati automaticamente se il bucket non li contiene già, insieme a quelli
+// della cartella schemas (defaultSchemas)
+var defaults = []Schema{
+	{
+		Metric: "heart_rate",
+		Fields: []Field{{Name: "bpm", Type: Int, Unit: "bpm", Min: ptr(1), Max: ptr(300)}},
+	},
+	{
+		Metric: "blood_oxygen",
+		Fields: []Field{{Name: "spO2", Type: Float, Unit: "%", Min: ptr(0), Max: ptr(100)}},
+	},
+}
+
+// Registry contiene gli schemi delle metriche, letti dal bucket KV sensor_schemas e
+// mantenuti aggiornati in tempo reale: una nuova metrica si aggiunge con
+//
+//	nats kv put sensor_schemas <metric> '<schema JSON>'
+type Registry struct {
+	mu      sync.RWMutex
+	schemas map[string]*Schema
+
+	watcher nats.KeyWatcher
+}
+
+// Open crea il bucket se non esiste, registra gli schemi di default e avvia il watcher
+func Open(js nats.JetStreamContext) (*Registry, error) {
+	kv, err := kvwatch.Open(js, &nats.KeyValueConfig{
+		Bucket:      Bucket,
+		Description: "Schemi delle metriche dei sensori",
+		History:     5,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	all, err := defaultSchemas()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range all {
+		data, err := json.Marshal(s)
+		if err != nil {
+			return nil, err
+		}
+		// Create fallisce se la chiave esiste già: gli schemi modificati dagli utenti non vengono sovrascritti
+		if _, err := kv.Create(s.Metric, data); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			return nil, fmt.Errorf("errore registrazione schema %s: %v", s.Metric, err)
+		}
+	}
+
+	r := &Registry{schemas: map[string]*Schema{}}
+	if r.watcher, err = kvwatch.Watch(kv, r.apply); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// defaultSchemas restituisce gli schemi di defaults e quelli dei file in schemas
+func defaultSchemas() ([]*Schema, error) {
+	var all []*Schema
+	for _, s := range defaults {
+		s.applyDefaults()
+		all = append(all, &s)
+	}
+
+	files, err := fs.Glob(schemas.Files, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		data, err := schemas.Files.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		s, err := Parse(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		all = append(all, s)
+	}
+	return all, nil
+}
+
+func (r *Registry) apply(entry nats.KeyValueEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry.Operation() != nats.KeyValuePut {
+		delete(r.schemas, entry.Key())
+		log.Printf("Schema %s rimosso dal registro", entry.Key())
+		return
+	}
+
+	s, err := Parse(entry.Value())
+	if err != nil {
+		log.Printf("Schema %s ignorato: %v", entry.Key(), err)
+		return
+	}
+	if s.Metric != entry.Key() {
+		log.Printf("Schema %s ignorato: la chiave non corrisponde alla metrica %s", entry.Key(), s.Metric)
+		return
+	}
+
+	r.schemas[s.Metric] = s
+}
+
+func (r *Registry) Get(metric string) (*Schema, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.schemas[metric]
+	return s, ok
+}
+
+func (r *Registry) Stop() error {
+	return r.watcher.Stop()
+}
@@ -0,0 +1,231 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// FieldType è il tipo JSON atteso per un campo del payload
+type FieldType string
+
+const (
+	Int        FieldType = "int"
+	Float      FieldType = "float"
+	String     FieldType = "string"
+	Bool       FieldType = "bool"
+	FloatArray FieldType = "float[]"
+)
+
+// Colonne presenti in ogni tabella delle letture, prima di quelle dei campi
+var BaseColumns = []string{"time", "gateway_id", "msg_id"}
+
+var validIdent = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+type Field struct {
+	// Chiave del campo nel payload JSON
+	Name string    `json:"name"`
+	Type FieldType `json:"type"`
+	Unit string    `json:"unit,omitempty"`
+	// Intervallo di valori ammessi (per float[] vale per ogni elemento)
+	Min *float64 `json:"min,omitempty"`
+	Max *float64 `json:"max,omitempty"`
+	// Colonna della tabella in cui scrivere il valore. Se vuota: il nome del campo in minuscolo
+	Column   string `json:"column,omitempty"`
+	Optional bool   `json:"optional,omitempty"`
+}
+
+// Schema descrive un tipo di misura: come validarne il payload e dove salvarlo
+type Schema struct {
+	// Token del subject sensors.<tenant>.<gateway>.<metric>
+	Metric string `json:"metric"`
+	// Tabella nello schema del tenant. Se vuota: uguale a Metric
+	Table string `json:"table,omitempty"`
+	// Campo del payload con l'istante della lettura. Se vuoto: "timestamp"
+	TimestampField string  `json:"timestamp_field,omitempty"`
+	Fields         []Field `json:"fields"`
+}
+
+// Parse legge uno schema in formato JSON, applica i valori di default e lo valida
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("schema non valido: %v", err)
+	}
+
+	s.applyDefaults()
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (s *Schema) applyDefaults() {
+	if s.Table == "" {
+		s.Table = s.Metric
+	}
+	if s.TimestampField == "" {
+		s.TimestampField = "timestamp"
+	}
+	for i := range s.Fields {
+		if s.Fields[i].Column == "" {
+			s.Fields[i].Column = strings.ToLower(s.Fields[i].Name)
+		}
+	}
+}
+
+func (s *Schema) Validate() error {
+	var errs []error
+
+	if s.Metric == "" || strings.ContainsAny(s.Metric, ".*> ") {
+		errs = append(errs, fmt.Errorf("metric %q non valida", s.Metric))
+	}
+	if !validIdent.MatchString(s.Table) {
+		errs = append(errs, fmt.Errorf("nome tabella %q non valido", s.Table))
+	}
+	if len(s.Fields) == 0 {
+		errs = append(errs, errors.New("nessun campo definito"))
+	}
+
+	columns := map[string]bool{}
+	for _, c := range BaseColumns {
+		columns[c] = true
+	}
+	for _, f := range s.Fields {
+		switch f.Type {
+		case Int, Float, String, Bool, FloatArray:
+		default:
+			errs = append(errs, fmt.Errorf("campo %s: tipo %q non supportato", f.Name, f.Type))
+		}
+		if f.Name == "" {
+			errs = append(errs, errors.New("campo senza nome"))
+		}
+		if !validIdent.MatchString(f.Column) {
+			errs = append(errs, fmt.Errorf("campo %s: nome colonna %q non valido", f.Name, f.Column))
+		} else if columns[f.Column] {
+			errs = append(errs, fmt.Errorf("campo %s: colonna %q duplicata o riservata", f.Name, f.Column))
+		}
+		columns[f.Column] = true
+		if f.Min != nil && f.Max != nil && *f.Min > *f.Max {
+			errs = append(errs, fmt.Errorf("campo %s: min maggiore di max", f.Name))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("schema %s non valido: %w", s.Metric, errors.Join(errs...))
+	}
+	return nil
+}
+
+// Columns restituisce le colonne della tabella, nell'ordine dei valori restituiti da Decode
+func (s *Schema) Columns() []string {
+	columns := append([]string{}, BaseColumns...)
+	for _, f := range s.Fields {
+		columns = append(columns, f.Column)
+	}
+	return columns
+}
+
+// Decode valida il payload e restituisce l'istante della lettura e i valori dei campi, nell'ordine di Fields
+func (s *Schema) Decode(data []byte) (time.Time, []any, error) {
+	var payload map[string]json.RawMessage
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return time.Time{}, nil, fmt.Errorf("payload %s non valido: %v", s.Metric, err)
+	}
+
+	var timestamp time.Time
+	rawTimestamp, ok := payload[s.TimestampField]
+	if !ok {
+		return time.Time{}, nil, fmt.Errorf("payload %s: campo %s mancante", s.Metric, s.TimestampField)
+	}
+	if err := json.Unmarshal(rawTimestamp, &timestamp); err != nil {
+		return time.Time{}, nil, fmt.Errorf("payload %s: timestamp non valido: %v", s.Metric, err)
+	}
+
+	values := make([]any, len(s.Fields))
+	for i, f := range s.Fields {
+		raw, ok := payload[f.Name]
+		if !ok || string(raw) == "null" {
+			if f.Optional {
+				continue
+			}
+			return time.Time{}, nil, fmt.Errorf("payload %s: campo %s mancante", s.Metric, f.Name)
+		}
+
+		value, err := f.decode(raw)
+		if err != nil {
+			return time.Time{}, nil, fmt.Errorf("payload %s: campo %s: %v", s.Metric, f.Name, err)
+		}
+		values[i] = value
+	}
+
+	return timestamp, values, nil
+}
+
+func (f Field) decode(raw json.RawMessage) (any, error) {
+	switch f.Type {
+	case Int:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("atteso un intero")
+		}
+		if v != math.Trunc(v) {
+			return nil, fmt.Errorf("atteso un intero, ricevuto %v", v)
+		}
+		if err := f.checkRange(v); err != nil {
+			return nil, err
+		}
+		return int64(v), nil
+	case Float:
+		var v float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("atteso un numero")
+		}
+		if err := f.checkRange(v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case String:
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("attesa una stringa")
+		}
+		return v, nil
+	case Bool:
+		var v bool
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("atteso un booleano")
+		}
+		return v, nil
+	case FloatArray:
+		var v []float64
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, fmt.Errorf("atteso un array di numeri")
+		}
+		for _, x := range v {
+			if err := f.checkRange(x); err != nil {
+				return nil, err
+			}
+		}
+		return v, nil
+	}
+
+	return nil, fmt.Errorf("tipo %q non supportato", f.Type)
+}
+
+func (f Field) checkRange(v float64) error {
+	if f.Min != nil && v < *f.Min {
+		return fmt.Errorf("valore %v sotto il minimo %v %s", v, *f.Min, f.Unit)
+	}
+	if f.Max != nil && v > *f.Max {
+		return fmt.Errorf("valore %v sopra il massimo %v %s", v, *f.Max, f.Unit)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package schema
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSchema = &Schema{
+	Metric:         "vitals",
+	Table:          "vitals",
+	TimestampField: "timestamp",
+	Fields: []Field{
+		{Name: "bpm", Type: Int, Unit: "bpm", Min: ptr(20), Max: ptr(300), Column: "bpm"},
+		{Name: "SpO2", Type: Float, Unit: "%", Min: ptr(0), Max: ptr(100), Column: "spo2"},
+		{Name: "note", Type: String, Column: "note", Optional: true},
+		{Name: "alarm", Type: Bool, Column: "alarm", Optional: true},
+		{Name: "samples", Type: FloatArray, Min: ptr(-5), Max: ptr(5), Column: "samples", Optional: true},
+	},
+}
+
+func TestDecode(t *testing.T) {
+	at := time.Date(2026, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		payload string
+		values  []any
+		// Parte attesa del messaggio di errore, vuota se il payload è valido
+		err string
+	}{
+		{
+			name:    "tutti i campi",
+			payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97.5,"note":"ok","alarm":false,"samples":[0.1,-0.2]}`,
+			values:  []any{int64(72), 97.5, "ok", false, []float64{0.1, -0.2}},
+		},
+		{
+			name:    "opzionali mancanti o null",
+			payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97,"note":null}`,
+			values:  []any{int64(72), 97.0, nil, nil, nil},
+		},
+		{
+			name:    "intero scritto come float",
+			payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72.0,"SpO2":97}`,
+			values:  []any{int64(72), 97.0, nil, nil, nil},
+		},
+		{
+			name:    "limiti inclusi",
+			payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":300,"SpO2":0,"samples":[-5,5]}`,
+			values:  []any{int64(300), 0.0, nil, nil, []float64{-5, 5}},
+		},
+		{name: "JSON non valido", payload: `{"bpm":`, err: "payload vitals non valido"},
+		{name: "timestamp mancante", payload: `{"bpm":72,"SpO2":97}`, err: "campo timestamp mancante"},
+		{name: "timestamp non valido", payload: `{"timestamp":"ieri","bpm":72,"SpO2":97}`, err: "timestamp non valido"},
+		{name: "obbligatorio mancante", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72}`, err: "campo SpO2 mancante"},
+		{name: "obbligatorio null", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":null,"SpO2":97}`, err: "campo bpm mancante"},
+		{name: "intero con decimali", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72.5,"SpO2":97}`, err: "campo bpm: atteso un intero"},
+		{name: "numero come stringa", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":"97"}`, err: "campo SpO2: atteso un numero"},
+		{name: "sotto il minimo", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":10,"SpO2":97}`, err: "valore 10 sotto il minimo 20 bpm"},
+		{name: "sopra il massimo", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":100.1}`, err: "valore 100.1 sopra il massimo 100 %"},
+		{name: "stringa del tipo sbagliato", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97,"note":1}`, err: "campo note: attesa una stringa"},
+		{name: "booleano del tipo sbagliato", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97,"alarm":"no"}`, err: "campo alarm: atteso un booleano"},
+		{name: "array con un elemento fuori intervallo", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97,"samples":[1,6]}`, err: "campo samples: valore 6 sopra il massimo 5"},
+		{name: "array del tipo sbagliato", payload: `{"timestamp":"2026-03-01T10:30:00Z","bpm":72,"SpO2":97,"samples":[1,"2"]}`, err: "atteso un array di numeri"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timestamp, values, err := testSchema.Decode([]byte(tt.payload))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Decode = %v, atteso un errore con %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode = %v", err)
+			}
+			if !timestamp.Equal(at) {
+				t.Errorf("timestamp = %v, atteso %v", timestamp, at)
+			}
+			if !reflect.DeepEqual(values, tt.values) {
+				t.Errorf("valori = %#v, attesi %#v", values, tt.values)
+			}
+		})
+	}
+}
+
+// Gli schemi registrati all'avvio (quelli di default e i file della cartella schemas) devono essere validi
+func TestDefaultSchemas(t *testing.T) {
+	schemas, err := defaultSchemas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := map[string]bool{}
+	for _, s := range schemas {
+		if metrics[s.Metric] {
+			t.Errorf("metrica %s registrata due volte", s.Metric)
+		}
+		metrics[s.Metric] = true
+	}
+	for _, m := range []string{"heart_rate", "blood_oxygen", "temperature", "ecg", "blood_pressure", "respiration_rate"} {
+		if !metrics[m] {
+			t.Errorf("schema %s mancante", m)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+// Package schemas contiene gli schemi dei sensori aggiuntivi del publisher, registrati
+// all'avvio del subscriber insieme a quelli di heart_rate e blood_oxygen
+package schemas
+
+import "embed"
+
+//go:embed *.json
+var Files embed.FS
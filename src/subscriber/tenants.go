@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"subscriber/kvwatch"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Bucket KV con l'elenco dei tenant da cui lo stream CONSUMING_SENSORS prende i dati.
+// La chiave è l'ID del tenant, il valore un TenantSource in JSON. Il provisioning della dashboard
+// aggiunge qui i nuovi tenant; per rimuoverne uno basta eliminare la chiave:
+//
+//	nats kv del tenants <tenant>
+const tenantsBucket = "tenants"
+
+// TenantSource descrive lo stream di un tenant, esportato verso l'account consumers
+type TenantSource struct {
+	NatsID string `json:"nats_id"`
+	// Nome dello stream nell'account del tenant
+	Stream string `json:"stream"`
+	// Prefisso con cui l'account consumers importa l'API JetStream del tenant
+	APIPrefix string `json:"api_prefix"`
+}
+
+func (t TenantSource) filterSubject() string {
+	return "sensors." + t.NatsID + ".>"
+}
+
+func (t TenantSource) validate() error {
+	if t.NatsID == "" || t.Stream == "" || t.APIPrefix == "" {
+		return errors.New("nats_id, stream e api_prefix sono obbligatori")
+	}
+	return nil
+}
+
+// Tenant registrati alla creazione del bucket, erano le sorgenti statiche di configStream
+var defaultTenants = []TenantSource{
+	{NatsID: "tenant_1", Stream: "ExportTenant1Data", APIPrefix: "tenant_1.$JS.API"},
+	{NatsID: "tenant_2", Stream: "ExportTenant2Data", APIPrefix: "tenant_2.$JS.API"},
+}
+
+// watchTenants allinea le sorgenti di CONSUMING_SENSORS al contenuto del bucket tenants e continua
+// ad aggiornarle finché ctx non viene annullato. Ritorna dopo il primo allineamento.
+// Rimuovere una sorgente non elimina i messaggi già copiati nello stream, che vengono comunque consumati.
+func watchTenants(ctx context.Context, js nats.JetStreamContext) error {
+	kv, err := openTenantsBucket(js)
+	if err != nil {
+		return err
+	}
+
+	var (
+		mu      sync.Mutex
+		tenants = map[string]TenantSource{}
+		// Le sorgenti si allineano dopo aver ricevuto tutti i tenant, poi a ogni cambiamento
+		loaded bool
+	)
+
+	watcher, err := kvwatch.Watch(kv, func(entry nats.KeyValueEntry) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !applyTenant(tenants, entry) || !loaded {
+			return
+		}
+		// Se l'aggiornamento fallisce viene ritentato al prossimo cambiamento del bucket
+		if err := reconcileSources(js, tenants); err != nil {
+			log.Printf("Errore aggiornamento sorgenti %s: %v", streamName, err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	loaded = true
+	err = reconcileSources(js, tenants)
+	mu.Unlock()
+	if err != nil {
+		watcher.Stop()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		watcher.Stop()
+	}()
+
+	return nil
+}
+
+func openTenantsBucket(js nats.JetStreamContext) (nats.KeyValue, error) {
+	kv, err := js.KeyValue(tenantsBucket)
+	if err == nil {
+		return kv, nil
+	}
+	if !errors.Is(err, nats.ErrBucketNotFound) {
+		return nil, fmt.Errorf("errore apertura bucket %s: %v", tenantsBucket, err)
+	}
+
+	kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:      tenantsBucket,
+		Description: "Tenant da cui " + streamName + " prende i dati",
+		History:     5,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("errore creazione bucket %s: %v", tenantsBucket, err)
+	}
+
+	// I tenant di default vengono registrati solo alla creazione, così restano eliminabili
+	for _, t := range defaultTenants {
+		data, err := json.Marshal(t)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := kv.Create(t.NatsID, data); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			return nil, fmt.Errorf("errore registrazione tenant %s: %v", t.NatsID, err)
+		}
+	}
+
+	return kv, nil
+}
+
+// applyTenant aggiorna l'elenco dei tenant e restituisce true se è cambiato
+func applyTenant(tenants map[string]TenantSource, entry nats.KeyValueEntry) bool {
+	if entry.Operation() != nats.KeyValuePut {
+		if _, ok := tenants[entry.Key()]; !ok {
+			return false
+		}
+		delete(tenants, entry.Key())
+		log.Printf("Tenant %s rimosso", entry.Key())
+		return true
+	}
+
+	var t TenantSource
+	if err := json.Unmarshal(entry.Value(), &t); err != nil {
+		log.Printf("Tenant %s ignorato: %v", entry.Key(), err)
+		return false
+	}
+	if err := t.validate(); err != nil {
+		log.Printf("Tenant %s ignorato: %v", entry.Key(), err)
+		return false
+	}
+	if t.NatsID != entry.Key() {
+		log.Printf("Tenant %s ignorato: la chiave non corrisponde a nats_id %s", entry.Key(), t.NatsID)
+		return false
+	}
+
+	if old, ok := tenants[t.NatsID]; ok && old == t {
+		return false
+	}
+	tenants[t.NatsID] = t
+	log.Printf("Tenant %s registrato (stream %s)", t.NatsID, t.Stream)
+	return true
+}
+
+// reconcileSources imposta le sorgenti dello stream in base ai tenant registrati.
+// Le sorgenti invariate vengono lasciate come sono, così lo stream riprende da dove era arrivato
+func reconcileSources(js nats.JetStreamContext, tenants map[string]TenantSource) error {
+	info, err := js.StreamInfo(streamName)
+	if err != nil {
+		return fmt.Errorf("errore lettura stream: %v", err)
+	}
+
+	ids := make([]string, 0, len(tenants))
+	for id := range tenants {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	sources := make([]*nats.StreamSource, 0, len(ids))
+	for _, id := range ids {
+		t := tenants[id]
+		sources = append(sources, &nats.StreamSource{
+			Name:          t.Stream,
+			FilterSubject: t.filterSubject(),
+			External: &nats.ExternalStream{
+				APIPrefix: t.APIPrefix,
+			},
+		})
+	}
+
+	if sameSources(info.Config.Sources, sources) {
+		return nil
+	}
+
+	cfg := info.Config
+	cfg.Sources = sources
+	if _, err := js.UpdateStream(&cfg); err != nil {
+		return fmt.Errorf("errore aggiornamento stream: %v", err)
+	}
+
+	log.Printf("Sorgenti di %s aggiornate: %d tenant", streamName, len(sources))
+	return nil
+}
+
+func sameSources(current []*nats.StreamSource, desired []*nats.StreamSource) bool {
+	if len(current) != len(desired) {
+		return false
+	}
+
+	key := func(s *nats.StreamSource) string {
+		prefix := ""
+		if s.External != nil {
+			prefix = s.External.APIPrefix
+		}
+		return s.Name + "|" + s.FilterSubject + "|" + prefix
+	}
+
+	existing := make(map[string]bool, len(current))
+	for _, s := range current {
+		existing[key(s)] = true
+	}
+	for _, s := range desired {
+		if !existing[key(s)] {
+			return false
+		}
+	}
+	return true
+}